@@ -7,10 +7,33 @@ import (
 	"github.com/ovotech/bigquery-metrics-extractor/pkg/daemon"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/pflag"
+	"os"
 )
 
 func main() {
-	cfg, err := config.NewConfig(fmt.Sprintf("%s (Version %s)", config.AppName, config.Version))
+	name := fmt.Sprintf("%s (Version %s)", config.AppName, config.Version)
+
+	// The flags of the validate command are parsed along with the config flags,
+	// so that they can be given in any order
+	validateFlags := pflag.NewFlagSet("validate", pflag.ExitOnError)
+	dryRunQueries := validateFlags.Bool("dry-run-queries", false, "With validate, also dry-runs every custom metric query against BigQuery")
+
+	cfg, args, err := config.LoadCommandConfig(name, os.Args[1:], validateFlags)
+	switch {
+	case len(args) > 0 && args[0] == "validate":
+		os.Exit(validate(cfg, err, *dryRunQueries))
+	case len(args) > 0:
+		log.Fatal().Strs("args", args).Msg("Unknown command, the only command is validate")
+	case validateFlags.Changed("dry-run-queries"):
+		log.Fatal().Msg("--dry-run-queries can only be used with the validate command")
+	}
+
+	if err == nil {
+		if err = config.ValidateConfig(cfg); err != nil {
+			err = fmt.Errorf("error validating config: %w", err)
+		}
+	}
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to parse config")
 	}
@@ -21,13 +44,58 @@ func main() {
 		log.Fatal().Err(err).Msg("Failed to create runner")
 	}
 
-	if err = app.RunOnce(ctx); err != nil {
+	err = app.RunOnce(ctx)
+	if cerr := app.Close(); cerr != nil {
+		log.Err(cerr).Msg("Error closing runner")
+	}
+	if err != nil {
 		log.Fatal().Err(err).Msg("Error during run")
 	}
 }
 
+// validate reports every problem found in the loaded config and returns the
+// exit code, which is non-zero if the config could not be loaded or has
+// problems. If dryRunQueries is set, every custom metric query is also dry-run
+// against BigQuery
+func validate(cfg *config.Config, loadErr error, dryRunQueries bool) int {
+	if loadErr != nil {
+		log.Error().Err(loadErr).Msg("Failed to load config")
+		return 1
+	}
+
+	problems := config.LintConfig(cfg)
+	if dryRunQueries {
+		checked, err := daemon.CheckQueries(context.Background(), cfg)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to check custom metric queries")
+			return 1
+		}
+		problems = append(problems, checked...)
+	}
+
+	source := cfg.ConfigFile
+	if source == "" {
+		source = "config"
+	}
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", source, p)
+	}
+
+	if len(problems) > 0 {
+		log.Error().Int("problems", len(problems)).Msg("Config is invalid")
+		return 1
+	}
+
+	log.Info().Msg("Config is valid")
+	return 0
+}
+
 func init() {
-	log.Logger = log.Output(zerolog.NewConsoleWriter())
+	// Logs are written to stderr so that they are kept apart from the metrics
+	// written to stdout in dry run mode
+	log.Logger = log.Output(zerolog.NewConsoleWriter(func(w *zerolog.ConsoleWriter) {
+		w.Out = os.Stderr
+	}))
 	ll := config.GetEnv("LOG_LEVEL", "info")
 	level, err := zerolog.ParseLevel(ll)
 	if err != nil {
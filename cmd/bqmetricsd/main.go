@@ -5,20 +5,22 @@ import (
 	"fmt"
 	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
 	"github.com/ovotech/bigquery-metrics-extractor/pkg/daemon"
-	"github.com/ovotech/bigquery-metrics-extractor/pkg/health"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"syscall"
 )
 
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	handleSignals(cancel)
 
-	cfg, err := config.NewConfig(fmt.Sprintf("%s (Version %s)", config.AppName, config.Version))
+	name := fmt.Sprintf("%s (Version %s)", config.AppName, config.Version)
+	cfg, err := config.NewConfig(name)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to parse config")
 	}
@@ -39,27 +41,55 @@ func main() {
 		}()
 	}
 
+	publisher, err := daemon.NewPublisher(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create publisher")
+	}
+
+	if prom, ok := prometheusPublisher(publisher); ok {
+		addr := fmt.Sprintf("0.0.0.0:%d", cfg.Prometheus.Port)
+		log.Info().Msgf("Running prometheus metrics server on %s%s", addr, cfg.Prometheus.Path)
+
+		mux := http.NewServeMux()
+		mux.HandleFunc(cfg.Prometheus.Path, prom.Handler)
+
+		go func() {
+			log.Err(http.ListenAndServe(addr, mux)).Msg("Shutting down prometheus metrics server")
+		}()
+	}
+
+	app, err := daemon.NewRunnerWithPublisher(ctx, cfg, publisher)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create runner")
+	}
+
 	if cfg.HealthCheck.Enabled {
 		addr := fmt.Sprintf("0.0.0.0:%d", cfg.HealthCheck.Port)
 		log.Info().Msgf("Running healthcheck server on %s", addr)
 
-		healthsrv := health.ServiceStatus{Status: health.Ok}
-
 		mux := http.NewServeMux()
-		mux.HandleFunc("/health", healthsrv.Handler)
+		mux.HandleFunc("/health", app.Health().Handler)
 
 		go func() {
 			log.Err(http.ListenAndServe(addr, mux)).Msg("Shutting down healthcheck server")
 		}()
 	}
 
-	app, err := daemon.NewRunner(ctx, cfg)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to create runner")
+	reload := make(chan struct{}, 1)
+	handleReloadSignal(reload)
+	if cfg.Reload.Watch {
+		watchConfigFile(ctx, cfg.ConfigFile, reload)
 	}
+	go app.ReloadOn(ctx, reload, func() (*config.Config, error) {
+		return config.NewConfig(name)
+	})
 
 	log.Printf("Starting the metrics collection daemon")
-	if err = app.RunUntil(ctx); err != nil {
+	err = app.RunUntil(ctx)
+	if cerr := app.Close(); cerr != nil {
+		log.Err(cerr).Msg("Error closing runner")
+	}
+	if err != nil {
 		log.Fatal().Err(err).Msg("Error during run")
 	}
 }
@@ -77,8 +107,25 @@ func init() {
 	log.Info().Msgf("Logging level set to %s", zerolog.GlobalLevel())
 }
 
+// prometheusPublisher returns the PrometheusPublisher among the configured
+// publishers, if there is one
+func prometheusPublisher(pub daemon.Publisher) (*metrics.PrometheusPublisher, bool) {
+	switch pub := pub.(type) {
+	case *metrics.PrometheusPublisher:
+		return pub, true
+	case *metrics.MultiPublisher:
+		for _, b := range pub.Backends() {
+			if prom, ok := b.Publisher.(*metrics.PrometheusPublisher); ok {
+				return prom, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
 func handleSignals(cancel context.CancelFunc) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill)
 
 	go func() {
@@ -89,3 +136,33 @@ func handleSignals(cancel context.CancelFunc) {
 		}
 	}()
 }
+
+// handleReloadSignal signals reload whenever a SIGHUP is received
+func handleReloadSignal(reload chan<- struct{}) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	go func() {
+		for range c {
+			select {
+			case reload <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
+
+// watchConfigFile signals reload whenever the config file changes
+func watchConfigFile(ctx context.Context, path string, reload chan<- struct{}) {
+	if path == "" {
+		log.Warn().Msg("No config file to watch, the config will only be reloaded on SIGHUP")
+		return
+	}
+
+	if err := config.WatchConfigFile(ctx, path, reload); err != nil {
+		log.Err(err).Msg("Unable to watch config file, the config will only be reloaded on SIGHUP")
+		return
+	}
+
+	log.Info().Str("config_file", path).Msg("Watching config file for changes")
+}
@@ -1,19 +1,30 @@
 package config
 
 import (
+	"cloud.google.com/go/civil"
 	"context"
 	"fmt"
 	"github.com/googleapis/gax-go/v2"
 	"github.com/mitchellh/mapstructure"
+	"github.com/robfig/cron/v3"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"golang.org/x/oauth2/google"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	// The time zone database is embedded so that custom metric schedules
+	// work in images without one installed
+	_ "time/tzdata"
+
 	sm "cloud.google.com/go/secretmanager/apiv1"
 	smpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
 )
@@ -32,29 +43,542 @@ var DefaultMetricPrefix = "custom.gcp.bigquery"
 // DefaultMetricInterval is the default period between table-level metric exports
 var DefaultMetricInterval = "30s"
 
+// DefaultCustomMetricMaxRows is the default limit on the number of rows read
+// from a custom metric query that has tag columns
+var DefaultCustomMetricMaxRows = 1000
+
 // Version is the version of the program
 var Version = "0.0.0"
 
+const (
+	// PublisherDatadog publishes metrics to the Datadog API
+	PublisherDatadog = "datadog"
+
+	// PublisherPrometheus serves metrics on an HTTP endpoint for Prometheus to scrape
+	PublisherPrometheus = "prometheus"
+)
+
+const (
+	// OutputTable writes metrics as a table with a row for each point
+	OutputTable = "table"
+
+	// OutputJSON writes metrics as a JSON array
+	OutputJSON = "json"
+
+	// OutputNDJSON writes metrics as newline-delimited JSON, one metric per line
+	OutputNDJSON = "ndjson"
+)
+
+const (
+	// DropOldest drops the oldest buffered points first when the buffer is full
+	DropOldest = "oldest"
+
+	// DropNewest drops incoming points when the buffer is full
+	DropNewest = "newest"
+
+	// DropLatest keeps only the latest point of each series when the buffer is full
+	DropLatest = "latest"
+)
+
+const (
+	// StartupImmediate runs a generator as soon as the process starts
+	StartupImmediate = "immediate"
+
+	// StartupJitter runs a generator after a random delay of up to the startup jitter
+	StartupJitter = "jitter"
+
+	// StartupWait runs a generator once its first interval has passed, or at
+	// its first scheduled time
+	StartupWait = "wait"
+)
+
+const (
+	// QueryCheckFail refuses to start when a custom metric query is estimated
+	// to process more than its maximum bytes billed
+	QueryCheckFail = "fail"
+
+	// QueryCheckDisable disables a custom metric whose query is estimated to
+	// process more than its maximum bytes billed
+	QueryCheckDisable = "disable"
+)
+
+const (
+	// TableMetricsAPI reads the metadata of each table with its own BigQuery
+	// API call
+	TableMetricsAPI = "api"
+
+	// TableMetricsInformationSchema reads the metadata of every table in a
+	// project with one query of INFORMATION_SCHEMA.TABLE_STORAGE
+	TableMetricsInformationSchema = "information-schema"
+)
+
+const (
+	// JobGroupUserEmail groups job metrics by the user or service account that ran the job
+	JobGroupUserEmail = "user_email"
+
+	// JobGroupDestinationDataset groups job metrics by the dataset of the job's destination table
+	JobGroupDestinationDataset = "destination_dataset"
+
+	// JobGroupReservation groups job metrics by the reservation the job ran in
+	JobGroupReservation = "reservation_id"
+
+	// JobGroupPriority groups job metrics by the priority of the job
+	JobGroupPriority = "priority"
+
+	// JobGroupLabelPrefix is the prefix of a group-by setting that groups job
+	// metrics by the value of a job label, e.g. label:team
+	JobGroupLabelPrefix = "label:"
+)
+
+// jobLabelKey matches the keys of BigQuery job labels
+var jobLabelKey = regexp.MustCompile(`^[a-z0-9_-]{1,63}$`)
+
+// jobsRegion matches the BigQuery regions that INFORMATION_SCHEMA views can be
+// read from
+var jobsRegion = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+const (
+	// ParamString is a STRING query parameter, the default
+	ParamString = "string"
+
+	// ParamInt64 is an INT64 query parameter
+	ParamInt64 = "int64"
+
+	// ParamFloat64 is a FLOAT64 query parameter
+	ParamFloat64 = "float64"
+
+	// ParamBool is a BOOL query parameter
+	ParamBool = "bool"
+
+	// ParamDate is a DATE query parameter, written as YYYY-MM-DD
+	ParamDate = "date"
+
+	// ParamTimestamp is a TIMESTAMP query parameter, written in RFC 3339 format
+	ParamTimestamp = "timestamp"
+)
+
+const (
+	// WindowLastRun is the time of the last successful run of a query
+	WindowLastRun = "last-run"
+
+	// WindowThisRun is the time of the current run of a query
+	WindowThisRun = "this-run"
+)
+
+// PatternRegexPrefix marks a table filter pattern as a regular expression
+// rather than a glob
+const PatternRegexPrefix = "re:"
+
+// queryParameterName matches the names of BigQuery query parameters
+var queryParameterName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
 // Config holds the configuration for the application
 type Config struct {
-	DatadogAPIKey  string         `viper:"datadog-api-key"`
-	DatadogSite    string         `viper:"datadog-site"`
-	DatasetFilter  string         `viper:"dataset-filter"`
-	GcpProject     string         `viper:"gcp-project-id"`
-	MetricPrefix   string         `viper:"metric-prefix"`
-	MetricTags     []string       `viper:"metric-tags"`
-	MetricInterval time.Duration  `viper:"metric-interval"`
-	CustomMetrics  []CustomMetric `viper:"custom-metrics"`
-	Profiler       Profiler       `viper:"profiler"`
-	HealthCheck    HealthCheck    `viper:"healthcheck"`
+	DatadogAPIKey    string           `viper:"datadog-api-key"`
+	DatadogSite      string           `viper:"datadog-site"`
+	DatadogRetry     Retry            `viper:"datadog-retry"`
+	DatasetFilter    string           `viper:"dataset-filter"`
+	TableFilter      TableFilter      `viper:"table-filter"`
+	Publishers       []string         `viper:"publishers"`
+	DryRun           bool             `viper:"dry-run"`
+	Output           string           `viper:"output"`
+	Prometheus       Prometheus       `viper:"prometheus"`
+	Buffer           Buffer           `viper:"buffer"`
+	Spool            Spool            `viper:"spool"`
+	Startup          Startup          `viper:"startup"`
+	State            State            `viper:"state"`
+	GcpProject       string           `viper:"gcp-project-id"`
+	Projects         []Project        `viper:"projects"`
+	MetricPrefix     string           `viper:"metric-prefix"`
+	MetricTags       []string         `viper:"metric-tags"`
+	MetricInterval   time.Duration    `viper:"metric-interval"`
+	MaxBytesBilled   int64            `viper:"maximum-bytes-billed"`
+	QueryCheck       QueryCheck       `viper:"query-check"`
+	ExporterMetrics  ExporterMetrics  `viper:"exporter-metrics"`
+	CustomMetrics    []CustomMetric   `viper:"custom-metrics"`
+	TableMetrics     TableMetrics     `viper:"table-metrics"`
+	TableScan        TableScan        `viper:"table-scan"`
+	MetadataCache    MetadataCache    `viper:"metadata-cache"`
+	ShardedTables    ShardedTables    `viper:"sharded-tables"`
+	PartitionMetrics PartitionMetrics `viper:"partition-metrics"`
+	JobMetrics       JobMetrics       `viper:"job-metrics"`
+	FreshnessSLOs    []FreshnessSLO   `viper:"freshness-slos"`
+	Profiler         Profiler         `viper:"profiler"`
+	HealthCheck      HealthCheck      `viper:"healthcheck"`
+	Reload           Reload           `viper:"reload"`
+	ConfigFile       string           `viper:"config-file"`
+}
+
+// Project holds details about a GCP project to collect table metrics from
+type Project struct {
+	ProjectID     string   `viper:"project-id"`
+	DatasetFilter string   `viper:"dataset-filter"`
+	MetricTags    []string `viper:"metric-tags"`
 }
 
 // CustomMetric holds details about a metric generated from an SQL query
 type CustomMetric struct {
-	MetricName     string        `viper:"metric-name"`
-	MetricTags     []string      `viper:"metric-tags"`
-	MetricInterval time.Duration `viper:"metric-interval"`
-	SQL            string        `viper:"sql"`
+	MetricName     string           `viper:"metric-name"`
+	MetricTags     []string         `viper:"metric-tags"`
+	MetricInterval time.Duration    `viper:"metric-interval"`
+	Schedule       string           `viper:"schedule"`
+	Timezone       string           `viper:"timezone"`
+	SQL            string           `viper:"sql"`
+	TagColumns     []string         `viper:"tag-columns"`
+	MaxRows        int              `viper:"max-rows"`
+	StartupPolicy  string           `viper:"startup-policy"`
+	MaxBytesBilled int64            `viper:"maximum-bytes-billed"`
+	Parameters     []QueryParameter `viper:"parameters"`
+}
+
+// QueryParameter is a named parameter passed to a custom metric query, which
+// is referred to in the SQL as @name. Its value is either static, read from an
+// environment variable, or the time of the last or current run of the query
+type QueryParameter struct {
+	Name   string `viper:"name"`
+	Type   string `viper:"type"`
+	Value  string `viper:"value"`
+	Env    string `viper:"env"`
+	Window string `viper:"window"`
+}
+
+// validate checks that the parameter is well formed. The environment variable
+// of a parameter is not read, as it only needs to be set when the query runs
+func (qp QueryParameter) validate() error {
+	if qp.Env == "" {
+		now := time.Now()
+		_, err := qp.Resolve(now, now)
+		return err
+	}
+
+	switch qp.Type {
+	case "", ParamString, ParamInt64, ParamFloat64, ParamBool, ParamDate, ParamTimestamp:
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown type %s", ErrInvalidQueryParameter, qp.Type)
+	}
+}
+
+// Resolve returns the value of the parameter, converted to its type. The
+// times of the last and current run are used for window parameters
+func (qp QueryParameter) Resolve(lastRun, thisRun time.Time) (interface{}, error) {
+	raw := qp.Value
+	switch {
+	case qp.Window != "":
+		var at time.Time
+		switch qp.Window {
+		case WindowLastRun:
+			at = lastRun
+		case WindowThisRun:
+			at = thisRun
+		default:
+			return nil, fmt.Errorf("%w: unknown window %s", ErrInvalidQueryParameter, qp.Window)
+		}
+
+		switch qp.Type {
+		case "", ParamTimestamp:
+			return at.UTC(), nil
+		case ParamDate:
+			return civil.DateOf(at.UTC()), nil
+		default:
+			return nil, fmt.Errorf("%w: window parameters must be a timestamp or date", ErrInvalidQueryParameter)
+		}
+	case qp.Env != "":
+		val, ok := os.LookupEnv(qp.Env)
+		if !ok {
+			return nil, fmt.Errorf("%w: environment variable %s is not set", ErrInvalidQueryParameter, qp.Env)
+		}
+		raw = val
+	}
+
+	var val interface{}
+	var err error
+	switch qp.Type {
+	case "", ParamString:
+		val = raw
+	case ParamInt64:
+		val, err = strconv.ParseInt(raw, 10, 64)
+	case ParamFloat64:
+		val, err = strconv.ParseFloat(raw, 64)
+	case ParamBool:
+		val, err = strconv.ParseBool(raw)
+	case ParamDate:
+		val, err = civil.ParseDate(raw)
+	case ParamTimestamp:
+		val, err = time.Parse(time.RFC3339, raw)
+	default:
+		return nil, fmt.Errorf("%w: unknown type %s", ErrInvalidQueryParameter, qp.Type)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidQueryParameter, err)
+	}
+	return val, nil
+}
+
+// CronSchedule returns the parsed cron schedule of the custom metric, in its
+// configured time zone. A nil schedule is returned when the custom metric runs
+// on its metric interval instead
+func (cm CustomMetric) CronSchedule() (cron.Schedule, error) {
+	if cm.Schedule == "" {
+		return nil, nil
+	}
+
+	spec := cm.Schedule
+	if cm.Timezone != "" {
+		if _, err := time.LoadLocation(cm.Timezone); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidTimezone, err)
+		}
+		spec = fmt.Sprintf("CRON_TZ=%s %s", cm.Timezone, spec)
+	}
+
+	sched, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSchedule, err)
+	}
+
+	return sched, nil
+}
+
+// maxPeriodRuns is the most runs of a schedule scanned for its longest period
+const maxPeriodRuns = 10000
+
+// LongestPeriod returns the longest time between consecutive runs of the
+// custom metric. For a scheduled custom metric, the runs over the year from
+// the given time are scanned, so that an irregular schedule such as one on
+// weekdays only is given the gap over the weekend. Otherwise, and if the
+// schedule is invalid, it is the metric interval
+func (cm CustomMetric) LongestPeriod(from time.Time) time.Duration {
+	schedule, err := cm.CronSchedule()
+	if err != nil || schedule == nil {
+		return cm.MetricInterval
+	}
+
+	var longest time.Duration
+	end := from.AddDate(1, 0, 0)
+	prev := schedule.Next(from)
+	for i := 0; i < maxPeriodRuns && !prev.IsZero(); i++ {
+		next := schedule.Next(prev)
+		if next.IsZero() {
+			break
+		}
+
+		if gap := next.Sub(prev); gap > longest {
+			longest = gap
+		}
+		if next.After(end) {
+			break
+		}
+		prev = next
+	}
+
+	return longest
+}
+
+// TableMetrics holds configuration for the optional table-level metrics, and
+// the strategy used to read them. The information-schema strategy reads the
+// tables of a project from the INFORMATION_SCHEMA.TABLE_STORAGE view of Region
+type TableMetrics struct {
+	SizeBytes     bool   `viper:"size-bytes"`
+	LongTermBytes bool   `viper:"long-term-bytes"`
+	PhysicalBytes bool   `viper:"physical-bytes"`
+	Strategy      string `viper:"strategy"`
+	Region        string `viper:"region"`
+}
+
+// TableScan holds the limits on the BigQuery API calls made for each table
+// during a table scan. At most Concurrency tables are read at once, and the
+// calls reading table metadata are limited to RateLimit per second, where zero
+// means no limit. Calls that fail because of a quota error are retried
+// following Retry
+type TableScan struct {
+	Concurrency int     `viper:"concurrency"`
+	RateLimit   float64 `viper:"rate-limit"`
+	Retry       Retry   `viper:"retry"`
+}
+
+// MetadataCache holds configuration for caching table metadata between table
+// scans. Cached metadata is reused until it is older than the TTL. If a region
+// is given, metadata is also read again as soon as the table is seen to have
+// changed in INFORMATION_SCHEMA.TABLE_STORAGE of that region
+type MetadataCache struct {
+	Enabled bool          `viper:"enabled"`
+	TTL     time.Duration `viper:"ttl"`
+	Region  string        `viper:"region"`
+}
+
+// ShardedTables holds configuration for date-sharded tables, such as
+// events_20210601. When collapsed, the shards of a table are reported as one
+// logical table such as events_*, and the series of each shard are only kept
+// if requested
+type ShardedTables struct {
+	Collapse   bool `viper:"collapse"`
+	KeepShards bool `viper:"keep-shards"`
+}
+
+// PartitionMetrics holds configuration for the partition-level metrics, which
+// are read from INFORMATION_SCHEMA.PARTITIONS of each dataset every interval
+type PartitionMetrics struct {
+	Enabled       bool          `viper:"enabled"`
+	MaxPartitions int           `viper:"max-partitions"`
+	Interval      time.Duration `viper:"interval"`
+}
+
+// QueryCheck holds configuration for estimating the bytes processed by each
+// custom metric query with a dry run at startup
+type QueryCheck struct {
+	Enabled bool   `viper:"enabled"`
+	Action  string `viper:"action"`
+}
+
+// JobMetrics holds configuration for the metrics describing the BigQuery jobs
+// run in each project, read from INFORMATION_SCHEMA.JOBS_BY_PROJECT. Each read
+// ends the lag before it runs, as jobs can appear in the view after they end
+type JobMetrics struct {
+	Enabled  bool          `viper:"enabled"`
+	Interval time.Duration `viper:"interval"`
+	Lag      time.Duration `viper:"lag"`
+	Region   string        `viper:"region"`
+	GroupBy  []string      `viper:"group-by"`
+}
+
+// TableFilter holds rules selecting the datasets and tables that metrics are
+// collected from, in addition to the dataset label filter. Patterns are globs
+// unless prefixed with re: to use a regular expression, and must match the
+// whole dataset or table ID. Excludes take priority over includes, and an
+// empty include list includes everything. Table labels are given as key:value,
+// or as key to match any value, and a table must have every label listed
+type TableFilter struct {
+	IncludeDatasets []string `viper:"include-datasets"`
+	ExcludeDatasets []string `viper:"exclude-datasets"`
+	IncludeTables   []string `viper:"include-tables"`
+	ExcludeTables   []string `viper:"exclude-tables"`
+	TableLabels     []string `viper:"table-labels"`
+}
+
+// CompilePattern returns a function matching a whole ID against a table
+// filter pattern, which is a glob unless it is prefixed with re:
+func CompilePattern(pattern string) (func(string) bool, error) {
+	if expr := strings.TrimPrefix(pattern, PatternRegexPrefix); expr != pattern {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidTableFilter, err)
+		}
+		return re.MatchString, nil
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("%w: invalid pattern %s", ErrInvalidTableFilter, pattern)
+	}
+	return func(id string) bool {
+		ok, _ := path.Match(pattern, id)
+		return ok
+	}, nil
+}
+
+// FreshnessSLO declares how recently the tables matching a pattern are
+// expected to have been modified. The table pattern is a glob matched against
+// the dataset and table ID as dataset.table, such as my-dataset.events_*, and
+// applies to every project unless a project ID is given
+type FreshnessSLO struct {
+	ProjectID string        `viper:"project-id"`
+	Table     string        `viper:"table"`
+	MaxAge    time.Duration `viper:"max-age"`
+	WarnAge   time.Duration `viper:"warn-age"`
+}
+
+// Matches returns whether the freshness SLO applies to the given table
+func (f FreshnessSLO) Matches(projectID, datasetID, tableID string) bool {
+	if f.ProjectID != "" && f.ProjectID != projectID {
+		return false
+	}
+
+	ok, err := path.Match(f.Table, datasetID+"."+tableID)
+	return ok && err == nil
+}
+
+// Retry holds configuration for retrying failed requests with exponential backoff
+type Retry struct {
+	MaxAttempts     int           `viper:"max-attempts"`
+	InitialInterval time.Duration `viper:"initial-interval"`
+	MaxInterval     time.Duration `viper:"max-interval"`
+	MaxElapsedTime  time.Duration `viper:"max-elapsed-time"`
+}
+
+// Backoff returns the wait before the given retry attempt, doubling from the
+// initial interval up to the max interval with equal jitter applied. Without
+// a max interval the wait stops doubling before it would overflow
+func (r Retry) Backoff(attempt int) time.Duration {
+	wait := r.InitialInterval
+	for i := 1; i < attempt && wait <= math.MaxInt64/2 && (r.MaxInterval <= 0 || wait < r.MaxInterval); i++ {
+		wait *= 2
+	}
+
+	if r.MaxInterval > 0 && wait > r.MaxInterval {
+		wait = r.MaxInterval
+	}
+
+	if wait <= 1 {
+		return wait
+	}
+
+	half := wait / 2
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+// CanRetryWithin returns whether waiting for the given duration would stay
+// within both the maximum elapsed time since start and the context deadline
+func (r Retry) CanRetryWithin(ctx context.Context, start time.Time, wait time.Duration) bool {
+	next := time.Now().Add(wait)
+
+	if r.MaxElapsedTime > 0 && next.Sub(start) > r.MaxElapsedTime {
+		return false
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && next.After(deadline) {
+		return false
+	}
+
+	return true
+}
+
+// ExporterMetrics holds configuration for the metrics describing the exporter
+// itself, which are named within the namespace under the metric prefix
+type ExporterMetrics struct {
+	Enabled   bool   `viper:"enabled"`
+	Namespace string `viper:"namespace"`
+}
+
+// Buffer holds the limits on metrics held while waiting to be published
+type Buffer struct {
+	MaxPoints  int    `viper:"max-points"`
+	MaxSeries  int    `viper:"max-series"`
+	DropPolicy string `viper:"drop-policy"`
+}
+
+// Spool holds configuration for persisting unpublished metrics to disk
+type Spool struct {
+	Enabled bool   `viper:"enabled"`
+	Path    string `viper:"path"`
+}
+
+// Startup holds configuration for when generators first run after the process starts
+type Startup struct {
+	Policy string        `viper:"policy"`
+	Jitter time.Duration `viper:"jitter"`
+}
+
+// State holds configuration for persisting the last run time of each
+// generator to disk, so that a restart does not repeat a recent run
+type State struct {
+	Enabled bool   `viper:"enabled"`
+	Path    string `viper:"path"`
+}
+
+// Prometheus holds configuration details for the Prometheus scrape endpoint
+type Prometheus struct {
+	Port int    `viper:"port"`
+	Path string `viper:"path"`
 }
 
 // Profiler holds configuration details for the profiler
@@ -63,10 +587,22 @@ type Profiler struct {
 	Port    int  `viper:"port"`
 }
 
-// HealthCheck holds configuration details for the health endpoint
+// HealthCheck holds configuration details for the health endpoint. The
+// maximum ages are how long since the last success before the service is
+// reported as unhealthy, where zero means five times the relevant interval
 type HealthCheck struct {
-	Enabled bool `viper:"enabled"`
-	Port    int  `viper:"port"`
+	Enabled            bool          `viper:"enabled"`
+	Port               int           `viper:"port"`
+	MaxPublishAge      time.Duration `viper:"max-publish-age"`
+	MaxTableScanAge    time.Duration `viper:"max-table-scan-age"`
+	MaxCustomMetricAge time.Duration `viper:"max-custom-metric-age"`
+}
+
+// Reload holds configuration for reloading the config file while running. The
+// config is always reloaded on SIGHUP, and also whenever the config file
+// changes if it is watched
+type Reload struct {
+	Watch bool `viper:"watch"`
 }
 
 // NewConfig creates a config struct using the package viper for configuration
@@ -74,6 +610,31 @@ type HealthCheck struct {
 // when running the application, or as environment variables. Priority is as
 // determined by the viper package.
 func NewConfig(name string) (*Config, error) {
+	cfg, err := LoadConfig(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ValidateConfig(cfg); err != nil {
+		return nil, fmt.Errorf("error validating config: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// LoadConfig creates a normalised config struct in the same way as NewConfig,
+// but without validating it, so that every problem with it can be reported
+// by LintConfig
+func LoadConfig(name string) (*Config, error) {
+	cfg, _, err := LoadCommandConfig(name, os.Args[1:], nil)
+	return cfg, err
+}
+
+// LoadCommandConfig creates a normalised config struct in the same way as
+// LoadConfig from the given command line arguments, which can also hold the
+// flags of a command. The flags of the command are not part of the config. The
+// positional arguments, such as the name of the command, are returned
+func LoadCommandConfig(name string, args []string, cmd *pflag.FlagSet) (*Config, []string, error) {
 	var cfg Config
 	var err error
 
@@ -87,54 +648,85 @@ func NewConfig(name string) (*Config, error) {
 
 	handleEnvBindings(vpr, fs)
 
+	if err = vpr.BindPFlags(fs); err != nil {
+		return nil, nil, fmt.Errorf("failed to bind flags: %w", err)
+	}
+
+	if cmd != nil {
+		fs.AddFlagSet(cmd)
+	}
+	_ = fs.Parse(args)
+
 	cfgFile, _ := fs.GetString("config-file")
 	if cfgFile != "" {
 		vpr.SetConfigFile(cfgFile)
 	}
 
-	if err = vpr.BindPFlags(fs); err != nil {
-		return nil, fmt.Errorf("failed to bind flags: %w", err)
-	}
-
 	if err = vpr.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok || cfgFile != "" {
-			return nil, fmt.Errorf("failed to read in config: %w", err)
+			return nil, nil, fmt.Errorf("failed to read in config: %w", err)
 		}
 	}
 
 	if err = handleAliases(vpr, "datadog-api-key"); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	// The config file may have been found on one of the search paths
+	vpr.Set("config-file", vpr.ConfigFileUsed())
+
 	if err = vpr.Unmarshal(&cfg, func(cfg *mapstructure.DecoderConfig) {
 		cfg.TagName = tagName
 	}); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+		return nil, nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 
 	if err = handleFinalDefaults(&cfg); err != nil {
-		return nil, fmt.Errorf("could not handle defaults: %w", err)
+		return nil, nil, fmt.Errorf("could not handle defaults: %w", err)
 	}
 
 	NormaliseConfig(&cfg)
-	if err = ValidateConfig(&cfg); err != nil {
-		return nil, fmt.Errorf("error validating config: %w", err)
-	}
 
-	return &cfg, nil
+	return &cfg, fs.Args(), nil
 }
 
 // NormaliseConfig will apply rules to normalise the config, specifically
+// * GCP project is set to the first project if missing
+// * Projects is set to the GCP project if missing
+// * Project dataset filter is set to the default dataset filter if missing
 // * CustomMetric interval is set to the default interval if missing
+// * CustomMetric row limit is set to the default if missing and tag columns are used
 func NormaliseConfig(c *Config) {
-	if len(c.CustomMetrics) == 0 {
-		return
+	if c.GcpProject == "" && len(c.Projects) > 0 {
+		c.GcpProject = c.Projects[0].ProjectID
+	}
+
+	if len(c.Projects) == 0 && c.GcpProject != "" {
+		c.Projects = []Project{{ProjectID: c.GcpProject}}
+	}
+
+	for i := range c.Projects {
+		if c.Projects[i].DatasetFilter == "" {
+			c.Projects[i].DatasetFilter = c.DatasetFilter
+		}
 	}
 
 	for i := range c.CustomMetrics {
 		if c.CustomMetrics[i].MetricInterval == time.Duration(0) {
 			c.CustomMetrics[i].MetricInterval = c.MetricInterval
 		}
+
+		if len(c.CustomMetrics[i].TagColumns) > 0 && c.CustomMetrics[i].MaxRows == 0 {
+			c.CustomMetrics[i].MaxRows = DefaultCustomMetricMaxRows
+		}
+
+		if c.CustomMetrics[i].StartupPolicy == "" {
+			c.CustomMetrics[i].StartupPolicy = c.Startup.Policy
+		}
+
+		if c.CustomMetrics[i].MaxBytesBilled == 0 {
+			c.CustomMetrics[i].MaxBytesBilled = c.MaxBytesBilled
+		}
 	}
 }
 
@@ -150,49 +742,148 @@ var DatadogSites = map[string]string{
 	"AP1":     "ap1.datadoghq.com",
 }
 
-// ValidateConfig will validate that all of the required config parameters are present
+// ValidateConfig will validate that all of the required config parameters are
+// present, returning the first problem found
 func ValidateConfig(c *Config) error {
-	if c.DatadogAPIKey == "" {
-		return ErrMissingDatadogAPIKey
+	if problems := validateConfig(c); len(problems) > 0 {
+		return problems[0]
 	}
 
-	if _, ok := DatadogSites[c.DatadogSite]; !ok {
-		return ErrInvalidDatadogSite
+	return nil
+}
+
+// validateConfig returns every problem found by ValidateConfig, in the order
+// the fields are checked
+func validateConfig(c *Config) []Problem {
+	var p problems
+
+	if c.DryRun {
+		switch c.Output {
+		case OutputTable, OutputJSON, OutputNDJSON:
+		default:
+			p.add("output", ErrInvalidOutputFormat)
+		}
+	} else {
+		validatePublishers(c, &p)
 	}
 
 	if c.GcpProject == "" {
-		return ErrMissingGcpProject
+		p.add("gcp-project-id", ErrMissingGcpProject)
+	}
+
+	seen := make(map[string]bool)
+	for i, proj := range c.Projects {
+		field := fmt.Sprintf("projects[%d].project-id", i)
+		if proj.ProjectID == "" {
+			p.add(field, ErrMissingGcpProject)
+			continue
+		}
+
+		if seen[proj.ProjectID] {
+			p.add(field, ErrDuplicateGcpProject)
+		}
+		seen[proj.ProjectID] = true
 	}
 
 	if c.MetricPrefix == "" {
-		return ErrMissingMetricPrefix
+		p.add("metric-prefix", ErrMissingMetricPrefix)
 	}
 
-	if c.MetricInterval == time.Duration(0) {
-		return ErrMissingMetricInterval
+	p.add("metric-interval", validateInterval(c.MetricInterval))
+
+	if c.ExporterMetrics.Enabled && c.ExporterMetrics.Namespace == "" {
+		p.add("exporter-metrics.namespace", ErrMissingExporterNamespace)
 	}
 
-	if len(c.CustomMetrics) > 0 {
-		for i, cm := range c.CustomMetrics {
-			if err := validateCustomMetric(cm); err != nil {
-				return fmt.Errorf("error in custom metric %d: %w", i, err)
-			}
+	if c.MaxBytesBilled < 0 {
+		p.add("maximum-bytes-billed", ErrInvalidMaxBytesBilled)
+	}
+
+	switch c.QueryCheck.Action {
+	case "", QueryCheckFail, QueryCheckDisable:
+	default:
+		p.add("query-check.action", ErrInvalidQueryCheckAction)
+	}
+
+	// Custom metrics are tracked by name, so the name of each must be unique
+	names := make(map[string]int, len(c.CustomMetrics))
+	for i, cm := range c.CustomMetrics {
+		field := fmt.Sprintf("custom-metrics[%d]", i)
+		validateCustomMetric(field, cm, &p)
+
+		if first, ok := names[cm.MetricName]; ok && cm.MetricName != "" {
+			p.add(field+".metric-name", fmt.Errorf("%w: %s is also the name of custom-metrics[%d]", ErrDuplicateMetricName, cm.MetricName, first))
+		} else {
+			names[cm.MetricName] = i
 		}
 	}
 
+	if c.TableScan.Concurrency < 0 {
+		p.add("table-scan.concurrency", ErrInvalidTableScan)
+	}
+
+	if c.TableScan.RateLimit < 0 {
+		p.add("table-scan.rate-limit", ErrInvalidTableScan)
+	}
+
+	p.add("table-scan.retry", validateRetry(c.TableScan.Retry))
+
+	if c.MetadataCache.Enabled {
+		p.add("metadata-cache", validateMetadataCache(c.MetadataCache))
+	}
+
+	p.add("table-filter", validateTableFilter(c.TableFilter))
+	p.add("table-metrics", validateTableMetrics(c.TableMetrics, c.TableFilter))
+
+	for i, f := range c.FreshnessSLOs {
+		p.add(fmt.Sprintf("freshness-slos[%d]", i), validateFreshnessSLO(f))
+	}
+
+	if c.PartitionMetrics.MaxPartitions < 0 {
+		p.add("partition-metrics.max-partitions", ErrInvalidMaxPartitions)
+	}
+
+	if c.PartitionMetrics.Enabled {
+		p.add("partition-metrics.interval", validateInterval(c.PartitionMetrics.Interval))
+	}
+
+	if c.JobMetrics.Enabled {
+		p.add("job-metrics", validateJobMetrics(c.JobMetrics))
+	}
+
+	p.add("buffer", validateBuffer(c.Buffer))
+
+	if c.Spool.Enabled && c.Spool.Path == "" {
+		p.add("spool.path", ErrMissingSpoolPath)
+	}
+
+	p.add("startup.policy", validateStartupPolicy(c.Startup.Policy))
+
+	if c.Startup.Jitter < 0 {
+		p.add("startup.jitter", ErrInvalidStartupJitter)
+	}
+
+	if c.State.Enabled && c.State.Path == "" {
+		p.add("state.path", ErrMissingStatePath)
+	}
+
 	if c.HealthCheck.Enabled {
 		if c.HealthCheck.Port <= 0 || c.HealthCheck.Port > 65535 {
-			return ErrInvalidPort
+			p.add("healthcheck.port", ErrInvalidPort)
+		}
+
+		if c.HealthCheck.MaxPublishAge < 0 || c.HealthCheck.MaxTableScanAge < 0 || c.HealthCheck.MaxCustomMetricAge < 0 {
+			p.add("healthcheck", ErrInvalidHealthCheckAge)
 		}
 	}
 
 	if c.Profiler.Enabled {
 		if c.Profiler.Port <= 0 || c.Profiler.Port > 65535 {
-			return ErrInvalidPort
+			p.add("profiler.port", ErrInvalidPort)
 		}
 	}
 
-	return nil
+	return p
 }
 
 // GetEnv will return the value of the environment variable if set, otherwise the default
@@ -215,16 +906,70 @@ func configFlags(name string) *pflag.FlagSet {
 	flags.String("datadog-api-key-file", "", "File containing the Datadog API key")
 	flags.String("datadog-api-key-secret-id", "", "Google Secret Manager Resource ID containing the Datadog API key")
 	flags.String("datadog-site", "US", "Datadog site to use (see https://docs.datadoghq.com/getting_started/site/)")
+	flags.Int("datadog-retry.max-attempts", 3, "The maximum number of attempts to publish metrics to Datadog in each publishing round")
+	flags.Duration("datadog-retry.initial-interval", time.Second, "The wait before the first retry of a failed Datadog request, doubling on each retry")
+	flags.Duration("datadog-retry.max-interval", 10*time.Second, "The maximum wait between retries of a failed Datadog request")
+	flags.Duration("datadog-retry.max-elapsed-time", 20*time.Second, "The maximum total time to spend retrying a failed Datadog request")
+	flags.Bool("dry-run", false, "Writes metrics to stdout instead of publishing them")
+	flags.String("output", OutputTable, "The format to write metrics in when running with --dry-run (table, json, ndjson)")
+	flags.StringSlice("table-filter.include-datasets", []string{}, "Comma-delimited list of glob or re: patterns of dataset IDs to collect metrics from")
+	flags.StringSlice("table-filter.exclude-datasets", []string{}, "Comma-delimited list of glob or re: patterns of dataset IDs to skip")
+	flags.StringSlice("table-filter.include-tables", []string{}, "Comma-delimited list of glob or re: patterns of table IDs to collect metrics from")
+	flags.StringSlice("table-filter.exclude-tables", []string{}, "Comma-delimited list of glob or re: patterns of table IDs to skip")
+	flags.StringSlice("table-filter.table-labels", []string{}, "Comma-delimited list of key:value labels that tables must have to collect metrics from")
+	flags.StringSlice("publishers", []string{PublisherDatadog}, "Comma-delimited list of destinations to publish metrics to (datadog, prometheus)")
+	flags.Int("buffer.max-points", 0, "The maximum number of points to hold while waiting to be published, or 0 for no limit")
+	flags.Int("buffer.max-series", 0, "The maximum number of series to hold while waiting to be published, or 0 for no limit")
+	flags.String("buffer.drop-policy", DropOldest, "Which points to drop when the buffer is full (oldest, newest, latest)")
+	flags.Bool("spool.enabled", false, "Enables persisting unpublished metrics to disk so they survive a restart")
+	flags.String("spool.path", "/var/lib/bqmetricsd/spool.jsonl", "The file to persist unpublished metrics to")
+	flags.String("startup.policy", StartupWait, "When generators first run after starting (immediate, jitter, wait)")
+	flags.Duration("startup.jitter", time.Minute, "The maximum random delay before generators first run with the jitter startup policy")
+	flags.Bool("state.enabled", false, "Enables persisting the last run time of each generator so a restart does not repeat a recent run")
+	flags.String("state.path", "/var/lib/bqmetricsd/state.json", "The file to persist the last run time of each generator to")
+	flags.Int("prometheus.port", 9464, "The port on which to serve the Prometheus metrics endpoint")
+	flags.String("prometheus.path", "/metrics", "The path on which to serve the Prometheus metrics endpoint")
 	flags.String("gcp-project-id", "", "The GCP project to extract BigQuery metrics from")
 	flags.String("metric-prefix", DefaultMetricPrefix, fmt.Sprintf("The prefix for the metrics names exported to Datadog (Default %s)", DefaultMetricPrefix))
 	flags.Duration("metric-interval", defInterval, fmt.Sprintf("The interval between metrics submissions (Default %s)", DefaultMetricInterval))
 	flags.StringSlice("metric-tags", []string{}, "Comma-delimited list of tags to attach to metrics")
+	flags.Int64("maximum-bytes-billed", 0, "The maximum bytes billed for each query, which fails if it would bill more (0 for no limit)")
+	flags.Bool("query-check.enabled", false, "Enables estimating the bytes processed by each custom metric query with a dry run at startup")
+	flags.String("query-check.action", QueryCheckFail, "What to do when a custom metric query is estimated to exceed its maximum bytes billed (fail, disable)")
+	flags.Bool("table-metrics.size-bytes", true, "Enables the table size in bytes metric")
+	flags.Bool("table-metrics.long-term-bytes", true, "Enables the table long-term storage bytes metric")
+	flags.Bool("table-metrics.physical-bytes", false, "Enables the table physical storage bytes metric (requires an extra API call per table with the api strategy)")
+	flags.String("table-metrics.strategy", TableMetricsAPI, "How table metadata is read (api, information-schema)")
+	flags.String("table-metrics.region", "us", "The BigQuery region to read tables from with the information-schema strategy, e.g. us, eu or europe-west2")
+	flags.Int("table-scan.concurrency", 0, "The maximum number of tables to read metadata for at once, or 0 for no limit")
+	flags.Float64("table-scan.rate-limit", 0, "The maximum number of table metadata reads per second during a table scan, or 0 for no limit. Listing tables is not limited")
+	flags.Int("table-scan.retry.max-attempts", 5, "The maximum number of attempts of a BigQuery API call that fails with a quota error")
+	flags.Duration("table-scan.retry.initial-interval", time.Second, "The wait before the first retry of a BigQuery API call that fails with a quota error")
+	flags.Duration("table-scan.retry.max-interval", 30*time.Second, "The maximum wait between retries of a BigQuery API call that fails with a quota error")
+	flags.Duration("table-scan.retry.max-elapsed-time", 2*time.Minute, "The maximum total time to spend retrying a BigQuery API call that fails with a quota error")
+	flags.Bool("metadata-cache.enabled", false, "Enables caching table metadata between table scans")
+	flags.Duration("metadata-cache.ttl", time.Hour, "The maximum age of cached table metadata")
+	flags.String("metadata-cache.region", "", "The BigQuery region to detect table changes in from INFORMATION_SCHEMA.TABLE_STORAGE, e.g. us, eu or europe-west2")
+	flags.Bool("sharded-tables.collapse", false, "Enables reporting date-sharded tables such as events_20210601 as one logical table events_*")
+	flags.Bool("sharded-tables.keep-shards", false, "Keeps the series of each shard of a collapsed date-sharded table")
+	flags.Bool("partition-metrics.enabled", false, "Enables the partition-level metrics")
+	flags.Int("partition-metrics.max-partitions", 10, "The number of most recent partitions per table to export metrics for (0 for all partitions)")
+	flags.Duration("partition-metrics.interval", time.Hour, "The interval between reads of the partitions of every table")
+	flags.Bool("job-metrics.enabled", false, "Enables the metrics describing the BigQuery jobs run in each project")
+	flags.Duration("job-metrics.interval", 5*time.Minute, "The interval between reads of the BigQuery jobs run in each project")
+	flags.Duration("job-metrics.lag", 5*time.Minute, "How long before each read of the BigQuery jobs the jobs read end, to allow for jobs appearing late")
+	flags.String("job-metrics.region", "us", "The BigQuery region to read jobs from, e.g. us, eu or europe-west2")
+	flags.StringSlice("job-metrics.group-by", []string{}, "Comma-delimited list of extra tags to group job metrics by (user_email, destination_dataset, reservation_id, priority, label:<key>)")
+	flags.Bool("exporter-metrics.enabled", false, "Enables metrics describing the exporter itself")
+	flags.String("exporter-metrics.namespace", "exporter", "The namespace under the metric prefix for metrics describing the exporter itself")
 	flags.Bool("profiler.enabled", false, "Enables the profiler")
 	flags.Int("profiler.port", 6060, "The port on which to run the profiler server")
+	flags.Bool("reload.watch", false, "Enables reloading the config whenever the config file changes, as well as on SIGHUP")
 	flags.Bool("healthcheck.enabled", false, "Enables the health check endpoint")
 	flags.Int("healthcheck.port", 8080, "The port on which to run the server providing the health check endpoint")
-
-	_ = flags.Parse(os.Args[1:])
+	flags.Duration("healthcheck.max-publish-age", 0, "The time since the last successful publish before reporting unhealthy, or 0 for five times the metric interval")
+	flags.Duration("healthcheck.max-table-scan-age", 0, "The time since the last successful table scan before reporting unhealthy, or 0 for five times the metric interval")
+	flags.Duration("healthcheck.max-custom-metric-age", 0, "The time since the last successful custom metric query before reporting unhealthy, or 0 for five times the custom metric interval")
 
 	return flags
 }
@@ -318,18 +1063,234 @@ func handleFinalDefaults(cfg *Config) error {
 	return nil
 }
 
-func validateCustomMetric(cm CustomMetric) error {
-	if cm.MetricInterval == time.Duration(0) {
+func validatePublishers(c *Config, p *problems) {
+	publishers := c.Publishers
+	if len(publishers) == 0 {
+		publishers = []string{PublisherDatadog}
+	}
+
+	seen := make(map[string]bool)
+	for i, pub := range publishers {
+		field := fmt.Sprintf("publishers[%d]", i)
+		if seen[pub] {
+			p.add(field, ErrDuplicatePublisher)
+			continue
+		}
+		seen[pub] = true
+
+		switch pub {
+		case PublisherDatadog:
+			if c.DatadogAPIKey == "" {
+				p.add("datadog-api-key", ErrMissingDatadogAPIKey)
+			}
+
+			if _, ok := DatadogSites[c.DatadogSite]; !ok {
+				p.add("datadog-site", ErrInvalidDatadogSite)
+			}
+
+			p.add("datadog-retry", validateRetry(c.DatadogRetry))
+
+			// Without a wait every retry of a failed request would be made at once
+			if c.DatadogRetry.MaxAttempts > 1 && c.DatadogRetry.InitialInterval == 0 {
+				p.add("datadog-retry.initial-interval", fmt.Errorf("%w: the initial interval must be positive to retry", ErrInvalidRetry))
+			}
+		case PublisherPrometheus:
+			if c.Prometheus.Port <= 0 || c.Prometheus.Port > 65535 {
+				p.add("prometheus.port", ErrInvalidPort)
+			}
+
+			if !strings.HasPrefix(c.Prometheus.Path, "/") {
+				p.add("prometheus.path", ErrInvalidPrometheusPath)
+			}
+		default:
+			p.add(field, ErrInvalidPublisher)
+		}
+	}
+}
+
+func validateBuffer(b Buffer) error {
+	if b.MaxPoints < 0 || b.MaxSeries < 0 {
+		return ErrInvalidBufferSize
+	}
+
+	switch b.DropPolicy {
+	case "", DropOldest, DropNewest, DropLatest:
+		return nil
+	default:
+		return ErrInvalidDropPolicy
+	}
+}
+
+// validateInterval returns an error if an interval is missing or negative
+func validateInterval(interval time.Duration) error {
+	switch {
+	case interval == 0:
 		return ErrMissingMetricInterval
+	case interval < 0:
+		return fmt.Errorf("%w: %s is negative", ErrInvalidInterval, interval)
+	default:
+		return nil
+	}
+}
+
+func validateJobMetrics(jm JobMetrics) error {
+	if err := validateInterval(jm.Interval); err != nil {
+		return err
+	}
+
+	if jm.Lag < 0 {
+		return ErrInvalidJobMetricsLag
+	}
+
+	if !jobsRegion.MatchString(jm.Region) {
+		return ErrInvalidJobMetricsRegion
+	}
+
+	for _, group := range jm.GroupBy {
+		switch group {
+		case JobGroupUserEmail, JobGroupDestinationDataset, JobGroupReservation, JobGroupPriority:
+			continue
+		}
+
+		if !strings.HasPrefix(group, JobGroupLabelPrefix) || !jobLabelKey.MatchString(strings.TrimPrefix(group, JobGroupLabelPrefix)) {
+			return fmt.Errorf("%w: %s", ErrInvalidJobMetricsGroupBy, group)
+		}
+	}
+
+	return nil
+}
+
+func validateTableMetrics(tm TableMetrics, tf TableFilter) error {
+	switch tm.Strategy {
+	case "", TableMetricsAPI:
+		return nil
+	case TableMetricsInformationSchema:
+	default:
+		return ErrInvalidTableMetricsStrategy
+	}
+
+	if !jobsRegion.MatchString(tm.Region) {
+		return ErrInvalidTableMetricsRegion
 	}
 
+	// INFORMATION_SCHEMA.TABLE_STORAGE has no table labels to filter on
+	if len(tf.TableLabels) > 0 {
+		return fmt.Errorf("%w: table labels cannot be filtered on with the %s strategy", ErrInvalidTableMetricsStrategy, tm.Strategy)
+	}
+
+	return nil
+}
+
+func validateMetadataCache(mc MetadataCache) error {
+	if mc.TTL <= 0 {
+		return ErrInvalidMetadataCacheTTL
+	}
+
+	if mc.Region != "" && !jobsRegion.MatchString(mc.Region) {
+		return ErrInvalidMetadataCacheRegion
+	}
+
+	return nil
+}
+
+func validateTableFilter(tf TableFilter) error {
+	for _, patterns := range [][]string{tf.IncludeDatasets, tf.ExcludeDatasets, tf.IncludeTables, tf.ExcludeTables} {
+		for _, pattern := range patterns {
+			if _, err := CompilePattern(pattern); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, label := range tf.TableLabels {
+		if strings.SplitN(label, ":", 2)[0] == "" {
+			return fmt.Errorf("%w: invalid table label %s", ErrInvalidTableFilter, label)
+		}
+	}
+
+	return nil
+}
+
+func validateFreshnessSLO(f FreshnessSLO) error {
+	if f.Table == "" {
+		return fmt.Errorf("%w: missing table pattern", ErrInvalidFreshnessSLO)
+	}
+
+	if _, err := path.Match(f.Table, ""); err != nil {
+		return fmt.Errorf("%w: invalid table pattern %s", ErrInvalidFreshnessSLO, f.Table)
+	}
+
+	if f.MaxAge <= 0 {
+		return fmt.Errorf("%w: max-age must be positive", ErrInvalidFreshnessSLO)
+	}
+
+	if f.WarnAge < 0 || f.WarnAge >= f.MaxAge {
+		return fmt.Errorf("%w: warn-age must be less than max-age", ErrInvalidFreshnessSLO)
+	}
+
+	return nil
+}
+
+func validateStartupPolicy(policy string) error {
+	switch policy {
+	case "", StartupImmediate, StartupJitter, StartupWait:
+		return nil
+	default:
+		return ErrInvalidStartupPolicy
+	}
+}
+
+func validateRetry(r Retry) error {
+	if r.MaxAttempts < 0 || r.InitialInterval < 0 || r.MaxInterval < 0 || r.MaxElapsedTime < 0 {
+		return ErrInvalidRetry
+	}
+
+	return nil
+}
+
+func validateCustomMetric(field string, cm CustomMetric, p *problems) {
+	p.add(field+".metric-interval", validateInterval(cm.MetricInterval))
+
 	if cm.MetricName == "" {
-		return ErrMissingMetricName
+		p.add(field+".metric-name", ErrMissingMetricName)
 	}
 
 	if cm.SQL == "" {
-		return ErrMissingCustomMetricSQL
+		p.add(field+".sql", ErrMissingCustomMetricSQL)
 	}
 
-	return nil
+	if cm.MaxRows < 0 {
+		p.add(field+".max-rows", ErrInvalidMaxRows)
+	}
+
+	if cm.MaxBytesBilled < 0 {
+		p.add(field+".maximum-bytes-billed", ErrInvalidMaxBytesBilled)
+	}
+
+	p.add(field+".startup-policy", validateStartupPolicy(cm.StartupPolicy))
+
+	seen := make(map[string]bool, len(cm.Parameters))
+	for i, qp := range cm.Parameters {
+		param := fmt.Sprintf("%s.parameters[%d]", field, i)
+		if !queryParameterName.MatchString(qp.Name) || seen[strings.ToLower(qp.Name)] {
+			p.add(param+".name", fmt.Errorf("%w: invalid or duplicate name %q", ErrInvalidQueryParameter, qp.Name))
+			continue
+		}
+		seen[strings.ToLower(qp.Name)] = true
+
+		if qp.Env != "" && qp.Window != "" {
+			p.add(param, fmt.Errorf("%w: %s has both an environment variable and a window", ErrInvalidQueryParameter, qp.Name))
+			continue
+		}
+
+		if err := qp.validate(); err != nil {
+			p.add(param, fmt.Errorf("parameter %s: %w", qp.Name, err))
+		}
+	}
+
+	if cm.Timezone != "" && cm.Schedule == "" {
+		p.add(field+".timezone", ErrInvalidTimezone)
+	} else if _, err := cm.CronSchedule(); err != nil {
+		p.add(field+".schedule", err)
+	}
 }
@@ -1,11 +1,14 @@
 package config
 
 import (
+	"cloud.google.com/go/civil"
 	"context"
 	"errors"
 	"github.com/googleapis/gax-go/v2"
+	"github.com/spf13/pflag"
 	smpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
 	"io/ioutil"
+	"math"
 	"os"
 	"reflect"
 	"strings"
@@ -42,56 +45,201 @@ func TestNewConfig(t *testing.T) {
 		wantErr bool
 	}{
 		{"all via env", setup([]string{"DATADOG_API_KEY=abc123", "DATADOG_SITE=EU", "DATASET_FILTER=bqmetrics:enabled", "GCP_PROJECT_ID=my-project-id", "METRIC_PREFIX=custom.gcp.bigquery.stats", "METRIC_TAGS=env:prod", "METRIC_INTERVAL=2m", "HEALTHCHECK_ENABLED=true"}, nil, ""), args{"bqmetricstest"}, &Config{
-			DatadogAPIKey:  "abc123",
-			DatadogSite:    "EU",
-			DatasetFilter:  "bqmetrics:enabled",
-			GcpProject:     "my-project-id",
-			MetricPrefix:   "custom.gcp.bigquery.stats",
-			MetricTags:     []string{"env:prod"},
-			MetricInterval: 2 * time.Minute,
-			Profiler:       Profiler{false, 6060},
-			HealthCheck:    HealthCheck{true, 8080},
+			DatadogAPIKey:    "abc123",
+			DatadogSite:      "EU",
+			DatasetFilter:    "bqmetrics:enabled",
+			GcpProject:       "my-project-id",
+			Projects:         []Project{{ProjectID: "my-project-id", DatasetFilter: "bqmetrics:enabled"}},
+			MetricPrefix:     "custom.gcp.bigquery.stats",
+			MetricTags:       []string{"env:prod"},
+			MetricInterval:   2 * time.Minute,
+			Publishers:       []string{PublisherDatadog},
+			Output:           OutputTable,
+			DatadogRetry:     Retry{3, time.Second, 10 * time.Second, 20 * time.Second},
+			Prometheus:       Prometheus{9464, "/metrics"},
+			Buffer:           Buffer{0, 0, DropOldest},
+			ExporterMetrics:  ExporterMetrics{false, "exporter"},
+			QueryCheck:       QueryCheck{false, QueryCheckFail},
+			Spool:            Spool{false, "/var/lib/bqmetricsd/spool.jsonl"},
+			Startup:          Startup{StartupWait, time.Minute},
+			State:            State{false, "/var/lib/bqmetricsd/state.json"},
+			TableMetrics:     TableMetrics{SizeBytes: true, LongTermBytes: true, Strategy: TableMetricsAPI, Region: "us"},
+			ShardedTables:    ShardedTables{false, false},
+			TableScan:        TableScan{0, 0, Retry{5, time.Second, 30 * time.Second, 2 * time.Minute}},
+			MetadataCache:    MetadataCache{false, time.Hour, ""},
+			PartitionMetrics: PartitionMetrics{MaxPartitions: 10, Interval: time.Hour},
+			JobMetrics:       JobMetrics{false, 5 * time.Minute, 5 * time.Minute, "us", []string{}},
+			TableFilter:      TableFilter{[]string{}, []string{}, []string{}, []string{}, []string{}},
+			Profiler:         Profiler{false, 6060},
+			HealthCheck:      HealthCheck{Enabled: true, Port: 8080},
 		}, false},
 		{"all via cmd", setup(nil, []string{"--datadog-api-key-file=/tmp/dd.key", "--datadog-site=EU", "--dataset-filter=bqmetrics:enabled", "--gcp-project-id=my-project-id", "--metric-prefix=custom.gcp.bigquery.stats", "--metric-tags=env:prod", "--metric-interval=2m", "--profiler.enabled"}, "abc123"), args{"bqmetricstest"}, &Config{
-			DatadogAPIKey:  "abc123",
-			DatadogSite:    "EU",
-			DatasetFilter:  "bqmetrics:enabled",
-			GcpProject:     "my-project-id",
-			MetricPrefix:   "custom.gcp.bigquery.stats",
-			MetricTags:     []string{"env:prod"},
-			MetricInterval: 2 * time.Minute,
-			Profiler:       Profiler{true, 6060},
-			HealthCheck:    HealthCheck{false, 8080},
+			DatadogAPIKey:    "abc123",
+			DatadogSite:      "EU",
+			DatasetFilter:    "bqmetrics:enabled",
+			GcpProject:       "my-project-id",
+			Projects:         []Project{{ProjectID: "my-project-id", DatasetFilter: "bqmetrics:enabled"}},
+			MetricPrefix:     "custom.gcp.bigquery.stats",
+			MetricTags:       []string{"env:prod"},
+			MetricInterval:   2 * time.Minute,
+			Publishers:       []string{PublisherDatadog},
+			Output:           OutputTable,
+			DatadogRetry:     Retry{3, time.Second, 10 * time.Second, 20 * time.Second},
+			Prometheus:       Prometheus{9464, "/metrics"},
+			Buffer:           Buffer{0, 0, DropOldest},
+			ExporterMetrics:  ExporterMetrics{false, "exporter"},
+			QueryCheck:       QueryCheck{false, QueryCheckFail},
+			Spool:            Spool{false, "/var/lib/bqmetricsd/spool.jsonl"},
+			Startup:          Startup{StartupWait, time.Minute},
+			State:            State{false, "/var/lib/bqmetricsd/state.json"},
+			TableMetrics:     TableMetrics{SizeBytes: true, LongTermBytes: true, Strategy: TableMetricsAPI, Region: "us"},
+			ShardedTables:    ShardedTables{false, false},
+			TableScan:        TableScan{0, 0, Retry{5, time.Second, 30 * time.Second, 2 * time.Minute}},
+			MetadataCache:    MetadataCache{false, time.Hour, ""},
+			PartitionMetrics: PartitionMetrics{MaxPartitions: 10, Interval: time.Hour},
+			JobMetrics:       JobMetrics{false, 5 * time.Minute, 5 * time.Minute, "us", []string{}},
+			TableFilter:      TableFilter{[]string{}, []string{}, []string{}, []string{}, []string{}},
+			Profiler:         Profiler{true, 6060},
+			HealthCheck:      HealthCheck{Enabled: false, Port: 8080},
 		}, false},
 		{"mixture of sources", setup([]string{"DATADOG_API_KEY=abc123", "DATADOG_SITE=US", "GCP_PROJECT_ID=my-project-id"}, []string{"--metric-prefix=custom.gcp.bigquery.stats", "--metric-tags=env:prod", "--metric-interval=2m"}, ""), args{"bqmetricstest"}, &Config{
-			DatadogAPIKey:  "abc123",
-			DatadogSite:    "US",
-			GcpProject:     "my-project-id",
-			MetricPrefix:   "custom.gcp.bigquery.stats",
-			MetricTags:     []string{"env:prod"},
-			MetricInterval: 2 * time.Minute,
-			Profiler:       Profiler{false, 6060},
-			HealthCheck:    HealthCheck{false, 8080},
+			DatadogAPIKey:    "abc123",
+			DatadogSite:      "US",
+			GcpProject:       "my-project-id",
+			Projects:         []Project{{ProjectID: "my-project-id"}},
+			MetricPrefix:     "custom.gcp.bigquery.stats",
+			MetricTags:       []string{"env:prod"},
+			MetricInterval:   2 * time.Minute,
+			Publishers:       []string{PublisherDatadog},
+			Output:           OutputTable,
+			DatadogRetry:     Retry{3, time.Second, 10 * time.Second, 20 * time.Second},
+			Prometheus:       Prometheus{9464, "/metrics"},
+			Buffer:           Buffer{0, 0, DropOldest},
+			ExporterMetrics:  ExporterMetrics{false, "exporter"},
+			QueryCheck:       QueryCheck{false, QueryCheckFail},
+			Spool:            Spool{false, "/var/lib/bqmetricsd/spool.jsonl"},
+			Startup:          Startup{StartupWait, time.Minute},
+			State:            State{false, "/var/lib/bqmetricsd/state.json"},
+			TableMetrics:     TableMetrics{SizeBytes: true, LongTermBytes: true, Strategy: TableMetricsAPI, Region: "us"},
+			ShardedTables:    ShardedTables{false, false},
+			TableScan:        TableScan{0, 0, Retry{5, time.Second, 30 * time.Second, 2 * time.Minute}},
+			MetadataCache:    MetadataCache{false, time.Hour, ""},
+			PartitionMetrics: PartitionMetrics{MaxPartitions: 10, Interval: time.Hour},
+			JobMetrics:       JobMetrics{false, 5 * time.Minute, 5 * time.Minute, "us", []string{}},
+			TableFilter:      TableFilter{[]string{}, []string{}, []string{}, []string{}, []string{}},
+			Profiler:         Profiler{false, 6060},
+			HealthCheck:      HealthCheck{Enabled: false, Port: 8080},
 		}, false},
 		{"minimum required config", setup([]string{"DATADOG_API_KEY=abc123", "GCP_PROJECT_ID=my-project-id"}, nil, ""), args{"bqmetricstest"}, &Config{
-			DatadogAPIKey:  "abc123",
-			DatadogSite:    "US",
-			GcpProject:     "my-project-id",
-			MetricPrefix:   DefaultMetricPrefix,
-			MetricTags:     []string{},
-			MetricInterval: 30 * time.Second,
-			Profiler:       Profiler{false, 6060},
-			HealthCheck:    HealthCheck{false, 8080},
+			DatadogAPIKey:    "abc123",
+			DatadogSite:      "US",
+			GcpProject:       "my-project-id",
+			Projects:         []Project{{ProjectID: "my-project-id"}},
+			MetricPrefix:     DefaultMetricPrefix,
+			MetricTags:       []string{},
+			MetricInterval:   30 * time.Second,
+			Publishers:       []string{PublisherDatadog},
+			Output:           OutputTable,
+			DatadogRetry:     Retry{3, time.Second, 10 * time.Second, 20 * time.Second},
+			Prometheus:       Prometheus{9464, "/metrics"},
+			Buffer:           Buffer{0, 0, DropOldest},
+			ExporterMetrics:  ExporterMetrics{false, "exporter"},
+			QueryCheck:       QueryCheck{false, QueryCheckFail},
+			Spool:            Spool{false, "/var/lib/bqmetricsd/spool.jsonl"},
+			Startup:          Startup{StartupWait, time.Minute},
+			State:            State{false, "/var/lib/bqmetricsd/state.json"},
+			TableMetrics:     TableMetrics{SizeBytes: true, LongTermBytes: true, Strategy: TableMetricsAPI, Region: "us"},
+			ShardedTables:    ShardedTables{false, false},
+			TableScan:        TableScan{0, 0, Retry{5, time.Second, 30 * time.Second, 2 * time.Minute}},
+			MetadataCache:    MetadataCache{false, time.Hour, ""},
+			PartitionMetrics: PartitionMetrics{MaxPartitions: 10, Interval: time.Hour},
+			JobMetrics:       JobMetrics{false, 5 * time.Minute, 5 * time.Minute, "us", []string{}},
+			TableFilter:      TableFilter{[]string{}, []string{}, []string{}, []string{}, []string{}},
+			Profiler:         Profiler{false, 6060},
+			HealthCheck:      HealthCheck{Enabled: false, Port: 8080},
 		}, false},
 		{"default credentials", setup([]string{"DATADOG_API_KEY=abc123", "GOOGLE_APPLICATION_CREDENTIALS=/tmp/dd.key"}, nil, "{\"type\": \"service_account\", \"project_id\": \"my-project-id\"}"), args{"bqmetricstest"}, &Config{
-			DatadogAPIKey:  "abc123",
-			DatadogSite:    "US",
-			GcpProject:     "my-project-id",
-			MetricPrefix:   DefaultMetricPrefix,
-			MetricTags:     []string{},
-			MetricInterval: 30 * time.Second,
-			Profiler:       Profiler{false, 6060},
-			HealthCheck:    HealthCheck{false, 8080},
+			DatadogAPIKey:    "abc123",
+			DatadogSite:      "US",
+			GcpProject:       "my-project-id",
+			Projects:         []Project{{ProjectID: "my-project-id"}},
+			MetricPrefix:     DefaultMetricPrefix,
+			MetricTags:       []string{},
+			MetricInterval:   30 * time.Second,
+			Publishers:       []string{PublisherDatadog},
+			Output:           OutputTable,
+			DatadogRetry:     Retry{3, time.Second, 10 * time.Second, 20 * time.Second},
+			Prometheus:       Prometheus{9464, "/metrics"},
+			Buffer:           Buffer{0, 0, DropOldest},
+			ExporterMetrics:  ExporterMetrics{false, "exporter"},
+			QueryCheck:       QueryCheck{false, QueryCheckFail},
+			Spool:            Spool{false, "/var/lib/bqmetricsd/spool.jsonl"},
+			Startup:          Startup{StartupWait, time.Minute},
+			State:            State{false, "/var/lib/bqmetricsd/state.json"},
+			TableMetrics:     TableMetrics{SizeBytes: true, LongTermBytes: true, Strategy: TableMetricsAPI, Region: "us"},
+			ShardedTables:    ShardedTables{false, false},
+			TableScan:        TableScan{0, 0, Retry{5, time.Second, 30 * time.Second, 2 * time.Minute}},
+			MetadataCache:    MetadataCache{false, time.Hour, ""},
+			PartitionMetrics: PartitionMetrics{MaxPartitions: 10, Interval: time.Hour},
+			JobMetrics:       JobMetrics{false, 5 * time.Minute, 5 * time.Minute, "us", []string{}},
+			TableFilter:      TableFilter{[]string{}, []string{}, []string{}, []string{}, []string{}},
+			Profiler:         Profiler{false, 6060},
+			HealthCheck:      HealthCheck{Enabled: false, Port: 8080},
+		}, false},
+		{"prometheus publisher without key", setup([]string{"PUBLISHERS=prometheus", "GCP_PROJECT_ID=my-project-id"}, nil, ""), args{"bqmetricstest"}, &Config{
+			DatadogSite:      "US",
+			Publishers:       []string{PublisherPrometheus},
+			Output:           OutputTable,
+			DatadogRetry:     Retry{3, time.Second, 10 * time.Second, 20 * time.Second},
+			Prometheus:       Prometheus{9464, "/metrics"},
+			Buffer:           Buffer{0, 0, DropOldest},
+			ExporterMetrics:  ExporterMetrics{false, "exporter"},
+			QueryCheck:       QueryCheck{false, QueryCheckFail},
+			Spool:            Spool{false, "/var/lib/bqmetricsd/spool.jsonl"},
+			Startup:          Startup{StartupWait, time.Minute},
+			State:            State{false, "/var/lib/bqmetricsd/state.json"},
+			GcpProject:       "my-project-id",
+			Projects:         []Project{{ProjectID: "my-project-id"}},
+			MetricPrefix:     DefaultMetricPrefix,
+			MetricTags:       []string{},
+			MetricInterval:   30 * time.Second,
+			TableMetrics:     TableMetrics{SizeBytes: true, LongTermBytes: true, Strategy: TableMetricsAPI, Region: "us"},
+			ShardedTables:    ShardedTables{false, false},
+			TableScan:        TableScan{0, 0, Retry{5, time.Second, 30 * time.Second, 2 * time.Minute}},
+			MetadataCache:    MetadataCache{false, time.Hour, ""},
+			PartitionMetrics: PartitionMetrics{MaxPartitions: 10, Interval: time.Hour},
+			JobMetrics:       JobMetrics{false, 5 * time.Minute, 5 * time.Minute, "us", []string{}},
+			TableFilter:      TableFilter{[]string{}, []string{}, []string{}, []string{}, []string{}},
+			Profiler:         Profiler{false, 6060},
+			HealthCheck:      HealthCheck{Enabled: false, Port: 8080},
+		}, false},
+		{"dry run without key", setup([]string{"DRY_RUN=true", "OUTPUT=ndjson", "GCP_PROJECT_ID=my-project-id"}, nil, ""), args{"bqmetricstest"}, &Config{
+			DatadogSite:      "US",
+			Publishers:       []string{PublisherDatadog},
+			DryRun:           true,
+			Output:           OutputNDJSON,
+			DatadogRetry:     Retry{3, time.Second, 10 * time.Second, 20 * time.Second},
+			Prometheus:       Prometheus{9464, "/metrics"},
+			Buffer:           Buffer{0, 0, DropOldest},
+			ExporterMetrics:  ExporterMetrics{false, "exporter"},
+			QueryCheck:       QueryCheck{false, QueryCheckFail},
+			Spool:            Spool{false, "/var/lib/bqmetricsd/spool.jsonl"},
+			Startup:          Startup{StartupWait, time.Minute},
+			State:            State{false, "/var/lib/bqmetricsd/state.json"},
+			GcpProject:       "my-project-id",
+			Projects:         []Project{{ProjectID: "my-project-id"}},
+			MetricPrefix:     DefaultMetricPrefix,
+			MetricTags:       []string{},
+			MetricInterval:   30 * time.Second,
+			TableMetrics:     TableMetrics{SizeBytes: true, LongTermBytes: true, Strategy: TableMetricsAPI, Region: "us"},
+			ShardedTables:    ShardedTables{false, false},
+			TableScan:        TableScan{0, 0, Retry{5, time.Second, 30 * time.Second, 2 * time.Minute}},
+			MetadataCache:    MetadataCache{false, time.Hour, ""},
+			PartitionMetrics: PartitionMetrics{MaxPartitions: 10, Interval: time.Hour},
+			JobMetrics:       JobMetrics{false, 5 * time.Minute, 5 * time.Minute, "us", []string{}},
+			TableFilter:      TableFilter{[]string{}, []string{}, []string{}, []string{}, []string{}},
+			Profiler:         Profiler{false, 6060},
+			HealthCheck:      HealthCheck{Enabled: false, Port: 8080},
 		}, false},
 		{"unreadable key file", setup([]string{"DATADOG_API_KEY_FILE=/tmp/not-found.key", "GCP_PROJECT_ID=my-project-id"}, nil, "abc123"), args{"bqmetricstest"}, nil, true},
 		{"missing key", setup([]string{"GCP_PROJECT_ID=my-project-id"}, nil, ""), args{"bqmetricstest"}, nil, true},
@@ -130,15 +278,34 @@ func TestNewConfig_configFile(t *testing.T) {
 
 	os.Args = []string{"./bqmetricstest", "--config-file", f.Name()}
 	want := &Config{
-		DatadogAPIKey:  "abc123",
-		DatadogSite:    "US",
-		DatasetFilter:  "bqmetrics:enabled",
-		GcpProject:     "my-project-id",
-		MetricPrefix:   "custom.gcp.bigquery.stats",
-		MetricTags:     []string{"env:prod", "team:my-team"},
-		MetricInterval: 2 * time.Minute,
-		Profiler:       Profiler{false, 6060},
-		HealthCheck:    HealthCheck{true, 8081},
+		ConfigFile:       f.Name(),
+		DatadogAPIKey:    "abc123",
+		DatadogSite:      "US",
+		DatasetFilter:    "bqmetrics:enabled",
+		GcpProject:       "my-project-id",
+		Projects:         []Project{{ProjectID: "my-project-id", DatasetFilter: "bqmetrics:enabled"}},
+		MetricPrefix:     "custom.gcp.bigquery.stats",
+		MetricTags:       []string{"env:prod", "team:my-team"},
+		MetricInterval:   2 * time.Minute,
+		Publishers:       []string{PublisherDatadog},
+		Output:           OutputTable,
+		DatadogRetry:     Retry{3, time.Second, 10 * time.Second, 20 * time.Second},
+		Prometheus:       Prometheus{9464, "/metrics"},
+		Buffer:           Buffer{0, 0, DropOldest},
+		ExporterMetrics:  ExporterMetrics{false, "exporter"},
+		QueryCheck:       QueryCheck{false, QueryCheckFail},
+		Spool:            Spool{false, "/var/lib/bqmetricsd/spool.jsonl"},
+		Startup:          Startup{StartupWait, time.Minute},
+		State:            State{false, "/var/lib/bqmetricsd/state.json"},
+		TableMetrics:     TableMetrics{SizeBytes: true, LongTermBytes: true, Strategy: TableMetricsAPI, Region: "us"},
+		ShardedTables:    ShardedTables{false, false},
+		TableScan:        TableScan{0, 0, Retry{5, time.Second, 30 * time.Second, 2 * time.Minute}},
+		MetadataCache:    MetadataCache{false, time.Hour, ""},
+		PartitionMetrics: PartitionMetrics{MaxPartitions: 10, Interval: time.Hour},
+		JobMetrics:       JobMetrics{false, 5 * time.Minute, 5 * time.Minute, "us", []string{}},
+		TableFilter:      TableFilter{[]string{}, []string{}, []string{}, []string{}, []string{}},
+		Profiler:         Profiler{false, 6060},
+		HealthCheck:      HealthCheck{Enabled: true, Port: 8081},
 	}
 
 	got, err := NewConfig("bqmetricstest")
@@ -175,6 +342,42 @@ func TestNewConfig_configFile_invalidFormat(t *testing.T) {
 	}
 }
 
+func TestLoadCommandConfig(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "config_*.json")
+	if err != nil {
+		t.Fatalf("error creating temporary file: %s", err)
+	}
+	defer func() {
+		n := f.Name()
+		_ = f.Close()
+		_ = os.Remove(n)
+	}()
+
+	data := []byte("{\"datadog-api-key\": \"abc123\", \"gcp-project-id\": \"my-project-id\"}")
+	if _, err = f.Write(data); err != nil {
+		t.Fatalf("error when writing test config file: %s", err)
+	}
+
+	cmd := pflag.NewFlagSet("validate", pflag.ContinueOnError)
+	dryRun := cmd.Bool("dry-run-queries", false, "")
+
+	args := []string{"--config-file", f.Name(), "validate", "--dry-run-queries"}
+	cfg, positional, err := LoadCommandConfig("bqmetricstest", args, cmd)
+	if err != nil {
+		t.Fatalf("LoadCommandConfig() error = %v", err)
+	}
+
+	if !reflect.DeepEqual(positional, []string{"validate"}) {
+		t.Errorf("LoadCommandConfig() args = %v, want %v", positional, []string{"validate"})
+	}
+	if !*dryRun {
+		t.Errorf("LoadCommandConfig() did not parse the command flags")
+	}
+	if cfg.ConfigFile != f.Name() || cfg.GcpProject != "my-project-id" {
+		t.Errorf("LoadCommandConfig() config file = %v, project = %v", cfg.ConfigFile, cfg.GcpProject)
+	}
+}
+
 func TestNewConfig_configFileWithCustomQueries(t *testing.T) {
 	f, err := ioutil.TempFile(os.TempDir(), "config_*.json")
 	if err != nil {
@@ -193,20 +396,40 @@ func TestNewConfig_configFileWithCustomQueries(t *testing.T) {
 
 	os.Args = []string{"./bqmetricstest", "--config-file", f.Name()}
 	want := &Config{
-		DatadogAPIKey:  "abc123",
-		DatadogSite:    "US",
-		GcpProject:     "my-project-id",
-		MetricPrefix:   "custom.gcp.bigquery.stats",
-		MetricTags:     []string{"env:prod", "team:my-team"},
-		MetricInterval: 2 * time.Minute,
-		Profiler:       Profiler{false, 6060},
+		ConfigFile:       f.Name(),
+		DatadogAPIKey:    "abc123",
+		DatadogSite:      "US",
+		GcpProject:       "my-project-id",
+		Projects:         []Project{{ProjectID: "my-project-id"}},
+		MetricPrefix:     "custom.gcp.bigquery.stats",
+		MetricTags:       []string{"env:prod", "team:my-team"},
+		MetricInterval:   2 * time.Minute,
+		Publishers:       []string{PublisherDatadog},
+		Output:           OutputTable,
+		DatadogRetry:     Retry{3, time.Second, 10 * time.Second, 20 * time.Second},
+		Prometheus:       Prometheus{9464, "/metrics"},
+		Buffer:           Buffer{0, 0, DropOldest},
+		ExporterMetrics:  ExporterMetrics{false, "exporter"},
+		QueryCheck:       QueryCheck{false, QueryCheckFail},
+		Spool:            Spool{false, "/var/lib/bqmetricsd/spool.jsonl"},
+		Startup:          Startup{StartupWait, time.Minute},
+		State:            State{false, "/var/lib/bqmetricsd/state.json"},
+		TableMetrics:     TableMetrics{SizeBytes: true, LongTermBytes: true, Strategy: TableMetricsAPI, Region: "us"},
+		ShardedTables:    ShardedTables{false, false},
+		TableScan:        TableScan{0, 0, Retry{5, time.Second, 30 * time.Second, 2 * time.Minute}},
+		MetadataCache:    MetadataCache{false, time.Hour, ""},
+		PartitionMetrics: PartitionMetrics{MaxPartitions: 10, Interval: time.Hour},
+		JobMetrics:       JobMetrics{false, 5 * time.Minute, 5 * time.Minute, "us", []string{}},
+		TableFilter:      TableFilter{[]string{}, []string{}, []string{}, []string{}, []string{}},
+		Profiler:         Profiler{false, 6060},
 		CustomMetrics: []CustomMetric{{
 			MetricName:     "my_metric",
 			MetricTags:     []string{"table_id:table"},
 			MetricInterval: 2 * time.Minute,
 			SQL:            "SELECT COUNT(DISTINCT *) FROM `table`",
+			StartupPolicy:  StartupWait,
 		}},
-		HealthCheck: HealthCheck{false, 8080},
+		HealthCheck: HealthCheck{Enabled: false, Port: 8080},
 	}
 
 	got, err := NewConfig("bqmetricstest")
@@ -219,6 +442,88 @@ func TestNewConfig_configFileWithCustomQueries(t *testing.T) {
 	}
 }
 
+func TestNewConfig_configFileWithQueryParameters(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "config_*.yaml")
+	if err != nil {
+		t.Fatalf("error creating temporary file: %s", err)
+	}
+	defer func() {
+		n := f.Name()
+		_ = f.Close()
+		_ = os.Remove(n)
+	}()
+
+	data := []byte(`datadog-api-key: abc123
+gcp-project-id: my-project-id
+custom-metrics:
+  - metric-name: daily_rows
+    sql: SELECT COUNT(*) AS rows FROM ` + "`my-dataset.events`" + ` WHERE day >= @since AND region = @region
+    parameters:
+      - name: since
+        type: date
+        window: last-run
+      - name: region
+        value: eu
+`)
+	if _, err = f.Write(data); err != nil {
+		t.Fatalf("error when writing test config file: %s", err)
+	}
+
+	os.Args = []string{"./bqmetricstest", "--config-file", f.Name()}
+	got, err := NewConfig("bqmetricstest")
+	if err != nil {
+		t.Fatalf("NewConfig() error = %v, wantErr false", err)
+	}
+
+	want := []QueryParameter{
+		{Name: "since", Type: ParamDate, Window: WindowLastRun},
+		{Name: "region", Value: "eu"},
+	}
+	if len(got.CustomMetrics) != 1 || !reflect.DeepEqual(got.CustomMetrics[0].Parameters, want) {
+		t.Errorf("NewConfig() got custom metrics = %v, want parameters %v", got.CustomMetrics, want)
+	}
+}
+
+func TestNewConfig_configFileWithFreshnessSLOs(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "config_*.yaml")
+	if err != nil {
+		t.Fatalf("error creating temporary file: %s", err)
+	}
+	defer func() {
+		n := f.Name()
+		_ = f.Close()
+		_ = os.Remove(n)
+	}()
+
+	data := []byte(`datadog-api-key: abc123
+gcp-project-id: my-project-id
+freshness-slos:
+  - table: my-dataset.events_*
+    max-age: 26h
+    warn-age: 20h
+  - project-id: my-other-project
+    table: "*.*"
+    max-age: 168h
+`)
+	if _, err = f.Write(data); err != nil {
+		t.Fatalf("error when writing test config file: %s", err)
+	}
+
+	os.Args = []string{"./bqmetricstest", "--config-file", f.Name()}
+	got, err := NewConfig("bqmetricstest")
+	if err != nil {
+		t.Fatalf("NewConfig() error = %v, wantErr false", err)
+	}
+
+	want := []FreshnessSLO{
+		{Table: "my-dataset.events_*", MaxAge: 26 * time.Hour, WarnAge: 20 * time.Hour},
+		{ProjectID: "my-other-project", Table: "*.*", MaxAge: 168 * time.Hour},
+	}
+	if !reflect.DeepEqual(got.FreshnessSLOs, want) {
+		t.Errorf("NewConfig() got freshness SLOs = %v, want %v", got.FreshnessSLOs, want)
+	}
+}
+
 func TestValidateConfig(t *testing.T) {
 	type args struct {
 		c *Config
@@ -236,100 +541,802 @@ func TestValidateConfig(t *testing.T) {
 			MetricTags:     []string{"env:prod"},
 			MetricInterval: time.Duration(30000),
 		}}, false},
-		{"missing datadog api key", args{&Config{
-			DatadogAPIKey:  "",
+		{"missing datadog api key", args{&Config{
+			DatadogAPIKey:  "",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+		}}, true},
+		{"missing datadog site", args{&Config{
+			DatadogAPIKey:  "abc123",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+		}}, true},
+		{"negative buffer size", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			Buffer:         Buffer{MaxPoints: -1},
+		}}, true},
+		{"invalid buffer drop policy", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			Buffer:         Buffer{DropPolicy: "random"},
+		}}, true},
+		{"exporter metrics without namespace", args{&Config{
+			DatadogAPIKey:   "abc123",
+			DatadogSite:     "US",
+			GcpProject:      "my-project-id",
+			MetricPrefix:    "custom.gcp.bigquery.stats",
+			MetricInterval:  time.Duration(30000),
+			ExporterMetrics: ExporterMetrics{Enabled: true},
+		}}, true},
+		{"dry run without datadog api key", args{&Config{
+			DryRun:         true,
+			Output:         OutputJSON,
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+		}}, false},
+		{"dry run invalid output", args{&Config{
+			DryRun:         true,
+			Output:         "xml",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+		}}, true},
+		{"spool without path", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			Spool:          Spool{Enabled: true},
+		}}, true},
+		{"immediate startup", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			Startup:        Startup{Policy: StartupImmediate},
+		}}, false},
+		{"invalid startup policy", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			Startup:        Startup{Policy: "later"},
+		}}, true},
+		{"negative startup jitter", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			Startup:        Startup{Policy: StartupJitter, Jitter: -time.Second},
+		}}, true},
+		{"state without path", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			State:          State{Enabled: true},
+		}}, true},
+		{"custom metrics invalid startup policy", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+				SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.my-table`",
+				StartupPolicy:  "later",
+			}},
+		}}, true},
+		{"job metrics", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			JobMetrics:     JobMetrics{Enabled: true, Interval: time.Minute, Region: "europe-west2", GroupBy: []string{"user_email", "label:team"}},
+		}}, false},
+		{"negative metric interval", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: -time.Minute,
+		}}, true},
+		{"negative custom metric interval", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: -time.Hour,
+				SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.my-table`",
+			}},
+		}}, true},
+		{"job metrics negative interval", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			JobMetrics:     JobMetrics{Enabled: true, Interval: -time.Minute, Region: "us"},
+		}}, true},
+		{"job metrics missing interval", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			JobMetrics:     JobMetrics{Enabled: true, Region: "us"},
+		}}, true},
+		{"job metrics negative lag", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			JobMetrics:     JobMetrics{Enabled: true, Interval: time.Minute, Lag: -time.Minute, Region: "us"},
+		}}, true},
+		{"job metrics invalid region", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			JobMetrics:     JobMetrics{Enabled: true, Interval: time.Minute, Region: "us`; DROP"},
+		}}, true},
+		{"job metrics unknown group-by", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			JobMetrics:     JobMetrics{Enabled: true, Interval: time.Minute, Region: "us", GroupBy: []string{"query"}},
+		}}, true},
+		{"job metrics invalid label key", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			JobMetrics:     JobMetrics{Enabled: true, Interval: time.Minute, Region: "us", GroupBy: []string{"label:Team'"}},
+		}}, true},
+		{"job metrics disabled", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			JobMetrics:     JobMetrics{Region: "nowhere!"},
+		}}, false},
+		{"maximum bytes billed", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			MaxBytesBilled: 10 << 30,
+			QueryCheck:     QueryCheck{Enabled: true, Action: QueryCheckDisable},
+		}}, false},
+		{"negative maximum bytes billed", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			MaxBytesBilled: -1,
+		}}, true},
+		{"invalid query check action", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			QueryCheck:     QueryCheck{Enabled: true, Action: "ignore"},
+		}}, true},
+		{"custom metrics negative maximum bytes billed", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+				SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.my-table`",
+				MaxBytesBilled: -1,
+			}},
+		}}, true},
+		{"custom metrics query parameters", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+				SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.my-table` WHERE day >= @since",
+				Parameters:     []QueryParameter{{Name: "since", Type: ParamDate, Window: WindowLastRun}, {Name: "min_rows", Type: ParamInt64, Value: "10"}},
+			}},
+		}}, false},
+		{"custom metrics query parameter invalid name", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+				SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.my-table` WHERE day >= @since",
+				Parameters:     []QueryParameter{{Name: "since-date", Window: WindowLastRun}},
+			}},
+		}}, true},
+		{"custom metrics query parameter duplicate name", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+				SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.my-table` WHERE day >= @since",
+				Parameters:     []QueryParameter{{Name: "since", Window: WindowLastRun}, {Name: "Since", Window: WindowThisRun}},
+			}},
+		}}, true},
+		{"custom metrics duplicate name", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+				SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.my-table`",
+			}, {
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+				SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.other-table`",
+			}},
+		}}, true},
+		{"custom metrics query parameter invalid value", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+				SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.my-table` WHERE day >= @since",
+				Parameters:     []QueryParameter{{Name: "min_rows", Type: ParamInt64, Value: "ten"}},
+			}},
+		}}, true},
+		{"custom metrics query parameter env not read until run", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+				SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.my-table` WHERE day >= @since",
+				Parameters:     []QueryParameter{{Name: "dataset", Env: "BQMETRICS_TEST_UNSET_ENV"}},
+			}},
+		}}, false},
+		{"custom metrics query parameter env unknown type", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+				SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.my-table` WHERE day >= @since",
+				Parameters:     []QueryParameter{{Name: "dataset", Type: "uuid", Env: "HOME"}},
+			}},
+		}}, true},
+		{"custom metrics query parameter env and window", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+				SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.my-table` WHERE day >= @since",
+				Parameters:     []QueryParameter{{Name: "since", Env: "HOME", Window: WindowLastRun}},
+			}},
+		}}, true},
+		{"negative datadog retry attempts", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			DatadogRetry:   Retry{MaxAttempts: -1},
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+		}}, true},
+		{"zero datadog retry initial interval", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			DatadogRetry:   Retry{MaxAttempts: 3, MaxInterval: time.Second},
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+		}}, true},
+		{"zero datadog retry initial interval without retries", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			DatadogRetry:   Retry{MaxAttempts: 1},
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+		}}, false},
+		{"missing gcp project id", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+		}}, true},
+		{"multiple projects", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			Projects:       []Project{{ProjectID: "project-1"}, {ProjectID: "project-2", MetricTags: []string{"team:data"}}},
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+		}}, false},
+		{"project missing id", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			Projects:       []Project{{ProjectID: "project-1"}, {DatasetFilter: "team:data"}},
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+		}}, true},
+		{"duplicate projects", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			Projects:       []Project{{ProjectID: "project-1"}, {ProjectID: "project-1"}},
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+		}}, true},
+		{"missing metric prefix", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+		}}, true},
+		{"missing metric tags", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     nil,
+			MetricInterval: time.Duration(30000),
+		}}, false},
+		{"missing metric interval", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(0),
+		}}, true},
+		{"missing profiling", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			Profiler:       Profiler{false, 6060},
+		}}, false},
+		{"custom metrics okay", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricTags:     []string{"table_id:my-table"},
+				MetricInterval: time.Duration(36000000),
+				SQL:            "SELECT COUNT(DISTINCT `my-column`) FROM `my-dataset.my-table`",
+			}},
+			HealthCheck: HealthCheck{Enabled: false, Port: 8080},
+		}}, false},
+		{"custom metrics missing name", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricInterval: time.Duration(36000000),
+				SQL:            "SELECT COUNT(DISTINCT `my-column`) FROM `my-dataset.my-table`",
+			}},
+		}}, true},
+		{"custom metrics missing sql", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+			}},
+		}}, true},
+		{"partition metrics negative limit", args{&Config{
+			DatadogAPIKey:    "abc123",
+			DatadogSite:      "US",
+			GcpProject:       "my-project-id",
+			MetricPrefix:     "custom.gcp.bigquery.stats",
+			MetricTags:       []string{"env:prod"},
+			MetricInterval:   time.Duration(30000),
+			PartitionMetrics: PartitionMetrics{true, -1, time.Hour},
+		}}, true},
+		{"partition metrics missing interval", args{&Config{
+			DatadogAPIKey:    "abc123",
+			DatadogSite:      "US",
+			GcpProject:       "my-project-id",
+			MetricPrefix:     "custom.gcp.bigquery.stats",
+			MetricTags:       []string{"env:prod"},
+			MetricInterval:   time.Duration(30000),
+			PartitionMetrics: PartitionMetrics{Enabled: true, MaxPartitions: 10},
+		}}, true},
+		{"prometheus publisher without datadog api key", args{&Config{
+			Publishers:     []string{PublisherPrometheus},
+			Prometheus:     Prometheus{9464, "/metrics"},
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+		}}, false},
+		{"prometheus publisher invalid path", args{&Config{
+			Publishers:     []string{PublisherPrometheus},
+			Prometheus:     Prometheus{9464, "metrics"},
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+		}}, true},
+		{"multiple publishers", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			Publishers:     []string{PublisherDatadog, PublisherPrometheus},
+			Prometheus:     Prometheus{9464, "/metrics"},
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+		}}, false},
+		{"multiple publishers missing datadog api key", args{&Config{
+			DatadogSite:    "US",
+			Publishers:     []string{PublisherPrometheus, PublisherDatadog},
+			Prometheus:     Prometheus{9464, "/metrics"},
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+		}}, true},
+		{"duplicate publishers", args{&Config{
+			Publishers:     []string{PublisherPrometheus, PublisherPrometheus},
+			Prometheus:     Prometheus{9464, "/metrics"},
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+		}}, true},
+		{"unknown publisher", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			Publishers:     []string{"statsd"},
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricInterval: time.Duration(30000),
+		}}, true},
+		{"custom metrics negative row limit", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+				SQL:            "SELECT region, COUNT(*) AS `count` FROM `my-dataset.my-table` GROUP BY region",
+				TagColumns:     []string{"region"},
+				MaxRows:        -1,
+			}},
+		}}, true},
+		{"custom metrics schedule", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+				Schedule:       "15 2 * * *",
+				SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.my-table`",
+			}},
+		}}, false},
+		{"custom metrics schedule with time zone", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+				Schedule:       "15 2 * * *",
+				Timezone:       "Europe/London",
+				SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.my-table`",
+			}},
+		}}, false},
+		{"custom metrics invalid schedule", args{&Config{
+			DatadogAPIKey:  "abc123",
 			DatadogSite:    "US",
 			GcpProject:     "my-project-id",
 			MetricPrefix:   "custom.gcp.bigquery.stats",
 			MetricTags:     []string{"env:prod"},
 			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+				Schedule:       "15 25 * * *",
+				SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.my-table`",
+			}},
 		}}, true},
-		{"missing datadog site", args{&Config{
+		{"custom metrics unknown time zone", args{&Config{
 			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
 			GcpProject:     "my-project-id",
 			MetricPrefix:   "custom.gcp.bigquery.stats",
 			MetricTags:     []string{"env:prod"},
 			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+				Schedule:       "15 2 * * *",
+				Timezone:       "Mars/Olympus_Mons",
+				SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.my-table`",
+			}},
 		}}, true},
-		{"missing gcp project id", args{&Config{
+		{"custom metrics time zone without schedule", args{&Config{
 			DatadogAPIKey:  "abc123",
 			DatadogSite:    "US",
-			GcpProject:     "",
+			GcpProject:     "my-project-id",
 			MetricPrefix:   "custom.gcp.bigquery.stats",
 			MetricTags:     []string{"env:prod"},
 			MetricInterval: time.Duration(30000),
+			CustomMetrics: []CustomMetric{{
+				MetricName:     "my_custom_metric",
+				MetricInterval: time.Duration(36000000),
+				Timezone:       "Europe/London",
+				SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.my-table`",
+			}},
 		}}, true},
-		{"missing metric prefix", args{&Config{
+		{"table scan limits", args{&Config{
 			DatadogAPIKey:  "abc123",
 			DatadogSite:    "US",
 			GcpProject:     "my-project-id",
-			MetricPrefix:   "",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			TableScan:      TableScan{Concurrency: 8, RateLimit: 20, Retry: Retry{MaxAttempts: 3}},
+		}}, false},
+		{"table scan negative concurrency", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
 			MetricTags:     []string{"env:prod"},
 			MetricInterval: time.Duration(30000),
+			TableScan:      TableScan{Concurrency: -1},
 		}}, true},
-		{"missing metric tags", args{&Config{
+		{"table scan negative rate limit", args{&Config{
 			DatadogAPIKey:  "abc123",
 			DatadogSite:    "US",
 			GcpProject:     "my-project-id",
 			MetricPrefix:   "custom.gcp.bigquery.stats",
-			MetricTags:     nil,
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			TableScan:      TableScan{RateLimit: -5},
+		}}, true},
+		{"table scan invalid retry", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			TableScan:      TableScan{Retry: Retry{InitialInterval: -time.Second}},
+		}}, true},
+		{"information schema table metrics", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
 			MetricInterval: time.Duration(30000),
+			TableMetrics:   TableMetrics{Strategy: TableMetricsInformationSchema, Region: "europe-west2"},
 		}}, false},
-		{"missing metric interval", args{&Config{
+		{"unknown table metrics strategy", args{&Config{
 			DatadogAPIKey:  "abc123",
 			DatadogSite:    "US",
 			GcpProject:     "my-project-id",
 			MetricPrefix:   "custom.gcp.bigquery.stats",
 			MetricTags:     []string{"env:prod"},
-			MetricInterval: time.Duration(0),
+			MetricInterval: time.Duration(30000),
+			TableMetrics:   TableMetrics{Strategy: "tables"},
 		}}, true},
-		{"missing profiling", args{&Config{
+		{"information schema table metrics without region", args{&Config{
 			DatadogAPIKey:  "abc123",
 			DatadogSite:    "US",
 			GcpProject:     "my-project-id",
 			MetricPrefix:   "custom.gcp.bigquery.stats",
 			MetricTags:     []string{"env:prod"},
 			MetricInterval: time.Duration(30000),
-			Profiler:       Profiler{false, 6060},
+			TableMetrics:   TableMetrics{Strategy: TableMetricsInformationSchema},
+		}}, true},
+		{"information schema table metrics with table labels", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			TableMetrics:   TableMetrics{Strategy: TableMetricsInformationSchema, Region: "eu"},
+			TableFilter:    TableFilter{TableLabels: []string{"team:data"}},
+		}}, true},
+		{"metadata cache", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			MetadataCache:  MetadataCache{Enabled: true, TTL: time.Hour, Region: "europe-west2"},
 		}}, false},
-		{"custom metrics okay", args{&Config{
+		{"metadata cache without TTL", args{&Config{
 			DatadogAPIKey:  "abc123",
 			DatadogSite:    "US",
 			GcpProject:     "my-project-id",
 			MetricPrefix:   "custom.gcp.bigquery.stats",
 			MetricTags:     []string{"env:prod"},
 			MetricInterval: time.Duration(30000),
-			CustomMetrics: []CustomMetric{{
-				MetricName:     "my_custom_metric",
-				MetricTags:     []string{"table_id:my-table"},
-				MetricInterval: time.Duration(36000000),
-				SQL:            "SELECT COUNT(DISTINCT `my-column`) FROM `my-dataset.my-table`",
-			}},
-			HealthCheck: HealthCheck{false, 8080},
+			MetadataCache:  MetadataCache{Enabled: true},
+		}}, true},
+		{"metadata cache invalid region", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			MetadataCache:  MetadataCache{Enabled: true, TTL: time.Hour, Region: "region-us`; DROP"},
+		}}, true},
+		{"table filter", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			TableFilter:    TableFilter{IncludeDatasets: []string{"analytics_*"}, ExcludeTables: []string{"*_staging", "re:events_[0-9]{8}"}, TableLabels: []string{"team:data", "tier"}},
 		}}, false},
-		{"custom metrics missing name", args{&Config{
+		{"table filter invalid glob", args{&Config{
 			DatadogAPIKey:  "abc123",
 			DatadogSite:    "US",
 			GcpProject:     "my-project-id",
 			MetricPrefix:   "custom.gcp.bigquery.stats",
 			MetricTags:     []string{"env:prod"},
 			MetricInterval: time.Duration(30000),
-			CustomMetrics: []CustomMetric{{
-				MetricInterval: time.Duration(36000000),
-				SQL:            "SELECT COUNT(DISTINCT `my-column`) FROM `my-dataset.my-table`",
-			}},
+			TableFilter:    TableFilter{IncludeTables: []string{"[events"}},
 		}}, true},
-		{"custom metrics missing sql", args{&Config{
+		{"table filter invalid regex", args{&Config{
 			DatadogAPIKey:  "abc123",
 			DatadogSite:    "US",
 			GcpProject:     "my-project-id",
 			MetricPrefix:   "custom.gcp.bigquery.stats",
 			MetricTags:     []string{"env:prod"},
 			MetricInterval: time.Duration(30000),
-			CustomMetrics: []CustomMetric{{
-				MetricName:     "my_custom_metric",
-				MetricInterval: time.Duration(36000000),
-			}},
+			TableFilter:    TableFilter{ExcludeDatasets: []string{"re:tmp_(["}},
+		}}, true},
+		{"table filter invalid label", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			TableFilter:    TableFilter{TableLabels: []string{":data"}},
+		}}, true},
+		{"freshness slo", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			FreshnessSLOs:  []FreshnessSLO{{Table: "my-dataset.events_*", MaxAge: 26 * time.Hour, WarnAge: 20 * time.Hour}},
+		}}, false},
+		{"freshness slo missing table", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			FreshnessSLOs:  []FreshnessSLO{{MaxAge: 26 * time.Hour}},
+		}}, true},
+		{"freshness slo invalid table pattern", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			FreshnessSLOs:  []FreshnessSLO{{Table: "my-dataset.[events", MaxAge: 26 * time.Hour}},
+		}}, true},
+		{"freshness slo missing max age", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			FreshnessSLOs:  []FreshnessSLO{{Table: "my-dataset.events"}},
+		}}, true},
+		{"freshness slo warn age over max age", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			FreshnessSLOs:  []FreshnessSLO{{Table: "my-dataset.events", MaxAge: 26 * time.Hour, WarnAge: 30 * time.Hour}},
 		}}, true},
 		{"health check disabled", args{&Config{
 			DatadogAPIKey:  "abc123",
@@ -338,7 +1345,7 @@ func TestValidateConfig(t *testing.T) {
 			MetricPrefix:   "custom.gcp.bigquery.stats",
 			MetricTags:     []string{"env:prod"},
 			MetricInterval: time.Duration(30000),
-			HealthCheck:    HealthCheck{false, 8080},
+			HealthCheck:    HealthCheck{Enabled: false, Port: 8080},
 		}}, false},
 		{"health check port invalid", args{&Config{
 			DatadogAPIKey:  "abc123",
@@ -347,7 +1354,16 @@ func TestValidateConfig(t *testing.T) {
 			MetricPrefix:   "custom.gcp.bigquery.stats",
 			MetricTags:     []string{"env:prod"},
 			MetricInterval: time.Duration(30000),
-			HealthCheck:    HealthCheck{true, -8080},
+			HealthCheck:    HealthCheck{Enabled: true, Port: -8080},
+		}}, true},
+		{"health check max age invalid", args{&Config{
+			DatadogAPIKey:  "abc123",
+			DatadogSite:    "US",
+			GcpProject:     "my-project-id",
+			MetricPrefix:   "custom.gcp.bigquery.stats",
+			MetricTags:     []string{"env:prod"},
+			MetricInterval: time.Duration(30000),
+			HealthCheck:    HealthCheck{Enabled: true, Port: 8080, MaxPublishAge: -time.Minute},
 		}}, true},
 	}
 	for _, tt := range tests {
@@ -455,16 +1471,41 @@ func TestNormaliseConfig(t *testing.T) {
 			&Config{},
 			&Config{},
 		},
+		{
+			"gcp project without projects",
+			&Config{GcpProject: "my-project-id", DatasetFilter: "bqmetrics:enabled"},
+			&Config{GcpProject: "my-project-id", DatasetFilter: "bqmetrics:enabled", Projects: []Project{{ProjectID: "my-project-id", DatasetFilter: "bqmetrics:enabled"}}},
+		},
+		{
+			"projects without gcp project",
+			&Config{DatasetFilter: "bqmetrics:enabled", Projects: []Project{{ProjectID: "project-1"}, {ProjectID: "project-2", DatasetFilter: "team:data"}}},
+			&Config{GcpProject: "project-1", DatasetFilter: "bqmetrics:enabled", Projects: []Project{{ProjectID: "project-1", DatasetFilter: "bqmetrics:enabled"}, {ProjectID: "project-2", DatasetFilter: "team:data"}}},
+		},
 		{
 			"custom metric missing interval",
 			&Config{MetricInterval: time.Second * 10, CustomMetrics: []CustomMetric{{MetricName: "my-metric"}}},
 			&Config{MetricInterval: time.Second * 10, CustomMetrics: []CustomMetric{{MetricName: "my-metric", MetricInterval: time.Second * 10}}},
 		},
+		{
+			"custom metric with tag columns missing row limit",
+			&Config{MetricInterval: time.Second * 5, CustomMetrics: []CustomMetric{{MetricName: "my-metric", TagColumns: []string{"region"}}}},
+			&Config{MetricInterval: time.Second * 5, CustomMetrics: []CustomMetric{{MetricName: "my-metric", MetricInterval: time.Second * 5, TagColumns: []string{"region"}, MaxRows: DefaultCustomMetricMaxRows}}},
+		},
 		{
 			"custom metric with interval",
 			&Config{MetricInterval: time.Second * 5, CustomMetrics: []CustomMetric{{MetricName: "my-metric", MetricInterval: time.Second * 10}}},
 			&Config{MetricInterval: time.Second * 5, CustomMetrics: []CustomMetric{{MetricName: "my-metric", MetricInterval: time.Second * 10}}},
 		},
+		{
+			"custom metric missing startup policy",
+			&Config{MetricInterval: time.Second * 5, Startup: Startup{Policy: StartupImmediate}, CustomMetrics: []CustomMetric{{MetricName: "my-metric", MetricInterval: time.Second * 10}, {MetricName: "other-metric", MetricInterval: time.Second * 10, StartupPolicy: StartupWait}}},
+			&Config{MetricInterval: time.Second * 5, Startup: Startup{Policy: StartupImmediate}, CustomMetrics: []CustomMetric{{MetricName: "my-metric", MetricInterval: time.Second * 10, StartupPolicy: StartupImmediate}, {MetricName: "other-metric", MetricInterval: time.Second * 10, StartupPolicy: StartupWait}}},
+		},
+		{
+			"custom metric missing maximum bytes billed",
+			&Config{MetricInterval: time.Second * 5, MaxBytesBilled: 1 << 30, CustomMetrics: []CustomMetric{{MetricName: "my-metric", MetricInterval: time.Second * 10}, {MetricName: "other-metric", MetricInterval: time.Second * 10, MaxBytesBilled: 1 << 20}}},
+			&Config{MetricInterval: time.Second * 5, MaxBytesBilled: 1 << 30, CustomMetrics: []CustomMetric{{MetricName: "my-metric", MetricInterval: time.Second * 10, MaxBytesBilled: 1 << 30}, {MetricName: "other-metric", MetricInterval: time.Second * 10, MaxBytesBilled: 1 << 20}}},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -529,3 +1570,222 @@ func Test_getValueFromSecretManager(t *testing.T) {
 		})
 	}
 }
+
+func TestCustomMetric_CronSchedule(t *testing.T) {
+	after := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		cm      CustomMetric
+		want    time.Time
+		wantErr error
+	}{
+		{"no schedule", CustomMetric{MetricInterval: time.Hour}, time.Time{}, nil},
+		{"utc", CustomMetric{Schedule: "15 2 * * *"}, time.Date(2021, 6, 2, 2, 15, 0, 0, time.UTC), nil},
+		{"time zone", CustomMetric{Schedule: "15 2 * * *", Timezone: "Europe/London"}, time.Date(2021, 6, 2, 1, 15, 0, 0, time.UTC), nil},
+		{"inline time zone", CustomMetric{Schedule: "CRON_TZ=Europe/London 15 2 * * *"}, time.Date(2021, 6, 2, 1, 15, 0, 0, time.UTC), nil},
+		{"descriptor", CustomMetric{Schedule: "@hourly"}, time.Date(2021, 6, 1, 13, 0, 0, 0, time.UTC), nil},
+		{"invalid schedule", CustomMetric{Schedule: "every day"}, time.Time{}, ErrInvalidSchedule},
+		{"unknown time zone", CustomMetric{Schedule: "@daily", Timezone: "Mars/Olympus_Mons"}, time.Time{}, ErrInvalidTimezone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cm.CronSchedule()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CronSchedule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got == nil {
+				if !tt.want.IsZero() {
+					t.Errorf("CronSchedule() got nil schedule, want next run at %v", tt.want)
+				}
+				return
+			}
+			if next := got.Next(after); !next.Equal(tt.want) {
+				t.Errorf("CronSchedule() next run = %v, want %v", next, tt.want)
+			}
+		})
+	}
+}
+
+func TestCustomMetric_LongestPeriod(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2021, 1, 6, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		cm   CustomMetric
+		want time.Duration
+	}{
+		{"interval", CustomMetric{MetricInterval: time.Hour}, time.Hour},
+		{"daily", CustomMetric{MetricInterval: time.Minute, Schedule: "15 2 * * *"}, 24 * time.Hour},
+		{"weekdays", CustomMetric{MetricInterval: time.Minute, Schedule: "0 9 * * MON-FRI"}, 72 * time.Hour},
+		{"twice a night", CustomMetric{MetricInterval: time.Minute, Schedule: "0 2,3 * * *"}, 23 * time.Hour},
+		{"weekly across daylight saving", CustomMetric{Schedule: "0 6 * * MON", Timezone: "Europe/London"}, 7*24*time.Hour + time.Hour},
+		{"monthly", CustomMetric{Schedule: "0 0 31 * *"}, 61 * 24 * time.Hour},
+		{"invalid schedule", CustomMetric{MetricInterval: time.Minute, Schedule: "daily"}, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cm.LongestPeriod(from); got != tt.want {
+				t.Errorf("LongestPeriod() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryParameter_Resolve(t *testing.T) {
+	lastRun := time.Date(2021, 6, 1, 23, 30, 0, 0, time.FixedZone("EST", -5*3600))
+	thisRun := time.Date(2021, 6, 2, 5, 30, 0, 0, time.UTC)
+	_ = os.Setenv("BQMETRICS_TEST_DATASET", "my_dataset")
+	defer os.Unsetenv("BQMETRICS_TEST_DATASET")
+
+	tests := []struct {
+		name    string
+		qp      QueryParameter
+		want    interface{}
+		wantErr bool
+	}{
+		{"static string", QueryParameter{Name: "p", Value: "my_table"}, "my_table", false},
+		{"static int64", QueryParameter{Name: "p", Type: ParamInt64, Value: "-42"}, int64(-42), false},
+		{"static float64", QueryParameter{Name: "p", Type: ParamFloat64, Value: "0.5"}, 0.5, false},
+		{"static bool", QueryParameter{Name: "p", Type: ParamBool, Value: "true"}, true, false},
+		{"static date", QueryParameter{Name: "p", Type: ParamDate, Value: "2021-06-01"}, civil.Date{Year: 2021, Month: time.June, Day: 1}, false},
+		{"static timestamp", QueryParameter{Name: "p", Type: ParamTimestamp, Value: "2021-06-01T12:00:00Z"}, time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), false},
+		{"invalid static value", QueryParameter{Name: "p", Type: ParamBool, Value: "maybe"}, nil, true},
+		{"unknown type", QueryParameter{Name: "p", Type: "bytes", Value: "abc"}, nil, true},
+		{"env", QueryParameter{Name: "p", Env: "BQMETRICS_TEST_DATASET"}, "my_dataset", false},
+		{"missing env", QueryParameter{Name: "p", Env: "BQMETRICS_TEST_UNSET_ENV"}, nil, true},
+		{"last run", QueryParameter{Name: "p", Window: WindowLastRun}, time.Date(2021, 6, 2, 4, 30, 0, 0, time.UTC), false},
+		{"this run", QueryParameter{Name: "p", Type: ParamTimestamp, Window: WindowThisRun}, thisRun, false},
+		{"last run date", QueryParameter{Name: "p", Type: ParamDate, Window: WindowLastRun}, civil.Date{Year: 2021, Month: time.June, Day: 2}, false},
+		{"window as int64", QueryParameter{Name: "p", Type: ParamInt64, Window: WindowThisRun}, nil, true},
+		{"unknown window", QueryParameter{Name: "p", Window: "yesterday"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.qp.Resolve(lastRun, thisRun)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidQueryParameter) {
+					t.Errorf("Resolve() error = %v, want %v", err, ErrInvalidQueryParameter)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Resolve() got = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFreshnessSLO_Matches(t *testing.T) {
+	tests := []struct {
+		name    string
+		slo     FreshnessSLO
+		project string
+		dataset string
+		table   string
+		want    bool
+	}{
+		{"exact table", FreshnessSLO{Table: "my-dataset.events"}, "my-project", "my-dataset", "events", true},
+		{"other table", FreshnessSLO{Table: "my-dataset.events"}, "my-project", "my-dataset", "orders", false},
+		{"table pattern", FreshnessSLO{Table: "my-dataset.events_*"}, "my-project", "my-dataset", "events_20210601", true},
+		{"dataset pattern", FreshnessSLO{Table: "*.events"}, "my-project", "other-dataset", "events", true},
+		{"matching project", FreshnessSLO{ProjectID: "my-project", Table: "*.*"}, "my-project", "my-dataset", "events", true},
+		{"other project", FreshnessSLO{ProjectID: "my-project", Table: "*.*"}, "other-project", "my-dataset", "events", false},
+		{"invalid pattern", FreshnessSLO{Table: "my-dataset.[events"}, "my-project", "my-dataset", "events", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.slo.Matches(tt.project, tt.dataset, tt.table); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompilePattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		id      string
+		want    bool
+		wantErr bool
+	}{
+		{"glob match", "events_*", "events_20210601", true, false},
+		{"glob no match", "events_*", "orders", false, false},
+		{"glob whole id", "staging", "my_staging_table", false, false},
+		{"regex match", "re:events_[0-9]{8}", "events_20210601", true, false},
+		{"regex whole id", "re:events_[0-9]{8}", "events_20210601_backup", false, false},
+		{"regex alternation", "re:tmp|temp", "temp", true, false},
+		{"invalid glob", "[events", "", false, true},
+		{"invalid regex", "re:events_(", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, err := CompilePattern(tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CompilePattern() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrInvalidTableFilter) {
+					t.Errorf("CompilePattern() error = %v, want %v", err, ErrInvalidTableFilter)
+				}
+				return
+			}
+			if got := match(tt.id); got != tt.want {
+				t.Errorf("CompilePattern() match(%s) = %v, want %v", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetry_Backoff(t *testing.T) {
+	retry := Retry{InitialInterval: time.Second, MaxInterval: 5 * time.Second}
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{1, 500 * time.Millisecond, time.Second},
+		{2, time.Second, 2 * time.Second},
+		{3, 2 * time.Second, 4 * time.Second},
+		{4, 2500 * time.Millisecond, 5 * time.Second},
+		{10, 2500 * time.Millisecond, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := retry.Backoff(tt.attempt); got < tt.min || got > tt.max {
+			t.Errorf("Backoff(%d) = %v, want between %v and %v", tt.attempt, got, tt.min, tt.max)
+		}
+	}
+
+	// Without a max interval the wait keeps doubling, but does not overflow
+	unbounded := Retry{InitialInterval: time.Second}
+	if got := unbounded.Backoff(100); got < math.MaxInt64/4 {
+		t.Errorf("Backoff(100) without a max interval = %v, want at least %v", got, time.Duration(math.MaxInt64/4))
+	}
+}
+
+func TestRetry_CanRetryWithin(t *testing.T) {
+	retry := Retry{MaxElapsedTime: time.Minute}
+	deadline, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name  string
+		ctx   context.Context
+		start time.Time
+		wait  time.Duration
+		want  bool
+	}{
+		{"within limits", context.Background(), time.Now(), time.Second, true},
+		{"past max elapsed time", context.Background(), time.Now().Add(-59 * time.Second), 2 * time.Second, false},
+		{"past context deadline", deadline, time.Now(), 20 * time.Second, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retry.CanRetryWithin(tt.ctx, tt.start, tt.wait); got != tt.want {
+				t.Errorf("CanRetryWithin() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -8,21 +8,127 @@ var (
 	// ErrInvalidDatadogSite is the error returned when the Config contains an invalid value for the Datadog site
 	ErrInvalidDatadogSite = errors.New("invalid Datadog site configured")
 
+	// ErrInvalidRetry is the error returned when the Config contains a negative retry setting
+	ErrInvalidRetry = errors.New("invalid retry configuration")
+
+	// ErrInvalidOutputFormat is the error returned when an unknown dry run output format is specified
+	ErrInvalidOutputFormat = errors.New("invalid output format specified")
+
+	// ErrInvalidPublisher is the error returned when the Config contains an unknown publisher
+	ErrInvalidPublisher = errors.New("invalid publisher configured")
+
+	// ErrDuplicatePublisher is the error returned when the same publisher is configured more than once
+	ErrDuplicatePublisher = errors.New("duplicate publisher configured")
+
+	// ErrInvalidPrometheusPath is the error returned when the Prometheus endpoint path is not absolute
+	ErrInvalidPrometheusPath = errors.New("invalid prometheus endpoint path configured")
+
 	// ErrMissingGcpProject is the error returned when the Config is missing the Google project ID
 	ErrMissingGcpProject = errors.New("no GCP project ID configured")
 
+	// ErrDuplicateGcpProject is the error returned when the same Google project ID is configured more than once
+	ErrDuplicateGcpProject = errors.New("duplicate GCP project ID configured")
+
 	// ErrMissingMetricPrefix is the error returned when the Config is missing a metric prefix
 	ErrMissingMetricPrefix = errors.New("no metric name prefix configured")
 
 	// ErrMissingMetricInterval is the error returned when the Config is missing a metric collection interval
 	ErrMissingMetricInterval = errors.New("no metric collection interval configured")
 
+	// ErrMissingExporterNamespace is the error returned when exporter metrics are enabled without a namespace
+	ErrMissingExporterNamespace = errors.New("no exporter metrics namespace configured")
+
 	// ErrMissingMetricName is the error returned when a CustomMetric is missing a metric name
 	ErrMissingMetricName = errors.New("no metric name configured")
 
 	// ErrMissingCustomMetricSQL is the error returned when a CustomMetric is missing SQL
 	ErrMissingCustomMetricSQL = errors.New("no custom metric sql query configured")
 
+	// ErrInvalidMaxRows is the error returned when a CustomMetric row limit is negative
+	ErrInvalidMaxRows = errors.New("invalid maximum number of rows configured")
+
+	// ErrInvalidMaxPartitions is the error returned when the partition limit is negative
+	ErrInvalidMaxPartitions = errors.New("invalid maximum number of partitions configured")
+
+	// ErrInvalidJobMetricsRegion is the error returned when the job metrics region is missing or invalid
+	ErrInvalidJobMetricsRegion = errors.New("invalid job metrics region configured")
+
+	// ErrInvalidJobMetricsLag is the error returned when the job metrics lag is negative
+	ErrInvalidJobMetricsLag = errors.New("invalid job metrics lag configured")
+
+	// ErrInvalidJobMetricsGroupBy is the error returned when an unknown job metrics group-by tag is specified
+	ErrInvalidJobMetricsGroupBy = errors.New("invalid job metrics group-by tag specified")
+
+	// ErrInvalidMaxBytesBilled is the error returned when a maximum bytes billed is negative
+	ErrInvalidMaxBytesBilled = errors.New("invalid maximum bytes billed configured")
+
+	// ErrInvalidQueryCheckAction is the error returned when an unknown query check action is specified
+	ErrInvalidQueryCheckAction = errors.New("invalid query check action specified")
+
+	// ErrQueryOverBudget is the error returned when a custom metric query is
+	// estimated to process more than its maximum bytes billed
+	ErrQueryOverBudget = errors.New("custom metric query exceeds its maximum bytes billed")
+
+	// ErrInvalidQueryParameter is the error returned when a custom metric query parameter is invalid
+	ErrInvalidQueryParameter = errors.New("invalid query parameter configured")
+
+	// ErrInvalidTableScan is the error returned when a table scan limit is negative
+	ErrInvalidTableScan = errors.New("invalid table scan limit configured")
+
+	// ErrInvalidTableMetricsStrategy is the error returned when an unknown or unsupported table metrics strategy is specified
+	ErrInvalidTableMetricsStrategy = errors.New("invalid table metrics strategy specified")
+
+	// ErrInvalidTableMetricsRegion is the error returned when the table metrics region is missing or invalid
+	ErrInvalidTableMetricsRegion = errors.New("invalid table metrics region configured")
+
+	// ErrInvalidMetadataCacheTTL is the error returned when the metadata cache is enabled without a positive TTL
+	ErrInvalidMetadataCacheTTL = errors.New("invalid metadata cache TTL configured")
+
+	// ErrInvalidMetadataCacheRegion is the error returned when the metadata cache region is invalid
+	ErrInvalidMetadataCacheRegion = errors.New("invalid metadata cache region configured")
+
+	// ErrInvalidTableFilter is the error returned when a table filter pattern or label is invalid
+	ErrInvalidTableFilter = errors.New("invalid table filter configured")
+
+	// ErrInvalidFreshnessSLO is the error returned when a freshness SLO is invalid
+	ErrInvalidFreshnessSLO = errors.New("invalid freshness SLO configured")
+
+	// ErrInvalidBufferSize is the error returned when a buffer limit is negative
+	ErrInvalidBufferSize = errors.New("invalid buffer size configured")
+
+	// ErrInvalidDropPolicy is the error returned when an unknown buffer drop policy is specified
+	ErrInvalidDropPolicy = errors.New("invalid buffer drop policy specified")
+
+	// ErrMissingSpoolPath is the error returned when the spool is enabled without a path
+	ErrMissingSpoolPath = errors.New("no spool path configured")
+
+	// ErrInvalidStartupPolicy is the error returned when an unknown startup policy is specified
+	ErrInvalidStartupPolicy = errors.New("invalid startup policy specified")
+
+	// ErrInvalidStartupJitter is the error returned when the startup jitter is negative
+	ErrInvalidStartupJitter = errors.New("invalid startup jitter configured")
+
+	// ErrMissingStatePath is the error returned when the state file is enabled without a path
+	ErrMissingStatePath = errors.New("no state file path configured")
+
+	// ErrInvalidHealthCheckAge is the error returned when a health check maximum age is negative
+	ErrInvalidHealthCheckAge = errors.New("invalid health check maximum age configured")
+
+	// ErrInvalidSchedule is the error returned when a custom metric schedule cannot be parsed
+	ErrInvalidSchedule = errors.New("invalid custom metric schedule configured")
+
+	// ErrInvalidTimezone is the error returned when a custom metric time zone is unknown or has no schedule
+	ErrInvalidTimezone = errors.New("invalid custom metric time zone configured")
+
 	// ErrInvalidPort is the error returned when an invalid port is specified
 	ErrInvalidPort = errors.New("invalid port specified")
+
+	// ErrDuplicateMetricName is the error returned when the same custom metric name is configured more than once
+	ErrDuplicateMetricName = errors.New("duplicate custom metric name configured")
+
+	// ErrInvalidMetricTag is the error returned when a metric tag is not a valid Datadog tag
+	ErrInvalidMetricTag = errors.New("invalid metric tag configured")
+
+	// ErrInvalidInterval is the error returned when an interval is negative or too short to be sensible
+	ErrInvalidInterval = errors.New("invalid interval configured")
 )
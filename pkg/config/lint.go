@@ -0,0 +1,113 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// MinInterval is the shortest interval between runs that is not reported as a
+// problem by LintConfig. Shorter intervals query BigQuery far more often than
+// the metrics are likely to change
+const MinInterval = 10 * time.Second
+
+// maxTagLength is the maximum length of a Datadog tag
+const maxTagLength = 200
+
+// datadogTag matches a valid Datadog tag, which must start with a letter
+var datadogTag = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_\-:./]*$`)
+
+// Problem is a problem found in the config, with the path of the field it was
+// found in, such as custom-metrics[2].metric-tags[0]
+type Problem struct {
+	Field string
+	Err   error
+}
+
+// Error returns the field path and the problem with it
+func (p Problem) Error() string {
+	return fmt.Sprintf("%s: %s", p.Field, p.Err)
+}
+
+// Unwrap returns the error describing the problem
+func (p Problem) Unwrap() error {
+	return p.Err
+}
+
+// problems collects the problems found while validating a config
+type problems []Problem
+
+// add records a problem with the field if err is not nil
+func (p *problems) add(field string, err error) {
+	if err != nil {
+		*p = append(*p, Problem{Field: field, Err: err})
+	}
+}
+
+// LintConfig returns every problem found in the config, rather than only the
+// first as ValidateConfig does. As well as the checks made by ValidateConfig,
+// custom metric names must be unique, tags must be valid Datadog tags, and
+// intervals must be at least MinInterval and within the health check maximum
+// ages
+func LintConfig(c *Config) []Problem {
+	p := problems(validateConfig(c))
+
+	lintTags("metric-tags", c.MetricTags, &p)
+	for i, proj := range c.Projects {
+		lintTags(fmt.Sprintf("projects[%d].metric-tags", i), proj.MetricTags, &p)
+	}
+
+	lintInterval("metric-interval", c.MetricInterval, &p)
+	if c.JobMetrics.Enabled && c.JobMetrics.Interval > 0 {
+		lintInterval("job-metrics.interval", c.JobMetrics.Interval, &p)
+	}
+	if c.PartitionMetrics.Enabled && c.PartitionMetrics.Interval > 0 {
+		lintInterval("partition-metrics.interval", c.PartitionMetrics.Interval, &p)
+	}
+
+	if c.HealthCheck.Enabled {
+		if c.HealthCheck.MaxPublishAge > 0 && c.HealthCheck.MaxPublishAge < c.MetricInterval {
+			p.add("healthcheck.max-publish-age", fmt.Errorf("%w: shorter than the metric interval of %s", ErrInvalidHealthCheckAge, c.MetricInterval))
+		}
+
+		if c.HealthCheck.MaxTableScanAge > 0 && c.HealthCheck.MaxTableScanAge < c.MetricInterval {
+			p.add("healthcheck.max-table-scan-age", fmt.Errorf("%w: shorter than the metric interval of %s", ErrInvalidHealthCheckAge, c.MetricInterval))
+		}
+	}
+
+	for i, cm := range c.CustomMetrics {
+		field := fmt.Sprintf("custom-metrics[%d]", i)
+		lintTags(field+".metric-tags", cm.MetricTags, &p)
+
+		// The interval of a scheduled custom metric is not used
+		if cm.Schedule != "" {
+			continue
+		}
+
+		lintInterval(field+".metric-interval", cm.MetricInterval, &p)
+
+		maxAge := c.HealthCheck.MaxCustomMetricAge
+		if c.HealthCheck.Enabled && maxAge > 0 && cm.MetricInterval > 0 && maxAge < cm.MetricInterval {
+			p.add(field+".metric-interval", fmt.Errorf("%w: longer than the health check maximum custom metric age of %s", ErrInvalidInterval, maxAge))
+		}
+	}
+
+	return p
+}
+
+// lintTags records a problem for each tag that is not a valid Datadog tag
+func lintTags(field string, tags []string, p *problems) {
+	for i, tag := range tags {
+		if len(tag) > maxTagLength || !datadogTag.MatchString(tag) || tag[len(tag)-1] == ':' {
+			p.add(fmt.Sprintf("%s[%d]", field, i), fmt.Errorf("%w: %q", ErrInvalidMetricTag, tag))
+		}
+	}
+}
+
+// lintInterval records a problem if the interval is shorter than MinInterval.
+// A missing or negative interval is reported by ValidateConfig
+func lintInterval(field string, interval time.Duration, p *problems) {
+	if interval > 0 && interval < MinInterval {
+		p.add(field, fmt.Errorf("%w: %s is shorter than %s", ErrInvalidInterval, interval, MinInterval))
+	}
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func lintConfig() *Config {
+	return &Config{
+		DatadogAPIKey:  "abc123",
+		DatadogSite:    "US",
+		GcpProject:     "my-project-id",
+		Projects:       []Project{{ProjectID: "my-project-id"}},
+		MetricPrefix:   "custom.gcp.bigquery.stats",
+		MetricTags:     []string{"env:prod", "team"},
+		MetricInterval: 30 * time.Second,
+		CustomMetrics: []CustomMetric{
+			{MetricName: "my-metric", MetricTags: []string{"source:my.dataset/table"}, MetricInterval: time.Hour, SQL: "SELECT 1"},
+			{MetricName: "my-other-metric", MetricInterval: time.Hour, Schedule: "0 6 * * *", SQL: "SELECT 1"},
+		},
+	}
+}
+
+func TestLintConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   map[string]error
+	}{
+		{"valid", func(c *Config) {}, map[string]error{}},
+		{"every validation problem", func(c *Config) {
+			c.DatadogAPIKey = ""
+			c.MetricPrefix = ""
+			c.CustomMetrics[0].SQL = ""
+			c.CustomMetrics[1].Timezone = "Mars/Olympus_Mons"
+		}, map[string]error{
+			"datadog-api-key":            ErrMissingDatadogAPIKey,
+			"metric-prefix":              ErrMissingMetricPrefix,
+			"custom-metrics[0].sql":      ErrMissingCustomMetricSQL,
+			"custom-metrics[1].schedule": ErrInvalidTimezone,
+		}},
+		{"duplicate metric names", func(c *Config) {
+			c.CustomMetrics[1].MetricName = "my-metric"
+		}, map[string]error{
+			"custom-metrics[1].metric-name": ErrDuplicateMetricName,
+		}},
+		{"invalid tags", func(c *Config) {
+			c.MetricTags = []string{"env:prod", "1env:prod", "env:"}
+			c.Projects[0].MetricTags = []string{"team name:data"}
+			c.CustomMetrics[0].MetricTags = []string{strings.Repeat("a", 201)}
+		}, map[string]error{
+			"metric-tags[1]":                   ErrInvalidMetricTag,
+			"metric-tags[2]":                   ErrInvalidMetricTag,
+			"projects[0].metric-tags[0]":       ErrInvalidMetricTag,
+			"custom-metrics[0].metric-tags[0]": ErrInvalidMetricTag,
+		}},
+		{"short intervals", func(c *Config) {
+			c.MetricInterval = -time.Minute
+			c.CustomMetrics[0].MetricInterval = time.Second
+			c.CustomMetrics[1].MetricInterval = time.Second
+			c.JobMetrics = JobMetrics{Enabled: true, Interval: time.Second, Region: "us"}
+		}, map[string]error{
+			"metric-interval":                   ErrInvalidInterval,
+			"job-metrics.interval":              ErrInvalidInterval,
+			"custom-metrics[0].metric-interval": ErrInvalidInterval,
+		}},
+		{"intervals beyond health check ages", func(c *Config) {
+			c.HealthCheck = HealthCheck{Enabled: true, Port: 8080, MaxPublishAge: 10 * time.Second, MaxCustomMetricAge: time.Minute}
+		}, map[string]error{
+			"healthcheck.max-publish-age":       ErrInvalidHealthCheckAge,
+			"custom-metrics[0].metric-interval": ErrInvalidInterval,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := lintConfig()
+			tt.modify(c)
+
+			got := make(map[string]error)
+			for _, p := range LintConfig(c) {
+				got[p.Field] = p.Err
+			}
+
+			fields := func(m map[string]error) []string {
+				var f []string
+				for field := range m {
+					f = append(f, field)
+				}
+				return f
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("LintConfig() problems with fields %v, want %v", fields(got), fields(tt.want))
+			}
+			for field, want := range tt.want {
+				if !errors.Is(got[field], want) {
+					t.Errorf("LintConfig() problem with %s = %v, want %v", field, got[field], want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateConfig_problem(t *testing.T) {
+	c := lintConfig()
+	c.CustomMetrics[1].SQL = ""
+	c.Startup.Policy = "eventually"
+
+	err := ValidateConfig(c)
+	want := Problem{Field: "custom-metrics[1].sql", Err: ErrMissingCustomMetricSQL}
+	if !reflect.DeepEqual(err, want) {
+		t.Fatalf("ValidateConfig() error = %v, want %v", err, want)
+	}
+	if !errors.Is(err, ErrMissingCustomMetricSQL) {
+		t.Errorf("ValidateConfig() error = %v, want it to wrap %v", err, ErrMissingCustomMetricSQL)
+	}
+	if got := err.Error(); got != "custom-metrics[1].sql: no custom metric sql query configured" {
+		t.Errorf("ValidateConfig() error message = %q", got)
+	}
+}
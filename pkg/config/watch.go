@@ -0,0 +1,64 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"path/filepath"
+)
+
+// WatchConfigFile watches the config file at the given path until the context
+// is cancelled, signalling on changed whenever it is written, replaced, or
+// the target of its symlink changes, as when mounted from a Kubernetes
+// ConfigMap. A burst of changes is collapsed into one signal if changed is
+// not ready to receive
+func WatchConfigFile(ctx context.Context, path string, changed chan<- struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating config file watcher: %w", err)
+	}
+
+	path = filepath.Clean(path)
+	// The directory is watched rather than the file, so that the file can
+	// still be followed after it is replaced
+	if err = watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return fmt.Errorf("error watching config file %s: %w", path, err)
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		target, _ := filepath.EvalSymlinks(path)
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				current, _ := filepath.EvalSymlinks(path)
+				written := filepath.Clean(event.Name) == path && event.Op&(fsnotify.Write|fsnotify.Create) != 0
+				if !written && (current == "" || current == target) {
+					continue
+				}
+				target = current
+
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Warn().Err(err).Str("config_file", path).Msg("Error watching config file")
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bqmetrics-config")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	if err = ioutil.WriteFile(path, []byte("metric-interval: 30s\n"), 0640); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	if err = WatchConfigFile(ctx, path, changed); err != nil {
+		t.Fatalf("WatchConfigFile() error = %v", err)
+	}
+
+	// Changes to other files in the directory are ignored
+	if err = ioutil.WriteFile(filepath.Join(dir, "other.yaml"), []byte("{}"), 0640); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	select {
+	case <-changed:
+		t.Errorf("WatchConfigFile() signalled a change to another file")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err = ioutil.WriteFile(path, []byte("metric-interval: 1m\n"), 0640); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("WatchConfigFile() did not signal a change to the config file")
+	}
+}
+
+func TestWatchConfigFile_missingDirectory(t *testing.T) {
+	if err := WatchConfigFile(context.TODO(), "/does/not/exist/config.yaml", make(chan struct{})); err == nil {
+		t.Errorf("WatchConfigFile() error = nil, want error")
+	}
+}
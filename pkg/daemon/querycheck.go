@@ -0,0 +1,106 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// checkQueryCosts estimates the bytes processed by every custom metric query
+// with a dry run, and compares them to the maximum bytes billed of each custom
+// metric. With the disable action, a copy of the config is returned without
+// the custom metrics over their maximum. With the fail action, an error is
+// returned if any custom metric is over its maximum. The estimates are
+// reported as exporter metrics to the consumer
+func checkQueryCosts(ctx context.Context, cfg *config.Config, generator Generator, consumer *metrics.Consumer) (*config.Config, error) {
+	producer := metrics.NewProducer(cfg)
+	kept := make([]config.CustomMetric, 0, len(cfg.CustomMetrics))
+	var err error
+
+	for _, cm := range cfg.CustomMetrics {
+		logger := log.With().
+			Str("metric_name", cm.MetricName).
+			Int64("maximum_bytes_billed", cm.MaxBytesBilled).
+			Logger()
+
+		estimate, eerr := generator.EstimateCustomMetric(ctx, cm)
+		if eerr != nil {
+			// The query will fail in the same way when it runs, which costs nothing
+			logger.Err(eerr).Msg("Unable to estimate the bytes processed by custom metric query")
+			kept = append(kept, cm)
+			continue
+		}
+
+		over := cm.MaxBytesBilled > 0 && estimate > cm.MaxBytesBilled
+		overBudget := 0.0
+		if over {
+			overBudget = 1
+		}
+
+		tags := append([]string{fmt.Sprintf("metric_name:%s", cm.MetricName)}, cm.MetricTags...)
+		consumer.Consume(producer.ProduceExporter("query_check.estimated_bytes", metrics.NewReading(float64(estimate)), tags))
+		consumer.Consume(producer.ProduceExporter("query_check.over_budget", metrics.NewReading(overBudget), tags))
+
+		logger = logger.With().Int64("estimated_bytes", estimate).Logger()
+		if !over {
+			logger.Info().Msg("Custom metric query is within its maximum bytes billed")
+			kept = append(kept, cm)
+			continue
+		}
+
+		if cfg.QueryCheck.Action == config.QueryCheckDisable {
+			logger.Error().Msg("Custom metric query exceeds its maximum bytes billed, disabling custom metric")
+			continue
+		}
+
+		logger.Error().Msg("Custom metric query exceeds its maximum bytes billed")
+		if err == nil {
+			err = fmt.Errorf("error in custom metric %s: %w", cm.MetricName, config.ErrQueryOverBudget)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	checked := *cfg
+	checked.CustomMetrics = kept
+	return &checked, nil
+}
+
+// CheckQueries dry-runs every custom metric query against BigQuery, returning
+// a problem for each query that is invalid or is estimated to exceed its
+// maximum bytes billed
+func CheckQueries(ctx context.Context, cfg *config.Config) ([]config.Problem, error) {
+	generator, err := newSourcesGenerator(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer generator.Close()
+
+	return checkQueries(ctx, cfg, generator), nil
+}
+
+func checkQueries(ctx context.Context, cfg *config.Config, generator Generator) []config.Problem {
+	var problems []config.Problem
+	for i, cm := range cfg.CustomMetrics {
+		field := fmt.Sprintf("custom-metrics[%d]", i)
+
+		estimate, err := generator.EstimateCustomMetric(ctx, cm)
+		if err != nil {
+			problems = append(problems, config.Problem{Field: field + ".sql", Err: err})
+			continue
+		}
+
+		if cm.MaxBytesBilled > 0 && estimate > cm.MaxBytesBilled {
+			problems = append(problems, config.Problem{
+				Field: field + ".maximum-bytes-billed",
+				Err:   fmt.Errorf("%w: estimated to process %d bytes", config.ErrQueryOverBudget, estimate),
+			})
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,101 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
+	"reflect"
+	"testing"
+)
+
+func Test_checkQueryCosts(t *testing.T) {
+	customMetrics := []config.CustomMetric{
+		{MetricName: "cheap", MaxBytesBilled: 1 << 30},
+		{MetricName: "expensive", MaxBytesBilled: 1 << 30},
+		{MetricName: "unlimited"},
+		{MetricName: "invalid", MaxBytesBilled: 1 << 30},
+	}
+	generator := mockGenerator{estimates: map[string]int64{
+		"cheap":     1 << 20,
+		"expensive": 1 << 40,
+		"unlimited": 1 << 40,
+	}}
+
+	tests := []struct {
+		name    string
+		action  string
+		want    []string
+		wantErr error
+	}{
+		{"fail", config.QueryCheckFail, nil, config.ErrQueryOverBudget},
+		{"disable", config.QueryCheckDisable, []string{"cheap", "unlimited", "invalid"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				CustomMetrics:   customMetrics,
+				QueryCheck:      config.QueryCheck{Enabled: true, Action: tt.action},
+				ExporterMetrics: config.ExporterMetrics{Enabled: true, Namespace: "exporter"},
+			}
+			consumer := metrics.NewConsumer()
+
+			got, err := checkQueryCosts(context.Background(), cfg, generator, consumer)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("checkQueryCosts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != nil {
+				names := make([]string, 0, len(got.CustomMetrics))
+				for _, cm := range got.CustomMetrics {
+					names = append(names, cm.MetricName)
+				}
+				if !reflect.DeepEqual(names, tt.want) {
+					t.Errorf("checkQueryCosts() custom metrics = %v, want %v", names, tt.want)
+				}
+				if len(cfg.CustomMetrics) != len(customMetrics) {
+					t.Errorf("checkQueryCosts() modified the original config")
+				}
+			}
+
+			overBudget := make(map[string]float64)
+			for _, m := range consumer.Flush() {
+				if m.Metric == "exporter.query_check.over_budget" {
+					overBudget[m.Tags[0]] = m.Points[0][1]
+				}
+			}
+			wantOverBudget := map[string]float64{"metric_name:cheap": 0, "metric_name:expensive": 1, "metric_name:unlimited": 0}
+			if !reflect.DeepEqual(overBudget, wantOverBudget) {
+				t.Errorf("checkQueryCosts() over budget metrics = %v, want %v", overBudget, wantOverBudget)
+			}
+		})
+	}
+}
+
+func Test_checkQueries(t *testing.T) {
+	cfg := &config.Config{CustomMetrics: []config.CustomMetric{
+		{MetricName: "cheap", MaxBytesBilled: 1 << 30},
+		{MetricName: "expensive", MaxBytesBilled: 1 << 30},
+		{MetricName: "unlimited"},
+		{MetricName: "invalid", MaxBytesBilled: 1 << 30},
+	}}
+	generator := mockGenerator{estimates: map[string]int64{
+		"cheap":     1 << 20,
+		"expensive": 1 << 40,
+		"unlimited": 1 << 40,
+	}}
+
+	got := checkQueries(context.Background(), cfg, generator)
+
+	fields := make([]string, 0, len(got))
+	for _, p := range got {
+		fields = append(fields, p.Field)
+	}
+	want := []string{"custom-metrics[1].maximum-bytes-billed", "custom-metrics[3].sql"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Fatalf("checkQueries() problems with fields %v, want %v", fields, want)
+	}
+	if !errors.Is(got[0], config.ErrQueryOverBudget) {
+		t.Errorf("checkQueries() problem = %v, want %v", got[0], config.ErrQueryOverBudget)
+	}
+}
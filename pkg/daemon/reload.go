@@ -0,0 +1,278 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/health"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
+	"github.com/rs/zerolog/log"
+	"reflect"
+	"sync"
+)
+
+// restartSettings are the Config fields that only take effect when bqmetricsd
+// is restarted, as they set up the publishers, buffer, servers and projects
+var restartSettings = []string{
+	"DatadogAPIKey",
+	"DatadogSite",
+	"DatadogRetry",
+	"DatasetFilter",
+	"Publishers",
+	"DryRun",
+	"Output",
+	"Prometheus",
+	"Buffer",
+	"Spool",
+	"State",
+	"GcpProject",
+	"Projects",
+	"MetricInterval",
+	"JobMetrics",
+	"PartitionMetrics",
+	"Profiler",
+	"HealthCheck",
+	"Reload",
+	"ConfigFile",
+}
+
+// customMetricRuns tracks the goroutine producing each custom metric, so that
+// they can be started and stopped individually when the config is reloaded
+type customMetricRuns struct {
+	mx       sync.Mutex
+	ctx      context.Context
+	receiver chan *metrics.Metric
+	wg       sync.WaitGroup
+	runs     []*customMetricRun
+	stopped  bool
+}
+
+// customMetricRun is a running custom metric goroutine
+type customMetricRun struct {
+	cm     config.CustomMetric
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startCustomMetrics starts a goroutine producing each custom metric, which
+// runs until the context is cancelled or it is stopped by a config reload
+func (d *Runner) startCustomMetrics(ctx context.Context, cms []config.CustomMetric, receiver chan *metrics.Metric) {
+	runs := &customMetricRuns{ctx: ctx, receiver: receiver}
+
+	runs.mx.Lock()
+	defer runs.mx.Unlock()
+
+	for _, cm := range cms {
+		d.startCustomMetric(runs, cm)
+	}
+
+	d.mx.Lock()
+	d.custom = runs
+	d.mx.Unlock()
+}
+
+// startCustomMetric starts the goroutine producing a custom metric. The lock
+// of the runs must be held
+func (d *Runner) startCustomMetric(runs *customMetricRuns, cm config.CustomMetric) {
+	ctx, cancel := context.WithCancel(runs.ctx)
+	run := &customMetricRun{cm: cm, cancel: cancel, done: make(chan struct{})}
+	runs.runs = append(runs.runs, run)
+
+	runs.wg.Add(1)
+	go func() {
+		defer close(run.done)
+		d.startCustomMetricsGenerator(ctx, cm, &runs.wg, runs.receiver)
+	}()
+}
+
+// stopCustomMetrics waits for every custom metric goroutine to finish, after
+// which no more can be started by a config reload
+func (d *Runner) stopCustomMetrics() {
+	d.mx.RLock()
+	runs := d.custom
+	d.mx.RUnlock()
+	if runs == nil {
+		return
+	}
+
+	runs.mx.Lock()
+	runs.stopped = true
+	for _, run := range runs.runs {
+		run.cancel()
+	}
+	runs.mx.Unlock()
+
+	runs.wg.Wait()
+}
+
+// rescheduleCustomMetrics stops the goroutines of custom metrics that have
+// been removed or changed, and starts goroutines for custom metrics that have
+// been added or changed. Custom metrics that are unchanged keep running on
+// their current schedule
+func (d *Runner) rescheduleCustomMetrics(cms []config.CustomMetric) (started, stopped int) {
+	d.mx.RLock()
+	runs := d.custom
+	d.mx.RUnlock()
+	if runs == nil {
+		return 0, 0
+	}
+
+	runs.mx.Lock()
+	defer runs.mx.Unlock()
+	if runs.stopped {
+		return 0, 0
+	}
+
+	pending := append([]config.CustomMetric{}, cms...)
+	kept := make([]*customMetricRun, 0, len(runs.runs))
+	for _, run := range runs.runs {
+		if i := indexOfCustomMetric(pending, run.cm); i >= 0 {
+			pending = append(pending[:i], pending[i+1:]...)
+			kept = append(kept, run)
+			continue
+		}
+
+		log.Info().Str("metric_name", run.cm.MetricName).Msg("Stopping custom metric production after config reload")
+		run.cancel()
+		<-run.done
+		stopped++
+	}
+	runs.runs = kept
+
+	for _, cm := range pending {
+		log.Info().Str("metric_name", cm.MetricName).Msg("Starting custom metric production after config reload")
+		d.startCustomMetric(runs, cm)
+		started++
+	}
+
+	return started, stopped
+}
+
+func indexOfCustomMetric(cms []config.CustomMetric, cm config.CustomMetric) int {
+	for i := range cms {
+		if reflect.DeepEqual(cms[i], cm) {
+			return i
+		}
+	}
+	return -1
+}
+
+// keepRestartSettings returns a copy of a reloaded config with the settings
+// that need a restart to change taken from the running config, along with the
+// names of the settings whose changes were ignored
+func keepRestartSettings(running, reloaded *config.Config) (*config.Config, []string) {
+	kept := *reloaded
+	var ignored []string
+
+	from := reflect.ValueOf(running).Elem()
+	to := reflect.ValueOf(&kept).Elem()
+	for _, name := range restartSettings {
+		field, _ := to.Type().FieldByName(name)
+		if reflect.DeepEqual(from.FieldByName(name).Interface(), to.FieldByName(name).Interface()) {
+			continue
+		}
+
+		ignored = append(ignored, field.Tag.Get("viper"))
+		to.FieldByName(name).Set(from.FieldByName(name))
+	}
+
+	return &kept, ignored
+}
+
+// Reload replaces the config of a running Runner with a reloaded config once
+// it has been validated, and creates a new Generator for it that reuses the
+// BigQuery clients of the running Generator. Custom metrics are only restarted
+// if they have changed, and metrics waiting to be published are kept. Settings
+// that need a restart to change are left as they are. The outcome is logged,
+// and reported to the health Tracker and as an exporter metric
+func (d *Runner) Reload(ctx context.Context, cfg *config.Config) error {
+	err := d.reload(ctx, cfg)
+	d.reportReload(err)
+	return err
+}
+
+// reportReload logs the outcome of a config reload, and reports it to the
+// health Tracker and as an exporter metric
+func (d *Runner) reportReload(err error) {
+	if err != nil {
+		log.Err(err).Msg("Failed to reload config, continuing with the previous config")
+	}
+	d.record(health.ComponentConfigReload, err)
+
+	running, _ := d.current()
+	if running.ExporterMetrics.Enabled {
+		failures := 0.0
+		if err != nil {
+			failures = 1
+		}
+		producer := metrics.NewProducer(running)
+		d.consumer.Consume(producer.ProduceExporter("config_reload.failures", metrics.NewReading(failures), nil))
+	}
+}
+
+func (d *Runner) reload(ctx context.Context, cfg *config.Config) error {
+	if err := config.ValidateConfig(cfg); err != nil {
+		return fmt.Errorf("error validating reloaded config: %w", err)
+	}
+
+	running, current := d.current()
+	cfg, ignored := keepRestartSettings(running, cfg)
+	if len(ignored) > 0 {
+		log.Warn().Strs("settings", ignored).Msg("Reloaded config changes settings that need a restart, keeping their previous values")
+	}
+
+	newGenerator := d.newGenerator
+	if newGenerator == nil {
+		newGenerator = reconfigureGenerator
+	}
+	generator, err := newGenerator(ctx, cfg, current)
+	if err != nil {
+		return err
+	}
+
+	if cfg.QueryCheck.Enabled {
+		if cfg, err = checkQueryCosts(ctx, cfg, generator, d.consumer); err != nil {
+			return err
+		}
+	}
+
+	d.mx.Lock()
+	d.cfg = cfg
+	d.generator = generator
+	d.mx.Unlock()
+
+	started, stopped := d.rescheduleCustomMetrics(cfg.CustomMetrics)
+	if d.health != nil {
+		d.health.Reconfigure(cfg)
+	}
+
+	log.Info().
+		Int("custom_metrics_started", started).
+		Int("custom_metrics_stopped", stopped).
+		Msg("Reloaded config")
+
+	return nil
+}
+
+// ReloadOn reloads the config each time a signal is received on reload, such
+// as on SIGHUP or when the config file changes, until the context is
+// cancelled. The config is loaded with load, and a config that fails to load
+// leaves the running config in place
+func (d *Runner) ReloadOn(ctx context.Context, reload <-chan struct{}, load func() (*config.Config, error)) {
+	for {
+		select {
+		case <-reload:
+			log.Info().Msg("Reloading config")
+
+			cfg, err := load()
+			if err != nil {
+				d.reportReload(fmt.Errorf("error loading config: %w", err))
+				continue
+			}
+
+			_ = d.Reload(ctx, cfg)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
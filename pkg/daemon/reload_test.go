@@ -0,0 +1,232 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/health"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// reloadConfig returns a valid config with the given custom metrics
+func reloadConfig(tags []string, cms ...config.CustomMetric) *config.Config {
+	return &config.Config{
+		DatadogAPIKey:   "abc123",
+		DatadogSite:     "US",
+		GcpProject:      "my-project-id",
+		MetricPrefix:    "custom.gcp.bigquery.stats",
+		MetricTags:      tags,
+		MetricInterval:  time.Hour,
+		Startup:         config.Startup{Policy: config.StartupWait},
+		ExporterMetrics: config.ExporterMetrics{Enabled: true, Namespace: "exporter"},
+		CustomMetrics:   cms,
+	}
+}
+
+func reloadCustomMetric(name string, interval time.Duration) config.CustomMetric {
+	return config.CustomMetric{
+		MetricName:     name,
+		MetricInterval: interval,
+		StartupPolicy:  config.StartupImmediate,
+		SQL:            "SELECT COUNT(*) AS `count` FROM `my-dataset.my-table`",
+	}
+}
+
+// countingGenerator counts the runs of each custom metric, across every
+// Generator created for a reloaded config
+type countingGenerator struct {
+	mockGenerator
+	mx   *sync.Mutex
+	runs map[string]int
+}
+
+func (m countingGenerator) ProduceCustomMetric(_ context.Context, cm config.CustomMetric, _, _ time.Time, c chan *metrics.Metric) error {
+	m.mx.Lock()
+	m.runs[cm.MetricName]++
+	m.mx.Unlock()
+
+	c <- &metrics.Metric{Metric: cm.MetricName, Points: [][]float64{{0, 1}}}
+	return nil
+}
+
+func (m countingGenerator) count(name string) int {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return m.runs[name]
+}
+
+type recordingPublisher struct {
+	mx        sync.Mutex
+	published []string
+}
+
+func (m *recordingPublisher) PublishMetricsSet(_ context.Context, ms []metrics.Metric) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	for _, met := range ms {
+		m.published = append(m.published, met.Metric)
+	}
+	return nil
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func Test_runner_Reload(t *testing.T) {
+	cfg := reloadConfig([]string{"env:prod"}, reloadCustomMetric("kept", time.Hour), reloadCustomMetric("changed", time.Hour), reloadCustomMetric("removed", time.Hour))
+	generator := countingGenerator{mx: &sync.Mutex{}, runs: make(map[string]int)}
+	publisher := &recordingPublisher{}
+
+	var generated []*config.Config
+	d := &Runner{
+		cfg:       cfg,
+		consumer:  metrics.NewConsumer(),
+		generator: generator,
+		publisher: publisher,
+		health:    health.NewTracker(cfg),
+		newGenerator: func(_ context.Context, cfg *config.Config, _ Generator) (Generator, error) {
+			generated = append(generated, cfg)
+			return generator, nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- d.RunUntil(ctx)
+	}()
+
+	waitFor(t, "custom metrics to start", func() bool {
+		return generator.count("kept") == 1 && generator.count("changed") == 1 && generator.count("removed") == 1
+	})
+
+	reloaded := reloadConfig([]string{"env:staging"}, reloadCustomMetric("kept", time.Hour), reloadCustomMetric("changed", 2*time.Hour), reloadCustomMetric("added", time.Hour))
+	reloaded.MetricInterval = time.Minute
+	if err := d.Reload(ctx, reloaded); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	waitFor(t, "changed custom metrics to restart", func() bool {
+		return generator.count("changed") == 2 && generator.count("added") == 1
+	})
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("RunUntil() error = %v", err)
+	}
+
+	wantRuns := map[string]int{"kept": 1, "changed": 2, "removed": 1, "added": 1}
+	generator.mx.Lock()
+	if !reflect.DeepEqual(generator.runs, wantRuns) {
+		t.Errorf("Reload() custom metric runs = %v, want %v", generator.runs, wantRuns)
+	}
+	generator.mx.Unlock()
+
+	running, _ := d.current()
+	if len(generated) != 1 || generated[0] != running {
+		t.Errorf("Reload() did not create a Generator for the reloaded config")
+	}
+	if !reflect.DeepEqual(running.MetricTags, []string{"env:staging"}) {
+		t.Errorf("Reload() metric tags = %v, want %v", running.MetricTags, []string{"env:staging"})
+	}
+	if running.MetricInterval != time.Hour {
+		t.Errorf("Reload() metric interval = %v, want it kept until a restart", running.MetricInterval)
+	}
+
+	// Metrics produced before the reload are still published
+	published := make(map[string]int)
+	for _, name := range publisher.published {
+		published[name]++
+	}
+	for _, name := range []string{"kept", "changed", "removed", "added"} {
+		if published[name] == 0 {
+			t.Errorf("RunUntil() did not publish the %s custom metric", name)
+		}
+	}
+	if published["custom.gcp.bigquery.stats.exporter.config_reload.failures"] != 1 {
+		t.Errorf("RunUntil() published %v, want a config reload exporter metric", publisher.published)
+	}
+
+	components := make(map[string]bool)
+	for _, c := range d.Health().ServiceStatus().Components {
+		components[c.Name] = c.LastSuccess != nil
+	}
+	if _, ok := components[health.ComponentCustomMetricPrefix+"removed"]; ok {
+		t.Errorf("Reload() kept tracking the health of a removed custom metric")
+	}
+	if !components[health.ComponentConfigReload] {
+		t.Errorf("Reload() did not record a successful config reload")
+	}
+}
+
+func Test_runner_Reload_invalid(t *testing.T) {
+	cfg := reloadConfig(nil, reloadCustomMetric("kept", time.Hour))
+	d := &Runner{
+		cfg:       cfg,
+		consumer:  metrics.NewConsumer(),
+		generator: mockGenerator{},
+		publisher: mockPublisher{},
+		health:    health.NewTracker(cfg),
+		newGenerator: func(context.Context, *config.Config, Generator) (Generator, error) {
+			return nil, errors.New("error creating metrics Generator")
+		},
+	}
+
+	tests := []struct {
+		name string
+		cfg  *config.Config
+	}{
+		{"invalid config", reloadConfig(nil, config.CustomMetric{MetricName: "invalid"})},
+		{"generator error", reloadConfig(nil, reloadCustomMetric("kept", time.Hour))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := d.Reload(context.TODO(), tt.cfg); err == nil {
+				t.Errorf("Reload() error = nil, want error")
+			}
+
+			if running, _ := d.current(); running != cfg {
+				t.Errorf("Reload() replaced the config after an error")
+			}
+		})
+	}
+
+	for _, c := range d.Health().ServiceStatus().Components {
+		if c.Name == health.ComponentConfigReload && c.ConsecutiveFailures != 2 {
+			t.Errorf("Reload() recorded %d consecutive failures, want %d", c.ConsecutiveFailures, 2)
+		}
+	}
+}
+
+func Test_keepRestartSettings(t *testing.T) {
+	running := reloadConfig([]string{"env:prod"})
+	reloaded := reloadConfig([]string{"env:staging"})
+	reloaded.Publishers = []string{config.PublisherPrometheus}
+	reloaded.MetricInterval = time.Minute
+
+	got, ignored := keepRestartSettings(running, reloaded)
+	if want := []string{"publishers", "metric-interval"}; !reflect.DeepEqual(ignored, want) {
+		t.Errorf("keepRestartSettings() ignored = %v, want %v", ignored, want)
+	}
+	if got.Publishers != nil || got.MetricInterval != time.Hour {
+		t.Errorf("keepRestartSettings() did not keep the running settings, got publishers %v and interval %v", got.Publishers, got.MetricInterval)
+	}
+	if !reflect.DeepEqual(got.MetricTags, []string{"env:staging"}) {
+		t.Errorf("keepRestartSettings() metric tags = %v, want the reloaded tags", got.MetricTags)
+	}
+	if !reflect.DeepEqual(reloaded.Publishers, []string{config.PublisherPrometheus}) {
+		t.Errorf("keepRestartSettings() modified the reloaded config")
+	}
+}
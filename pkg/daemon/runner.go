@@ -2,19 +2,27 @@ package daemon
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/health"
 	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
 	"github.com/ovotech/bigquery-metrics-extractor/pkg/sources"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"os"
 	"sync"
 	"time"
 )
 
 // Generator defines something that is able to output *metrics.Metric into a channel
 type Generator interface {
-	ProduceMetrics(context.Context, chan *metrics.Metric)
-	ProduceCustomMetric(context.Context, config.CustomMetric, chan *metrics.Metric)
+	ProduceMetrics(context.Context, chan *metrics.Metric) ([]metrics.ServiceCheck, error)
+	ProduceCustomMetric(context.Context, config.CustomMetric, time.Time, time.Time, chan *metrics.Metric) error
+	ProduceJobMetrics(ctx context.Context, projectID string, since, until time.Time, out chan *metrics.Metric) error
+	ProducePartitionMetrics(ctx context.Context, projectID string, out chan *metrics.Metric) error
+	EstimateCustomMetric(context.Context, config.CustomMetric) (int64, error)
+	Close() error
 }
 
 // Publisher defines something that is able to publish a slice of metrics.Metric
@@ -22,29 +30,264 @@ type Publisher interface {
 	PublishMetricsSet(context.Context, []metrics.Metric) error
 }
 
-// Runner co-ordinates metric generation and metric publishing
+// Runner co-ordinates metric generation and metric publishing. The config and
+// Generator can be replaced while running by reloading the config
 type Runner struct {
+	mx        sync.RWMutex
 	cfg       *config.Config
 	consumer  *metrics.Consumer
 	generator Generator
 	publisher Publisher
+	health    *health.Tracker
+	state     *runState
+	custom    *customMetricRuns
+
+	// newGenerator creates the Generator for a reloaded config, sharing the
+	// clients of the running Generator
+	newGenerator func(context.Context, *config.Config, Generator) (Generator, error)
 }
 
 // NewRunner returns a Runner instance configured appropriately
 func NewRunner(ctx context.Context, cfg *config.Config) (*Runner, error) {
-	generator, err := sources.NewGenerator(ctx, cfg)
+	publisher, err := NewPublisher(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("error creating metrics Generator: %w", err)
+		return nil, err
+	}
+
+	return NewRunnerWithPublisher(ctx, cfg, publisher)
+}
+
+// NewRunnerWithPublisher returns a Runner instance that publishes metrics to
+// the given Publisher
+func NewRunnerWithPublisher(ctx context.Context, cfg *config.Config, publisher Publisher) (*Runner, error) {
+	generator, err := newSourcesGenerator(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	consumer := metrics.NewBoundedConsumer(cfg.Buffer)
+	if cfg.Spool.Enabled {
+		spool, err := metrics.OpenSpool(cfg.Spool.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		loaded, err := consumer.AttachSpool(spool)
+		if err != nil {
+			_ = spool.Close()
+			return nil, fmt.Errorf("error replaying metric spool: %w", err)
+		}
+
+		log.Info().
+			Str("spool", cfg.Spool.Path).
+			Int("metrics_count", loaded).
+			Msg("Replayed unpublished metrics from spool")
+	}
+
+	if cfg.QueryCheck.Enabled {
+		checked, err := checkQueryCosts(ctx, cfg, generator, consumer)
+		if err != nil {
+			// The results of the check are published before refusing to start,
+			// so that the failure is visible in the exporter metrics
+			if perr := consumer.PublishTo(ctx, publisher); perr != nil {
+				log.Err(perr).Msg("Unable to publish the results of the query check")
+			}
+			_ = consumer.Close()
+			return nil, err
+		}
+		cfg = checked
+	}
+
+	var state *runState
+	if cfg.State.Enabled {
+		if state, err = loadRunState(cfg.State.Path); err != nil {
+			_ = consumer.Close()
+			return nil, err
+		}
 	}
 
 	return &Runner{
-		cfg:       cfg,
-		consumer:  metrics.NewConsumer(),
-		generator: generator,
-		publisher: metrics.NewDatadogPublisher(cfg),
+		cfg:          cfg,
+		consumer:     consumer,
+		generator:    generator,
+		publisher:    publisher,
+		health:       health.NewTracker(cfg),
+		state:        state,
+		newGenerator: reconfigureGenerator,
 	}, nil
 }
 
+// newSourcesGenerator returns the BigQuery metrics Generator for the config
+func newSourcesGenerator(ctx context.Context, cfg *config.Config) (Generator, error) {
+	generator, err := sources.NewGenerator(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error creating metrics Generator: %w", err)
+	}
+	return generator, nil
+}
+
+// reconfigureGenerator returns the BigQuery metrics Generator for a reloaded
+// config, which reuses the clients of the running Generator
+func reconfigureGenerator(ctx context.Context, cfg *config.Config, running Generator) (Generator, error) {
+	g, ok := running.(*sources.Generator)
+	if !ok {
+		return newSourcesGenerator(ctx, cfg)
+	}
+
+	generator, err := g.Reconfigure(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error creating metrics Generator: %w", err)
+	}
+	return generator, nil
+}
+
+// current returns the config and Generator in use, which change when the
+// config is reloaded
+func (d *Runner) current() (*config.Config, Generator) {
+	d.mx.RLock()
+	defer d.mx.RUnlock()
+
+	return d.cfg, d.generator
+}
+
+// Close releases the resources held by the Runner, flushing any metrics
+// waiting to be written to the spool. It is called once the Runner has finished
+func (d *Runner) Close() error {
+	_, generator := d.current()
+	err := generator.Close()
+	if cerr := d.consumer.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Health returns the Tracker that the Runner reports its state to
+func (d *Runner) Health() *health.Tracker {
+	return d.health
+}
+
+// publish publishes the consumed metrics, reporting the outcome to the health
+// Tracker and as exporter metrics
+func (d *Runner) publish(ctx context.Context) error {
+	start := time.Now()
+	err := d.consumer.PublishTo(ctx, d.publisher)
+	d.record(health.ComponentPublisher, err)
+
+	cfg, _ := d.current()
+	if cfg.ExporterMetrics.Enabled {
+		failures := 0.0
+		if err != nil {
+			failures = 1
+		}
+
+		series, points := d.consumer.Size()
+		producer := metrics.NewProducer(cfg)
+		d.consumer.Consume(producer.ProduceExporter("publish.duration_seconds", metrics.NewReading(time.Since(start).Seconds()), nil))
+		d.consumer.Consume(producer.ProduceExporter("publish.failures", metrics.NewReading(failures), nil))
+		d.consumer.Consume(producer.ProduceExporter("buffer.series", metrics.NewReading(float64(series)), nil))
+		d.consumer.Consume(producer.ProduceExporter("buffer.points", metrics.NewReading(float64(points)), nil))
+		d.consumer.Consume(producer.ProduceExporter("buffer.dropped_points", metrics.NewReading(float64(d.consumer.Dropped())), nil))
+	}
+
+	return err
+}
+
+// scanTables produces the table metrics, and then publishes the service check
+// results of the scan
+func (d *Runner) scanTables(ctx context.Context, receiver chan *metrics.Metric) error {
+	_, generator := d.current()
+	checks, err := generator.ProduceMetrics(ctx, receiver)
+	d.publishServiceChecks(ctx, checks)
+	return err
+}
+
+// publishServiceChecks submits service check results straight away if the
+// publisher supports them. Service checks describe a point in time, so unlike
+// metrics they are not buffered and retried on the next publish
+func (d *Runner) publishServiceChecks(ctx context.Context, checks []metrics.ServiceCheck) {
+	if len(checks) == 0 {
+		return
+	}
+
+	scp, ok := d.publisher.(metrics.ServiceCheckPublisher)
+	if !ok {
+		log.Debug().
+			Int("service_checks_count", len(checks)).
+			Msg("Publisher does not support service checks, discarding them")
+
+		return
+	}
+
+	if err := scp.PublishServiceChecks(ctx, checks); err != nil {
+		log.Err(err).
+			Int("service_checks_count", len(checks)).
+			Msg("Unable to publish service checks")
+	}
+}
+
+// record reports the outcome of an attempt by a component to the health Tracker
+func (d *Runner) record(component string, err error) {
+	if d.health != nil {
+		d.health.Record(component, err)
+	}
+}
+
+// NewPublisher returns the Publisher selected in the config. If more than one
+// publisher is configured, a publisher that fans metrics out to all of them is
+// returned. In dry run mode, a publisher writing metrics to stdout is returned
+func NewPublisher(cfg *config.Config) (Publisher, error) {
+	if cfg.DryRun {
+		return metrics.NewWriterPublisher(os.Stdout, cfg.Output), nil
+	}
+
+	if len(cfg.Publishers) <= 1 {
+		name := config.PublisherDatadog
+		if len(cfg.Publishers) == 1 {
+			name = cfg.Publishers[0]
+		}
+
+		return newNamedPublisher(cfg, name)
+	}
+
+	backends := make([]metrics.Backend, len(cfg.Publishers))
+	for i, name := range cfg.Publishers {
+		pub, err := newNamedPublisher(cfg, name)
+		if err != nil {
+			return nil, err
+		}
+		backends[i] = metrics.Backend{Name: name, Publisher: pub}
+	}
+
+	return metrics.NewMultiPublisher(cfg.Buffer, backends...), nil
+}
+
+func newNamedPublisher(cfg *config.Config, name string) (Publisher, error) {
+	switch name {
+	case config.PublisherDatadog:
+		return metrics.NewDatadogPublisher(cfg), nil
+	case config.PublisherPrometheus:
+		return metrics.NewPrometheusPublisher(), nil
+	default:
+		return nil, fmt.Errorf("error creating publisher %s: %w", name, config.ErrInvalidPublisher)
+	}
+}
+
+// onceLastRun returns the last run passed to the window parameters of a custom
+// metric run once at now, which is the previous scheduled run of a scheduled
+// custom metric, or one interval ago
+func onceLastRun(cm config.CustomMetric, now time.Time) time.Time {
+	schedule, err := cm.CronSchedule()
+	if err != nil {
+		return now.Add(-cm.MetricInterval)
+	}
+
+	plan := runPlan{interval: cm.MetricInterval, schedule: schedule}
+	if last := plan.previous(now); !last.IsZero() {
+		return last
+	}
+	return now.Add(-cm.LongestPeriod(now))
+}
+
 // RunOnce runs a single round of metrics collection and submits them
 // to DataDog immediately
 func (d *Runner) RunOnce(ctx context.Context) error {
@@ -56,22 +299,46 @@ func (d *Runner) RunOnce(ctx context.Context) error {
 	consumerCtx, done := context.WithCancel(ctx)
 	receiver := d.consumer.Run(consumerCtx, &cwg)
 
+	now := time.Now()
 	wg := sync.WaitGroup{}
 	wg.Add(len(d.cfg.CustomMetrics))
 	for _, m := range d.cfg.CustomMetrics {
 		go func(cm config.CustomMetric) {
-			d.generator.ProduceCustomMetric(ctx, cm, receiver)
+			d.record(health.ComponentCustomMetricPrefix+cm.MetricName, d.generator.ProduceCustomMetric(ctx, cm, onceLastRun(cm, now), now, receiver))
 			wg.Done()
 		}(m)
 	}
+	if d.cfg.JobMetrics.Enabled {
+		wg.Add(len(d.cfg.Projects))
+		for _, p := range d.cfg.Projects {
+			go func(projectID string) {
+				until := now.Add(-d.cfg.JobMetrics.Lag)
+				d.record(health.ComponentJobMetricsPrefix+projectID, d.generator.ProduceJobMetrics(ctx, projectID, until.Add(-d.cfg.JobMetrics.Interval), until, receiver))
+				wg.Done()
+			}(p.ProjectID)
+		}
+	}
+	if d.cfg.PartitionMetrics.Enabled {
+		wg.Add(len(d.cfg.Projects))
+		for _, p := range d.cfg.Projects {
+			go func(projectID string) {
+				d.record(health.ComponentPartitionMetricsPrefix+projectID, d.generator.ProducePartitionMetrics(ctx, projectID, receiver))
+				wg.Done()
+			}(p.ProjectID)
+		}
+	}
 	wg.Wait()
 
-	d.generator.ProduceMetrics(ctx, receiver)
+	d.record(health.ComponentTableScan, d.scanTables(ctx, receiver))
 
 	done()
 	cwg.Wait()
 
+	// The publishing and buffer exporter metrics describe a publish once it
+	// has finished, and would need a second publish. A single run publishes
+	// once, so they are not produced
 	err := d.consumer.PublishTo(ctx, d.publisher)
+	d.record(health.ComponentPublisher, err)
 
 	log.Err(err).Msg("Finishing Runner")
 
@@ -90,18 +357,45 @@ func (d *Runner) RunUntil(ctx context.Context) error {
 	var problem chan error
 	problem = make(chan error, 1)
 
-	wg := sync.WaitGroup{}
-	wg.Add(3 + len(d.cfg.CustomMetrics))
+	// The consumer is not stopped by the context, see the shutdown below
+	consumerCtx, stopConsumer := context.WithCancel(context.Background())
+	cwg := sync.WaitGroup{}
+	cwg.Add(1)
+	receiver := d.consumer.Run(consumerCtx, &cwg)
 
-	receiver := d.consumer.Run(ctx, &wg)
+	drained := make(chan struct{})
+	pwg := sync.WaitGroup{}
+	pwg.Add(1)
+	go d.startMetricPublisher(ctx, abort, drained, &pwg, problem)
 
-	go d.startMetricPublisher(ctx, abort, &wg, problem)
+	cfg, _ := d.current()
+	wg := sync.WaitGroup{}
+	wg.Add(1)
 	go d.startTableMetricsGenerator(ctx, &wg, receiver)
-	for _, cm := range d.cfg.CustomMetrics {
-		go d.startCustomMetricsGenerator(ctx, cm, &wg, receiver)
+	d.startCustomMetrics(ctx, cfg.CustomMetrics, receiver)
+	if cfg.JobMetrics.Enabled {
+		wg.Add(len(cfg.Projects))
+		for _, p := range cfg.Projects {
+			go d.startJobMetricsGenerator(ctx, p, &wg, receiver)
+		}
+	}
+	if cfg.PartitionMetrics.Enabled {
+		wg.Add(len(cfg.Projects))
+		for _, p := range cfg.Projects {
+			go d.startPartitionMetricsGenerator(ctx, p, &wg, receiver)
+		}
 	}
 
+	// Generators can still be sending the metrics of a run cut short when the
+	// context is cancelled. So that none of them are sent to a closed channel
+	// or lost, the consumer is only stopped once every generator has finished,
+	// and the final publish waits until the consumer has stopped
 	wg.Wait()
+	d.stopCustomMetrics()
+	stopConsumer()
+	cwg.Wait()
+	close(drained)
+	pwg.Wait()
 
 	close(problem)
 	err := <-problem
@@ -109,22 +403,23 @@ func (d *Runner) RunUntil(ctx context.Context) error {
 	return err
 }
 
-func (d *Runner) startMetricPublisher(ctx context.Context, abort context.CancelFunc, wg *sync.WaitGroup, problem chan error) {
+func (d *Runner) startMetricPublisher(ctx context.Context, abort context.CancelFunc, drained chan struct{}, wg *sync.WaitGroup, problem chan error) {
+	cfg, _ := d.current()
 	logger := log.With().
 		Str("component", "Publisher").
-		Str("metric_interval", d.cfg.MetricInterval.String()).
-		Str("metric_prefix", d.cfg.MetricPrefix).
+		Str("metric_interval", cfg.MetricInterval.String()).
+		Str("metric_prefix", cfg.MetricPrefix).
 		Logger()
 	logger.Info().Msg("Starting metric publishing")
 
-	ticker := time.NewTicker(d.cfg.MetricInterval)
+	ticker := time.NewTicker(cfg.MetricInterval)
 	defer ticker.Stop()
 	defer wg.Done()
 
 	for {
 		select {
 		case <-ticker.C:
-			err := d.consumer.PublishTo(ctx, d.publisher)
+			err := d.publish(ctx)
 			if metrics.IsUnrecoverable(err) {
 				logger.Err(err).
 					Msg("Unrecoverable error occurred when publishing, finishing metric production goroutine. Metric data will be lost")
@@ -135,13 +430,17 @@ func (d *Runner) startMetricPublisher(ctx context.Context, abort context.CancelF
 			}
 		case <-ctx.Done():
 			logger.Info().Msg("Received end signal, performing final metric publishing")
+			<-drained
 
 			finalCtx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
-			err := d.consumer.PublishTo(finalCtx, d.publisher)
+			err := d.publish(finalCtx)
 			cancel()
 			if err != nil {
-				logger.Err(err).
-					Msg("Error during final metric publishing. Metric data will be lost")
+				msg := "Error during final metric publishing. Metric data will be lost"
+				if cfg.Spool.Enabled && (metrics.IsRecoverable(err) || errors.Is(err, metrics.ErrPartialPublish)) {
+					msg = "Error during final metric publishing. Metric data has been kept in the spool"
+				}
+				logger.Err(err).Msg(msg)
 
 				problem <- err
 			}
@@ -151,48 +450,163 @@ func (d *Runner) startMetricPublisher(ctx context.Context, abort context.CancelF
 }
 
 func (d *Runner) startCustomMetricsGenerator(ctx context.Context, cm config.CustomMetric, wg *sync.WaitGroup, receiver chan *metrics.Metric) {
-	logger := log.With().
+	defer wg.Done()
+
+	cfg, _ := d.current()
+	logctx := log.With().
 		Str("component", "Custom Generator").
-		Str("metric_interval", cm.MetricInterval.String()).
 		Str("metric_name", cm.MetricName).
-		Str("metric_prefix", d.cfg.MetricPrefix).
-		Logger()
+		Str("metric_prefix", cfg.MetricPrefix).
+		Str("startup_policy", cm.StartupPolicy)
+	if cm.Schedule != "" {
+		logctx = logctx.Str("schedule", cm.Schedule).Str("timezone", cm.Timezone)
+	} else {
+		logctx = logctx.Str("metric_interval", cm.MetricInterval.String())
+	}
+	logger := logctx.Logger()
+
+	schedule, err := cm.CronSchedule()
+	if err != nil {
+		logger.Err(err).Msg("Invalid custom metric schedule, not starting metric production")
+		return
+	}
+
 	logger.Info().Msg("Starting custom metric production")
 
-	ticker := time.NewTicker(cm.MetricInterval)
-	defer ticker.Stop()
-	defer wg.Done()
+	// Window parameters are passed the start of the last successful run. Without
+	// a previous run, the first run acts as if the last run was one period ago
+	component := health.ComponentCustomMetricPrefix + cm.MetricName
+	lastRun := d.state.lastRun(component)
 
-	for {
-		select {
-		case <-ticker.C:
-			d.generator.ProduceCustomMetric(ctx, cm, receiver)
-		case <-ctx.Done():
-			logger.Info().Msg("Received end signal, finishing metric production")
-			return
+	plan := runPlan{interval: cm.MetricInterval, schedule: schedule}
+	d.runGenerator(ctx, logger, component, plan, cm.StartupPolicy, func(start time.Time) error {
+		if lastRun.IsZero() {
+			lastRun = start.Add(-plan.period(start))
 		}
-	}
+
+		_, generator := d.current()
+		err := generator.ProduceCustomMetric(ctx, cm, lastRun, start, receiver)
+		if err == nil {
+			lastRun = start
+		}
+		return err
+	})
 }
 
 func (d *Runner) startTableMetricsGenerator(ctx context.Context, wg *sync.WaitGroup, receiver chan *metrics.Metric) {
+	defer wg.Done()
+
+	cfg, _ := d.current()
 	logger := log.With().
 		Str("component", "Generator").
-		Str("metric_interval", d.cfg.MetricInterval.String()).
-		Str("metric_prefix", d.cfg.MetricPrefix).
+		Str("metric_interval", cfg.MetricInterval.String()).
+		Str("metric_prefix", cfg.MetricPrefix).
+		Str("startup_policy", cfg.Startup.Policy).
 		Logger()
 	logger.Info().Msg("Starting table metric production")
 
-	ticker := time.NewTicker(d.cfg.MetricInterval)
-	defer ticker.Stop()
+	plan := runPlan{interval: cfg.MetricInterval}
+	d.runGenerator(ctx, logger, health.ComponentTableScan, plan, cfg.Startup.Policy, func(time.Time) error {
+		return d.scanTables(ctx, receiver)
+	})
+}
+
+func (d *Runner) startJobMetricsGenerator(ctx context.Context, project config.Project, wg *sync.WaitGroup, receiver chan *metrics.Metric) {
 	defer wg.Done()
 
-	for {
+	cfg, _ := d.current()
+	logger := log.With().
+		Str("component", "Job Generator").
+		Str("metric_interval", cfg.JobMetrics.Interval.String()).
+		Str("metric_prefix", cfg.MetricPrefix).
+		Str("project_id", project.ProjectID).
+		Str("startup_policy", cfg.Startup.Policy).
+		Logger()
+	logger.Info().Msg("Starting job metric production")
+
+	// Each run reads the jobs that completed since the last successful run, so
+	// that no job is counted twice. Without a previous run, the first run reads
+	// the jobs from the last interval. Jobs can appear in the view some time
+	// after they complete, so every run reads up to the lag before it started
+	component := health.ComponentJobMetricsPrefix + project.ProjectID
+	lag := cfg.JobMetrics.Lag
+	since := d.state.lastRun(component)
+	if since.IsZero() {
+		since = time.Now().Add(-cfg.JobMetrics.Interval)
+	}
+	since = since.Add(-lag)
+
+	plan := runPlan{interval: cfg.JobMetrics.Interval}
+	d.runGenerator(ctx, logger, component, plan, cfg.Startup.Policy, func(start time.Time) error {
+		_, generator := d.current()
+		until := start.Add(-lag)
+		err := generator.ProduceJobMetrics(ctx, project.ProjectID, since, until, receiver)
+		if err == nil {
+			since = until
+		}
+		return err
+	})
+}
+
+func (d *Runner) startPartitionMetricsGenerator(ctx context.Context, project config.Project, wg *sync.WaitGroup, receiver chan *metrics.Metric) {
+	defer wg.Done()
+
+	cfg, _ := d.current()
+	logger := log.With().
+		Str("component", "Partition Generator").
+		Str("metric_interval", cfg.PartitionMetrics.Interval.String()).
+		Str("metric_prefix", cfg.MetricPrefix).
+		Str("project_id", project.ProjectID).
+		Str("startup_policy", cfg.Startup.Policy).
+		Logger()
+	logger.Info().Msg("Starting partition metric production")
+
+	plan := runPlan{interval: cfg.PartitionMetrics.Interval}
+	d.runGenerator(ctx, logger, health.ComponentPartitionMetricsPrefix+project.ProjectID, plan, cfg.Startup.Policy, func(time.Time) error {
+		_, generator := d.current()
+		return generator.ProducePartitionMetrics(ctx, project.ProjectID, receiver)
+	})
+}
+
+// runGenerator runs a generator following its plan and startup policy until
+// the context is cancelled. Each run is passed the time it started. The
+// outcome of each run is reported to the health Tracker under the given
+// component name, and the start of each successful run is saved to the state
+// file if it is enabled
+func (d *Runner) runGenerator(ctx context.Context, logger zerolog.Logger, component string, plan runPlan, policy string, generate func(time.Time) error) {
+	cfg, _ := d.current()
+	at := plan.firstRun(policy, time.Now(), randomJitter(cfg.Startup.Jitter), d.state.lastRun(component))
+	logger.Info().Strs("next_runs", plannedRuns(plan, at, plannedRunsLogged)).Msg("Planned metric production")
+
+	for !at.IsZero() {
+		timer := time.NewTimer(time.Until(at))
 		select {
-		case <-ticker.C:
-			d.generator.ProduceMetrics(ctx, receiver)
+		case <-timer.C:
 		case <-ctx.Done():
+			timer.Stop()
+			logger.Info().Msg("Received end signal, finishing metric production")
+			return
+		}
+
+		start := time.Now()
+		err := generate(start)
+		// A run cut short because the generator is stopping, such as when a
+		// custom metric is removed by a config reload, is not recorded
+		if ctx.Err() != nil {
 			logger.Info().Msg("Received end signal, finishing metric production")
 			return
 		}
+		d.record(component, err)
+		if err == nil {
+			if serr := d.state.record(component, start); serr != nil {
+				logger.Warn().Err(serr).Msg("Unable to save the last run time to the state file")
+			}
+		}
+
+		at = plan.following(at, time.Now())
 	}
+
+	logger.Warn().Msg("No further runs are planned, metric production is paused")
+	<-ctx.Done()
+	logger.Info().Msg("Received end signal, finishing metric production")
 }
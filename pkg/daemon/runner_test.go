@@ -1,13 +1,18 @@
 package daemon
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/health"
 	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
@@ -15,22 +20,57 @@ import (
 var ErrUnexpectedMetricsPublished = errors.New("unexpected metrics")
 
 type mockGenerator struct {
-	results []metrics.Metric
-	custom  []metrics.Metric
+	results    []metrics.Metric
+	custom     []metrics.Metric
+	jobs       []metrics.Metric
+	partitions []metrics.Metric
+	estimates  map[string]int64
+	checks     []metrics.ServiceCheck
+	err        error
 }
 
-func (m mockGenerator) ProduceMetrics(_ context.Context, c chan *metrics.Metric) {
+func (m mockGenerator) ProduceMetrics(_ context.Context, c chan *metrics.Metric) ([]metrics.ServiceCheck, error) {
 	for _, res := range m.results {
 		res := res
 		c <- &res
 	}
+	return m.checks, m.err
 }
 
-func (m mockGenerator) ProduceCustomMetric(_ context.Context, _ config.CustomMetric, c chan *metrics.Metric) {
+func (m mockGenerator) ProduceJobMetrics(_ context.Context, _ string, _, _ time.Time, c chan *metrics.Metric) error {
+	for _, res := range m.jobs {
+		res := res
+		c <- &res
+	}
+	return m.err
+}
+
+func (m mockGenerator) ProducePartitionMetrics(_ context.Context, _ string, c chan *metrics.Metric) error {
+	for _, res := range m.partitions {
+		res := res
+		c <- &res
+	}
+	return m.err
+}
+
+func (m mockGenerator) EstimateCustomMetric(_ context.Context, cm config.CustomMetric) (int64, error) {
+	estimate, ok := m.estimates[cm.MetricName]
+	if !ok {
+		return 0, errors.New("400 syntax error")
+	}
+	return estimate, nil
+}
+
+func (m mockGenerator) Close() error {
+	return nil
+}
+
+func (m mockGenerator) ProduceCustomMetric(_ context.Context, _ config.CustomMetric, _, _ time.Time, c chan *metrics.Metric) error {
 	for _, res := range m.custom {
 		res := res
 		c <- &res
 	}
+	return m.err
 }
 
 type mockPublisher struct {
@@ -250,3 +290,374 @@ func TestNewRunner(t *testing.T) {
 		t.Errorf("NewRunner() got.publisher = %+v, want %+v", got.publisher, metrics.NewDatadogPublisher(&config.Config{}))
 	}
 }
+
+func TestNewPublisher(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *config.Config
+		want    Publisher
+		wantErr bool
+	}{
+		{"default publisher", &config.Config{}, metrics.NewDatadogPublisher(&config.Config{}), false},
+		{"datadog publisher", &config.Config{Publishers: []string{config.PublisherDatadog}}, metrics.NewDatadogPublisher(&config.Config{Publishers: []string{config.PublisherDatadog}}), false},
+		{"prometheus publisher", &config.Config{Publishers: []string{config.PublisherPrometheus}}, metrics.NewPrometheusPublisher(), false},
+		{"multiple publishers", &config.Config{Publishers: []string{config.PublisherDatadog, config.PublisherPrometheus}}, metrics.NewMultiPublisher(
+			config.Buffer{},
+			metrics.Backend{Name: config.PublisherDatadog, Publisher: metrics.NewDatadogPublisher(&config.Config{Publishers: []string{config.PublisherDatadog, config.PublisherPrometheus}})},
+			metrics.Backend{Name: config.PublisherPrometheus, Publisher: metrics.NewPrometheusPublisher()},
+		), false},
+		{"dry run", &config.Config{DryRun: true, Output: config.OutputJSON}, metrics.NewWriterPublisher(os.Stdout, config.OutputJSON), false},
+		{"unknown publisher", &config.Config{Publishers: []string{"statsd"}}, nil, true},
+		{"unknown publisher among multiple", &config.Config{Publishers: []string{config.PublisherDatadog, "statsd"}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewPublisher(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewPublisher() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NewPublisher() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_onceLastRun(t *testing.T) {
+	now := time.Date(2021, 6, 7, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		cm   config.CustomMetric
+		want time.Time
+	}{
+		{"interval", config.CustomMetric{MetricInterval: time.Hour}, time.Date(2021, 6, 7, 7, 0, 0, 0, time.UTC)},
+		{"schedule", config.CustomMetric{MetricInterval: time.Hour, Schedule: "0 9 * * MON-FRI"}, time.Date(2021, 6, 4, 9, 0, 0, 0, time.UTC)},
+		{"schedule with time zone", config.CustomMetric{MetricInterval: time.Hour, Schedule: "0 2 * * *", Timezone: "Europe/London"}, time.Date(2021, 6, 7, 1, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := onceLastRun(tt.cm, now); !got.Equal(tt.want) {
+				t.Errorf("onceLastRun() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_runner_RunOnce_reportsHealth(t *testing.T) {
+	cfg := &config.Config{
+		MetricInterval:   time.Minute,
+		Projects:         []config.Project{{ProjectID: "my-project"}},
+		CustomMetrics:    []config.CustomMetric{{MetricName: "custom", MetricInterval: time.Minute}},
+		PartitionMetrics: config.PartitionMetrics{Enabled: true, Interval: time.Hour},
+	}
+	d := &Runner{
+		cfg:       cfg,
+		consumer:  metrics.NewConsumer(),
+		generator: mockGenerator{err: errors.New("403 forbidden")},
+		publisher: mockPublisher{expected: []metrics.Metric{}},
+		health:    health.NewTracker(cfg),
+	}
+
+	if err := d.RunOnce(context.Background()); err != nil {
+		t.Fatalf("RunOnce() error = %v", err)
+	}
+
+	got := make(map[string]int)
+	for _, c := range d.Health().ServiceStatus().Components {
+		got[c.Name] = c.ConsecutiveFailures
+		if c.Name == health.ComponentPublisher && c.LastSuccess == nil {
+			t.Errorf("RunOnce() did not record a successful publish")
+		}
+	}
+
+	want := map[string]int{
+		health.ComponentPublisher:                             0,
+		health.ComponentTableScan:                             1,
+		health.ComponentCustomMetricPrefix + "custom":         1,
+		health.ComponentPartitionMetricsPrefix + "my-project": 1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RunOnce() health got = %v, want %v", got, want)
+	}
+}
+
+func Test_runner_RunOnce_exporterMetrics(t *testing.T) {
+	cfg := &config.Config{ExporterMetrics: config.ExporterMetrics{Enabled: true, Namespace: "exporter"}}
+	out := &bytes.Buffer{}
+	d := &Runner{
+		cfg:       cfg,
+		consumer:  metrics.NewConsumer(),
+		generator: mockGenerator{results: []metrics.Metric{{Metric: "count", Points: [][]float64{{1608114735, 1}}}}},
+		publisher: metrics.NewWriterPublisher(out, config.OutputJSON),
+	}
+
+	if err := d.RunOnce(context.Background()); err != nil {
+		t.Fatalf("RunOnce() error = %v", err)
+	}
+
+	if series, _ := d.consumer.Size(); series != 0 {
+		t.Errorf("RunOnce() left %d series unpublished", series)
+	}
+
+	// The output is a single JSON array, as the metrics are published once
+	var published []metrics.Metric
+	if err := json.Unmarshal(out.Bytes(), &published); err != nil {
+		t.Fatalf("RunOnce() wrote invalid JSON: %v\n%s", err, out.String())
+	}
+
+	got := make(map[string]bool)
+	for _, m := range published {
+		got[m.Metric] = true
+	}
+
+	want := map[string]bool{"count": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RunOnce() published metrics got = %v, want %v", got, want)
+	}
+}
+
+type mockCheckPublisher struct {
+	mockPublisher
+	checks []metrics.ServiceCheck
+}
+
+func (m *mockCheckPublisher) PublishServiceChecks(_ context.Context, checks []metrics.ServiceCheck) error {
+	m.checks = append(m.checks, checks...)
+	return nil
+}
+
+func Test_runner_RunOnce_serviceChecks(t *testing.T) {
+	checks := []metrics.ServiceCheck{
+		{Check: "table.freshness", Status: metrics.ServiceCheckCritical, Tags: []string{"table_id:events"}},
+	}
+	publisher := &mockCheckPublisher{mockPublisher: mockPublisher{expected: []metrics.Metric{}}}
+	d := &Runner{
+		cfg:       &config.Config{},
+		consumer:  metrics.NewConsumer(),
+		generator: mockGenerator{checks: checks},
+		publisher: publisher,
+	}
+
+	if err := d.RunOnce(context.Background()); err != nil {
+		t.Fatalf("RunOnce() error = %v", err)
+	}
+
+	if !reflect.DeepEqual(publisher.checks, checks) {
+		t.Errorf("RunOnce() published service checks = %v, want %v", publisher.checks, checks)
+	}
+}
+
+func Test_runner_RunUntil_startupPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bqmetrics-state")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Config{
+		MetricInterval: time.Hour,
+		Startup:        config.Startup{Policy: config.StartupWait},
+		State:          config.State{Enabled: true, Path: filepath.Join(dir, "state.json")},
+		CustomMetrics: []config.CustomMetric{
+			{MetricName: "immediate", MetricInterval: time.Hour, StartupPolicy: config.StartupImmediate},
+			{MetricName: "wait", MetricInterval: time.Hour, StartupPolicy: config.StartupWait},
+		},
+	}
+	state, err := loadRunState(cfg.State.Path)
+	if err != nil {
+		t.Fatalf("loadRunState() error = %v", err)
+	}
+
+	d := &Runner{
+		cfg:       cfg,
+		consumer:  metrics.NewConsumer(),
+		generator: mockGenerator{},
+		publisher: mockPublisher{},
+		health:    health.NewTracker(cfg),
+		state:     state,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := d.RunUntil(ctx); err != nil {
+		t.Fatalf("RunUntil() error = %v", err)
+	}
+
+	ran := make(map[string]bool)
+	for _, c := range d.Health().ServiceStatus().Components {
+		ran[c.Name] = c.LastSuccess != nil
+	}
+	want := map[string]bool{
+		health.ComponentPublisher:                        true,
+		health.ComponentTableScan:                        false,
+		health.ComponentCustomMetricPrefix + "immediate": true,
+		health.ComponentCustomMetricPrefix + "wait":      false,
+	}
+	if !reflect.DeepEqual(ran, want) {
+		t.Errorf("RunUntil() components run = %v, want %v", ran, want)
+	}
+
+	saved, err := loadRunState(cfg.State.Path)
+	if err != nil {
+		t.Fatalf("loadRunState() error = %v", err)
+	}
+	if saved.lastRun(health.ComponentCustomMetricPrefix + "immediate").IsZero() {
+		t.Errorf("RunUntil() did not save the last run of the immediate custom metric")
+	}
+	if !saved.lastRun(health.ComponentCustomMetricPrefix + "wait").IsZero() {
+		t.Errorf("RunUntil() saved a last run of the waiting custom metric")
+	}
+}
+
+type jobWindowGenerator struct {
+	mockGenerator
+	mx      sync.Mutex
+	windows [][2]time.Time
+	fail    int
+}
+
+func (m *jobWindowGenerator) ProduceJobMetrics(_ context.Context, _ string, since, until time.Time, _ chan *metrics.Metric) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.windows = append(m.windows, [2]time.Time{since, until})
+	if len(m.windows) == m.fail {
+		return errors.New("403 access denied")
+	}
+	return nil
+}
+
+func Test_runner_RunUntil_jobMetricsWindows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bqmetrics-state")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Config{
+		MetricInterval: time.Hour,
+		Projects:       []config.Project{{ProjectID: "my-project"}},
+		JobMetrics:     config.JobMetrics{Enabled: true, Interval: 20 * time.Millisecond},
+		Startup:        config.Startup{Policy: config.StartupImmediate},
+		State:          config.State{Enabled: true, Path: filepath.Join(dir, "state.json")},
+	}
+	state, err := loadRunState(cfg.State.Path)
+	if err != nil {
+		t.Fatalf("loadRunState() error = %v", err)
+	}
+	lastRun := time.Now().Add(-time.Second)
+	if err = state.record(health.ComponentJobMetricsPrefix+"my-project", lastRun); err != nil {
+		t.Fatalf("record() error = %v", err)
+	}
+
+	generator := &jobWindowGenerator{fail: 2}
+	d := &Runner{
+		cfg:       cfg,
+		consumer:  metrics.NewConsumer(),
+		generator: generator,
+		publisher: mockPublisher{},
+		state:     state,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	if err := d.RunUntil(ctx); err != nil {
+		t.Fatalf("RunUntil() error = %v", err)
+	}
+
+	generator.mx.Lock()
+	defer generator.mx.Unlock()
+
+	if len(generator.windows) < 3 {
+		t.Fatalf("RunUntil() read %d job windows, want at least 3", len(generator.windows))
+	}
+	if !generator.windows[0][0].Equal(lastRun) {
+		t.Errorf("RunUntil() first job window since = %v, want last run %v", generator.windows[0][0], lastRun)
+	}
+	// The second window fails, so the third must start where the second did
+	if !generator.windows[1][0].Equal(generator.windows[0][1]) {
+		t.Errorf("RunUntil() second job window since = %v, want %v", generator.windows[1][0], generator.windows[0][1])
+	}
+	if !generator.windows[2][0].Equal(generator.windows[1][0]) {
+		t.Errorf("RunUntil() job window after a failure since = %v, want %v", generator.windows[2][0], generator.windows[1][0])
+	}
+	for i := 3; i < len(generator.windows); i++ {
+		if !generator.windows[i][0].Equal(generator.windows[i-1][1]) {
+			t.Errorf("RunUntil() job window %d since = %v, want %v", i, generator.windows[i][0], generator.windows[i-1][1])
+		}
+	}
+}
+
+func Test_runner_RunUntil_jobMetricsLag(t *testing.T) {
+	lag := time.Minute
+	cfg := &config.Config{
+		MetricInterval: time.Hour,
+		Projects:       []config.Project{{ProjectID: "my-project"}},
+		JobMetrics:     config.JobMetrics{Enabled: true, Interval: 20 * time.Millisecond, Lag: lag},
+		Startup:        config.Startup{Policy: config.StartupImmediate},
+	}
+
+	generator := &jobWindowGenerator{}
+	d := &Runner{
+		cfg:       cfg,
+		consumer:  metrics.NewConsumer(),
+		generator: generator,
+		publisher: mockPublisher{},
+	}
+
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := d.RunUntil(ctx); err != nil {
+		t.Fatalf("RunUntil() error = %v", err)
+	}
+
+	generator.mx.Lock()
+	defer generator.mx.Unlock()
+
+	if len(generator.windows) < 2 {
+		t.Fatalf("RunUntil() read %d job windows, want at least 2", len(generator.windows))
+	}
+	for i, w := range generator.windows {
+		if until := w[1]; until.After(time.Now().Add(-lag)) || until.Before(started.Add(-lag)) {
+			t.Errorf("RunUntil() job window %d until = %v, want the lag before the run", i, until)
+		}
+		if i > 0 && !w[0].Equal(generator.windows[i-1][1]) {
+			t.Errorf("RunUntil() job window %d since = %v, want %v", i, w[0], generator.windows[i-1][1])
+		}
+	}
+}
+
+// lateGenerator sends its table metrics only once the context is cancelled,
+// like a table scan that finishes while the runner is shutting down
+type lateGenerator struct {
+	mockGenerator
+}
+
+func (m lateGenerator) ProduceMetrics(ctx context.Context, c chan *metrics.Metric) ([]metrics.ServiceCheck, error) {
+	<-ctx.Done()
+	c <- &metrics.Metric{Metric: "late", Points: [][]float64{{1608114735, 1}}}
+	return nil, ctx.Err()
+}
+
+func Test_runner_RunUntil_shutdown(t *testing.T) {
+	cfg := &config.Config{MetricInterval: time.Hour, Startup: config.Startup{Policy: config.StartupImmediate}}
+	publisher := &recordingPublisher{}
+	d := &Runner{
+		cfg:       cfg,
+		consumer:  metrics.NewConsumer(),
+		generator: lateGenerator{},
+		publisher: publisher,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := d.RunUntil(ctx); err != nil {
+		t.Fatalf("RunUntil() error = %v", err)
+	}
+
+	if !reflect.DeepEqual(publisher.published, []string{"late"}) {
+		t.Errorf("RunUntil() published %v, want the metrics sent while shutting down", publisher.published)
+	}
+}
@@ -0,0 +1,130 @@
+package daemon
+
+import (
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/robfig/cron/v3"
+	"math/rand"
+	"time"
+)
+
+// plannedRunsLogged is the number of upcoming runs of a generator that are
+// logged when it starts
+const plannedRunsLogged = 3
+
+// maxPreviousLookback is how far back a schedule is searched for its previous run
+const maxPreviousLookback = 366 * 24 * time.Hour
+
+// runPlan describes when a generator runs, either at a fixed interval or on a
+// cron schedule
+type runPlan struct {
+	interval time.Duration
+	schedule cron.Schedule
+}
+
+// next returns the time of the run following the given time. The zero time is
+// returned if the schedule has no further runs, or the interval is not positive
+func (p runPlan) next(after time.Time) time.Time {
+	if p.schedule != nil {
+		return p.schedule.Next(after)
+	}
+	if p.interval <= 0 {
+		return time.Time{}
+	}
+	return after.Add(p.interval)
+}
+
+// period returns the time between the run following the given time and the
+// run after it, or zero if the schedule has no further runs
+func (p runPlan) period(at time.Time) time.Duration {
+	if p.schedule == nil {
+		if p.interval <= 0 {
+			return 0
+		}
+		return p.interval
+	}
+
+	first := p.next(at)
+	if first.IsZero() {
+		return 0
+	}
+	second := p.next(first)
+	if second.IsZero() {
+		return 0
+	}
+	return second.Sub(first)
+}
+
+// previous returns the time of the last run before the given time. The zero
+// time is returned if the schedule had no runs in the year before it
+func (p runPlan) previous(before time.Time) time.Time {
+	if p.schedule == nil {
+		if p.interval <= 0 {
+			return time.Time{}
+		}
+		return before.Add(-p.interval)
+	}
+
+	// Runs are searched for over a window that doubles until one is found,
+	// so that frequent schedules are not scanned over the whole year
+	for lookback := time.Hour; lookback < 2*maxPreviousLookback; lookback *= 2 {
+		var last time.Time
+		for at := p.next(before.Add(-lookback)); !at.IsZero() && at.Before(before); at = p.next(at) {
+			last = at
+		}
+		if !last.IsZero() {
+			return last
+		}
+	}
+	return time.Time{}
+}
+
+// firstRun returns when a generator should first run after starting at now,
+// following its startup policy. If it is known when the generator last ran,
+// the first run is never sooner than the run that would have followed it
+func (p runPlan) firstRun(policy string, now time.Time, jitter time.Duration, last time.Time) time.Time {
+	var first time.Time
+	switch policy {
+	case config.StartupImmediate:
+		first = now
+	case config.StartupJitter:
+		first = now.Add(jitter)
+	default:
+		first = p.next(now)
+	}
+
+	if !last.IsZero() {
+		if due := p.next(last); due.After(first) {
+			first = due
+		}
+	}
+
+	return first
+}
+
+// following returns the next run after one planned for the given time, skipping
+// any runs that were missed while it was in progress
+func (p runPlan) following(at, now time.Time) time.Time {
+	next := p.next(at)
+	if !next.IsZero() && next.Before(now) {
+		next = p.next(now)
+	}
+	return next
+}
+
+// plannedRuns returns up to n run times of the plan starting at the given
+// first run, formatted for logging
+func plannedRuns(p runPlan, first time.Time, n int) []string {
+	runs := make([]string, 0, n)
+	for at := first; len(runs) < n && !at.IsZero(); at = p.next(at) {
+		runs = append(runs, at.Format(time.RFC3339))
+	}
+	return runs
+}
+
+// randomJitter returns a random duration of less than max
+func randomJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
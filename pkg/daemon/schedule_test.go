@@ -0,0 +1,207 @@
+package daemon
+
+import (
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_runPlan_firstRun(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	hourly := runPlan{interval: time.Hour}
+	nightly := runPlan{}
+	if sched, err := (config.CustomMetric{Schedule: "15 2 * * *"}).CronSchedule(); err != nil {
+		t.Fatalf("CronSchedule() error = %v", err)
+	} else {
+		nightly.schedule = sched
+	}
+
+	tests := []struct {
+		name   string
+		plan   runPlan
+		policy string
+		jitter time.Duration
+		last   time.Time
+		want   time.Time
+	}{
+		{"wait by default", hourly, "", 0, time.Time{}, now.Add(time.Hour)},
+		{"wait", hourly, config.StartupWait, 0, time.Time{}, now.Add(time.Hour)},
+		{"immediate", hourly, config.StartupImmediate, 0, time.Time{}, now},
+		{"jitter", hourly, config.StartupJitter, 20 * time.Second, time.Time{}, now.Add(20 * time.Second)},
+		{"immediate after a recent run", hourly, config.StartupImmediate, 0, now.Add(-20 * time.Minute), now.Add(40 * time.Minute)},
+		{"immediate after an old run", hourly, config.StartupImmediate, 0, now.Add(-2 * time.Hour), now},
+		{"jitter after a recent run", hourly, config.StartupJitter, 30 * time.Minute, now.Add(-50 * time.Minute), now.Add(30 * time.Minute)},
+		{"wait after an old run", hourly, config.StartupWait, 0, now.Add(-2 * time.Hour), now.Add(time.Hour)},
+		{"wait for schedule", nightly, config.StartupWait, 0, time.Time{}, time.Date(2021, 6, 2, 2, 15, 0, 0, time.UTC)},
+		{"immediate with schedule", nightly, config.StartupImmediate, 0, time.Time{}, now},
+		{"immediate with schedule already run", nightly, config.StartupImmediate, 0, time.Date(2021, 6, 1, 2, 15, 3, 0, time.UTC), time.Date(2021, 6, 2, 2, 15, 0, 0, time.UTC)},
+		{"immediate with missed schedule", nightly, config.StartupImmediate, 0, time.Date(2021, 5, 31, 2, 15, 3, 0, time.UTC), now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.plan.firstRun(tt.policy, now, tt.jitter, tt.last); !got.Equal(tt.want) {
+				t.Errorf("firstRun() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_runPlan_following(t *testing.T) {
+	at := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	plan := runPlan{interval: time.Minute}
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{"run finished in time", at.Add(10 * time.Second), at.Add(time.Minute)},
+		{"run overran", at.Add(150 * time.Second), at.Add(210 * time.Second)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := plan.following(at, tt.now); !got.Equal(tt.want) {
+				t.Errorf("following() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_runPlan_nonPositiveInterval(t *testing.T) {
+	at := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, interval := range []time.Duration{0, -time.Minute} {
+		plan := runPlan{interval: interval}
+		if got := plan.following(at, at.Add(time.Second)); !got.IsZero() {
+			t.Errorf("following() with interval %s = %v, want no further runs", interval, got)
+		}
+		if got := plan.period(at); got != 0 {
+			t.Errorf("period() with interval %s = %v, want 0", interval, got)
+		}
+		if got := plan.previous(at); !got.IsZero() {
+			t.Errorf("previous() with interval %s = %v, want no previous run", interval, got)
+		}
+	}
+}
+
+func Test_runPlan_period(t *testing.T) {
+	at := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	weekdays, err := (config.CustomMetric{Schedule: "0 6 * * 1-5"}).CronSchedule()
+	if err != nil {
+		t.Fatalf("CronSchedule() error = %v", err)
+	}
+	never, err := (config.CustomMetric{Schedule: "0 0 30 2 *"}).CronSchedule()
+	if err != nil {
+		t.Fatalf("CronSchedule() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		plan runPlan
+		at   time.Time
+		want time.Duration
+	}{
+		{"interval", runPlan{interval: 10 * time.Minute}, at, 10 * time.Minute},
+		{"schedule", runPlan{schedule: weekdays}, at, 24 * time.Hour},
+		{"schedule over a weekend", runPlan{schedule: weekdays}, time.Date(2021, 6, 4, 12, 0, 0, 0, time.UTC), 24 * time.Hour},
+		{"schedule before a weekend", runPlan{schedule: weekdays}, time.Date(2021, 6, 3, 12, 0, 0, 0, time.UTC), 72 * time.Hour},
+		{"schedule without runs", runPlan{schedule: never}, at, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.plan.period(tt.at); got != tt.want {
+				t.Errorf("period() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_runPlan_previous(t *testing.T) {
+	weekdays, err := (config.CustomMetric{Schedule: "0 9 * * MON-FRI"}).CronSchedule()
+	if err != nil {
+		t.Fatalf("CronSchedule() error = %v", err)
+	}
+	never, err := (config.CustomMetric{Schedule: "0 0 30 2 *"}).CronSchedule()
+	if err != nil {
+		t.Fatalf("CronSchedule() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		plan   runPlan
+		before time.Time
+		want   time.Time
+	}{
+		{"interval", runPlan{interval: 10 * time.Minute}, time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), time.Date(2021, 6, 1, 11, 50, 0, 0, time.UTC)},
+		{"schedule", runPlan{schedule: weekdays}, time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), time.Date(2021, 6, 1, 9, 0, 0, 0, time.UTC)},
+		{"schedule at a run", runPlan{schedule: weekdays}, time.Date(2021, 6, 1, 9, 0, 0, 0, time.UTC), time.Date(2021, 5, 31, 9, 0, 0, 0, time.UTC)},
+		{"schedule over a weekend", runPlan{schedule: weekdays}, time.Date(2021, 6, 7, 8, 0, 0, 0, time.UTC), time.Date(2021, 6, 4, 9, 0, 0, 0, time.UTC)},
+		{"schedule without runs", runPlan{schedule: never}, time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.plan.previous(tt.before); !got.Equal(tt.want) {
+				t.Errorf("previous() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_randomJitter(t *testing.T) {
+	if got := randomJitter(0); got != 0 {
+		t.Errorf("randomJitter() = %v, want 0", got)
+	}
+
+	for i := 0; i < 100; i++ {
+		if got := randomJitter(time.Second); got < 0 || got >= time.Second {
+			t.Fatalf("randomJitter() = %v, want within [0s, 1s)", got)
+		}
+	}
+}
+
+func Test_plannedRuns(t *testing.T) {
+	after := time.Date(2021, 3, 26, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		cm   config.CustomMetric
+		want []string
+	}{
+		{
+			"daily in utc",
+			config.CustomMetric{Schedule: "15 2 * * *"},
+			[]string{"2021-03-27T02:15:00Z", "2021-03-28T02:15:00Z", "2021-03-29T02:15:00Z"},
+		},
+		{
+			"daily across a daylight saving change",
+			config.CustomMetric{Schedule: "30 6 * * *", Timezone: "Europe/London"},
+			[]string{"2021-03-27T06:30:00Z", "2021-03-28T05:30:00Z", "2021-03-29T05:30:00Z"},
+		},
+		{
+			"weekdays",
+			config.CustomMetric{Schedule: "0 9 * * MON-FRI"},
+			[]string{"2021-03-29T09:00:00Z", "2021-03-30T09:00:00Z", "2021-03-31T09:00:00Z"},
+		},
+		{
+			"interval",
+			config.CustomMetric{MetricInterval: 6 * time.Hour},
+			[]string{"2021-03-26T18:00:00Z", "2021-03-27T00:00:00Z", "2021-03-27T06:00:00Z"},
+		},
+		{
+			"impossible date",
+			config.CustomMetric{Schedule: "0 0 30 2 *"},
+			[]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := tt.cm.CronSchedule()
+			if err != nil {
+				t.Fatalf("CronSchedule() error = %v", err)
+			}
+			plan := runPlan{interval: tt.cm.MetricInterval, schedule: schedule}
+			if got := plannedRuns(plan, plan.next(after), plannedRunsLogged); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("plannedRuns() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
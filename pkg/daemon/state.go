@@ -0,0 +1,86 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// runState persists the time each generator last ran successfully to a file
+// on disk, so that a restart does not repeat a run that happened recently
+type runState struct {
+	mx   sync.Mutex
+	path string
+	runs map[string]time.Time
+}
+
+// loadRunState reads the state file at the given path, starting with no
+// recorded runs if it does not exist yet
+func loadRunState(path string) (*runState, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, fmt.Errorf("error creating state directory: %w", err)
+	}
+
+	s := &runState{path: path, runs: make(map[string]time.Time)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file: %w", err)
+	}
+
+	if err = json.Unmarshal(data, &s.runs); err != nil {
+		return nil, fmt.Errorf("error reading state file: %w", err)
+	}
+
+	return s, nil
+}
+
+// lastRun returns when the named generator last ran successfully, or the zero
+// time if it is not known
+func (s *runState) lastRun(name string) time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.runs[name]
+}
+
+// record saves the time the named generator last ran successfully. The state
+// is written to a temporary file which then replaces the state file, so it is
+// never left partially written
+func (s *runState) record(name string, at time.Time) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.runs[name] = at.UTC()
+
+	data, err := json.MarshalIndent(s.runs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+
+	if err = os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+
+	return nil
+}
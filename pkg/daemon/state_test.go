@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_runState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bqmetrics-state")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "nested", "state.json")
+	s, err := loadRunState(path)
+	if err != nil {
+		t.Fatalf("loadRunState() error = %v", err)
+	}
+	if got := s.lastRun("table-scan"); !got.IsZero() {
+		t.Errorf("lastRun() of a new state = %v, want zero time", got)
+	}
+
+	at := time.Date(2021, 6, 1, 2, 15, 0, 0, time.FixedZone("BST", 3600))
+	if err = s.record("table-scan", at); err != nil {
+		t.Fatalf("record() error = %v", err)
+	}
+
+	reloaded, err := loadRunState(path)
+	if err != nil {
+		t.Fatalf("loadRunState() error = %v", err)
+	}
+	if got := reloaded.lastRun("table-scan"); !got.Equal(at) {
+		t.Errorf("lastRun() after reload = %v, want %v", got, at)
+	}
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("record() left a temporary file behind, stat error = %v", err)
+	}
+}
+
+func Test_runState_nil(t *testing.T) {
+	var s *runState
+	if got := s.lastRun("table-scan"); !got.IsZero() {
+		t.Errorf("lastRun() = %v, want zero time", got)
+	}
+	if err := s.record("table-scan", time.Now()); err != nil {
+		t.Errorf("record() error = %v", err)
+	}
+}
+
+func Test_loadRunState_invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bqmetrics-state")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+	if err = ioutil.WriteFile(path, []byte("{not json"), 0640); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	if _, err = loadRunState(path); err == nil {
+		t.Errorf("loadRunState() error = nil, want error")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"github.com/rs/zerolog/log"
 	"net/http"
+	"time"
 )
 
 // Status is the health status of the service
@@ -19,7 +20,17 @@ const (
 
 // ServiceStatus holds information about the health of the bqmetricsd service
 type ServiceStatus struct {
-	Status Status `json:"status"`
+	Status     Status            `json:"status"`
+	Components []ComponentStatus `json:"components,omitempty"`
+}
+
+// ComponentStatus holds information about the health of part of the service
+type ComponentStatus struct {
+	Name                string     `json:"name"`
+	Status              Status     `json:"status"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
 }
 
 // Handler will handle HTTP requests to the health endpoint
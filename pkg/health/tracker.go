@@ -0,0 +1,195 @@
+package health
+
+import (
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultAgeIntervals is the number of intervals without a success after which
+// a component is unhealthy, if no maximum age is configured
+const defaultAgeIntervals = 5
+
+const (
+	// ComponentPublisher is the component that publishes metrics
+	ComponentPublisher = "publisher"
+
+	// ComponentTableScan is the component that produces table metrics
+	ComponentTableScan = "table-scan"
+
+	// ComponentCustomMetricPrefix is the prefix of the component producing a custom metric
+	ComponentCustomMetricPrefix = "custom-metric:"
+
+	// ComponentJobMetricsPrefix is the prefix of the component producing the job metrics of a project
+	ComponentJobMetricsPrefix = "job-metrics:"
+
+	// ComponentPartitionMetricsPrefix is the prefix of the component producing the partition metrics of a project
+	ComponentPartitionMetricsPrefix = "partition-metrics:"
+
+	// ComponentConfigReload is the component that reloads the config
+	ComponentConfigReload = "config-reload"
+)
+
+// component holds the state of a single part of the service. Components added
+// after the service started record when they were added
+type component struct {
+	added               time.Time
+	maxAge              time.Duration
+	lastSuccess         time.Time
+	lastError           error
+	consecutiveFailures int
+}
+
+// Tracker keeps track of the state of the components of the service, and
+// reports the service unhealthy once a component has gone too long without
+// succeeding
+type Tracker struct {
+	mx         sync.Mutex
+	started    time.Time
+	components map[string]*component
+	now        func() time.Time
+}
+
+// NewTracker returns a Tracker for the publisher, table scan, custom metrics
+// and job metrics of the service, using the maximum ages from the config
+func NewTracker(cfg *config.Config) *Tracker {
+	t := &Tracker{
+		started:    time.Now(),
+		components: make(map[string]*component),
+		now:        time.Now,
+	}
+
+	for name, age := range maxAges(cfg, t.started) {
+		t.components[name] = &component{maxAge: age}
+	}
+
+	return t
+}
+
+// maxAges returns the maximum age of each component configured
+func maxAges(cfg *config.Config, now time.Time) map[string]time.Duration {
+	ages := map[string]time.Duration{
+		ComponentPublisher: maxAge(cfg.HealthCheck.MaxPublishAge, cfg.MetricInterval),
+		ComponentTableScan: maxAge(cfg.HealthCheck.MaxTableScanAge, cfg.MetricInterval),
+	}
+	for _, cm := range cfg.CustomMetrics {
+		ages[ComponentCustomMetricPrefix+cm.MetricName] = maxAge(cfg.HealthCheck.MaxCustomMetricAge, cm.LongestPeriod(now))
+	}
+	if cfg.JobMetrics.Enabled {
+		for _, p := range cfg.Projects {
+			ages[ComponentJobMetricsPrefix+p.ProjectID] = maxAge(0, cfg.JobMetrics.Interval)
+		}
+	}
+	if cfg.PartitionMetrics.Enabled {
+		for _, p := range cfg.Projects {
+			ages[ComponentPartitionMetricsPrefix+p.ProjectID] = maxAge(0, cfg.PartitionMetrics.Interval)
+		}
+	}
+
+	return ages
+}
+
+// Reconfigure updates the components tracked to match a reloaded config. The
+// history of components that are still configured is kept, components that
+// are no longer configured are removed, and new components are given their
+// maximum age from now before they are unhealthy
+func (t *Tracker) Reconfigure(cfg *config.Config) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	now := t.now()
+	ages := maxAges(cfg, now)
+	for name, c := range t.components {
+		if age, ok := ages[name]; ok {
+			c.maxAge = age
+			continue
+		}
+
+		if strings.HasPrefix(name, ComponentCustomMetricPrefix) || strings.HasPrefix(name, ComponentJobMetricsPrefix) || strings.HasPrefix(name, ComponentPartitionMetricsPrefix) {
+			delete(t.components, name)
+		}
+	}
+
+	for name, age := range ages {
+		if _, ok := t.components[name]; !ok {
+			t.components[name] = &component{added: now, maxAge: age}
+		}
+	}
+}
+
+func maxAge(configured, interval time.Duration) time.Duration {
+	if configured > 0 {
+		return configured
+	}
+	return defaultAgeIntervals * interval
+}
+
+// Record records the outcome of an attempt by a component, where a nil error
+// is a success
+func (t *Tracker) Record(name string, err error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	c, ok := t.components[name]
+	if !ok {
+		c = &component{added: t.now()}
+		t.components[name] = c
+	}
+
+	if err != nil {
+		c.lastError = err
+		c.consecutiveFailures++
+		return
+	}
+
+	c.lastSuccess = t.now()
+	c.lastError = nil
+	c.consecutiveFailures = 0
+}
+
+// ServiceStatus returns the current status of the service and its components.
+// A component is unhealthy when its last success, or when it was first
+// tracked if it has not yet succeeded, is older than its maximum age
+func (t *Tracker) ServiceStatus() ServiceStatus {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	now := t.now()
+	ss := ServiceStatus{Status: Ok, Components: make([]ComponentStatus, 0, len(t.components))}
+	for name, c := range t.components {
+		cs := ComponentStatus{Name: name, Status: Ok, ConsecutiveFailures: c.consecutiveFailures}
+
+		since := t.started
+		if !c.added.IsZero() {
+			since = c.added
+		}
+		if !c.lastSuccess.IsZero() {
+			since = c.lastSuccess
+			last := c.lastSuccess
+			cs.LastSuccess = &last
+		}
+
+		if c.lastError != nil {
+			cs.LastError = c.lastError.Error()
+		}
+
+		if c.maxAge > 0 && now.Sub(since) > c.maxAge {
+			cs.Status = Error
+			ss.Status = Error
+		}
+
+		ss.Components = append(ss.Components, cs)
+	}
+
+	sort.Slice(ss.Components, func(i, j int) bool { return ss.Components[i].Name < ss.Components[j].Name })
+	return ss
+}
+
+// Handler will handle HTTP requests to the health endpoint with the current
+// status of the service
+func (t *Tracker) Handler(w http.ResponseWriter, r *http.Request) {
+	t.ServiceStatus().Handler(w, r)
+}
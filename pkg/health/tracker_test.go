@@ -0,0 +1,218 @@
+package health
+
+import (
+	"errors"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTracker_ServiceStatus(t *testing.T) {
+	start := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	cfg := &config.Config{
+		MetricInterval: time.Minute,
+		CustomMetrics:  []config.CustomMetric{{MetricName: "custom", MetricInterval: time.Hour}},
+		HealthCheck:    config.HealthCheck{MaxPublishAge: 10 * time.Minute},
+	}
+
+	tests := []struct {
+		name    string
+		records map[string]error
+		elapsed time.Duration
+		want    map[string]Status
+	}{
+		{
+			"healthy during startup",
+			nil,
+			time.Minute,
+			map[string]Status{ComponentPublisher: Ok, ComponentTableScan: Ok, ComponentCustomMetricPrefix + "custom": Ok},
+		},
+		{
+			"unhealthy when never succeeded",
+			nil,
+			11 * time.Minute,
+			map[string]Status{ComponentPublisher: Error, ComponentTableScan: Error, ComponentCustomMetricPrefix + "custom": Ok},
+		},
+		{
+			"healthy after recent success",
+			map[string]error{ComponentPublisher: nil, ComponentTableScan: nil},
+			0,
+			map[string]Status{ComponentPublisher: Ok, ComponentTableScan: Ok, ComponentCustomMetricPrefix + "custom": Ok},
+		},
+		{
+			"unhealthy when success is stale",
+			map[string]error{ComponentPublisher: nil, ComponentTableScan: nil, ComponentCustomMetricPrefix + "custom": nil},
+			6 * time.Minute,
+			map[string]Status{ComponentPublisher: Ok, ComponentTableScan: Error, ComponentCustomMetricPrefix + "custom": Ok},
+		},
+		{
+			"failures do not reset last success",
+			map[string]error{ComponentTableScan: errors.New("403 forbidden")},
+			0,
+			map[string]Status{ComponentPublisher: Ok, ComponentTableScan: Ok, ComponentCustomMetricPrefix + "custom": Ok},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := start
+			tr := NewTracker(cfg)
+			tr.started = start
+			tr.now = func() time.Time { return now }
+
+			for name, err := range tt.records {
+				tr.Record(name, err)
+			}
+			now = now.Add(tt.elapsed)
+
+			ss := tr.ServiceStatus()
+			wantStatus := Ok
+			for _, c := range ss.Components {
+				if c.Status != tt.want[c.Name] {
+					t.Errorf("ServiceStatus() component %s got = %v, want %v", c.Name, c.Status, tt.want[c.Name])
+				}
+				if tt.want[c.Name] == Error {
+					wantStatus = Error
+				}
+			}
+			if len(ss.Components) != len(tt.want) {
+				t.Errorf("ServiceStatus() got %d components, want %d", len(ss.Components), len(tt.want))
+			}
+			if ss.Status != wantStatus {
+				t.Errorf("ServiceStatus() got status = %v, want %v", ss.Status, wantStatus)
+			}
+		})
+	}
+}
+
+func TestTracker_Reconfigure(t *testing.T) {
+	start := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	tr := NewTracker(&config.Config{
+		MetricInterval: time.Minute,
+		CustomMetrics: []config.CustomMetric{
+			{MetricName: "kept", MetricInterval: time.Minute},
+			{MetricName: "removed", MetricInterval: time.Minute},
+		},
+	})
+	tr.started = start
+	tr.now = func() time.Time { return now }
+
+	tr.Record(ComponentTableScan, nil)
+	tr.Record(ComponentCustomMetricPrefix+"kept", errors.New("403 forbidden"))
+	tr.Record(ComponentConfigReload, nil)
+
+	// An hour later, after every component has become stale
+	now = now.Add(time.Hour)
+	tr.Reconfigure(&config.Config{
+		MetricInterval: time.Minute,
+		CustomMetrics: []config.CustomMetric{
+			{MetricName: "kept", MetricInterval: time.Minute},
+			{MetricName: "added", MetricInterval: time.Minute},
+		},
+	})
+
+	want := map[string]ComponentStatus{
+		ComponentPublisher:                    {Status: Error},
+		ComponentTableScan:                    {Status: Error},
+		ComponentConfigReload:                 {Status: Ok},
+		ComponentCustomMetricPrefix + "kept":  {Status: Error, LastError: "403 forbidden", ConsecutiveFailures: 1},
+		ComponentCustomMetricPrefix + "added": {Status: Ok},
+	}
+
+	ss := tr.ServiceStatus()
+	if len(ss.Components) != len(want) {
+		t.Errorf("ServiceStatus() got %d components, want %d", len(ss.Components), len(want))
+	}
+	for _, c := range ss.Components {
+		w, ok := want[c.Name]
+		if !ok {
+			t.Errorf("ServiceStatus() got unexpected component %s", c.Name)
+			continue
+		}
+		if c.Status != w.Status || c.LastError != w.LastError || c.ConsecutiveFailures != w.ConsecutiveFailures {
+			t.Errorf("ServiceStatus() component %s got = %+v, want %+v", c.Name, c, w)
+		}
+	}
+}
+
+func Test_maxAges_schedules(t *testing.T) {
+	// A Wednesday
+	now := time.Date(2021, 1, 6, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		cm   config.CustomMetric
+		want time.Duration
+	}{
+		{"interval", config.CustomMetric{MetricInterval: time.Hour}, defaultAgeIntervals * time.Hour},
+		{"daily schedule", config.CustomMetric{MetricInterval: time.Minute, Schedule: "15 2 * * *"}, defaultAgeIntervals * 24 * time.Hour},
+		{"weekdays schedule", config.CustomMetric{MetricInterval: time.Minute, Schedule: "0 9 * * MON-FRI"}, defaultAgeIntervals * 72 * time.Hour},
+		{"irregular daily schedule", config.CustomMetric{MetricInterval: time.Minute, Schedule: "0 2,3 * * *"}, defaultAgeIntervals * 23 * time.Hour},
+		{"invalid schedule", config.CustomMetric{MetricInterval: time.Minute, Schedule: "daily"}, defaultAgeIntervals * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cm.MetricName = "my-metric"
+			ages := maxAges(&config.Config{CustomMetrics: []config.CustomMetric{tt.cm}}, now)
+			if got := ages[ComponentCustomMetricPrefix+"my-metric"]; got != tt.want {
+				t.Errorf("maxAges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTracker_ServiceStatus_irregularSchedule(t *testing.T) {
+	cfg := &config.Config{CustomMetrics: []config.CustomMetric{{MetricName: "my-metric", Schedule: "0 2,3 * * *"}}}
+	tr := NewTracker(cfg)
+
+	// The last run was at 3am, and the next is at 2am the following day
+	last := time.Date(2021, 1, 6, 3, 0, 0, 0, time.UTC)
+	tr.now = func() time.Time { return last }
+	tr.Record(ComponentCustomMetricPrefix+"my-metric", nil)
+
+	tr.now = func() time.Time { return last.Add(22 * time.Hour) }
+	if got := tr.ServiceStatus().Status; got != Ok {
+		t.Errorf("ServiceStatus() between runs = %v, want %v", got, Ok)
+	}
+}
+
+func TestTracker_Record(t *testing.T) {
+	tr := NewTracker(&config.Config{MetricInterval: time.Minute})
+	tr.Record(ComponentPublisher, errors.New("500 internal server error"))
+	tr.Record(ComponentPublisher, errors.New("503 service unavailable"))
+
+	var got ComponentStatus
+	for _, c := range tr.ServiceStatus().Components {
+		if c.Name == ComponentPublisher {
+			got = c
+		}
+	}
+
+	if got.ConsecutiveFailures != 2 || got.LastError != "503 service unavailable" || got.LastSuccess != nil {
+		t.Errorf("Record() got = %+v", got)
+	}
+
+	tr.Record(ComponentPublisher, nil)
+	for _, c := range tr.ServiceStatus().Components {
+		if c.Name == ComponentPublisher && (c.ConsecutiveFailures != 0 || c.LastError != "" || c.LastSuccess == nil) {
+			t.Errorf("Record() after success got = %+v", c)
+		}
+	}
+}
+
+func TestTracker_Handler(t *testing.T) {
+	tr := NewTracker(&config.Config{MetricInterval: time.Minute})
+	tr.started = time.Now().Add(-time.Hour)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(tr.Handler).ServeHTTP(rr, httptest.NewRequest("GET", "/health", nil))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusInternalServerError)
+	}
+	if !strings.Contains(rr.Body.String(), "\"name\":\"publisher\",\"status\":\"Error\"") {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+}
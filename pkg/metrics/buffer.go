@@ -0,0 +1,226 @@
+package metrics
+
+import (
+	"container/heap"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"sort"
+)
+
+func (c *Consumer) bounded() bool {
+	return c.buffer.MaxPoints > 0 || c.buffer.MaxSeries > 0
+}
+
+// admit returns the metric holding only the points that fit in the buffer,
+// or nil if none of them fit. Points that replace the value of an existing
+// point always fit, as they do not grow the buffer
+func (c *Consumer) admit(m *Metric) *Metric {
+	cur, exists := c.metrics[m.ID()]
+	if !exists && c.buffer.MaxSeries > 0 && len(c.metrics) >= c.buffer.MaxSeries {
+		c.dropped += uint64(len(m.Points))
+		return nil
+	}
+
+	free := -1
+	if c.buffer.MaxPoints > 0 {
+		free = c.buffer.MaxPoints - c.points
+	}
+
+	var pm pointmap
+	if exists {
+		pm = createPointmap(cur)
+	}
+
+	points := make([][]float64, 0, len(m.Points))
+	for _, point := range m.Points {
+		if len(point) != 2 {
+			continue
+		}
+
+		if _, ok := pm[point[0]]; !ok {
+			if free == 0 {
+				c.dropped++
+				continue
+			}
+			if free > 0 {
+				free--
+			}
+		}
+		points = append(points, point)
+	}
+
+	if len(points) == 0 {
+		return nil
+	}
+
+	m.Points = points
+	return m
+}
+
+// trim drops points until the buffer is within its limits, following the
+// drop policy of the buffer
+func (c *Consumer) trim() {
+	for c.buffer.MaxSeries > 0 && len(c.metrics) > c.buffer.MaxSeries {
+		c.dropSeries(c.stalest.first())
+	}
+
+	if c.buffer.MaxPoints <= 0 {
+		return
+	}
+
+	if c.points <= c.buffer.MaxPoints {
+		return
+	}
+
+	if c.buffer.DropPolicy == config.DropLatest {
+		for id := range c.multi {
+			m := c.metrics[id]
+			n := len(m.Points)
+			m.Points = m.Points[n-1:]
+			c.dropped += uint64(n - 1)
+			c.points -= n - 1
+			c.oldest.update(id)
+		}
+		c.multi = make(map[string]struct{})
+
+		for c.points > c.buffer.MaxPoints {
+			c.dropSeries(c.stalest.first())
+		}
+		return
+	}
+
+	for c.points > c.buffer.MaxPoints {
+		id := c.oldest.first()
+		m := c.metrics[id]
+		if len(m.Points) == 0 {
+			c.dropSeries(id)
+			continue
+		}
+
+		m.Points = m.Points[1:]
+		c.dropped++
+		c.points--
+
+		if len(m.Points) == 0 {
+			c.dropSeries(id)
+			continue
+		}
+		if len(m.Points) == 1 {
+			delete(c.multi, id)
+		}
+		c.oldest.update(id)
+	}
+}
+
+// index records that the points of a series have changed, so that the
+// series is in the right place to be dropped when the buffer is full
+func (c *Consumer) index(id string) {
+	if c.oldest == nil {
+		c.oldest = newSeriesIndex(c, func(m *Metric) []float64 { return m.Points[0] })
+		c.stalest = newSeriesIndex(c, func(m *Metric) []float64 { return m.Points[len(m.Points)-1] })
+		c.multi = make(map[string]struct{})
+	}
+
+	c.oldest.update(id)
+	c.stalest.update(id)
+	if len(c.metrics[id].Points) > 1 {
+		c.multi[id] = struct{}{}
+	}
+}
+
+// dropSeries removes a series from the buffer
+func (c *Consumer) dropSeries(id string) {
+	n := len(c.metrics[id].Points)
+	c.dropped += uint64(n)
+	c.points -= n
+	c.oldest.remove(id)
+	c.stalest.remove(id)
+	delete(c.multi, id)
+	delete(c.metrics, id)
+}
+
+// seriesIndex is a heap of the series in a buffer, ordered by the timestamp
+// of one of their points, so the next series to drop is found without
+// scanning every series
+type seriesIndex struct {
+	c       *Consumer
+	point   func(*Metric) []float64
+	entries []*seriesEntry
+	byID    map[string]*seriesEntry
+}
+
+type seriesEntry struct {
+	id    string
+	m     *Metric
+	index int
+}
+
+func newSeriesIndex(c *Consumer, point func(*Metric) []float64) *seriesIndex {
+	return &seriesIndex{c: c, point: point, byID: make(map[string]*seriesEntry)}
+}
+
+// first returns the ID of the series whose point has the oldest timestamp.
+// Series without any points come first
+func (s *seriesIndex) first() string {
+	return s.entries[0].id
+}
+
+// update adds the series to the index, or moves it after its points changed
+func (s *seriesIndex) update(id string) {
+	if e, ok := s.byID[id]; ok {
+		heap.Fix(s, e.index)
+		return
+	}
+	heap.Push(s, &seriesEntry{id: id, m: s.c.metrics[id]})
+}
+
+// remove drops the series from the index
+func (s *seriesIndex) remove(id string) {
+	if e, ok := s.byID[id]; ok {
+		heap.Remove(s, e.index)
+	}
+}
+
+func (s *seriesIndex) Len() int {
+	return len(s.entries)
+}
+
+func (s *seriesIndex) Less(i, j int) bool {
+	a, b := s.entries[i], s.entries[j]
+	if len(a.m.Points) == 0 || len(b.m.Points) == 0 {
+		return len(a.m.Points) < len(b.m.Points) || (len(a.m.Points) == len(b.m.Points) && a.id < b.id)
+	}
+
+	ta, tb := s.point(a.m)[0], s.point(b.m)[0]
+	return ta < tb || (ta == tb && a.id < b.id)
+}
+
+func (s *seriesIndex) Swap(i, j int) {
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+	s.entries[i].index = i
+	s.entries[j].index = j
+}
+
+func (s *seriesIndex) Push(x interface{}) {
+	e := x.(*seriesEntry)
+	e.index = len(s.entries)
+	s.entries = append(s.entries, e)
+	s.byID[e.id] = e
+}
+
+func (s *seriesIndex) Pop() interface{} {
+	e := s.entries[len(s.entries)-1]
+	s.entries = s.entries[:len(s.entries)-1]
+	delete(s.byID, e.id)
+	return e
+}
+
+// sortPoints orders the points of the metric by timestamp, given that the
+// first n points are already in order
+func (m *Metric) sortPoints(n int) {
+	tail := m.Points[n:]
+	sorted := sort.SliceIsSorted(tail, func(i, j int) bool { return tail[i][0] < tail[j][0] })
+	if sorted && (n == 0 || len(tail) == 0 || m.Points[n-1][0] <= tail[0][0]) {
+		return
+	}
+	sort.SliceStable(m.Points, func(i, j int) bool { return m.Points[i][0] < m.Points[j][0] })
+}
@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"fmt"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"reflect"
+	"testing"
+)
+
+func TestConsumer_consume_Bounded(t *testing.T) {
+	row := func(points ...[]float64) *Metric { return &Metric{Metric: "row_count", Points: points} }
+	size := func(points ...[]float64) *Metric { return &Metric{Metric: "size_bytes", Points: points} }
+
+	tests := []struct {
+		name        string
+		buffer      config.Buffer
+		consume     []*Metric
+		want        map[string][][]float64
+		wantDropped uint64
+	}{
+		{
+			"unbounded",
+			config.Buffer{},
+			[]*Metric{row([]float64{1, 1}), row([]float64{2, 2}), row([]float64{3, 3})},
+			map[string][][]float64{"row_count": {{1, 1}, {2, 2}, {3, 3}}},
+			0,
+		},
+		{
+			"drop oldest points",
+			config.Buffer{MaxPoints: 3, DropPolicy: config.DropOldest},
+			[]*Metric{row([]float64{1, 1}), size([]float64{2, 2}), row([]float64{3, 3}), size([]float64{4, 4})},
+			map[string][][]float64{"row_count": {{3, 3}}, "size_bytes": {{2, 2}, {4, 4}}},
+			1,
+		},
+		{
+			"drop oldest is default policy",
+			config.Buffer{MaxPoints: 2},
+			[]*Metric{row([]float64{1, 1}), row([]float64{2, 2}), row([]float64{3, 3})},
+			map[string][][]float64{"row_count": {{2, 2}, {3, 3}}},
+			1,
+		},
+		{
+			"drop newest points",
+			config.Buffer{MaxPoints: 2, DropPolicy: config.DropNewest},
+			[]*Metric{row([]float64{1, 1}), row([]float64{2, 2}), row([]float64{3, 3}), size([]float64{4, 4})},
+			map[string][][]float64{"row_count": {{1, 1}, {2, 2}}},
+			2,
+		},
+		{
+			"drop newest still updates existing points",
+			config.Buffer{MaxPoints: 1, DropPolicy: config.DropNewest},
+			[]*Metric{row([]float64{1, 1}), row([]float64{1, 5})},
+			map[string][][]float64{"row_count": {{1, 5}}},
+			0,
+		},
+		{
+			"keep latest points",
+			config.Buffer{MaxPoints: 3, DropPolicy: config.DropLatest},
+			[]*Metric{row([]float64{1, 1}), row([]float64{2, 2}), size([]float64{3, 3}), row([]float64{4, 4})},
+			map[string][][]float64{"row_count": {{4, 4}}, "size_bytes": {{3, 3}}},
+			2,
+		},
+		{
+			"series limit drops stalest series",
+			config.Buffer{MaxSeries: 1, DropPolicy: config.DropOldest},
+			[]*Metric{row([]float64{1, 1}), row([]float64{2, 2}), size([]float64{3, 3})},
+			map[string][][]float64{"size_bytes": {{3, 3}}},
+			2,
+		},
+		{
+			"series limit drops new series",
+			config.Buffer{MaxSeries: 1, DropPolicy: config.DropNewest},
+			[]*Metric{row([]float64{1, 1}), size([]float64{2, 2}), row([]float64{3, 3})},
+			map[string][][]float64{"row_count": {{1, 1}, {3, 3}}},
+			1,
+		},
+		{
+			"points kept in timestamp order",
+			config.Buffer{MaxPoints: 2},
+			[]*Metric{row([]float64{3, 3}), row([]float64{1, 1}), row([]float64{2, 2})},
+			map[string][][]float64{"row_count": {{2, 2}, {3, 3}}},
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewBoundedConsumer(tt.buffer)
+			for _, m := range tt.consume {
+				c.consume(m)
+			}
+
+			got := make(map[string][][]float64)
+			points := 0
+			for id, m := range c.metrics {
+				got[id] = m.Points
+				points += len(m.Points)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("consume() got = %v, want %v", got, tt.want)
+			}
+			if c.Dropped() != tt.wantDropped {
+				t.Errorf("Dropped() got = %v, want %v", c.Dropped(), tt.wantDropped)
+			}
+			if series, size := c.Size(); series != len(tt.want) || size != points {
+				t.Errorf("Size() got = %v, %v, want %v, %v", series, size, len(tt.want), points)
+			}
+		})
+	}
+}
+
+func TestConsumer_consume_BoundedManySeries(t *testing.T) {
+	const series, intervals, kept = 1000, 20, 5
+
+	c := NewBoundedConsumer(config.Buffer{MaxPoints: series * kept, DropPolicy: config.DropOldest})
+	consumeSeries(c, series, intervals)
+
+	if got, points := c.Size(); got != series || points != series*kept {
+		t.Fatalf("Size() got = %v, %v, want %v, %v", got, points, series, series*kept)
+	}
+	for id, m := range c.metrics {
+		if len(m.Points) != kept || m.Points[0][0] != intervals-kept {
+			t.Errorf("consume() series %s got = %v, want the last %d points", id, m.Points, kept)
+		}
+	}
+	if want := uint64(series * (intervals - kept)); c.Dropped() != want {
+		t.Errorf("Dropped() got = %v, want %v", c.Dropped(), want)
+	}
+}
+
+func BenchmarkConsumer_consume_Bounded(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		c := NewBoundedConsumer(config.Buffer{MaxPoints: 10000, DropPolicy: config.DropOldest})
+		consumeSeries(c, 5000, 20)
+	}
+}
+
+// consumeSeries consumes a point for each series at each interval, as the
+// consumer receives them while publishing is failing
+func consumeSeries(c *Consumer, series, intervals int) {
+	for ts := 0; ts < intervals; ts++ {
+		for i := 0; i < series; i++ {
+			c.consume(&Metric{
+				Metric: "row_count",
+				Tags:   []string{fmt.Sprintf("table:t%d", i)},
+				Points: [][]float64{{float64(ts), 1}},
+			})
+		}
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"github.com/rs/zerolog/log"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 )
 
@@ -20,6 +22,7 @@ type httpClient interface {
 type DatadogPublisher struct {
 	cfg    *config.Config
 	client httpClient
+	wait   func(context.Context, time.Duration) error
 }
 
 // NewDatadogPublisher returns a new DatadogPublisher
@@ -28,7 +31,9 @@ func NewDatadogPublisher(cfg *config.Config) *DatadogPublisher {
 	return &DatadogPublisher{cfg: cfg, client: client}
 }
 
-// PublishMetricsSet takes a list of metrics and publishes them to Datadog
+// PublishMetricsSet takes a list of metrics and publishes them to Datadog.
+// Requests that fail with a recoverable error are retried with exponential
+// backoff, within the limits of the retry configuration and the context deadline
 func (dp *DatadogPublisher) PublishMetricsSet(ctx context.Context, metrics []Metric) error {
 	type Request struct {
 		Series []Metric `json:"series"`
@@ -44,32 +49,134 @@ func (dp *DatadogPublisher) PublishMetricsSet(ctx context.Context, metrics []Met
 		return NewUnrecoverableError(err)
 	}
 
+	return dp.post(ctx, "series", body)
+}
+
+// PublishServiceChecks takes a list of service check results and submits them
+// to Datadog, retrying in the same way as metrics. Checks without a host name
+// are submitted with the host name of the exporter
+func (dp *DatadogPublisher) PublishServiceChecks(ctx context.Context, checks []ServiceCheck) error {
+	log.Info().
+		Int("service_checks_count", len(checks)).
+		Msg("Publishing service checks to datadog")
+
+	hostname, _ := os.Hostname()
+	submitted := make([]ServiceCheck, len(checks))
+	for i, check := range checks {
+		if check.HostName == "" {
+			check.HostName = hostname
+		}
+		submitted[i] = check
+	}
+
+	body, err := json.Marshal(submitted)
+	if err != nil {
+		return NewUnrecoverableError(err)
+	}
+
+	return dp.post(ctx, "check_run", body)
+}
+
+// post sends the body to the given Datadog API endpoint. Requests that fail
+// with a recoverable error are retried with exponential backoff
+func (dp *DatadogPublisher) post(ctx context.Context, endpoint string, body []byte) error {
+	retry := dp.cfg.DatadogRetry
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		retryAfter, err := dp.send(ctx, endpoint, body)
+		if err == nil || !IsRecoverable(err) || attempt >= retry.MaxAttempts {
+			return err
+		}
+
+		wait := retryAfter
+		if wait <= 0 {
+			wait = retry.Backoff(attempt)
+		}
+
+		if !retry.CanRetryWithin(ctx, start, wait) {
+			return err
+		}
+
+		log.Warn().
+			Err(err).
+			Int("attempt", attempt).
+			Str("retry_in", wait.String()).
+			Str("endpoint", endpoint).
+			Msg("Recoverable error publishing to datadog, retrying")
+
+		if werr := dp.sleep(ctx, wait); werr != nil {
+			return err
+		}
+	}
+}
+
+// send makes a single request to an endpoint of the Datadog API, returning
+// how long Datadog asked to wait before retrying if it did so
+func (dp *DatadogPublisher) send(ctx context.Context, endpoint string, body []byte) (time.Duration, error) {
 	ddSite := config.DatadogSites[dp.cfg.DatadogSite]
-	url := fmt.Sprintf("https://api.%s/api/v1/series?api_key=%s", ddSite, dp.cfg.DatadogAPIKey)
+	url := fmt.Sprintf("https://api.%s/api/v1/%s?api_key=%s", ddSite, endpoint, dp.cfg.DatadogAPIKey)
 	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
 	if err != nil {
-		return NewUnrecoverableError(err)
+		return 0, NewUnrecoverableError(err)
 	}
 
 	resp, err := dp.client.Do(request)
 	if err != nil {
-		return NewRecoverableError(err)
+		return 0, NewRecoverableError(err)
 	}
 
 	if _, err = ioutil.ReadAll(resp.Body); err != nil {
-		return NewRecoverableError(err)
+		return 0, NewRecoverableError(err)
 	}
 
 	if err = resp.Body.Close(); err != nil {
-		return NewRecoverableError(err)
+		return 0, NewRecoverableError(err)
 	}
 
 	switch {
 	case resp.StatusCode >= 500, resp.StatusCode == 429:
-		return NewRecoverableError(err)
+		return retryAfter(resp.Header, time.Now()), NewRecoverableError(fmt.Errorf("datadog %s returned %d", endpoint, resp.StatusCode))
 	case resp.StatusCode >= 400:
-		return NewUnrecoverableError(err)
+		return 0, NewUnrecoverableError(fmt.Errorf("datadog %s returned %d", endpoint, resp.StatusCode))
+	}
+
+	return 0, nil
+}
+
+func (dp *DatadogPublisher) sleep(ctx context.Context, d time.Duration) error {
+	if dp.wait != nil {
+		return dp.wait(ctx, d)
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryAfter reads how long to wait before retrying from the Retry-After
+// header, or the Datadog rate limit headers when the rate limit is exhausted
+func retryAfter(h http.Header, now time.Time) time.Duration {
+	if val := h.Get("Retry-After"); val != "" {
+		if secs, err := strconv.Atoi(val); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+
+		if at, err := http.ParseTime(val); err == nil && at.After(now) {
+			return at.Sub(now)
+		}
+	}
+
+	if h.Get("X-RateLimit-Remaining") == "0" {
+		if secs, err := strconv.Atoi(h.Get("X-RateLimit-Reset")); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
 	}
 
-	return nil
+	return 0
 }
@@ -3,11 +3,16 @@ package metrics
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
 	"io/ioutil"
 	"net/http"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 type mockHTTPClient struct {
@@ -89,13 +94,13 @@ func TestDatadogPublisher_PublishMetricsSet(t *testing.T) {
 			"Datadog internal error",
 			testResponse("{\"errors\": [\"Internal Server Error\"]}", 500),
 			args{metrics: metrics},
-			NewRecoverableError(nil),
+			NewRecoverableError(errors.New("datadog series returned 500")),
 		},
 		{
 			"Datadog bad request error",
 			testResponse("{\"errors\": [\"Bad Request\"]}", 400),
 			args{metrics: metrics},
-			NewUnrecoverableError(nil),
+			NewUnrecoverableError(errors.New("datadog series returned 400")),
 		},
 	}
 	for _, tt := range tests {
@@ -105,9 +110,207 @@ func TestDatadogPublisher_PublishMetricsSet(t *testing.T) {
 				client: &mockHTTPClient{tt.dofunc(t)},
 			}
 			err := dp.PublishMetricsSet(context.TODO(), tt.args.metrics)
-			if err != tt.wantErr {
+			if fmt.Sprint(err) != fmt.Sprint(tt.wantErr) {
 				t.Errorf("PublishMetricsSet() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
+
+func TestDatadogPublisher_PublishServiceChecks(t *testing.T) {
+	var got []ServiceCheck
+	var url string
+	client := &mockHTTPClient{doFunc: func(req *http.Request) (*http.Response, error) {
+		url = req.URL.String()
+		body, _ := ioutil.ReadAll(req.Body)
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("Request body %s was not a list of service checks: %v", body, err)
+		}
+
+		return &http.Response{
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte(""))),
+			StatusCode: 202,
+		}, nil
+	}}
+
+	dp := &DatadogPublisher{cfg: &config.Config{DatadogAPIKey: "ABC123", DatadogSite: "US"}, client: client}
+	checks := []ServiceCheck{
+		{Check: "bigquery.table.freshness", Status: ServiceCheckCritical, Timestamp: 1600, Tags: []string{"table_id:events"}},
+		{Check: "bigquery.table.freshness", HostName: "exporter-1", Status: ServiceCheckOK, Timestamp: 1600, Tags: []string{"table_id:orders"}},
+	}
+	if err := dp.PublishServiceChecks(context.TODO(), checks); err != nil {
+		t.Fatalf("PublishServiceChecks() error = %v", err)
+	}
+
+	if !strings.Contains(url, "/api/v1/check_run?api_key=ABC123") {
+		t.Errorf("PublishServiceChecks() sent to %s, want the check_run endpoint", url)
+	}
+	if len(got) != 2 {
+		t.Fatalf("PublishServiceChecks() sent %d service checks, want 2", len(got))
+	}
+	if got[0].HostName == "" || got[1].HostName != "exporter-1" {
+		t.Errorf("PublishServiceChecks() host names = %q and %q, want the exporter host name and exporter-1", got[0].HostName, got[1].HostName)
+	}
+	if got[0].Status != ServiceCheckCritical || got[0].Tags[0] != "table_id:events" {
+		t.Errorf("PublishServiceChecks() sent %v, want %v", got[0], checks[0])
+	}
+	if checks[0].HostName != "" {
+		t.Errorf("PublishServiceChecks() modified the service checks passed to it")
+	}
+}
+
+func TestDatadogPublisher_PublishMetricsSet_Retry(t *testing.T) {
+	respond := func(statuses []int, header http.Header, calls *int) func(req *http.Request) (*http.Response, error) {
+		return func(req *http.Request) (*http.Response, error) {
+			status := statuses[len(statuses)-1]
+			if *calls < len(statuses) {
+				status = statuses[*calls]
+			}
+			*calls++
+
+			if body, _ := ioutil.ReadAll(req.Body); len(body) == 0 {
+				t.Errorf("Request %d was sent without a body", *calls)
+			}
+
+			return &http.Response{
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte(""))),
+				Header:     header,
+				StatusCode: status,
+			}, nil
+		}
+	}
+
+	retry := config.Retry{MaxAttempts: 3, InitialInterval: time.Second, MaxInterval: 10 * time.Second, MaxElapsedTime: time.Minute}
+	tests := []struct {
+		name      string
+		retry     config.Retry
+		statuses  []int
+		header    http.Header
+		wantCalls int
+		wantWaits []time.Duration
+		wantErr   error
+	}{
+		{
+			"succeeds after retries",
+			retry,
+			[]int{500, 503, 200},
+			nil,
+			3,
+			nil,
+			nil,
+		},
+		{
+			"attempts exhausted",
+			retry,
+			[]int{500},
+			nil,
+			3,
+			nil,
+			NewRecoverableError(errors.New("datadog series returned 500")),
+		},
+		{
+			"unrecoverable errors not retried",
+			retry,
+			[]int{400},
+			nil,
+			1,
+			nil,
+			NewUnrecoverableError(errors.New("datadog series returned 400")),
+		},
+		{
+			"retry after header honoured",
+			retry,
+			[]int{429, 200},
+			http.Header{"Retry-After": []string{"7"}},
+			2,
+			[]time.Duration{7 * time.Second},
+			nil,
+		},
+		{
+			"rate limit reset header honoured",
+			retry,
+			[]int{429, 200},
+			http.Header{"X-Ratelimit-Remaining": []string{"0"}, "X-Ratelimit-Reset": []string{"4"}},
+			2,
+			[]time.Duration{4 * time.Second},
+			nil,
+		},
+		{
+			"wait beyond max elapsed time not attempted",
+			config.Retry{MaxAttempts: 3, MaxElapsedTime: 5 * time.Second},
+			[]int{429, 200},
+			http.Header{"Retry-After": []string{"30"}},
+			1,
+			nil,
+			NewRecoverableError(errors.New("datadog series returned 429")),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			var waits []time.Duration
+			dp := &DatadogPublisher{
+				cfg:    &config.Config{DatadogRetry: tt.retry},
+				client: &mockHTTPClient{respond(tt.statuses, tt.header, &calls)},
+				wait: func(_ context.Context, d time.Duration) error {
+					waits = append(waits, d)
+					return nil
+				},
+			}
+			err := dp.PublishMetricsSet(context.TODO(), []Metric{{Metric: "value"}})
+			if fmt.Sprint(err) != fmt.Sprint(tt.wantErr) {
+				t.Errorf("PublishMetricsSet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("PublishMetricsSet() calls = %v, want %v", calls, tt.wantCalls)
+			}
+			if tt.wantWaits != nil && !reflect.DeepEqual(waits, tt.wantWaits) {
+				t.Errorf("PublishMetricsSet() waits = %v, want %v", waits, tt.wantWaits)
+			}
+		})
+	}
+}
+
+func TestDatadogPublisher_PublishMetricsSet_Deadline(t *testing.T) {
+	calls := 0
+	dp := &DatadogPublisher{
+		cfg: &config.Config{DatadogRetry: config.Retry{MaxAttempts: 5, InitialInterval: time.Minute}},
+		client: &mockHTTPClient{func(_ *http.Request) (*http.Response, error) {
+			calls++
+			return &http.Response{Body: ioutil.NopCloser(bytes.NewReader(nil)), StatusCode: 502}, nil
+		}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	want := NewRecoverableError(errors.New("datadog series returned 502"))
+	if err := dp.PublishMetricsSet(ctx, []Metric{{Metric: "value"}}); fmt.Sprint(err) != fmt.Sprint(want) {
+		t.Errorf("PublishMetricsSet() error = %v, wantErr %v", err, want)
+	}
+	if calls != 1 {
+		t.Errorf("PublishMetricsSet() calls = %v, want 1", calls)
+	}
+}
+
+func Test_retryAfter(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"no headers", http.Header{}, 0},
+		{"retry after seconds", http.Header{"Retry-After": []string{"12"}}, 12 * time.Second},
+		{"retry after date", http.Header{"Retry-After": []string{"Fri, 01 Jan 2021 12:00:30 GMT"}}, 30 * time.Second},
+		{"rate limit remaining", http.Header{"X-Ratelimit-Remaining": []string{"10"}, "X-Ratelimit-Reset": []string{"5"}}, 0},
+		{"rate limit exhausted", http.Header{"X-Ratelimit-Remaining": []string{"0"}, "X-Ratelimit-Reset": []string{"5"}}, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryAfter(tt.header, now); got != tt.want {
+				t.Errorf("retryAfter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -120,7 +120,8 @@ func (m *Metric) mergePoints(o *Metric) {
 
 // Producer can create new metrics
 type Producer struct {
-	config *config.Config
+	config   *config.Config
+	interval time.Duration
 }
 
 // NewProducer returns a metric Producer
@@ -128,13 +129,25 @@ func NewProducer(c *config.Config) Producer {
 	return Producer{config: c}
 }
 
+// WithInterval returns a Producer of metrics that are produced at the given
+// interval, rather than at the metric interval of the config
+func (p Producer) WithInterval(interval time.Duration) Producer {
+	p.interval = interval
+	return p
+}
+
 // Produce creates a metric from a given Reading, based on current configuration
 func (p *Producer) Produce(metric string, read Reading, tags []string) *Metric {
 	tags = append(tags, p.config.MetricTags...)
 	sort.Strings(tags)
 
+	interval := p.config.MetricInterval
+	if p.interval > 0 {
+		interval = p.interval
+	}
+
 	return &Metric{
-		Interval: uint64(p.config.MetricInterval.Seconds()),
+		Interval: uint64(interval.Seconds()),
 		Metric:   getFullMetricName(p.config.MetricPrefix, metric),
 		Points:   [][]float64{read.serialize()},
 		Tags:     tags,
@@ -142,6 +155,16 @@ func (p *Producer) Produce(metric string, read Reading, tags []string) *Metric {
 	}
 }
 
+// ProduceExporter creates a metric describing the exporter itself, named within
+// the exporter metrics namespace. It returns nil if exporter metrics are disabled
+func (p *Producer) ProduceExporter(metric string, read Reading, tags []string) *Metric {
+	if !p.config.ExporterMetrics.Enabled {
+		return nil
+	}
+
+	return p.Produce(getFullMetricName(p.config.ExporterMetrics.Namespace, metric), read, tags)
+}
+
 func getFullMetricName(prefix, metric string) string {
 	sb := strings.Builder{}
 	sb.WriteString(prefix)
@@ -172,16 +195,79 @@ func createPointmap(m *Metric) pointmap {
 // Consumer consumes metrics, storing them in an internal map and maintaining
 // a consistent view of currently unpublished metrics
 type Consumer struct {
-	mx      sync.Mutex
-	metrics map[string]*Metric
+	mx       sync.Mutex
+	metrics  map[string]*Metric
+	points   int
+	buffer   config.Buffer
+	dropped  uint64
+	reported uint64
+	spool    *Spool
+
+	// oldest, stalest and multi index the series of a bounded buffer
+	oldest  *seriesIndex
+	stalest *seriesIndex
+	multi   map[string]struct{}
 }
 
-// NewConsumer is a factory for creating a Consumer
+// NewConsumer is a factory for creating a Consumer with no limit on the
+// number of metrics it holds
 func NewConsumer() *Consumer {
+	return NewBoundedConsumer(config.Buffer{})
+}
+
+// NewBoundedConsumer is a factory for creating a Consumer that holds no more
+// points and series than the buffer limits, dropping points according to the
+// buffer drop policy when full
+func NewBoundedConsumer(buffer config.Buffer) *Consumer {
 	var metrics map[string]*Metric
 	metrics = make(map[string]*Metric)
 
-	return &Consumer{metrics: metrics}
+	return &Consumer{metrics: metrics, buffer: buffer}
+}
+
+// Dropped returns the total number of points dropped because the buffer was full
+func (c *Consumer) Dropped() uint64 {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	return c.dropped
+}
+
+// AttachSpool loads any metrics held in the spool into the consumer, and then
+// persists every metric consumed to the spool until it is published. It
+// returns the number of metrics loaded from the spool
+func (c *Consumer) AttachSpool(s *Spool) (int, error) {
+	loaded, err := s.Load()
+	if err != nil {
+		return 0, err
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	for i := range loaded {
+		c.store(&loaded[i])
+	}
+
+	c.spool = s
+	return len(loaded), s.Compact(c.getMetrics())
+}
+
+// Consume adds a metric to the consumer, to be published with the other
+// metrics consumed. The metric is written to the spool straight away
+func (c *Consumer) Consume(m *Metric) {
+	if m != nil {
+		c.consume(m)
+		c.writeSpool()
+	}
+}
+
+// Size returns the number of series and points currently held by the consumer
+func (c *Consumer) Size() (series, points int) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	return len(c.metrics), c.points
 }
 
 // Run will run the consumer, returning a channel to feed metrics into
@@ -197,6 +283,10 @@ func (c *Consumer) Run(ctx context.Context, wg *sync.WaitGroup) chan *Metric {
 			select {
 			case metric := <-receiver:
 				c.consume(metric)
+				c.consumeReady(receiver)
+				// Metrics are written to the spool once each batch has been
+				// consumed, so that a crash loses at most the batch in flight
+				c.writeSpool()
 			case <-ctx.Done():
 				close(receiver)
 				return
@@ -206,13 +296,27 @@ func (c *Consumer) Run(ctx context.Context, wg *sync.WaitGroup) chan *Metric {
 	return receiver
 }
 
+// consumeReady consumes the metrics that are ready to be received, returning
+// once none are waiting
+func (c *Consumer) consumeReady(receiver chan *Metric) {
+	for {
+		select {
+		case metric := <-receiver:
+			c.consume(metric)
+		default:
+			return
+		}
+	}
+}
+
 // Flush will return all currently consumed metrics and empty the metric buffer
 func (c *Consumer) Flush() []Metric {
 	c.mx.Lock()
 	defer c.mx.Unlock()
 
 	metrics := c.getMetrics()
-	c.metrics = make(map[string]*Metric)
+	c.clear()
+	c.compactSpool(nil)
 	return metrics
 }
 
@@ -220,6 +324,14 @@ type publisher interface {
 	PublishMetricsSet(context.Context, []Metric) error
 }
 
+// pendingPublisher is a publisher that retains metrics of its own to retry,
+// which are published by PublishPending even when there are no new metrics.
+// The retained metrics are kept in the spool until they are published
+type pendingPublisher interface {
+	PublishPending(context.Context) error
+	Pending() []Metric
+}
+
 // PublishTo will publish the metrics collected so far to the provided publisher
 // If a recoverable error is encountered, the metric buffer is not flushed so that
 // the metrics can be resent during the next publishing attempt
@@ -227,24 +339,99 @@ func (c *Consumer) PublishTo(ctx context.Context, pub publisher) error {
 	c.mx.Lock()
 	defer c.mx.Unlock()
 
+	if c.dropped > c.reported {
+		log.Warn().
+			Uint64("dropped_points", c.dropped-c.reported).
+			Uint64("dropped_points_total", c.dropped).
+			Msg("Metric buffer was full, points have been dropped")
+
+		c.reported = c.dropped
+	}
+
+	c.flushSpool()
 	metrics := c.getMetrics()
 	if len(metrics) == 0 {
 		log.Debug().
 			Int("metrics_count", 0).
 			Msg("No metrics to publish")
 
+		// The publisher may still hold metrics it failed to publish earlier,
+		// which would otherwise wait for new metrics or be lost at shutdown
+		if pp, ok := pub.(pendingPublisher); ok {
+			err := pp.PublishPending(ctx)
+			c.compactSpool(pub)
+			return err
+		}
 		return nil
 	}
 
 	err := pub.PublishMetricsSet(ctx, metrics)
 	if IsRecoverable(err) {
+		c.compactSpool(pub)
 		return fmt.Errorf("error publishing %d metrics, %w", len(metrics), err)
 	}
 
-	c.metrics = make(map[string]*Metric)
+	c.clear()
+	c.compactSpool(pub)
 	return err
 }
 
+// Close flushes and closes the spool attached to the consumer, if any
+func (c *Consumer) Close() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.spool == nil {
+		return nil
+	}
+	return c.spool.Close()
+}
+
+// writeSpool writes the metrics appended to the spool since it was last written
+func (c *Consumer) writeSpool() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.flushSpool()
+}
+
+// flushSpool writes the metrics appended to the spool to the file. The
+// consumer must be locked
+func (c *Consumer) flushSpool() {
+	if c.spool == nil {
+		return
+	}
+
+	if err := c.spool.Flush(); err != nil {
+		log.Err(err).Msg("Unable to write metrics to the spool")
+	}
+}
+
+// compactSpool rewrites the spool to hold only the metrics currently buffered,
+// along with any metrics the publisher has retained to retry. Retained metrics
+// are replayed to every publisher after a restart
+func (c *Consumer) compactSpool(pub publisher) {
+	if c.spool == nil {
+		return
+	}
+
+	metrics := c.getMetrics()
+	if pp, ok := pub.(pendingPublisher); ok {
+		metrics = append(metrics, pp.Pending()...)
+	}
+
+	if err := c.spool.Compact(metrics); err != nil {
+		log.Err(err).Msg("Unable to compact the metric spool")
+	}
+}
+
+// clear empties the buffer
+func (c *Consumer) clear() {
+	c.metrics = make(map[string]*Metric)
+	c.points = 0
+	c.oldest, c.stalest, c.multi = nil, nil, nil
+}
+
 func (c *Consumer) getMetrics() []Metric {
 	var metrics []Metric
 	metrics = make([]Metric, len(c.metrics))
@@ -262,9 +449,39 @@ func (c *Consumer) consume(m *Metric) {
 	c.mx.Lock()
 	defer c.mx.Unlock()
 
-	if _, ok := c.metrics[m.ID()]; ok {
-		c.metrics[m.ID()].mergePoints(m)
+	if m = c.store(m); m == nil || c.spool == nil {
+		return
+	}
+
+	if err := c.spool.Append(m); err != nil {
+		log.Err(err).Msg("Unable to write metric to the spool")
+	}
+}
+
+// store adds the metric to the buffer, returning the metric holding the
+// points that were accepted or nil if none were
+func (c *Consumer) store(m *Metric) *Metric {
+	if c.bounded() && c.buffer.DropPolicy == config.DropNewest {
+		if m = c.admit(m); m == nil {
+			return nil
+		}
+	}
+
+	n := 0
+	if cur, ok := c.metrics[m.ID()]; ok {
+		n = len(cur.Points)
+		cur.mergePoints(m)
+		c.points += len(cur.Points) - n
 	} else {
 		c.metrics[m.ID()] = m
+		c.points += len(m.Points)
 	}
+
+	if c.bounded() {
+		c.metrics[m.ID()].sortPoints(n)
+		c.index(m.ID())
+		c.trim()
+	}
+
+	return m
 }
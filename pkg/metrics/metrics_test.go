@@ -224,6 +224,38 @@ func Test_createPointMap(t *testing.T) {
 	}
 }
 
+func TestProducer_ProduceExporter(t *testing.T) {
+	enabled := &config.Config{
+		MetricPrefix:    "custom.gcp.bigquery",
+		MetricTags:      []string{"env:prod"},
+		ExporterMetrics: config.ExporterMetrics{Enabled: true, Namespace: "exporter"},
+	}
+	tests := []struct {
+		name   string
+		config *config.Config
+		want   *Metric
+	}{
+		{
+			name:   "exporter metrics enabled",
+			config: enabled,
+			want:   &Metric{Metric: "custom.gcp.bigquery.exporter.publish.failures", Points: [][]float64{{1600, 1}}, Tags: []string{"env:prod"}, Type: TypeGauge},
+		},
+		{
+			name:   "exporter metrics disabled",
+			config: &config.Config{MetricPrefix: "custom.gcp.bigquery"},
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProducer(tt.config)
+			if got := p.ProduceExporter("publish.failures", Reading{time.Unix(1600, 0), 1}, nil); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ProduceExporter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestProducer_Produce(t *testing.T) {
 	type fields struct {
 		config *config.Config
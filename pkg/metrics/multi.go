@@ -0,0 +1,209 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// ErrPartialPublish is returned when some publishers failed to accept metrics.
+// Metrics are retained by the MultiPublisher for the publishers that failed
+// with a recoverable error, and resent to only those publishers on the next
+// publishing attempt
+var ErrPartialPublish = errors.New("metrics were not accepted by every publisher")
+
+// Backend is a named destination that metrics are published to
+type Backend struct {
+	Name      string
+	Publisher publisher
+}
+
+// BackendStatus holds the outcome of publishing to a Backend
+type BackendStatus struct {
+	Name                string
+	LastSuccess         time.Time
+	LastFailure         time.Time
+	LastError           error
+	ConsecutiveFailures int
+}
+
+// MultiPublisher fans out slices of Metric to several publishers. Each
+// publisher has its own buffer, so that a publisher that fails with a
+// recoverable error is retried without resending metrics to the publishers
+// that have already accepted them
+type MultiPublisher struct {
+	mx       sync.Mutex
+	backends []Backend
+	pending  []*Consumer
+	status   []BackendStatus
+}
+
+// NewMultiPublisher returns a MultiPublisher publishing to the given backends,
+// with the buffer of each backend limited by the given buffer configuration
+func NewMultiPublisher(buffer config.Buffer, backends ...Backend) *MultiPublisher {
+	mp := &MultiPublisher{
+		backends: backends,
+		pending:  make([]*Consumer, len(backends)),
+		status:   make([]BackendStatus, len(backends)),
+	}
+
+	for i, b := range backends {
+		mp.pending[i] = NewBoundedConsumer(buffer)
+		mp.status[i] = BackendStatus{Name: b.Name}
+	}
+
+	return mp
+}
+
+// Backends returns the backends that metrics are published to
+func (mp *MultiPublisher) Backends() []Backend {
+	return mp.backends
+}
+
+// Status returns the publishing status of each backend
+func (mp *MultiPublisher) Status() []BackendStatus {
+	mp.mx.Lock()
+	defer mp.mx.Unlock()
+
+	status := make([]BackendStatus, len(mp.status))
+	copy(status, mp.status)
+	return status
+}
+
+// PublishMetricsSet publishes the metrics to every backend, along with any
+// metrics retained for the backend. Metrics are only retained for the backends
+// that failed with a recoverable error. The failure of a backend is recorded
+// in its status and ErrPartialPublish is returned, so that publishing to the
+// other backends carries on. An unrecoverable error is only returned if every
+// backend failed with one
+func (mp *MultiPublisher) PublishMetricsSet(ctx context.Context, metrics []Metric) error {
+	mp.mx.Lock()
+	defer mp.mx.Unlock()
+
+	errs := make([]error, len(mp.backends))
+	attempted := make([]bool, len(mp.backends))
+	wg := sync.WaitGroup{}
+	for i := range mp.backends {
+		for _, m := range metrics {
+			mp.pending[i].consume(m.copy())
+		}
+
+		// There is nothing to publish to a backend with no metrics retained
+		// when there are no new metrics
+		if series, _ := mp.pending[i].Size(); series == 0 {
+			continue
+		}
+
+		attempted[i] = true
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = mp.pending[i].PublishTo(ctx, mp.backends[i].Publisher)
+		}(i)
+	}
+	wg.Wait()
+
+	var failed, unrecoverable int
+	var firstUnrecoverable error
+	now := time.Now()
+	for i, err := range errs {
+		if !attempted[i] {
+			continue
+		}
+
+		status := &mp.status[i]
+		if err == nil {
+			status.LastSuccess = now
+			status.ConsecutiveFailures = 0
+			continue
+		}
+
+		failed++
+		status.LastFailure = now
+		status.LastError = err
+		status.ConsecutiveFailures++
+
+		log.Err(err).
+			Str("publisher", status.Name).
+			Int("consecutive_failures", status.ConsecutiveFailures).
+			Bool("retained", IsRecoverable(err)).
+			Msg("Error publishing metrics to publisher")
+
+		if !IsRecoverable(err) {
+			unrecoverable++
+			if firstUnrecoverable == nil {
+				firstUnrecoverable = fmt.Errorf("error publishing to %s: %w", status.Name, err)
+			}
+		}
+	}
+
+	switch {
+	case failed == 0:
+		return nil
+	case unrecoverable == len(mp.backends):
+		return firstUnrecoverable
+	default:
+		return ErrPartialPublish
+	}
+}
+
+// Pending returns the metrics retained for the backends that failed with a
+// recoverable error
+func (mp *MultiPublisher) Pending() []Metric {
+	mp.mx.Lock()
+	defer mp.mx.Unlock()
+
+	var metrics []Metric
+	for _, c := range mp.pending {
+		c.mx.Lock()
+		metrics = append(metrics, c.getMetrics()...)
+		c.mx.Unlock()
+	}
+	return metrics
+}
+
+// PublishPending publishes the metrics retained for the backends that failed
+// with a recoverable error, even though there are no new metrics to publish
+func (mp *MultiPublisher) PublishPending(ctx context.Context) error {
+	return mp.PublishMetricsSet(ctx, nil)
+}
+
+// PublishServiceChecks submits the service check results to every backend
+// that supports service checks. Service checks describe a point in time, so
+// they are not retained for backends that fail to accept them. The first
+// error from any backend is returned
+func (mp *MultiPublisher) PublishServiceChecks(ctx context.Context, checks []ServiceCheck) error {
+	var result error
+	for _, b := range mp.backends {
+		scp, ok := b.Publisher.(ServiceCheckPublisher)
+		if !ok {
+			continue
+		}
+
+		if err := scp.PublishServiceChecks(ctx, checks); err != nil {
+			log.Err(err).
+				Str("publisher", b.Name).
+				Msg("Error publishing service checks to publisher")
+
+			if result == nil {
+				result = fmt.Errorf("error publishing service checks to %s: %w", b.Name, err)
+			}
+		}
+	}
+
+	return result
+}
+
+func (m Metric) copy() *Metric {
+	points := make([][]float64, len(m.Points))
+	for i, point := range m.Points {
+		points[i] = append([]float64(nil), point...)
+	}
+	m.Points = points
+	m.Tags = append([]string(nil), m.Tags...)
+	return &m
+}
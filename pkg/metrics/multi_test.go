@@ -0,0 +1,183 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"reflect"
+	"testing"
+)
+
+type recordingPublisher struct {
+	errs      []error
+	call      int
+	published [][]Metric
+}
+
+func (r *recordingPublisher) PublishMetricsSet(_ context.Context, metrics []Metric) error {
+	r.published = append(r.published, metrics)
+	r.call++
+	if r.call <= len(r.errs) {
+		return r.errs[r.call-1]
+	}
+	return nil
+}
+
+type recordingCheckPublisher struct {
+	recordingPublisher
+	err    error
+	checks [][]ServiceCheck
+}
+
+func (r *recordingCheckPublisher) PublishServiceChecks(_ context.Context, checks []ServiceCheck) error {
+	r.checks = append(r.checks, checks)
+	return r.err
+}
+
+func TestMultiPublisher_PublishMetricsSet(t *testing.T) {
+	healthy := &recordingPublisher{}
+	flaky := &recordingPublisher{errs: []error{NewRecoverableError(errors.New("429 too many requests"))}}
+
+	mp := NewMultiPublisher(
+		config.Buffer{},
+		Backend{Name: "healthy", Publisher: healthy},
+		Backend{Name: "flaky", Publisher: flaky},
+	)
+
+	first := []Metric{{Metric: "row_count", Points: [][]float64{{1600, 1}}}}
+	err := mp.PublishMetricsSet(context.TODO(), first)
+	if err != ErrPartialPublish {
+		t.Errorf("PublishMetricsSet() error = %v, want %v", err, ErrPartialPublish)
+	}
+
+	second := []Metric{{Metric: "row_count", Points: [][]float64{{1660, 2}}}}
+	if err = mp.PublishMetricsSet(context.TODO(), second); err != nil {
+		t.Errorf("PublishMetricsSet() error = %v, want %v", err, nil)
+	}
+
+	wantHealthy := [][]Metric{first, second}
+	if !reflect.DeepEqual(healthy.published, wantHealthy) {
+		t.Errorf("healthy publisher got = %v, want %v", healthy.published, wantHealthy)
+	}
+
+	wantFlaky := [][]Metric{first, {{Metric: "row_count", Points: [][]float64{{1600, 1}, {1660, 2}}}}}
+	if !reflect.DeepEqual(flaky.published, wantFlaky) {
+		t.Errorf("flaky publisher got = %v, want %v", flaky.published, wantFlaky)
+	}
+
+	status := mp.Status()
+	if status[0].Name != "healthy" || status[0].ConsecutiveFailures != 0 || status[0].LastSuccess.IsZero() {
+		t.Errorf("healthy publisher status = %+v", status[0])
+	}
+	if status[1].Name != "flaky" || status[1].ConsecutiveFailures != 0 || status[1].LastFailure.IsZero() {
+		t.Errorf("flaky publisher status = %+v", status[1])
+	}
+}
+
+func TestMultiPublisher_PublishMetricsSet_unrecoverable(t *testing.T) {
+	broken := &recordingPublisher{errs: []error{NewUnrecoverableError(errors.New("403 forbidden"))}}
+	healthy := &recordingPublisher{}
+
+	mp := NewMultiPublisher(
+		config.Buffer{},
+		Backend{Name: "healthy", Publisher: healthy},
+		Backend{Name: "broken", Publisher: broken},
+	)
+
+	first := []Metric{{Metric: "row_count", Points: [][]float64{{1600, 1}}}}
+	err := mp.PublishMetricsSet(context.TODO(), first)
+	if err != ErrPartialPublish {
+		t.Errorf("PublishMetricsSet() error = %v, want %v", err, ErrPartialPublish)
+	}
+
+	status := mp.Status()
+	if status[1].ConsecutiveFailures != 1 || status[1].LastError == nil {
+		t.Errorf("broken publisher status = %+v", status[1])
+	}
+
+	second := []Metric{{Metric: "row_count", Points: [][]float64{{1660, 2}}}}
+	if err = mp.PublishMetricsSet(context.TODO(), second); err != nil {
+		t.Errorf("PublishMetricsSet() error = %v, want %v", err, nil)
+	}
+
+	if !reflect.DeepEqual(healthy.published, [][]Metric{first, second}) {
+		t.Errorf("healthy publisher got = %v, want %v", healthy.published, [][]Metric{first, second})
+	}
+	// Metrics are not retained after an unrecoverable error
+	if !reflect.DeepEqual(broken.published, [][]Metric{first, second}) {
+		t.Errorf("broken publisher got = %v, want %v", broken.published, [][]Metric{first, second})
+	}
+}
+
+func TestMultiPublisher_PublishMetricsSet_allUnrecoverable(t *testing.T) {
+	mp := NewMultiPublisher(
+		config.Buffer{},
+		Backend{Name: "datadog", Publisher: &recordingPublisher{errs: []error{NewUnrecoverableError(errors.New("403 forbidden"))}}},
+		Backend{Name: "datadog-eu", Publisher: &recordingPublisher{errs: []error{NewUnrecoverableError(errors.New("403 forbidden"))}}},
+	)
+
+	err := mp.PublishMetricsSet(context.TODO(), []Metric{{Metric: "row_count", Points: [][]float64{{1600, 1}}}})
+	if !IsUnrecoverable(err) {
+		t.Errorf("PublishMetricsSet() error = %v, want unrecoverable error", err)
+	}
+}
+
+func TestMultiPublisher_PublishPending(t *testing.T) {
+	healthy := &recordingPublisher{}
+	flaky := &recordingPublisher{errs: []error{NewRecoverableError(errors.New("503 unavailable"))}}
+
+	mp := NewMultiPublisher(
+		config.Buffer{},
+		Backend{Name: "healthy", Publisher: healthy},
+		Backend{Name: "flaky", Publisher: flaky},
+	)
+
+	metrics := []Metric{{Metric: "row_count", Points: [][]float64{{1600, 1}}}}
+	consumer := NewConsumer()
+	consumer.Consume(&Metric{Metric: "row_count", Points: [][]float64{{1600, 1}}})
+	if err := consumer.PublishTo(context.TODO(), mp); err != ErrPartialPublish {
+		t.Errorf("PublishTo() error = %v, want %v", err, ErrPartialPublish)
+	}
+
+	// Nothing new has been consumed, but the metrics retained for the flaky
+	// publisher are still resent
+	if err := consumer.PublishTo(context.TODO(), mp); err != nil {
+		t.Errorf("PublishTo() error = %v, want %v", err, nil)
+	}
+
+	if !reflect.DeepEqual(healthy.published, [][]Metric{metrics}) {
+		t.Errorf("healthy publisher got = %v, want %v", healthy.published, [][]Metric{metrics})
+	}
+	if !reflect.DeepEqual(flaky.published, [][]Metric{metrics, metrics}) {
+		t.Errorf("flaky publisher got = %v, want %v", flaky.published, [][]Metric{metrics, metrics})
+	}
+	if series, _ := mp.pending[1].Size(); series != 0 {
+		t.Errorf("flaky publisher still has %d series pending", series)
+	}
+}
+
+func TestMultiPublisher_PublishServiceChecks(t *testing.T) {
+	metricsOnly := &recordingPublisher{}
+	healthy := &recordingCheckPublisher{}
+	failing := &recordingCheckPublisher{err: NewRecoverableError(errors.New("503 service unavailable"))}
+
+	mp := NewMultiPublisher(
+		config.Buffer{},
+		Backend{Name: "prometheus", Publisher: metricsOnly},
+		Backend{Name: "datadog", Publisher: healthy},
+		Backend{Name: "datadog-eu", Publisher: failing},
+	)
+
+	checks := []ServiceCheck{{Check: "bigquery.table.freshness", Status: ServiceCheckOK}}
+	err := mp.PublishServiceChecks(context.TODO(), checks)
+	if err == nil || !IsRecoverable(err) {
+		t.Errorf("PublishServiceChecks() error = %v, want a recoverable error", err)
+	}
+
+	if !reflect.DeepEqual(healthy.checks, [][]ServiceCheck{checks}) || !reflect.DeepEqual(failing.checks, [][]ServiceCheck{checks}) {
+		t.Errorf("PublishServiceChecks() did not send the service checks to every supporting backend")
+	}
+	if len(metricsOnly.published) != 0 {
+		t.Errorf("PublishServiceChecks() published metrics to a backend without service checks")
+	}
+}
@@ -0,0 +1,294 @@
+package metrics
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// promStaleIntervals is the number of intervals a series can go without being
+// updated before it is removed from the endpoint, such as the series of a
+// table that has been deleted
+const promStaleIntervals = 5
+
+// PrometheusPublisher holds the latest reading of each published metric and
+// serves them in the Prometheus text exposition format
+type PrometheusPublisher struct {
+	mx     sync.RWMutex
+	series map[string]promSeries
+
+	// owners holds the ID of the metric exposed under each Prometheus name and
+	// label set, and collisions the collisions that have already been logged
+	owners     map[string]string
+	collisions map[string]bool
+
+	// now returns the current time, or is nil to use the system clock
+	now func() time.Time
+}
+
+type promSeries struct {
+	name      string
+	labels    string
+	timestamp float64
+	value     float64
+	updated   time.Time
+	maxAge    time.Duration
+}
+
+// stale returns whether the series has gone too long without being updated.
+// Series without an interval never go stale
+func (s promSeries) stale(now time.Time) bool {
+	return s.maxAge > 0 && now.Sub(s.updated) > s.maxAge
+}
+
+// NewPrometheusPublisher returns a new PrometheusPublisher
+func NewPrometheusPublisher() *PrometheusPublisher {
+	return &PrometheusPublisher{
+		series:     make(map[string]promSeries),
+		owners:     make(map[string]string),
+		collisions: make(map[string]bool),
+	}
+}
+
+func (pp *PrometheusPublisher) clock() time.Time {
+	if pp.now != nil {
+		return pp.now()
+	}
+	return time.Now()
+}
+
+// PublishMetricsSet stores the latest reading of each metric so that it is
+// returned on the next scrape of the endpoint. Series that have not been
+// updated for several of their intervals are removed. Metrics that would be
+// exposed with the same name and labels as another metric, because their
+// names or tags only differ in characters that are not valid in Prometheus,
+// are dropped so the series already exposed is not overwritten
+func (pp *PrometheusPublisher) PublishMetricsSet(_ context.Context, metrics []Metric) error {
+	pp.mx.Lock()
+	defer pp.mx.Unlock()
+
+	log.Debug().
+		Int("metrics_count", len(metrics)).
+		Msg("Updating metrics for prometheus endpoint")
+
+	// Metrics are handled in order of ID, so the same metric of a collision is
+	// kept however the metrics are ordered
+	ids := make([]string, len(metrics))
+	order := make([]int, len(metrics))
+	for i := range metrics {
+		ids[i] = metrics[i].ID()
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return ids[order[i]] < ids[order[j]] })
+
+	now := pp.clock()
+	for _, i := range order {
+		m, id := metrics[i], ids[i]
+		latest, ok := latestPoint(m.Points)
+		if !ok {
+			continue
+		}
+
+		name := promMetricName(m.Metric)
+		labels, dropped := promLabels(m.Tags)
+		if len(dropped) > 0 {
+			pp.logCollision(id, strings.Join(dropped, ","), "Dropped tags that collide with another tag as Prometheus labels")
+		}
+
+		if owner, ok := pp.owners[name+labels]; ok && owner != id {
+			pp.logCollision(id, owner, "Dropped metric that collides with another metric as a Prometheus series")
+			continue
+		}
+
+		if existing, ok := pp.series[id]; ok && existing.timestamp > latest[0] {
+			continue
+		}
+
+		pp.owners[name+labels] = id
+		pp.series[id] = promSeries{
+			name:      name,
+			labels:    labels,
+			timestamp: latest[0],
+			value:     latest[1],
+			updated:   now,
+			maxAge:    promStaleIntervals * time.Duration(m.Interval) * time.Second,
+		}
+	}
+
+	for id, s := range pp.series {
+		if s.stale(now) {
+			delete(pp.series, id)
+			delete(pp.owners, s.name+s.labels)
+		}
+	}
+
+	return nil
+}
+
+// logCollision logs that part or all of a metric was dropped because it
+// collided with something else, once for each collision
+func (pp *PrometheusPublisher) logCollision(id, with, msg string) {
+	key := id + "|" + with
+	if pp.collisions[key] {
+		return
+	}
+	pp.collisions[key] = true
+
+	log.Warn().
+		Str("metric_id", id).
+		Str("collides_with", with).
+		Msg(msg)
+}
+
+// Handler will handle HTTP requests to the Prometheus metrics endpoint
+func (pp *PrometheusPublisher) Handler(w http.ResponseWriter, _ *http.Request) {
+	pp.mx.RLock()
+	now := pp.clock()
+	series := make([]promSeries, 0, len(pp.series))
+	for _, s := range pp.series {
+		if !s.stale(now) {
+			series = append(series, s)
+		}
+	}
+	pp.mx.RUnlock()
+
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+		return series[i].labels < series[j].labels
+	})
+
+	sb := strings.Builder{}
+	for i, s := range series {
+		if i == 0 || series[i-1].name != s.name {
+			sb.WriteString("# TYPE ")
+			sb.WriteString(s.name)
+			sb.WriteString(" gauge\n")
+		}
+		sb.WriteString(s.name)
+		sb.WriteString(s.labels)
+		sb.WriteRune(' ')
+		sb.WriteString(strconv.FormatFloat(s.value, 'g', -1, 64))
+		sb.WriteRune('\n')
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte(sb.String())); err != nil {
+		log.Err(err).Msg("error when writing prometheus http response")
+	}
+}
+
+func latestPoint(points [][]float64) ([]float64, bool) {
+	var latest []float64
+	for _, point := range points {
+		if len(point) != 2 {
+			continue
+		}
+
+		if latest == nil || point[0] >= latest[0] {
+			latest = point
+		}
+	}
+	return latest, latest != nil
+}
+
+// promMetricName converts a dotted metric name into a valid Prometheus metric name
+func promMetricName(name string) string {
+	return sanitisePromName(name, true)
+}
+
+// promLabels converts a list of key:value tags into a Prometheus label set.
+// Tags without a value are given the value "true", and repeated keys have their
+// values joined with a comma. Different keys that sanitise to the same label
+// name, such as a.b and a_b, are not merged. Only the first key in sorted order
+// is kept, and the tags of the others are returned as dropped
+func promLabels(tags []string) (string, []string) {
+	if len(tags) == 0 {
+		return "", nil
+	}
+
+	kept := make(map[string]string)
+	for _, tag := range tags {
+		orig := strings.SplitN(tag, ":", 2)[0]
+		key := sanitisePromName(orig, false)
+		if first, ok := kept[key]; !ok || orig < first {
+			kept[key] = orig
+		}
+	}
+
+	var dropped []string
+	values := make(map[string][]string)
+	for _, tag := range tags {
+		kv := strings.SplitN(tag, ":", 2)
+		key := sanitisePromName(kv[0], false)
+		if key == "" {
+			continue
+		}
+		if kv[0] != kept[key] {
+			dropped = append(dropped, tag)
+			continue
+		}
+
+		val := "true"
+		if len(kv) == 2 {
+			val = kv[1]
+		}
+		values[key] = append(values[key], val)
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sb := strings.Builder{}
+	sb.WriteRune('{')
+	for i, key := range keys {
+		if i > 0 {
+			sb.WriteRune(',')
+		}
+		sort.Strings(values[key])
+		sb.WriteString(key)
+		sb.WriteString("=\"")
+		sb.WriteString(escapePromLabelValue(strings.Join(values[key], ",")))
+		sb.WriteRune('"')
+	}
+	sb.WriteRune('}')
+	return sb.String(), dropped
+}
+
+// sanitisePromName replaces characters that are not valid in a Prometheus
+// metric or label name with underscores. Colons are only valid in metric names
+func sanitisePromName(name string, allowColon bool) string {
+	sb := strings.Builder{}
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+			sb.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				sb.WriteRune('_')
+			}
+			sb.WriteRune(r)
+		case r == ':' && allowColon:
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('_')
+		}
+	}
+	return sb.String()
+}
+
+var promLabelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapePromLabelValue(val string) string {
+	return promLabelValueReplacer.Replace(val)
+}
@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_promMetricName(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  string
+		want string
+	}{
+		{"dotted name", "custom.gcp.bigquery.table.row_count", "custom_gcp_bigquery_table_row_count"},
+		{"leading digit", "2xx.count", "_2xx_count"},
+		{"invalid characters", "custom-metric.my metric", "custom_metric_my_metric"},
+		{"colon allowed", "custom:metric", "custom:metric"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := promMetricName(tt.arg); got != tt.want {
+				t.Errorf("promMetricName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_promLabels(t *testing.T) {
+	tests := []struct {
+		name        string
+		arg         []string
+		want        string
+		wantDropped []string
+	}{
+		{"no tags", nil, "", nil},
+		{"key value tags", []string{"table_id:my-table", "dataset_id:my_dataset"}, `{dataset_id="my_dataset",table_id="my-table"}`, nil},
+		{"tag without value", []string{"production"}, `{production="true"}`, nil},
+		{"value containing colon", []string{"url:https://example.com"}, `{url="https://example.com"}`, nil},
+		{"invalid key characters", []string{"team.name:data-eng", "1st:yes"}, `{_1st="yes",team_name="data-eng"}`, nil},
+		{"repeated key", []string{"env:prod", "env:eu"}, `{env="eu,prod"}`, nil},
+		{"escaped value", []string{`sql:SELECT "a\b"`}, `{sql="SELECT \"a\\b\""}`, nil},
+		{"colliding keys", []string{"team_name:web", "team.name:data", "team.name:eng"}, `{team_name="data,eng"}`, []string{"team_name:web"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, dropped := promLabels(tt.arg)
+			if got != tt.want {
+				t.Errorf("promLabels() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(dropped, tt.wantDropped) {
+				t.Errorf("promLabels() dropped = %v, want %v", dropped, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestPrometheusPublisher_Handler(t *testing.T) {
+	pp := NewPrometheusPublisher()
+
+	err := pp.PublishMetricsSet(context.TODO(), []Metric{
+		{Metric: "custom.table.row_count", Points: [][]float64{{1600, 10}, {1660, 20}}, Tags: []string{"table_id:b"}},
+		{Metric: "custom.table.row_count", Points: [][]float64{{1600, 5}}, Tags: []string{"table_id:a"}},
+		{Metric: "custom.table.last_modified", Points: [][]float64{{1600, 30}}, Tags: []string{"table_id:a"}},
+	})
+	if err != nil {
+		t.Fatalf("PublishMetricsSet() error = %v", err)
+	}
+
+	err = pp.PublishMetricsSet(context.TODO(), []Metric{
+		{Metric: "custom.table.row_count", Points: [][]float64{{1600, 15}}, Tags: []string{"table_id:b"}},
+		{Metric: "custom.table.last_modified", Points: [][]float64{{1720, 90}}, Tags: []string{"table_id:a"}},
+	})
+	if err != nil {
+		t.Fatalf("PublishMetricsSet() error = %v", err)
+	}
+
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(pp.Handler).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	want := "# TYPE custom_table_last_modified gauge\n" +
+		"custom_table_last_modified{table_id=\"a\"} 90\n" +
+		"# TYPE custom_table_row_count gauge\n" +
+		"custom_table_row_count{table_id=\"a\"} 5\n" +
+		"custom_table_row_count{table_id=\"b\"} 20\n"
+	if rr.Body.String() != want {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), want)
+	}
+}
+
+func TestPrometheusPublisher_collisions(t *testing.T) {
+	pp := NewPrometheusPublisher()
+
+	// The metrics are exposed as the same series, so only the first by ID is kept
+	for _, metrics := range [][]Metric{
+		{
+			{Metric: "custom.table_count", Points: [][]float64{{1600, 2}}, Tags: []string{"env:prod"}},
+			{Metric: "custom.table.count", Points: [][]float64{{1600, 1}}, Tags: []string{"env:prod"}},
+		},
+		{
+			{Metric: "custom.table_count", Points: [][]float64{{1660, 4}}, Tags: []string{"env:prod"}},
+			{Metric: "custom.table.count", Points: [][]float64{{1660, 3}}, Tags: []string{"env:prod"}},
+		},
+	} {
+		if err := pp.PublishMetricsSet(context.TODO(), metrics); err != nil {
+			t.Fatalf("PublishMetricsSet() error = %v", err)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	pp.Handler(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := "# TYPE custom_table_count gauge\n" +
+		"custom_table_count{env=\"prod\"} 3\n"
+	if rr.Body.String() != want {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), want)
+	}
+}
+
+func TestPrometheusPublisher_staleSeries(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	pp := NewPrometheusPublisher()
+	pp.now = func() time.Time { return now }
+
+	err := pp.PublishMetricsSet(context.TODO(), []Metric{
+		{Interval: 60, Metric: "custom.table.row_count", Points: [][]float64{{1600, 10}}, Tags: []string{"table_id:deleted"}},
+		{Interval: 60, Metric: "custom.table.row_count", Points: [][]float64{{1600, 20}}, Tags: []string{"table_id:kept"}},
+		{Interval: 86400, Metric: "custom.custom_metric.daily", Points: [][]float64{{1600, 30}}},
+	})
+	if err != nil {
+		t.Fatalf("PublishMetricsSet() error = %v", err)
+	}
+
+	// Only the kept table is updated over the following intervals
+	for i := 0; i < 6; i++ {
+		now = now.Add(time.Minute)
+		err = pp.PublishMetricsSet(context.TODO(), []Metric{
+			{Interval: 60, Metric: "custom.table.row_count", Points: [][]float64{{1660, 20}}, Tags: []string{"table_id:kept"}},
+		})
+		if err != nil {
+			t.Fatalf("PublishMetricsSet() error = %v", err)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	pp.Handler(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := "# TYPE custom_custom_metric_daily gauge\n" +
+		"custom_custom_metric_daily 30\n" +
+		"# TYPE custom_table_row_count gauge\n" +
+		"custom_table_row_count{table_id=\"kept\"} 20\n"
+	if rr.Body.String() != want {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), want)
+	}
+	if _, ok := pp.series["custom.table.row_count;table_id:deleted"]; ok {
+		t.Errorf("PublishMetricsSet() kept the stale series of a deleted table")
+	}
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// ServiceCheckStatus is the status of a Datadog service check
+type ServiceCheckStatus int
+
+const (
+	// ServiceCheckOK is the status of a passing service check
+	ServiceCheckOK ServiceCheckStatus = 0
+
+	// ServiceCheckWarning is the status of a service check close to failing
+	ServiceCheckWarning ServiceCheckStatus = 1
+
+	// ServiceCheckCritical is the status of a failing service check
+	ServiceCheckCritical ServiceCheckStatus = 2
+
+	// ServiceCheckUnknown is the status of a service check that could not be evaluated
+	ServiceCheckUnknown ServiceCheckStatus = 3
+)
+
+// String returns the name of the status as shown by Datadog
+func (s ServiceCheckStatus) String() string {
+	switch s {
+	case ServiceCheckOK:
+		return "OK"
+	case ServiceCheckWarning:
+		return "WARNING"
+	case ServiceCheckCritical:
+		return "CRITICAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// ServiceCheck represents the result of a service check to submit
+type ServiceCheck struct {
+	Check     string             `json:"check"`
+	HostName  string             `json:"host_name"`
+	Status    ServiceCheckStatus `json:"status"`
+	Timestamp int64              `json:"timestamp"`
+	Message   string             `json:"message,omitempty"`
+	Tags      []string           `json:"tags"`
+}
+
+// ServiceCheckPublisher is a publisher that can also submit service check results
+type ServiceCheckPublisher interface {
+	PublishServiceChecks(context.Context, []ServiceCheck) error
+}
+
+// ProduceServiceCheck creates a service check result, named and tagged in
+// the same way as the metrics created by the Producer
+func (p *Producer) ProduceServiceCheck(check string, status ServiceCheckStatus, message string, tags []string) *ServiceCheck {
+	tags = append(tags, p.config.MetricTags...)
+	sort.Strings(tags)
+
+	return &ServiceCheck{
+		Check:     getFullMetricName(p.config.MetricPrefix, check),
+		Status:    status,
+		Timestamp: time.Now().Unix(),
+		Message:   message,
+		Tags:      tags,
+	}
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"reflect"
+	"testing"
+)
+
+func TestProducer_ProduceServiceCheck(t *testing.T) {
+	p := NewProducer(&config.Config{MetricPrefix: "custom.gcp.bigquery", MetricTags: []string{"env:prod"}})
+
+	got := p.ProduceServiceCheck("table.freshness", ServiceCheckWarning, "stale", []string{"table_id:events"})
+	if got.Check != "custom.gcp.bigquery.table.freshness" {
+		t.Errorf("ProduceServiceCheck() check = %v, want %v", got.Check, "custom.gcp.bigquery.table.freshness")
+	}
+	if got.Status != ServiceCheckWarning {
+		t.Errorf("ProduceServiceCheck() status = %v, want %v", got.Status, ServiceCheckWarning)
+	}
+	if want := []string{"env:prod", "table_id:events"}; !reflect.DeepEqual(got.Tags, want) {
+		t.Errorf("ProduceServiceCheck() tags = %v, want %v", got.Tags, want)
+	}
+	if got.Timestamp == 0 {
+		t.Errorf("ProduceServiceCheck() timestamp was not set")
+	}
+}
+
+func TestServiceCheckStatus_String(t *testing.T) {
+	tests := []struct {
+		status ServiceCheckStatus
+		want   string
+	}{
+		{ServiceCheckOK, "OK"},
+		{ServiceCheckWarning, "WARNING"},
+		{ServiceCheckCritical, "CRITICAL"},
+		{ServiceCheckUnknown, "UNKNOWN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := tt.status.String(); got != tt.want {
+				t.Errorf("String() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
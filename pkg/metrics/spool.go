@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Spool persists metrics to a file on disk as lines of JSON, so that
+// unpublished metrics survive a restart of the process. Appended metrics are
+// buffered in memory until the spool is flushed
+type Spool struct {
+	mx     sync.Mutex
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// OpenSpool opens the spool file at the given path, creating it and its
+// directory if they do not exist
+func OpenSpool(path string) (*Spool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, fmt.Errorf("error creating spool directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("error opening spool file: %w", err)
+	}
+
+	return &Spool{path: path, file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// Append writes a metric to the end of the spool. The metric is not written
+// to the file until the spool is flushed
+func (s *Spool) Append(m *Metric) error {
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	_, err = s.writer.Write(append(line, '\n'))
+	return err
+}
+
+// Flush writes the metrics appended since the last flush to the file
+func (s *Spool) Flush() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if err := s.writer.Flush(); err != nil {
+		return fmt.Errorf("error writing spool file: %w", err)
+	}
+	return nil
+}
+
+// Load reads every metric held in the spool. Lines that cannot be read, such
+// as one left partially written by a crash, are skipped
+func (s *Spool) Load() ([]Metric, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading spool file: %w", err)
+	}
+	defer file.Close()
+
+	metrics := make([]Metric, 0)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var m Metric
+			if jerr := json.Unmarshal(line, &m); jerr != nil {
+				log.Warn().Err(jerr).Str("spool", s.path).Msg("Skipping unreadable metric in spool")
+			} else {
+				metrics = append(metrics, m)
+			}
+		}
+
+		if err == io.EOF {
+			return metrics, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading spool file: %w", err)
+		}
+	}
+}
+
+// Compact replaces the contents of the spool with the given metrics, which
+// supersede any appended metrics that have not been flushed. The new contents
+// are written to a temporary file which then replaces the spool, so the spool
+// is never left partially written
+func (s *Spool) Compact(metrics []Metric) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("error compacting spool file: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	enc := json.NewEncoder(writer)
+	for i := range metrics {
+		if err = enc.Encode(&metrics[i]); err != nil {
+			_ = file.Close()
+			return fmt.Errorf("error compacting spool file: %w", err)
+		}
+	}
+
+	if err = writer.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("error compacting spool file: %w", err)
+	}
+
+	if err = os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("error compacting spool file: %w", err)
+	}
+
+	_ = s.file.Close()
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("error opening spool file: %w", err)
+	}
+	s.writer.Reset(s.file)
+
+	return nil
+}
+
+// Close flushes any appended metrics and closes the spool file
+func (s *Spool) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	err := s.writer.Flush()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,242 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSpool(t *testing.T) (*Spool, string) {
+	dir, err := ioutil.TempDir("", "bqmetrics-spool")
+	if err != nil {
+		t.Fatalf("error creating spool directory: %s", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "spool", "spool.jsonl")
+	s, err := OpenSpool(path)
+	if err != nil {
+		t.Fatalf("OpenSpool() error = %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	return s, path
+}
+
+func TestSpool_AppendLoad(t *testing.T) {
+	s, path := newTestSpool(t)
+
+	first := &Metric{Metric: "row_count", Points: [][]float64{{1600, 1}}, Tags: []string{"env:prod"}, Type: TypeGauge}
+	second := &Metric{Metric: "size_bytes", Points: [][]float64{{1600, 2}}, Type: TypeGauge}
+	for _, m := range []*Metric{first, second} {
+		if err := s.Append(m); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		t.Fatalf("error opening spool: %s", err)
+	}
+	_, _ = f.WriteString("{\"metric\":\"trunc")
+	_ = f.Close()
+
+	got, err := s.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	want := []Metric{*first, *second}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Load() got = %v, want %v", got, want)
+	}
+}
+
+func TestSpool_Compact(t *testing.T) {
+	s, _ := newTestSpool(t)
+
+	_ = s.Append(&Metric{Metric: "row_count", Points: [][]float64{{1600, 1}}})
+	kept := []Metric{{Metric: "size_bytes", Points: [][]float64{{1600, 2}}}}
+	if err := s.Compact(kept); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+
+	appended := Metric{Metric: "row_count", Points: [][]float64{{1660, 3}}}
+	_ = s.Append(&appended)
+	_ = s.Flush()
+
+	got, err := s.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	want := append(kept, appended)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Load() got = %v, want %v", got, want)
+	}
+}
+
+func TestConsumer_AttachSpool(t *testing.T) {
+	s, path := newTestSpool(t)
+
+	c := NewConsumer()
+	if _, err := c.AttachSpool(s); err != nil {
+		t.Fatalf("AttachSpool() error = %v", err)
+	}
+
+	c.consume(&Metric{Metric: "row_count", Points: [][]float64{{1600, 1}}})
+	c.consume(&Metric{Metric: "row_count", Points: [][]float64{{1660, 2}}})
+
+	err := c.PublishTo(context.Background(), mockPublisher{err: NewRecoverableError(errors.New("500 internal server error"))})
+	if !IsRecoverable(err) {
+		t.Fatalf("PublishTo() error = %v, want recoverable error", err)
+	}
+	_ = s.Close()
+
+	// A new consumer replays the spool as if the process had restarted
+	restarted, err := OpenSpool(path)
+	if err != nil {
+		t.Fatalf("OpenSpool() error = %v", err)
+	}
+	defer restarted.Close()
+
+	c = NewConsumer()
+	loaded, err := c.AttachSpool(restarted)
+	if err != nil {
+		t.Fatalf("AttachSpool() error = %v", err)
+	}
+	if loaded != 1 {
+		t.Errorf("AttachSpool() loaded = %v, want %v", loaded, 1)
+	}
+
+	want := []Metric{{Metric: "row_count", Points: [][]float64{{1600, 1}, {1660, 2}}}}
+	pub := mockPublisher{expected: want}
+	if err = c.PublishTo(context.Background(), pub); err != nil {
+		t.Errorf("PublishTo() error = %v", err)
+	}
+
+	got, err := restarted.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("Load() after publish got = %v, want empty spool", got)
+	}
+}
+
+func TestSpool_Flush(t *testing.T) {
+	s, path := newTestSpool(t)
+
+	m := Metric{Metric: "row_count", Points: [][]float64{{1600, 1}}}
+	_ = s.Append(&m)
+
+	got, _ := s.Load()
+	if len(got) != 0 {
+		t.Errorf("Load() before Flush() got = %v, want empty spool", got)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// Closing the spool flushes the metrics appended to it
+	restarted, err := OpenSpool(path)
+	if err != nil {
+		t.Fatalf("OpenSpool() error = %v", err)
+	}
+	defer restarted.Close()
+
+	got, err = restarted.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, []Metric{m}) {
+		t.Errorf("Load() got = %v, want %v", got, []Metric{m})
+	}
+}
+
+func TestConsumer_AttachSpool_partialPublish(t *testing.T) {
+	s, _ := newTestSpool(t)
+
+	c := NewConsumer()
+	if _, err := c.AttachSpool(s); err != nil {
+		t.Fatalf("AttachSpool() error = %v", err)
+	}
+
+	mp := NewMultiPublisher(
+		config.Buffer{},
+		Backend{Name: "healthy", Publisher: &recordingPublisher{}},
+		Backend{Name: "flaky", Publisher: &recordingPublisher{errs: []error{NewRecoverableError(errors.New("503 unavailable"))}}},
+	)
+
+	m := Metric{Metric: "row_count", Points: [][]float64{{1600, 1}}}
+	c.Consume(&Metric{Metric: m.Metric, Points: m.Points})
+	if err := c.PublishTo(context.Background(), mp); err != ErrPartialPublish {
+		t.Fatalf("PublishTo() error = %v, want %v", err, ErrPartialPublish)
+	}
+
+	// The metrics retained for the flaky publisher are kept in the spool
+	got, err := s.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, []Metric{m}) {
+		t.Errorf("Load() got = %v, want %v", got, []Metric{m})
+	}
+
+	if err = c.PublishTo(context.Background(), mp); err != nil {
+		t.Fatalf("PublishTo() error = %v", err)
+	}
+	if got, _ = s.Load(); len(got) != 0 {
+		t.Errorf("Load() after publish got = %v, want empty spool", got)
+	}
+}
+
+func TestConsumer_Run_writesSpool(t *testing.T) {
+	s, path := newTestSpool(t)
+
+	c := NewConsumer()
+	if _, err := c.AttachSpool(s); err != nil {
+		t.Fatalf("AttachSpool() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	receiver := c.Run(ctx, &wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	receiver <- &Metric{Metric: "row_count", Points: [][]float64{{1600, 1}}}
+	receiver <- &Metric{Metric: "size_bytes", Points: [][]float64{{1600, 2}}}
+
+	// The metrics are written to the file without waiting for a publish, as
+	// if the process crashed before publishing them
+	var got []Metric
+	for deadline := time.Now().Add(time.Second); len(got) < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		crashed, err := OpenSpool(path)
+		if err != nil {
+			t.Fatalf("OpenSpool() error = %v", err)
+		}
+		if got, err = crashed.Load(); err != nil {
+			t.Fatalf("Load() error = %v", err)
+		}
+		_ = crashed.Close()
+	}
+
+	if len(got) != 2 {
+		t.Errorf("Load() before publishing got = %v, want both metrics consumed", got)
+	}
+}
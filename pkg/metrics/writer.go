@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// WriterPublisher writes slices of Metric to an io.Writer instead of
+// publishing them, so that the metrics can be inspected
+type WriterPublisher struct {
+	mx     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// NewWriterPublisher returns a WriterPublisher writing metrics in the given
+// format, one of config.OutputTable, config.OutputJSON or config.OutputNDJSON
+func NewWriterPublisher(w io.Writer, format string) *WriterPublisher {
+	return &WriterPublisher{w: w, format: format}
+}
+
+// PublishMetricsSet writes the metrics, ordered by metric name and tags
+func (wp *WriterPublisher) PublishMetricsSet(_ context.Context, metrics []Metric) error {
+	sorted := make([]Metric, len(metrics))
+	copy(sorted, metrics)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID() < sorted[j].ID() })
+
+	wp.mx.Lock()
+	defer wp.mx.Unlock()
+
+	var err error
+	switch wp.format {
+	case config.OutputJSON:
+		err = wp.writeJSON(sorted)
+	case config.OutputNDJSON:
+		err = wp.writeNDJSON(sorted)
+	default:
+		err = wp.writeTable(sorted)
+	}
+
+	if err != nil {
+		return NewUnrecoverableError(err)
+	}
+	return nil
+}
+
+func (wp *WriterPublisher) writeJSON(metrics []Metric) error {
+	enc := json.NewEncoder(wp.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(metrics)
+}
+
+func (wp *WriterPublisher) writeNDJSON(metrics []Metric) error {
+	enc := json.NewEncoder(wp.w)
+	for i := range metrics {
+		if err := enc.Encode(&metrics[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wp *WriterPublisher) writeTable(metrics []Metric) error {
+	tw := tabwriter.NewWriter(wp.w, 0, 4, 2, ' ', 0)
+	if _, err := fmt.Fprintln(tw, "METRIC\tTAGS\tTIMESTAMP\tVALUE"); err != nil {
+		return err
+	}
+
+	for _, m := range metrics {
+		for _, point := range m.Points {
+			if len(point) != 2 {
+				continue
+			}
+
+			ts := time.Unix(int64(point[0]), 0).UTC().Format(time.RFC3339)
+			val := strconv.FormatFloat(point[1], 'f', -1, 64)
+			if _, err := fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.Metric, strings.Join(m.Tags, ","), ts, val); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"testing"
+)
+
+func TestWriterPublisher_PublishMetricsSet(t *testing.T) {
+	metrics := []Metric{
+		{Metric: "table.size_bytes", Points: [][]float64{{1609459200, 2048}}, Tags: []string{"table_id:b"}, Type: TypeGauge},
+		{Interval: 60, Metric: "table.row_count", Points: [][]float64{{1609459200, 10}, {1609459260, 12.5}}, Tags: []string{"env:prod", "table_id:a"}, Type: TypeGauge},
+	}
+
+	tests := []struct {
+		name   string
+		format string
+		want   string
+	}{
+		{
+			"table",
+			config.OutputTable,
+			"METRIC            TAGS                 TIMESTAMP             VALUE\n" +
+				"table.row_count   env:prod,table_id:a  2021-01-01T00:00:00Z  10\n" +
+				"table.row_count   env:prod,table_id:a  2021-01-01T00:01:00Z  12.5\n" +
+				"table.size_bytes  table_id:b           2021-01-01T00:00:00Z  2048\n",
+		},
+		{
+			"json",
+			config.OutputJSON,
+			"[\n" +
+				"  {\n    \"interval\": 60,\n    \"metric\": \"table.row_count\",\n    \"points\": [\n      [\n        1609459200,\n        10\n      ],\n      [\n        1609459260,\n        12.5\n      ]\n    ],\n    \"tags\": [\n      \"env:prod\",\n      \"table_id:a\"\n    ],\n    \"type\": \"gauge\"\n  },\n" +
+				"  {\n    \"interval\": 0,\n    \"metric\": \"table.size_bytes\",\n    \"points\": [\n      [\n        1609459200,\n        2048\n      ]\n    ],\n    \"tags\": [\n      \"table_id:b\"\n    ],\n    \"type\": \"gauge\"\n  }\n" +
+				"]\n",
+		},
+		{
+			"ndjson",
+			config.OutputNDJSON,
+			"{\"interval\":60,\"metric\":\"table.row_count\",\"points\":[[1609459200,10],[1609459260,12.5]],\"tags\":[\"env:prod\",\"table_id:a\"],\"type\":\"gauge\"}\n" +
+				"{\"interval\":0,\"metric\":\"table.size_bytes\",\"points\":[[1609459200,2048]],\"tags\":[\"table_id:b\"],\"type\":\"gauge\"}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			wp := NewWriterPublisher(buf, tt.format)
+			if err := wp.PublishMetricsSet(context.TODO(), metrics); err != nil {
+				t.Fatalf("PublishMetricsSet() error = %v", err)
+			}
+
+			if got := buf.String(); got != tt.want {
+				t.Errorf("PublishMetricsSet() got =\n%v\nwant =\n%v", got, tt.want)
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
 	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
 	"github.com/rs/zerolog/log"
+	bqv2 "google.golang.org/api/bigquery/v2"
 	"google.golang.org/api/iterator"
 	"sync"
 	"time"
@@ -17,9 +18,27 @@ import (
 type Generator struct {
 	cfg      *config.Config
 	client   bq.Client
+	projects []projectSource
+	storage  tableStorageClient
+	filter   *tableFilter
+	api      *apiCaller
+	cache    *metadataCache
 	producer metrics.Producer
 }
 
+// projectSource is a GCP project to collect table metrics from, along with a
+// BigQuery client for that project
+type projectSource struct {
+	project config.Project
+	client  bq.Client
+}
+
+// tableStorageClient can look up table storage details that are not exposed
+// through the BigQuery client library's table metadata
+type tableStorageClient interface {
+	PhysicalBytes(ctx context.Context, projectID, datasetID, tableID string) (int64, error)
+}
+
 // NewGenerator returns a new BigQuery metrics Generator
 func NewGenerator(ctx context.Context, cfg *config.Config) (*Generator, error) {
 	client, err := bigquery.NewClient(ctx, cfg.GcpProject)
@@ -27,29 +46,255 @@ func NewGenerator(ctx context.Context, cfg *config.Config) (*Generator, error) {
 		return nil, fmt.Errorf("error creating BigQuery client: %w", err)
 	}
 
-	return &Generator{
+	filter, err := newTableFilter(cfg.TableFilter)
+	if err != nil {
+		return nil, fmt.Errorf("error creating table filter: %w", err)
+	}
+
+	g := &Generator{
 		cfg:      cfg,
 		client:   bq.AdaptClient(client),
+		filter:   filter,
+		api:      newAPICaller(cfg.TableScan),
+		cache:    newMetadataCache(cfg.MetadataCache),
 		producer: metrics.NewProducer(cfg),
-	}, nil
+	}
+
+	for _, p := range cfg.Projects {
+		if p.ProjectID == cfg.GcpProject {
+			g.projects = append(g.projects, projectSource{project: p, client: g.client})
+			continue
+		}
+
+		pc, err := bigquery.NewClient(ctx, p.ProjectID)
+		if err != nil {
+			return nil, fmt.Errorf("error creating BigQuery client for project %s: %w", p.ProjectID, err)
+		}
+		g.projects = append(g.projects, projectSource{project: p, client: bq.AdaptClient(pc)})
+	}
+
+	if g.storage, err = newTableStorage(ctx, cfg); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// newTableStorage returns the client used to read table storage details, or
+// nil if the config does not need one. The information-schema strategy reads
+// physical bytes with the other table metrics
+func newTableStorage(ctx context.Context, cfg *config.Config) (tableStorageClient, error) {
+	if !cfg.TableMetrics.PhysicalBytes || cfg.TableMetrics.Strategy == config.TableMetricsInformationSchema {
+		return nil, nil
+	}
+
+	svc, err := bqv2.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error creating BigQuery API service: %w", err)
+	}
+	return restTableStorage{svc: svc}, nil
+}
+
+// Reconfigure returns a Generator for a reloaded config that shares the
+// BigQuery clients of this Generator, as the projects they are created for
+// need a restart to change. The metadata cache and the table scan rate limit
+// are also kept unless their settings have changed. Only the returned
+// Generator should be closed
+func (g *Generator) Reconfigure(ctx context.Context, cfg *config.Config) (*Generator, error) {
+	filter, err := newTableFilter(cfg.TableFilter)
+	if err != nil {
+		return nil, fmt.Errorf("error creating table filter: %w", err)
+	}
+
+	r := *g
+	r.cfg = cfg
+	r.filter = filter
+	r.producer = metrics.NewProducer(cfg)
+
+	if cfg.TableScan != g.cfg.TableScan {
+		r.api = newAPICaller(cfg.TableScan)
+	}
+	if cfg.MetadataCache != g.cfg.MetadataCache {
+		r.cache = newMetadataCache(cfg.MetadataCache)
+	}
+	if cfg.TableMetrics != g.cfg.TableMetrics {
+		if r.storage, err = newTableStorage(ctx, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	return &r, nil
+}
+
+// Close closes the BigQuery clients of the Generator
+func (g *Generator) Close() error {
+	err := g.client.Close()
+	for _, p := range g.projects {
+		if p.client == g.client {
+			continue
+		}
+		if cerr := p.client.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// projectSource returns the configured project with the given ID, or nil if
+// there is none
+func (g Generator) projectSource(projectID string) *projectSource {
+	for i := range g.projects {
+		if g.projects[i].project.ProjectID == projectID {
+			return &g.projects[i]
+		}
+	}
+	return nil
+}
+
+// ProduceMetrics will generate table level metrics for all BigQuery tables in
+// every configured project, returning the service check results of any
+// freshness SLOs evaluated. Tables are read by a pool of workers limited by
+// the table scan concurrency, or with one query per project with the
+// information-schema strategy. An error is returned if the datasets or tables
+// of any project could not be listed
+func (g Generator) ProduceMetrics(ctx context.Context, receiver chan *metrics.Metric) ([]metrics.ServiceCheck, error) {
+	var err error
+	var checks []metrics.ServiceCheck
+	for _, p := range g.projects {
+		log.Debug().
+			Str("project_id", p.project.ProjectID).
+			Str("dataset-filter", p.project.DatasetFilter).
+			Msg("Producing table level metrics")
+
+		start := time.Now()
+		stats := &scanStats{}
+		var shards *shardSet
+		if g.cfg.ShardedTables.Collapse {
+			shards = newShardSet()
+		}
+
+		// With the information-schema strategy the tables of every listed
+		// dataset are read with one query once the datasets are listed
+		bulk := g.cfg.TableMetrics.Strategy == config.TableMetricsInformationSchema
+		datasets := make(map[string]bool)
+		if !bulk {
+			g.detectTableChanges(ctx, p)
+		}
+
+		var workers chan struct{}
+		if g.cfg.TableScan.Concurrency > 0 {
+			workers = make(chan struct{}, g.cfg.TableScan.Concurrency)
+		}
+
+		wg := sync.WaitGroup{}
+		for ds := range iterateDatasets(ctx, p.client, p.project.DatasetFilter, g.filter, stats) {
+			if bulk {
+				datasets[ds.DatasetID()] = true
+				continue
+			}
+
+			for tbl := range iterateTables(ctx, ds, g.filter, stats) {
+				stats.addTable()
+				wg.Add(1)
+				if workers == nil {
+					go g.outputTableLevelMetrics(ctx, tbl, p.project.MetricTags, receiver, &wg, stats, shards)
+					continue
+				}
+
+				workers <- struct{}{}
+				go func(tbl bq.Table) {
+					defer func() { <-workers }()
+					g.outputTableLevelMetrics(ctx, tbl, p.project.MetricTags, receiver, &wg, stats, shards)
+				}(tbl)
+			}
+		}
+		wg.Wait()
+
+		if bulk {
+			g.outputTableStorage(ctx, p, datasets, receiver, stats, shards)
+		}
+
+		if shards != nil {
+			g.outputShardedTables(shards, receiver, stats)
+		}
+
+		g.outputScanMetrics(p.project, time.Since(start), stats, receiver)
+		g.logScan(p.project, time.Since(start), stats)
+		checks = append(checks, stats.serviceChecks()...)
+		if err == nil {
+			err = stats.Err()
+		}
+	}
+	g.cache.prune()
+
+	return checks, err
 }
 
-// ProduceMetrics will generate table level metrics for all BigQuery tables
-func (g Generator) ProduceMetrics(ctx context.Context, receiver chan *metrics.Metric) {
-	log.Debug().Str("dataset-filter", g.cfg.DatasetFilter).Msg("Producing table level metrics")
+// outputScanMetrics outputs the exporter metrics describing a table scan of a project
+func (g Generator) outputScanMetrics(p config.Project, duration time.Duration, stats *scanStats, out chan *metrics.Metric) {
+	tags := append([]string{fmt.Sprintf("project_id:%s", p.ProjectID)}, p.MetricTags...)
+	tables, failed, errors := stats.counts()
+
+	for _, m := range []*metrics.Metric{
+		g.producer.ProduceExporter("table_scan.duration_seconds", metrics.NewReading(duration.Seconds()), tags),
+		g.producer.ProduceExporter("table_scan.tables", metrics.NewReading(float64(tables)), tags),
+		g.producer.ProduceExporter("table_scan.failed_tables", metrics.NewReading(float64(failed)), tags),
+		g.producer.ProduceExporter("table_scan.errors", metrics.NewReading(float64(errors)), tags),
+	} {
+		if m != nil {
+			out <- m
+		}
+	}
+
+	if g.cache == nil {
+		return
+	}
 
-	wg := sync.WaitGroup{}
-	for ds := range iterateDatasets(ctx, g.client, g.cfg.DatasetFilter) {
-		for tbl := range iterateTables(ctx, ds) {
-			wg.Add(1)
-			go g.outputTableLevelMetrics(ctx, tbl, receiver, &wg)
+	hits, misses := stats.cacheCounts()
+	ms := []*metrics.Metric{
+		g.producer.ProduceExporter("table_scan.cache_hits", metrics.NewReading(float64(hits)), tags),
+		g.producer.ProduceExporter("table_scan.cache_misses", metrics.NewReading(float64(misses)), tags),
+	}
+	if hits+misses > 0 {
+		ratio := float64(hits) / float64(hits+misses)
+		ms = append(ms, g.producer.ProduceExporter("table_scan.cache_hit_ratio", metrics.NewReading(ratio), tags))
+	}
+	for _, m := range ms {
+		if m != nil {
+			out <- m
 		}
 	}
-	wg.Wait()
 }
 
-// ProduceCustomMetric will generate a metric based on a CustomMetric
-func (g Generator) ProduceCustomMetric(ctx context.Context, cm config.CustomMetric, out chan *metrics.Metric) {
+// logScan logs the outcome of a table scan of a project, warning if the
+// metrics of any table could not be collected
+func (g Generator) logScan(p config.Project, duration time.Duration, stats *scanStats) {
+	tables, failed, errors := stats.counts()
+
+	event := log.Info()
+	if failed > 0 {
+		event = log.Warn()
+	}
+
+	event = event.
+		Str("project_id", p.ProjectID).
+		Str("duration", duration.String()).
+		Int("tables", tables).
+		Int("failed_tables", failed).
+		Int("errors", errors)
+
+	if g.cache != nil {
+		hits, misses := stats.cacheCounts()
+		event = event.Int("cache_hits", hits).Int("cache_misses", misses)
+	}
+
+	event.Msg("Finished table scan")
+}
+
+// ProduceCustomMetric will generate a metric based on a CustomMetric,
+// returning an error if the query could not be run or its results read. The
+// times of the last and current run are passed to any window parameters
+func (g Generator) ProduceCustomMetric(ctx context.Context, cm config.CustomMetric, lastRun, thisRun time.Time, out chan *metrics.Metric) error {
 	logger := log.With().
 		Str("metric-name", cm.MetricName).
 		Str("sql", cm.SQL).
@@ -57,31 +302,132 @@ func (g Generator) ProduceCustomMetric(ctx context.Context, cm config.CustomMetr
 
 	logger.Debug().Msg("Producing custom metric")
 
-	iter, err := g.runSQLQuery(ctx, cm.SQL)
+	// The metrics of this run are produced at the interval of the custom
+	// metric. The Generator is a copy, so this does not affect other runs
+	g.producer = g.producer.WithInterval(cm.LongestPeriod(thisRun))
+
+	params, err := customMetricParameters(cm, lastRun, thisRun)
+	if err != nil {
+		logger.Err(err).Msg("Error occurred resolving custom query parameters")
+		return err
+	}
+
+	start := time.Now()
+	job, iter, err := runQuery(ctx, g.client, cm.SQL, params, cm.MaxBytesBilled)
 	if err != nil {
 		logger.Err(err).Msg("Error occurred reading custom query")
-		return
+		return err
 	}
+	g.outputQueryMetrics(ctx, cm, job, time.Since(start), out)
 
 	now := time.Now()
 
-	var results map[string]bigquery.Value
-	err = iter.Next(&results)
-	if err != nil {
-		if err == iterator.Done {
-			logger.Info().Msg("Query returned no results")
-			return
+	// Without tag columns every row would produce the same series, so only the
+	// first row is used
+	limit := 1
+	if len(cm.TagColumns) > 0 {
+		limit = cm.MaxRows
+	}
+
+	rows := 0
+	for {
+		var results map[string]bigquery.Value
+		err = iter.Next(&results)
+		if err != nil {
+			if err == iterator.Done {
+				if rows == 0 {
+					logger.Info().Msg("Query returned no results")
+				}
+				return nil
+			}
+
+			logger.Err(err).Msg("Query results iterator produced an error")
+			return fmt.Errorf("error reading query results: %w", err)
+		}
+
+		if limit > 0 && rows >= limit {
+			if len(cm.TagColumns) == 0 {
+				logger.Warn().Msg("Query returned multiple rows but only the first row is used")
+			} else {
+				logger.Warn().
+					Int("max_rows", limit).
+					Uint64("total_rows", iter.TotalRows()).
+					Msg("Query returned more rows than the row limit, remaining rows are ignored")
+			}
+			return nil
 		}
+		rows++
+
+		g.outputCustomMetricRow(cm, results, now, out)
+	}
+}
 
-		logger.Err(err).Msg("Query results iterator produced an error")
+// outputQueryMetrics outputs the exporter metrics describing a custom metric query
+func (g Generator) outputQueryMetrics(ctx context.Context, cm config.CustomMetric, job bq.Job, duration time.Duration, out chan *metrics.Metric) {
+	if !g.cfg.ExporterMetrics.Enabled {
 		return
 	}
 
-	if iter.TotalRows() > 1 {
-		logger.Warn().Msg("Query returned multiple rows but only the first row is used")
+	tags := append([]string{fmt.Sprintf("metric_name:%s", cm.MetricName)}, cm.MetricTags...)
+	out <- g.producer.ProduceExporter("custom_metric.duration_seconds", metrics.NewReading(duration.Seconds()), tags)
+
+	status, err := job.Status(ctx)
+	if err != nil || status.Statistics == nil {
+		log.Warn().
+			Err(err).
+			Str("metric-name", cm.MetricName).
+			Msg("Unable to read the bytes processed by custom metric query")
+		return
+	}
+
+	out <- g.producer.ProduceExporter("custom_metric.bytes_processed", metrics.NewReading(float64(status.Statistics.TotalBytesProcessed)), tags)
+}
+
+// customMetricParameters returns the BigQuery query parameters of a custom
+// metric, passing the times of the last and current run to window parameters
+func customMetricParameters(cm config.CustomMetric, lastRun, thisRun time.Time) ([]bigquery.QueryParameter, error) {
+	if len(cm.Parameters) == 0 {
+		return nil, nil
+	}
+
+	params := make([]bigquery.QueryParameter, 0, len(cm.Parameters))
+	for _, qp := range cm.Parameters {
+		val, err := qp.Resolve(lastRun, thisRun)
+		if err != nil {
+			return nil, fmt.Errorf("error in query parameter %s: %w", qp.Name, err)
+		}
+		params = append(params, bigquery.QueryParameter{Name: qp.Name, Value: val})
+	}
+
+	return params, nil
+}
+
+func (g Generator) outputCustomMetricRow(cm config.CustomMetric, results map[string]bigquery.Value, now time.Time, out chan *metrics.Metric) {
+	logger := log.With().
+		Str("metric-name", cm.MetricName).
+		Logger()
+
+	isTagColumn := make(map[string]bool, len(cm.TagColumns))
+	rowTags := make([]string, 0, len(cm.TagColumns))
+	for _, col := range cm.TagColumns {
+		isTagColumn[col] = true
+
+		val, ok := results[col]
+		if !ok {
+			logger.Warn().Str("column_id", col).Msg("Tag column is missing from the query results")
+			continue
+		}
+		if val == nil {
+			continue
+		}
+		rowTags = append(rowTags, fmt.Sprintf("%s:%v", col, val))
 	}
 
 	for colName, colVal := range results {
+		if isTagColumn[colName] {
+			continue
+		}
+
 		reading, err := metrics.NewReadingFrom(colVal, now)
 		if err != nil {
 			logger.Err(err).
@@ -89,43 +435,127 @@ func (g Generator) ProduceCustomMetric(ctx context.Context, cm config.CustomMetr
 				Msg("Query results must be of numeric type")
 			continue
 		}
-		tags := append(
-			[]string{fmt.Sprintf("column_id:%s", colName)},
-			cm.MetricTags...,
-		)
+
+		tags := make([]string, 0, 1+len(rowTags)+len(cm.MetricTags))
+		tags = append(tags, fmt.Sprintf("column_id:%s", colName))
+		tags = append(tags, rowTags...)
+		tags = append(tags, cm.MetricTags...)
 
 		out <- g.producer.Produce(fmt.Sprintf("custom_metric.%s", cm.MetricName), reading, tags)
 	}
 }
 
 func (g Generator) runSQLQuery(ctx context.Context, sql string) (bq.RowIterator, error) {
-	q := g.client.Query(sql)
+	_, iter, err := g.runSQLJob(ctx, sql)
+	return iter, err
+}
+
+// runSQLJob runs the query, returning the job that ran it along with its results
+func (g Generator) runSQLJob(ctx context.Context, sql string) (bq.Job, bq.RowIterator, error) {
+	return runQuery(ctx, g.client, sql, nil, g.cfg.MaxBytesBilled)
+}
+
+// EstimateCustomMetric returns the number of bytes the query of a custom
+// metric would process, estimated with a dry run of the query that has no cost.
+// Any window parameters are set as if the query last ran one interval ago
+func (g Generator) EstimateCustomMetric(ctx context.Context, cm config.CustomMetric) (int64, error) {
+	now := time.Now()
+	params, err := customMetricParameters(cm, now.Add(-cm.MetricInterval), now)
+	if err != nil {
+		return 0, err
+	}
+
+	return estimateQuery(ctx, g.client, cm.SQL, params, cm.MaxBytesBilled)
+}
+
+// estimateQuery returns the bytes a query with the given parameters is
+// estimated to process, using a dry run that costs nothing
+func estimateQuery(ctx context.Context, client bq.Client, sql string, params []bigquery.QueryParameter, maxBytesBilled int64) (int64, error) {
+	q := client.Query(sql)
+
+	cfg := queryConfig(sql, params, maxBytesBilled)
+	cfg.DryRun = true
+	q.SetQueryConfig(cfg)
 
+	job, err := q.Run(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error estimating query: %w", err)
+	}
+
+	status := job.LastStatus()
+	if status == nil || status.Statistics == nil {
+		return 0, fmt.Errorf("error estimating query: no statistics returned")
+	}
+
+	return status.Statistics.TotalBytesProcessed, nil
+}
+
+// queryConfig returns the config to run a query with, which fails without
+// billing if it would bill more than maxBytesBilled bytes, if non-zero
+func queryConfig(sql string, params []bigquery.QueryParameter, maxBytesBilled int64) bq.QueryConfig {
 	cfg := bq.QueryConfig{}
 	cfg.Q = sql
+	cfg.Parameters = params
+	cfg.MaxBytesBilled = maxBytesBilled
 	cfg.Labels = make(map[string]string)
 	cfg.Labels["created-by"] = config.AppName
 
-	q.SetQueryConfig(cfg)
+	return cfg
+}
+
+// runQuery runs the query with the given parameters using the client,
+// returning the job that ran it along with its results
+func runQuery(ctx context.Context, client bq.Client, sql string, params []bigquery.QueryParameter, maxBytesBilled int64) (bq.Job, bq.RowIterator, error) {
+	q := client.Query(sql)
+	q.SetQueryConfig(queryConfig(sql, params, maxBytesBilled))
 
 	job, err := q.Run(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("error running query: %w", err)
+		return nil, nil, fmt.Errorf("error running query: %w", err)
 	}
 
 	iter, err := job.Read(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("error reading query results: %w", err)
+		return nil, nil, fmt.Errorf("error reading query results: %w", err)
+	}
+
+	return job, iter, nil
+}
+
+// tableMetadata returns the metadata of a table, from the metadata cache if
+// the table has not changed since it was cached
+func (g Generator) tableMetadata(ctx context.Context, t bq.Table, stats *scanStats) (*bigquery.TableMetadata, error) {
+	if meta, ok := g.cache.get(t.ProjectID(), t.DatasetID(), t.TableID()); ok {
+		stats.addCacheLookup(true)
+		return meta, nil
+	}
+
+	if g.cache != nil {
+		stats.addCacheLookup(false)
+	}
+
+	var meta *bigquery.TableMetadata
+	err := g.api.call(ctx, func() (err error) {
+		meta, err = t.Metadata(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return iter, nil
+	g.cache.put(t.ProjectID(), t.DatasetID(), t.TableID(), meta)
+	return meta, nil
 }
 
-func (g Generator) outputTableLevelMetrics(ctx context.Context, t bq.Table, out chan *metrics.Metric, wg *sync.WaitGroup) {
+// outputTableLevelMetrics outputs the metrics of a table. If a set of shards is
+// given, date-sharded tables are added to it to be reported as one logical
+// table, and only output on their own if the shards are kept
+func (g Generator) outputTableLevelMetrics(ctx context.Context, t bq.Table, extraTags []string, out chan *metrics.Metric, wg *sync.WaitGroup, stats *scanStats, shards *shardSet) {
 	defer wg.Done()
 
-	meta, err := t.Metadata(ctx)
+	meta, err := g.tableMetadata(ctx, t, stats)
 	if err != nil {
+		stats.addFailedTable()
 		log.Err(err).
 			Str("project_id", t.ProjectID()).
 			Str("dataset_id", t.DatasetID()).
@@ -140,18 +570,229 @@ func (g Generator) outputTableLevelMetrics(ctx context.Context, t bq.Table, out
 		return
 	}
 
-	tags := []string{
-		fmt.Sprintf("dataset_id:%s", t.DatasetID()),
-		fmt.Sprintf("table_id:%s", t.TableID()),
-		fmt.Sprintf("project_id:%s", t.ProjectID()),
+	// Table labels are not returned when listing tables, so can only be
+	// filtered on once the metadata has been read
+	if !g.filter.labelsMatch(meta.Labels) {
+		return
+	}
+
+	tags, ok := g.outputTableMetadata(t.ProjectID(), t.DatasetID(), t.TableID(), meta, extraTags, out, stats, shards)
+	if !ok {
+		return
+	}
+
+	if g.cfg.TableMetrics.PhysicalBytes && g.storage != nil {
+		var physical int64
+		err := g.api.call(ctx, func() (err error) {
+			physical, err = g.storage.PhysicalBytes(ctx, t.ProjectID(), t.DatasetID(), t.TableID())
+			return err
+		})
+		if err != nil {
+			stats.addError()
+			log.Err(err).
+				Str("project_id", t.ProjectID()).
+				Str("dataset_id", t.DatasetID()).
+				Str("table_id", t.TableID()).
+				Msg("An error occurred when fetching table physical storage")
+
+			return
+		}
+
+		out <- g.producer.Produce("table.physical_bytes", metrics.NewReading(float64(physical)), tags)
 	}
+}
+
+// outputTableMetadata outputs the metrics of a table that are read from its
+// metadata, returning the tags of the table. If a set of shards is given,
+// date-sharded tables are added to it, and false is returned if the shards are
+// not kept so no further metrics of the table should be output
+func (g Generator) outputTableMetadata(projectID, datasetID, tableID string, meta *bigquery.TableMetadata, extraTags []string, out chan *metrics.Metric, stats *scanStats, shards *shardSet) ([]string, bool) {
+	isShard := false
+	if shards != nil {
+		if logical, date, ok := shardOf(tableID); ok {
+			shards.add(projectID, datasetID, logical, date, meta, extraTags)
+			if !g.cfg.ShardedTables.KeepShards {
+				return nil, false
+			}
+			isShard = true
+		}
+	}
+
+	tags := append([]string{
+		fmt.Sprintf("dataset_id:%s", datasetID),
+		fmt.Sprintf("table_id:%s", tableID),
+		fmt.Sprintf("project_id:%s", projectID),
+	}, extraTags...)
 	now := time.Now().Unix()
 	out <- g.producer.Produce("table.row_count", metrics.NewReading(float64(meta.NumRows)), tags)
-	out <- g.producer.Produce("table.last_modified_time", metrics.NewReading(float64(meta.LastModifiedTime.Unix())), tags)
-	out <- g.producer.Produce("table.last_modified", metrics.NewReading(float64(now)-float64(meta.LastModifiedTime.Unix())), tags)
+	// The last modification time is unknown when TABLE_STORAGE has none for
+	// the table, in which case no last modified metrics are output for it
+	if !meta.LastModifiedTime.IsZero() {
+		out <- g.producer.Produce("table.last_modified_time", metrics.NewReading(float64(meta.LastModifiedTime.Unix())), tags)
+		out <- g.producer.Produce("table.last_modified", metrics.NewReading(float64(now)-float64(meta.LastModifiedTime.Unix())), tags)
+		// Old shards are never modified again, so the freshness of a sharded
+		// table is only evaluated for the logical table
+		if !isShard {
+			g.outputFreshness(projectID, datasetID, tableID, meta.LastModifiedTime, tags, out, stats)
+		}
+	}
+
+	if g.cfg.TableMetrics.SizeBytes {
+		out <- g.producer.Produce("table.size_bytes", metrics.NewReading(float64(meta.NumBytes)), tags)
+	}
+
+	if g.cfg.TableMetrics.LongTermBytes {
+		out <- g.producer.Produce("table.long_term_bytes", metrics.NewReading(float64(meta.NumLongTermBytes)), tags)
+	}
+
+	return tags, true
+}
+
+// restTableStorage reads table storage details from the BigQuery REST API,
+// as the physical storage size is not available from bigquery.TableMetadata
+type restTableStorage struct {
+	svc *bqv2.Service
 }
 
-func iterateDatasets(ctx context.Context, client bq.Client, filter string) chan bq.Dataset {
+// PhysicalBytes returns the total physical bytes stored for a table, including
+// time travel storage
+func (r restTableStorage) PhysicalBytes(ctx context.Context, projectID, datasetID, tableID string) (int64, error) {
+	tbl, err := r.svc.Tables.Get(projectID, datasetID, tableID).
+		Fields("numTotalPhysicalBytes").
+		Context(ctx).
+		Do()
+	if err != nil {
+		return 0, err
+	}
+
+	return tbl.NumTotalPhysicalBytes, nil
+}
+
+// scanStats holds the counts, first listing error and service checks of a table scan
+type scanStats struct {
+	mx     sync.Mutex
+	err    error
+	tables int
+	failed int
+	errors int
+	hits   int
+	misses int
+	checks []metrics.ServiceCheck
+}
+
+func (s *scanStats) addTable() {
+	if s == nil {
+		return
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.tables++
+}
+
+// addError counts an error that affected a single table or dataset
+func (s *scanStats) addError() {
+	if s == nil {
+		return
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.errors++
+}
+
+// addFailedTable counts a table whose metrics could not be collected
+func (s *scanStats) addFailedTable() {
+	if s == nil {
+		return
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.failed++
+	s.errors++
+}
+
+// addCacheLookup counts a lookup of table metadata in the metadata cache
+func (s *scanStats) addCacheLookup(hit bool) {
+	if s == nil {
+		return
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if hit {
+		s.hits++
+	} else {
+		s.misses++
+	}
+}
+
+// record counts an error that prevented datasets or tables being listed,
+// keeping the first such error to fail the scan with
+func (s *scanStats) record(err error) {
+	if s == nil {
+		return
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.errors++
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// addCheck records the result of a service check evaluated during the scan
+func (s *scanStats) addCheck(check *metrics.ServiceCheck) {
+	if s == nil || check == nil {
+		return
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.checks = append(s.checks, *check)
+}
+
+func (s *scanStats) serviceChecks() []metrics.ServiceCheck {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.checks
+}
+
+func (s *scanStats) counts() (tables, failed, errors int) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.tables, s.failed, s.errors
+}
+
+// cacheCounts returns the number of metadata cache hits and misses
+func (s *scanStats) cacheCounts() (hits, misses int) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.hits, s.misses
+}
+
+// Err returns the first listing error recorded, if any
+func (s *scanStats) Err() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.err
+}
+
+// iterateDatasets lists the datasets of a project matching the label filter,
+// skipping any excluded by the table filter
+func iterateDatasets(ctx context.Context, client bq.Client, filter string, tf *tableFilter, errs *scanStats) chan bq.Dataset {
 	var out chan bq.Dataset
 	out = make(chan bq.Dataset)
 
@@ -172,9 +813,14 @@ func iterateDatasets(ctx context.Context, client bq.Client, filter string) chan
 				log.Err(err).
 					Msg("An error occurred when fetching dataset information")
 
+				errs.record(fmt.Errorf("error listing datasets: %w", err))
 				break
 			}
 
+			if !tf.datasetIncluded(ds.DatasetID()) {
+				continue
+			}
+
 			out <- ds
 		}
 	}()
@@ -182,7 +828,9 @@ func iterateDatasets(ctx context.Context, client bq.Client, filter string) chan
 	return out
 }
 
-func iterateTables(ctx context.Context, ds bq.Dataset) chan bq.Table {
+// iterateTables lists the tables of a dataset, skipping any excluded by the
+// table filter
+func iterateTables(ctx context.Context, ds bq.Dataset, tf *tableFilter, errs *scanStats) chan bq.Table {
 	var out chan bq.Table
 	out = make(chan bq.Table)
 
@@ -202,9 +850,14 @@ func iterateTables(ctx context.Context, ds bq.Dataset) chan bq.Table {
 					Str("dataset_id", ds.DatasetID()).
 					Msg("An error occurred when fetching table information")
 
+				errs.record(fmt.Errorf("error listing tables in dataset %s: %w", ds.DatasetID(), err))
 				break
 			}
 
+			if !tf.tableIncluded(tbl.TableID()) {
+				continue
+			}
+
 			out <- tbl
 		}
 	}()
@@ -3,6 +3,8 @@ package sources
 import (
 	"cloud.google.com/go/bigquery"
 	"context"
+	"errors"
+	"fmt"
 	bq "github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
 	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
 	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
@@ -20,7 +22,7 @@ func Test_iterateTables(t *testing.T) {
 		newMockTableDefaults("table-2"),
 		newMockTableDefaults("table-3"),
 	})
-	out := iterateTables(context.TODO(), ds)
+	out := iterateTables(context.TODO(), ds, nil, nil)
 
 	got := make([]string, 0)
 	for tbl := range out {
@@ -38,7 +40,7 @@ func Test_iterateDatasets(t *testing.T) {
 		newMockDatasetDefaults("dataset-1"),
 		newMockDatasetDefaults("dataset-2"),
 	})
-	out := iterateDatasets(context.TODO(), cl, "")
+	out := iterateDatasets(context.TODO(), cl, "", nil, nil)
 
 	got := make([]string, 0)
 	for ds := range out {
@@ -53,7 +55,7 @@ func Test_iterateDatasets(t *testing.T) {
 
 func Test_iterateDatasets_withFiltering(t *testing.T) {
 	cl := newMockClient("my-project", []mockDataset{})
-	out := iterateDatasets(context.TODO(), cl, "filter:yes")
+	out := iterateDatasets(context.TODO(), cl, "filter:yes", nil, nil)
 	<-out
 
 	want := "labels.filter:yes"
@@ -69,11 +71,13 @@ func TestGenerator_outputTableLevelMetrics(t *testing.T) {
 	}
 	tests := []struct {
 		name string
+		cfg  config.TableMetrics
 		args args
 		want []*metrics.Metric
 	}{
 		{
 			"regular table metrics",
+			config.TableMetrics{},
 			args{newMockTable("my-table", "my-dataset", "my-project", bigquery.RegularTable, time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC), 0)},
 			[]*metrics.Metric{
 				{
@@ -99,8 +103,69 @@ func TestGenerator_outputTableLevelMetrics(t *testing.T) {
 				},
 			},
 		},
+		{
+			"regular table storage metrics",
+			config.TableMetrics{SizeBytes: true, LongTermBytes: true, PhysicalBytes: true},
+			args{mockTable{
+				dataset: "my-dataset",
+				project: "my-project",
+				table:   "my-table",
+				meta: &bigquery.TableMetadata{
+					Type:             bigquery.RegularTable,
+					LastModifiedTime: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
+					NumRows:          10,
+					NumBytes:         2048,
+					NumLongTermBytes: 1024,
+				},
+			}},
+			[]*metrics.Metric{
+				{
+					Interval: 0,
+					Metric:   "table.row_count",
+					Points:   [][]float64{{float64(time.Now().Unix()), 10}},
+					Tags:     []string{"dataset_id:my-dataset", "project_id:my-project", "table_id:my-table"},
+					Type:     metrics.TypeGauge,
+				},
+				{
+					Interval: 0,
+					Metric:   "table.last_modified_time",
+					Points:   [][]float64{{float64(time.Now().Unix()), 1577880000}},
+					Tags:     []string{"dataset_id:my-dataset", "project_id:my-project", "table_id:my-table"},
+					Type:     metrics.TypeGauge,
+				},
+				{
+					Interval: 0,
+					Metric:   "table.last_modified",
+					Points:   [][]float64{{float64(time.Now().Unix()), float64(time.Now().Unix()) - 1577880000}},
+					Tags:     []string{"dataset_id:my-dataset", "project_id:my-project", "table_id:my-table"},
+					Type:     metrics.TypeGauge,
+				},
+				{
+					Interval: 0,
+					Metric:   "table.size_bytes",
+					Points:   [][]float64{{float64(time.Now().Unix()), 2048}},
+					Tags:     []string{"dataset_id:my-dataset", "project_id:my-project", "table_id:my-table"},
+					Type:     metrics.TypeGauge,
+				},
+				{
+					Interval: 0,
+					Metric:   "table.long_term_bytes",
+					Points:   [][]float64{{float64(time.Now().Unix()), 1024}},
+					Tags:     []string{"dataset_id:my-dataset", "project_id:my-project", "table_id:my-table"},
+					Type:     metrics.TypeGauge,
+				},
+				{
+					Interval: 0,
+					Metric:   "table.physical_bytes",
+					Points:   [][]float64{{float64(time.Now().Unix()), 512}},
+					Tags:     []string{"dataset_id:my-dataset", "project_id:my-project", "table_id:my-table"},
+					Type:     metrics.TypeGauge,
+				},
+			},
+		},
 		{
 			"view table metrics",
+			config.TableMetrics{SizeBytes: true},
 			args{newMockTable("my-view", "my-dataset", "my-project", bigquery.ViewTable, time.Now(), 0)},
 			[]*metrics.Metric{},
 		},
@@ -108,8 +173,9 @@ func TestGenerator_outputTableLevelMetrics(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			g := Generator{
-				cfg:      &config.Config{},
+				cfg:      &config.Config{TableMetrics: tt.cfg},
 				client:   &mockClient{},
+				storage:  mockTableStorage{physical: 512},
 				producer: metrics.NewProducer(&config.Config{}),
 			}
 
@@ -118,7 +184,7 @@ func TestGenerator_outputTableLevelMetrics(t *testing.T) {
 
 			wg := &sync.WaitGroup{}
 			wg.Add(1)
-			go g.outputTableLevelMetrics(context.TODO(), tt.args.t, out, wg)
+			go g.outputTableLevelMetrics(context.TODO(), tt.args.t, nil, out, wg, nil, nil)
 			wg.Wait()
 
 			close(out)
@@ -140,6 +206,112 @@ func TestGenerator_outputTableLevelMetrics(t *testing.T) {
 	}
 }
 
+func TestGenerator_ProduceMetrics_multipleProjects(t *testing.T) {
+	g := Generator{
+		cfg: &config.Config{},
+		projects: []projectSource{
+			{
+				project: config.Project{ProjectID: "project-1"},
+				client: newMockClient("project-1", []mockDataset{
+					newMockDataset("dataset-1", "project-1", []mockTable{newMockTableDefaults("table-1")}),
+				}),
+			},
+			{
+				project: config.Project{ProjectID: "project-2", MetricTags: []string{"team:data"}},
+				client: newMockClient("project-2", []mockDataset{
+					newMockDataset("dataset-2", "project-2", []mockTable{newMockTableDefaults("table-2")}),
+				}),
+			},
+		},
+		producer: metrics.NewProducer(&config.Config{}),
+	}
+
+	out := make(chan *metrics.Metric, 100)
+	if _, err := g.ProduceMetrics(context.TODO(), out); err != nil {
+		t.Errorf("ProduceMetrics() err = %v, want = %v", err, nil)
+	}
+	close(out)
+
+	got := make(map[string]bool)
+	for met := range out {
+		if met.Metric == "table.row_count" {
+			got[strings.Join(met.Tags, ",")] = true
+		}
+	}
+
+	want := map[string]bool{
+		"dataset_id:dataset-1,project_id:project-1,table_id:table-1":           true,
+		"dataset_id:dataset-2,project_id:project-2,table_id:table-2,team:data": true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ProduceMetrics() got tags = %v, want %v", got, want)
+	}
+}
+
+func TestGenerator_Reconfigure(t *testing.T) {
+	cfg := &config.Config{
+		TableScan:     config.TableScan{Concurrency: 4, RateLimit: 10},
+		MetadataCache: config.MetadataCache{Enabled: true, TTL: time.Hour},
+	}
+	client := newMockClient("project-1", nil)
+	g := &Generator{
+		cfg:      cfg,
+		client:   client,
+		projects: []projectSource{{project: config.Project{ProjectID: "project-1"}, client: client}},
+		api:      newAPICaller(cfg.TableScan),
+		cache:    newMetadataCache(cfg.MetadataCache),
+		producer: metrics.NewProducer(cfg),
+	}
+
+	unchanged := *cfg
+	unchanged.MetricTags = []string{"env:prod"}
+	got, err := g.Reconfigure(context.TODO(), &unchanged)
+	if err != nil {
+		t.Fatalf("Reconfigure() error = %v", err)
+	}
+	if got.cfg != &unchanged || got.client != g.client || !reflect.DeepEqual(got.projects, g.projects) {
+		t.Errorf("Reconfigure() did not reuse the BigQuery clients for the reloaded config")
+	}
+	if got.api != g.api || got.cache != g.cache {
+		t.Errorf("Reconfigure() replaced the rate limit or metadata cache when their settings were unchanged")
+	}
+
+	changed := *cfg
+	changed.TableScan.RateLimit = 5
+	changed.MetadataCache.TTL = time.Minute
+	if got, err = g.Reconfigure(context.TODO(), &changed); err != nil {
+		t.Fatalf("Reconfigure() error = %v", err)
+	}
+	if got.api == g.api || got.cache == g.cache {
+		t.Errorf("Reconfigure() kept the rate limit or metadata cache when their settings changed")
+	}
+}
+
+func TestGenerator_ProduceMetrics_listingError(t *testing.T) {
+	g := Generator{
+		cfg: &config.Config{},
+		projects: []projectSource{{
+			project: config.Project{ProjectID: "project-1"},
+			client: &mockClient{iterator: &mockDatasetIterator{
+				datasets: []mockDataset{newMockDataset("dataset-1", "project-1", []mockTable{newMockTableDefaults("table-1")})},
+				err:      errors.New("403 forbidden"),
+			}},
+		}},
+		producer: metrics.NewProducer(&config.Config{}),
+	}
+
+	out := make(chan *metrics.Metric, 100)
+	_, err := g.ProduceMetrics(context.TODO(), out)
+	close(out)
+
+	if err == nil {
+		t.Errorf("ProduceMetrics() err = %v, want error", err)
+	}
+	if len(out) == 0 {
+		t.Errorf("ProduceMetrics() produced no metrics for the datasets that were listed")
+	}
+}
+
 func compareMetrics(got, want *metrics.Metric) bool {
 	if got.ID() != want.ID() {
 		return false
@@ -209,12 +381,12 @@ func TestGenerator_produceCustomMetrics(t *testing.T) {
 	}
 
 	collector := make(chan *metrics.Metric, 1)
-	g.ProduceCustomMetric(context.TODO(), cm, collector)
+	g.ProduceCustomMetric(context.TODO(), cm, time.Time{}, time.Now(), collector)
 	close(collector)
 
 	got := <-collector
 	want := &metrics.Metric{
-		Interval: 0,
+		Interval: 3600,
 		Metric:   "custom_metric.row_count",
 		Points:   [][]float64{{float64(time.Now().Unix()), 100.0}},
 		Tags:     []string{"column_id:count", "table_id:my-view"},
@@ -240,7 +412,9 @@ func TestGenerator_produceCustomMetrics_noMetricsWhenNoResults(t *testing.T) {
 	}
 
 	collector := make(chan *metrics.Metric, 100)
-	g.ProduceCustomMetric(context.TODO(), cm, collector)
+	if err := g.ProduceCustomMetric(context.TODO(), cm, time.Time{}, time.Now(), collector); err != nil {
+		t.Errorf("ProduceCustomMetric() err = %v, want = %v", err, nil)
+	}
 	close(collector)
 
 	got := make([]*metrics.Metric, 0)
@@ -254,6 +428,176 @@ func TestGenerator_produceCustomMetrics_noMetricsWhenNoResults(t *testing.T) {
 	}
 }
 
+func TestGenerator_ProduceMetrics_exporterMetrics(t *testing.T) {
+	cfg := &config.Config{ExporterMetrics: config.ExporterMetrics{Enabled: true, Namespace: "exporter"}}
+	broken := newMockTableDefaults("table-2")
+	broken.err = errors.New("404 not found")
+
+	g := Generator{
+		cfg: cfg,
+		projects: []projectSource{{
+			project: config.Project{ProjectID: "project-1"},
+			client: newMockClient("project-1", []mockDataset{
+				newMockDataset("dataset-1", "project-1", []mockTable{newMockTableDefaults("table-1"), broken}),
+			}),
+		}},
+		producer: metrics.NewProducer(cfg),
+	}
+
+	out := make(chan *metrics.Metric, 100)
+	if _, err := g.ProduceMetrics(context.TODO(), out); err != nil {
+		t.Errorf("ProduceMetrics() err = %v, want = %v", err, nil)
+	}
+	close(out)
+
+	got := make(map[string]float64)
+	for met := range out {
+		if strings.HasPrefix(met.Metric, "exporter.") {
+			got[met.Metric] = met.Points[0][1]
+			if !reflect.DeepEqual(met.Tags, []string{"project_id:project-1"}) {
+				t.Errorf("ProduceMetrics() got exporter tags = %v", met.Tags)
+			}
+		}
+	}
+
+	if _, ok := got["exporter.table_scan.duration_seconds"]; !ok {
+		t.Errorf("ProduceMetrics() did not produce the scan duration")
+	}
+	if got["exporter.table_scan.tables"] != 2 {
+		t.Errorf("ProduceMetrics() got tables = %v, want %v", got["exporter.table_scan.tables"], 2)
+	}
+	if got["exporter.table_scan.failed_tables"] != 1 {
+		t.Errorf("ProduceMetrics() got failed tables = %v, want %v", got["exporter.table_scan.failed_tables"], 1)
+	}
+	if got["exporter.table_scan.errors"] != 1 {
+		t.Errorf("ProduceMetrics() got errors = %v, want %v", got["exporter.table_scan.errors"], 1)
+	}
+}
+
+func TestGenerator_ProduceMetrics_concurrency(t *testing.T) {
+	cfg := &config.Config{
+		TableMetrics: config.TableMetrics{PhysicalBytes: true},
+		TableScan:    config.TableScan{Concurrency: 2},
+	}
+	tables := make([]mockTable, 0, 10)
+	for i := 0; i < 10; i++ {
+		tables = append(tables, newMockTableDefaults(fmt.Sprintf("table-%d", i)))
+	}
+
+	storage := &countingTableStorage{}
+	g := Generator{
+		cfg: cfg,
+		projects: []projectSource{{
+			project: config.Project{ProjectID: "project-1"},
+			client: newMockClient("project-1", []mockDataset{
+				newMockDataset("dataset-1", "project-1", tables),
+			}),
+		}},
+		storage:  storage,
+		producer: metrics.NewProducer(cfg),
+	}
+
+	out := make(chan *metrics.Metric, 100)
+	if _, err := g.ProduceMetrics(context.TODO(), out); err != nil {
+		t.Errorf("ProduceMetrics() err = %v, want = %v", err, nil)
+	}
+	close(out)
+
+	if storage.calls != 10 {
+		t.Errorf("ProduceMetrics() read %d tables, want %d", storage.calls, 10)
+	}
+	if storage.peak > 2 {
+		t.Errorf("ProduceMetrics() read %d tables at once, want at most %d", storage.peak, 2)
+	}
+}
+
+// countingTableStorage records how many tables are read at once
+type countingTableStorage struct {
+	mx     sync.Mutex
+	active int
+	peak   int
+	calls  int
+}
+
+func (m *countingTableStorage) PhysicalBytes(_ context.Context, _, _, _ string) (int64, error) {
+	m.mx.Lock()
+	m.active++
+	m.calls++
+	if m.active > m.peak {
+		m.peak = m.active
+	}
+	m.mx.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	m.mx.Lock()
+	m.active--
+	m.mx.Unlock()
+	return 0, nil
+}
+
+func TestGenerator_produceCustomMetrics_exporterMetrics(t *testing.T) {
+	cfg := &config.Config{ExporterMetrics: config.ExporterMetrics{Enabled: true, Namespace: "exporter"}}
+	g := Generator{
+		cfg: cfg,
+		client: &mockClient{
+			query: &mockQuery{job: &mockJob{
+				rows:   &mockRowIterator{rows: []map[string]bigquery.Value{{"count": 1}}},
+				status: &bigquery.JobStatus{State: bigquery.Done, Statistics: &bigquery.JobStatistics{TotalBytesProcessed: 2048}},
+			}},
+		},
+		producer: metrics.NewProducer(cfg),
+	}
+
+	cm := config.CustomMetric{
+		MetricName:     "row_count",
+		MetricInterval: time.Second * 3600,
+		SQL:            "SELECT COUNT(*) AS `count` FROM `my-table`",
+	}
+
+	collector := make(chan *metrics.Metric, 100)
+	if err := g.ProduceCustomMetric(context.TODO(), cm, time.Time{}, time.Now(), collector); err != nil {
+		t.Errorf("ProduceCustomMetric() err = %v, want = %v", err, nil)
+	}
+	close(collector)
+
+	got := make(map[string]float64)
+	for met := range collector {
+		got[met.Metric] = met.Points[0][1]
+	}
+
+	if _, ok := got["exporter.custom_metric.duration_seconds"]; !ok {
+		t.Errorf("ProduceCustomMetric() did not produce the query duration")
+	}
+	if got["exporter.custom_metric.bytes_processed"] != 2048 {
+		t.Errorf("ProduceCustomMetric() got bytes processed = %v, want %v", got["exporter.custom_metric.bytes_processed"], 2048)
+	}
+	if _, ok := got["custom_metric.row_count"]; !ok {
+		t.Errorf("ProduceCustomMetric() did not produce the custom metric")
+	}
+}
+
+func TestGenerator_produceCustomMetrics_errorReadingResults(t *testing.T) {
+	g := Generator{
+		cfg: &config.Config{},
+		client: &mockClient{
+			query: &mockQuery{job: &mockJob{rows: &mockRowIterator{err: errors.New("500 backend error")}}},
+		},
+		producer: metrics.NewProducer(&config.Config{}),
+	}
+
+	cm := config.CustomMetric{
+		MetricName:     "row_count",
+		MetricInterval: time.Second * 3600,
+		SQL:            "SELECT COUNT(*) AS `count` FROM `my-table`",
+	}
+
+	collector := make(chan *metrics.Metric, 100)
+	if err := g.ProduceCustomMetric(context.TODO(), cm, time.Time{}, time.Now(), collector); err == nil {
+		t.Errorf("ProduceCustomMetric() err = %v, want error", err)
+	}
+}
+
 func TestGenerator_produceCustomMetrics_produceMetricsWhenZeroResult(t *testing.T) {
 	g := Generator{
 		cfg: &config.Config{},
@@ -277,12 +621,12 @@ func TestGenerator_produceCustomMetrics_produceMetricsWhenZeroResult(t *testing.
 	}
 
 	collector := make(chan *metrics.Metric, 1)
-	g.ProduceCustomMetric(context.TODO(), cm, collector)
+	g.ProduceCustomMetric(context.TODO(), cm, time.Time{}, time.Now(), collector)
 	close(collector)
 
 	got := <-collector
 	want := &metrics.Metric{
-		Interval: 0,
+		Interval: 3600,
 		Metric:   "custom_metric.row_count",
 		Points:   [][]float64{{float64(time.Now().Unix()), 0.0}},
 		Tags:     []string{"column_id:count", "table_id:my-unused-view"},
@@ -293,6 +637,79 @@ func TestGenerator_produceCustomMetrics_produceMetricsWhenZeroResult(t *testing.
 	}
 }
 
+func TestGenerator_produceCustomMetrics_tagColumns(t *testing.T) {
+	g := Generator{
+		cfg: &config.Config{},
+		client: &mockClient{
+			query: &mockQuery{
+				job: &mockJob{
+					rows: &mockRowIterator{
+						rows: []map[string]bigquery.Value{
+							{"region": "eu", "product": "energy", "count": 100},
+							{"region": "us", "product": nil, "count": 50},
+							{"region": "ap", "product": "energy", "count": 10},
+						},
+					},
+				},
+			},
+		},
+		producer: metrics.NewProducer(&config.Config{}),
+	}
+
+	cm := config.CustomMetric{
+		MetricName:     "row_count",
+		MetricTags:     []string{"table_id:my-view"},
+		MetricInterval: time.Second * 3600,
+		SQL:            "SELECT region, product, COUNT(*) AS `count` FROM `my-view` GROUP BY region, product",
+		TagColumns:     []string{"region", "product"},
+		MaxRows:        2,
+	}
+
+	collector := make(chan *metrics.Metric, 100)
+	g.ProduceCustomMetric(context.TODO(), cm, time.Time{}, time.Now(), collector)
+	close(collector)
+
+	got := make([]*metrics.Metric, 0)
+	for met := range collector {
+		got = append(got, met)
+	}
+
+	want := []*metrics.Metric{
+		{
+			Interval: 3600,
+			Metric:   "custom_metric.row_count",
+			Points:   [][]float64{{float64(time.Now().Unix()), 100.0}},
+			Tags:     []string{"column_id:count", "product:energy", "region:eu", "table_id:my-view"},
+			Type:     metrics.TypeGauge,
+		},
+		{
+			Interval: 3600,
+			Metric:   "custom_metric.row_count",
+			Points:   [][]float64{{float64(time.Now().Unix()), 50.0}},
+			Tags:     []string{"column_id:count", "region:us", "table_id:my-view"},
+			Type:     metrics.TypeGauge,
+		},
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("ProduceCustomMetric() got len = %v, want len = %v", len(got), len(want))
+	}
+
+	for i := range got {
+		if !compareMetrics(want[i], got[i]) {
+			t.Errorf("ProduceCustomMetric() got = %v, want = %v", got[i], want[i])
+		}
+	}
+}
+
+type mockTableStorage struct {
+	physical int64
+}
+
+func (m mockTableStorage) PhysicalBytes(_ context.Context, _, _, _ string) (int64, error) {
+	return m.physical, nil
+}
+
 type mockClient struct {
 	bq.Client
 	proj     string
@@ -341,6 +758,7 @@ type mockDatasetIterator struct {
 	filter   string
 	datasets []mockDataset
 	idx      int
+	err      error
 }
 
 func (m *mockDatasetIterator) SetFilter(s string) {
@@ -349,6 +767,9 @@ func (m *mockDatasetIterator) SetFilter(s string) {
 
 func (m *mockDatasetIterator) Next() (bq.Dataset, error) {
 	if m.idx >= len(m.datasets) {
+		if m.err != nil {
+			return nil, m.err
+		}
 		return nil, iterator.Done
 	}
 
@@ -425,7 +846,20 @@ func (m *mockQuery) Run(_ context.Context) (bq.Job, error) {
 
 type mockJob struct {
 	bq.Job
-	rows bq.RowIterator
+	rows   bq.RowIterator
+	status *bigquery.JobStatus
+}
+
+func (m *mockJob) Status(_ context.Context) (*bigquery.JobStatus, error) {
+	if m.status != nil {
+		return m.status, nil
+	}
+
+	return &bigquery.JobStatus{State: bigquery.Done, Statistics: &bigquery.JobStatistics{}}, nil
+}
+
+func (m *mockJob) LastStatus() *bigquery.JobStatus {
+	return m.status
 }
 
 func (m *mockJob) Read(_ context.Context) (bq.RowIterator, error) {
@@ -443,6 +877,7 @@ type mockRowIterator struct {
 	bq.RowIterator
 	rows []map[string]bigquery.Value
 	idx  int
+	err  error
 }
 
 func (m *mockRowIterator) TotalRows() uint64 {
@@ -451,6 +886,9 @@ func (m *mockRowIterator) TotalRows() uint64 {
 
 func (m *mockRowIterator) Next(out interface{}) error {
 	if m.idx >= len(m.rows) {
+		if m.err != nil {
+			return m.err
+		}
 		return iterator.Done
 	}
 
@@ -488,6 +926,7 @@ type mockTable struct {
 	project string
 	table   string
 	meta    *bigquery.TableMetadata
+	err     error
 }
 
 func newMockTable(table, dataset, project string, typ bigquery.TableType, lmd time.Time, rows uint64) mockTable {
@@ -519,7 +958,7 @@ func (m mockTable) FullyQualifiedName() string {
 }
 
 func (m mockTable) Metadata(_ context.Context) (*bigquery.TableMetadata, error) {
-	return m.meta, nil
+	return m.meta, m.err
 }
 
 func (m mockTable) ProjectID() string {
@@ -529,3 +968,127 @@ func (m mockTable) ProjectID() string {
 func (m mockTable) TableID() string {
 	return m.table
 }
+
+func TestGenerator_produceCustomMetrics_maxBytesBilled(t *testing.T) {
+	query := &mockQuery{}
+	g := Generator{
+		cfg:      &config.Config{MaxBytesBilled: 1 << 30},
+		client:   &mockClient{query: query},
+		producer: metrics.NewProducer(&config.Config{}),
+	}
+
+	cm := config.CustomMetric{
+		MetricName:     "row_count",
+		SQL:            "SELECT COUNT(*) AS `count` FROM `my-table`",
+		MaxBytesBilled: 1 << 20,
+	}
+
+	collector := make(chan *metrics.Metric, 100)
+	if err := g.ProduceCustomMetric(context.TODO(), cm, time.Time{}, time.Now(), collector); err != nil {
+		t.Fatalf("ProduceCustomMetric() error = %v", err)
+	}
+
+	if query.cfg.MaxBytesBilled != 1<<20 {
+		t.Errorf("ProduceCustomMetric() maximum bytes billed = %v, want %v", query.cfg.MaxBytesBilled, 1<<20)
+	}
+	if query.cfg.DryRun {
+		t.Errorf("ProduceCustomMetric() ran the query as a dry run")
+	}
+}
+
+func TestGenerator_produceCustomMetrics_parameters(t *testing.T) {
+	query := &mockQuery{}
+	g := Generator{
+		cfg:      &config.Config{},
+		client:   &mockClient{query: query},
+		producer: metrics.NewProducer(&config.Config{}),
+	}
+
+	cm := config.CustomMetric{
+		MetricName: "new_rows",
+		SQL:        "SELECT COUNT(*) AS `count` FROM `my-table` WHERE created_at > @since AND created_at <= @until AND region = @region",
+		Parameters: []config.QueryParameter{
+			{Name: "since", Type: config.ParamTimestamp, Window: config.WindowLastRun},
+			{Name: "until", Type: config.ParamTimestamp, Window: config.WindowThisRun},
+			{Name: "region", Value: "eu"},
+			{Name: "limit", Type: config.ParamInt64, Value: "10"},
+		},
+	}
+
+	lastRun := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	thisRun := lastRun.Add(time.Hour)
+	collector := make(chan *metrics.Metric, 100)
+	if err := g.ProduceCustomMetric(context.TODO(), cm, lastRun, thisRun, collector); err != nil {
+		t.Fatalf("ProduceCustomMetric() error = %v", err)
+	}
+
+	want := []bigquery.QueryParameter{
+		{Name: "since", Value: lastRun},
+		{Name: "until", Value: thisRun},
+		{Name: "region", Value: "eu"},
+		{Name: "limit", Value: int64(10)},
+	}
+	if !reflect.DeepEqual(query.cfg.Parameters, want) {
+		t.Errorf("ProduceCustomMetric() parameters = %v, want %v", query.cfg.Parameters, want)
+	}
+	if query.cfg.Q != cm.SQL {
+		t.Errorf("ProduceCustomMetric() query = %v, want %v", query.cfg.Q, cm.SQL)
+	}
+}
+
+func TestGenerator_produceCustomMetrics_invalidParameter(t *testing.T) {
+	query := &mockQuery{}
+	g := Generator{
+		cfg:      &config.Config{},
+		client:   &mockClient{query: query},
+		producer: metrics.NewProducer(&config.Config{}),
+	}
+
+	cm := config.CustomMetric{
+		MetricName: "row_count",
+		SQL:        "SELECT COUNT(*) AS `count` FROM `my-table` WHERE region = @region",
+		Parameters: []config.QueryParameter{{Name: "region", Env: "BQMETRICS_TEST_UNSET_REGION"}},
+	}
+
+	collector := make(chan *metrics.Metric, 100)
+	if err := g.ProduceCustomMetric(context.TODO(), cm, time.Time{}, time.Now(), collector); !errors.Is(err, config.ErrInvalidQueryParameter) {
+		t.Errorf("ProduceCustomMetric() error = %v, want %v", err, config.ErrInvalidQueryParameter)
+	}
+	if query.cfg.Q != "" {
+		t.Errorf("ProduceCustomMetric() ran the query with an invalid parameter")
+	}
+}
+
+func TestGenerator_EstimateCustomMetric(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  *bigquery.JobStatus
+		want    int64
+		wantErr bool
+	}{
+		{"estimate", &bigquery.JobStatus{State: bigquery.Done, Statistics: &bigquery.JobStatistics{TotalBytesProcessed: 2 << 30}}, 2 << 30, false},
+		{"no statistics", &bigquery.JobStatus{State: bigquery.Done}, 0, true},
+		{"no status", nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := &mockQuery{job: &mockJob{status: tt.status}}
+			g := Generator{
+				cfg:      &config.Config{},
+				client:   &mockClient{query: query},
+				producer: metrics.NewProducer(&config.Config{}),
+			}
+
+			got, err := g.EstimateCustomMetric(context.TODO(), config.CustomMetric{MetricName: "row_count", SQL: "SELECT 1 AS `one`"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EstimateCustomMetric() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("EstimateCustomMetric() got = %v, want %v", got, tt.want)
+			}
+			if !query.cfg.DryRun {
+				t.Errorf("EstimateCustomMetric() did not run the query as a dry run")
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package sources
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"fmt"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/iterator"
+	"time"
+)
+
+// tableStorageColumns are the INFORMATION_SCHEMA.TABLE_STORAGE columns read
+// by the information-schema table metrics strategy
+var tableStorageColumns = []string{
+	"table_schema",
+	"table_name",
+	"total_rows",
+	"total_logical_bytes",
+	"long_term_logical_bytes",
+	"total_physical_bytes",
+	"storage_last_modified_time",
+}
+
+// outputTableStorage outputs the metrics of every table in the given datasets
+// of a project, read with one query of INFORMATION_SCHEMA.TABLE_STORAGE rather
+// than a BigQuery API call per table. The bytes the query is estimated to
+// process are reported before it runs
+func (g Generator) outputTableStorage(ctx context.Context, p projectSource, datasets map[string]bool, out chan *metrics.Metric, stats *scanStats, shards *shardSet) {
+	projectID := p.project.ProjectID
+	logger := log.With().Str("project_id", projectID).Logger()
+	sql := tableStorageQuery(projectID, g.cfg.TableMetrics.Region, tableStorageColumns...)
+
+	estimate, err := estimateQuery(ctx, p.client, sql, nil, g.cfg.MaxBytesBilled)
+	if err != nil {
+		stats.addError()
+		logger.Err(err).Msg("Unable to estimate the bytes processed by table storage query")
+	} else {
+		logger.Debug().Int64("estimated_bytes", estimate).Msg("Estimated the bytes processed by table storage query")
+		tags := append([]string{fmt.Sprintf("project_id:%s", projectID)}, p.project.MetricTags...)
+		if m := g.producer.ProduceExporter("table_scan.estimated_bytes", metrics.NewReading(float64(estimate)), tags); m != nil {
+			out <- m
+		}
+	}
+
+	_, iter, err := runQuery(ctx, p.client, sql, nil, g.cfg.MaxBytesBilled)
+	if err != nil {
+		stats.record(fmt.Errorf("error reading table storage of project %s: %w", projectID, err))
+		logger.Err(err).Msg("Error occurred reading table storage")
+		return
+	}
+
+	for {
+		var row map[string]bigquery.Value
+		err = iter.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			stats.record(fmt.Errorf("error reading table storage of project %s: %w", projectID, err))
+			logger.Err(err).Msg("Table storage results iterator produced an error")
+			return
+		}
+
+		datasetID, _ := row["table_schema"].(string)
+		tableID, _ := row["table_name"].(string)
+		if !datasets[datasetID] || !g.filter.tableIncluded(tableID) {
+			continue
+		}
+
+		stats.addTable()
+		meta := &bigquery.TableMetadata{
+			Type:             bigquery.RegularTable,
+			NumRows:          uint64(int64Value(row["total_rows"])),
+			NumBytes:         int64Value(row["total_logical_bytes"]),
+			NumLongTermBytes: int64Value(row["long_term_logical_bytes"]),
+		}
+		// A NULL last modification time leaves it zero, so that no last
+		// modified metrics are output for the table
+		meta.LastModifiedTime, _ = row["storage_last_modified_time"].(time.Time)
+
+		tags, ok := g.outputTableMetadata(projectID, datasetID, tableID, meta, p.project.MetricTags, out, stats, shards)
+		if ok && g.cfg.TableMetrics.PhysicalBytes {
+			out <- g.producer.Produce("table.physical_bytes", metrics.NewReading(float64(int64Value(row["total_physical_bytes"]))), tags)
+		}
+	}
+}
+
+// int64Value returns an INT64 column value, or zero if it is NULL
+func int64Value(v bigquery.Value) int64 {
+	i, _ := v.(int64)
+	return i
+}
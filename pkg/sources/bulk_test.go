@@ -0,0 +1,169 @@
+package sources
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerator_ProduceMetrics_informationSchema(t *testing.T) {
+	lmd := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tables := []mockTable{
+		{table: "orders", meta: &bigquery.TableMetadata{Type: bigquery.RegularTable, LastModifiedTime: lmd, NumRows: 10, NumBytes: 2048, NumLongTermBytes: 1024}},
+		{table: "events_20210601", meta: &bigquery.TableMetadata{Type: bigquery.RegularTable, LastModifiedTime: lmd, NumRows: 5, NumBytes: 512}},
+		{table: "events_20210602", meta: &bigquery.TableMetadata{Type: bigquery.RegularTable, LastModifiedTime: lmd.Add(24 * time.Hour), NumRows: 7, NumBytes: 768}},
+	}
+	rows := []map[string]bigquery.Value{
+		{"table_schema": "my-dataset", "table_name": "orders", "total_rows": int64(10), "total_logical_bytes": int64(2048), "long_term_logical_bytes": int64(1024), "total_physical_bytes": int64(512), "storage_last_modified_time": lmd},
+		{"table_schema": "my-dataset", "table_name": "events_20210601", "total_rows": int64(5), "total_logical_bytes": int64(512), "long_term_logical_bytes": nil, "total_physical_bytes": int64(128), "storage_last_modified_time": lmd},
+		{"table_schema": "my-dataset", "table_name": "events_20210602", "total_rows": int64(7), "total_logical_bytes": int64(768), "long_term_logical_bytes": nil, "total_physical_bytes": int64(256), "storage_last_modified_time": lmd.Add(24 * time.Hour)},
+		// Tables of datasets that were not listed, or excluded tables, are skipped
+		{"table_schema": "other-dataset", "table_name": "orders", "total_rows": int64(1), "storage_last_modified_time": lmd},
+		{"table_schema": "my-dataset", "table_name": "orders_staging", "total_rows": int64(1), "storage_last_modified_time": lmd},
+	}
+
+	tableMetrics := config.TableMetrics{SizeBytes: true, LongTermBytes: true, Region: "eu"}
+	filter, err := newTableFilter(config.TableFilter{ExcludeTables: []string{"*_staging"}})
+	if err != nil {
+		t.Fatalf("newTableFilter() error = %v", err)
+	}
+
+	produce := func(strategy string) map[string]float64 {
+		cfg := &config.Config{
+			ExporterMetrics: config.ExporterMetrics{Enabled: true, Namespace: "exporter"},
+			TableMetrics:    tableMetrics,
+			ShardedTables:   config.ShardedTables{Collapse: true},
+		}
+		cfg.TableMetrics.Strategy = strategy
+
+		client := newMockClient("my-project", []mockDataset{newMockDataset("my-dataset", "my-project", append([]mockTable{}, tables...))})
+		client.query = &mockQuery{job: &mockJob{
+			rows:   &mockRowIterator{rows: rows},
+			status: &bigquery.JobStatus{State: bigquery.Done, Statistics: &bigquery.JobStatistics{TotalBytesProcessed: 10485760}},
+		}}
+
+		g := Generator{
+			cfg:      cfg,
+			projects: []projectSource{{project: config.Project{ProjectID: "my-project", MetricTags: []string{"env:prod"}}, client: client}},
+			filter:   filter,
+			producer: metrics.NewProducer(cfg),
+		}
+
+		out := make(chan *metrics.Metric, 100)
+		if _, err := g.ProduceMetrics(context.TODO(), out); err != nil {
+			t.Fatalf("ProduceMetrics() with %s strategy err = %v", strategy, err)
+		}
+		close(out)
+
+		got := make(map[string]float64)
+		for met := range out {
+			// The age of the last modification depends on when the metric was produced
+			if met.Metric == "table.last_modified" {
+				met.Points[0][1] = 0
+			}
+			got[fmt.Sprintf("%s%v", met.Metric, met.Tags)] = met.Points[0][1]
+		}
+		return got
+	}
+
+	api := produce(config.TableMetricsAPI)
+	bulk := produce(config.TableMetricsInformationSchema)
+
+	estimate := "exporter.table_scan.estimated_bytes[env:prod project_id:my-project]"
+	if bulk[estimate] != 10485760 {
+		t.Errorf("ProduceMetrics() got estimated bytes = %v, want %v", bulk[estimate], 10485760)
+	}
+	if _, ok := api[estimate]; ok {
+		t.Errorf("ProduceMetrics() with api strategy reported an estimated bytes metric")
+	}
+
+	series := func(got map[string]float64) map[string]float64 {
+		tableSeries := make(map[string]float64)
+		for name, val := range got {
+			if strings.HasPrefix(name, "table.") {
+				tableSeries[name] = val
+			}
+		}
+		return tableSeries
+	}
+	if len(series(api)) == 0 {
+		t.Fatalf("ProduceMetrics() with api strategy produced no table series")
+	}
+	if want, got := series(api), series(bulk); !reflect.DeepEqual(got, want) {
+		t.Errorf("ProduceMetrics() with information-schema strategy got series %v, want %v", sortedKeys(got), sortedKeys(want))
+	}
+	if got := bulk["exporter.table_scan.tables[env:prod project_id:my-project]"]; got != 3 {
+		t.Errorf("ProduceMetrics() got tables = %v, want %v", got, 3)
+	}
+}
+
+func TestGenerator_ProduceMetrics_informationSchemaError(t *testing.T) {
+	cfg := &config.Config{TableMetrics: config.TableMetrics{Strategy: config.TableMetricsInformationSchema, Region: "eu"}}
+	client := newMockClient("my-project", []mockDataset{newMockDatasetDefaults("my-dataset")})
+	client.query = &mockQuery{job: &mockJob{rows: &mockRowIterator{err: errors.New("403 access denied")}}}
+
+	g := Generator{
+		cfg:      cfg,
+		projects: []projectSource{{project: config.Project{ProjectID: "my-project"}, client: client}},
+		producer: metrics.NewProducer(cfg),
+	}
+
+	out := make(chan *metrics.Metric, 100)
+	if _, err := g.ProduceMetrics(context.TODO(), out); err == nil {
+		t.Errorf("ProduceMetrics() err = %v, want error", err)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestGenerator_ProduceMetrics_informationSchemaNullLastModified(t *testing.T) {
+	cfg := &config.Config{
+		TableMetrics:  config.TableMetrics{Strategy: config.TableMetricsInformationSchema, Region: "eu"},
+		FreshnessSLOs: []config.FreshnessSLO{{Table: "my-dataset.orders", MaxAge: time.Hour}},
+	}
+	client := newMockClient("my-project", []mockDataset{newMockDatasetDefaults("my-dataset")})
+	client.query = &mockQuery{job: &mockJob{rows: &mockRowIterator{rows: []map[string]bigquery.Value{
+		{"table_schema": "my-dataset", "table_name": "orders", "total_rows": int64(10), "storage_last_modified_time": nil},
+	}}}}
+
+	g := Generator{
+		cfg:      cfg,
+		projects: []projectSource{{project: config.Project{ProjectID: "my-project"}, client: client}},
+		producer: metrics.NewProducer(cfg),
+	}
+
+	out := make(chan *metrics.Metric, 100)
+	checks, err := g.ProduceMetrics(context.TODO(), out)
+	if err != nil {
+		t.Fatalf("ProduceMetrics() err = %v", err)
+	}
+	close(out)
+
+	var got []string
+	for met := range out {
+		if strings.HasPrefix(met.Metric, "table.") {
+			got = append(got, met.Metric)
+		}
+	}
+	if want := []string{"table.row_count"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ProduceMetrics() got metrics %v, want %v", got, want)
+	}
+	if len(checks) != 0 {
+		t.Errorf("ProduceMetrics() got service checks %v, want none", checks)
+	}
+}
@@ -0,0 +1,185 @@
+package sources
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"fmt"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/iterator"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metadataCache holds the table metadata read in previous table scans, so that
+// tables that have not changed need not be read again. It is safe for
+// concurrent use, and a nil metadataCache caches nothing
+type metadataCache struct {
+	mx       sync.Mutex
+	ttl      time.Duration
+	now      func() time.Time
+	entries  map[string]cachedMetadata
+	modified map[string]map[string]time.Time
+}
+
+// cachedMetadata is the metadata of a table along with when it was read, and
+// when the table storage was last modified at the time, if known
+type cachedMetadata struct {
+	meta     *bigquery.TableMetadata
+	fetched  time.Time
+	modified time.Time
+}
+
+// newMetadataCache returns a metadataCache if it is enabled, otherwise nil
+func newMetadataCache(cfg config.MetadataCache) *metadataCache {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	return &metadataCache{
+		ttl:      cfg.TTL,
+		now:      time.Now,
+		entries:  make(map[string]cachedMetadata),
+		modified: make(map[string]map[string]time.Time),
+	}
+}
+
+func tableKey(projectID, datasetID, tableID string) string {
+	return fmt.Sprintf("%s.%s.%s", projectID, datasetID, tableID)
+}
+
+// get returns the cached metadata of a table if it was read within the TTL,
+// and the table has not been seen to change since
+func (c *metadataCache) get(projectID, datasetID, tableID string) (*bigquery.TableMetadata, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	key := tableKey(projectID, datasetID, tableID)
+	entry, ok := c.entries[key]
+	if !ok || c.now().Sub(entry.fetched) >= c.ttl {
+		return nil, false
+	}
+
+	if modified, ok := c.modified[projectID][key]; ok && !modified.Equal(entry.modified) {
+		return nil, false
+	}
+
+	return entry.meta, true
+}
+
+// put caches the metadata of a table
+func (c *metadataCache) put(projectID, datasetID, tableID string, meta *bigquery.TableMetadata) {
+	if c == nil {
+		return
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	key := tableKey(projectID, datasetID, tableID)
+	c.entries[key] = cachedMetadata{
+		meta:     meta,
+		fetched:  c.now(),
+		modified: c.modified[projectID][key],
+	}
+}
+
+// setModified records when the storage of each table of a project was last
+// modified, replacing the times recorded in previous scans. Without any times
+// the cached metadata of the project only expires with the TTL
+func (c *metadataCache) setModified(projectID string, modified map[string]time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if modified == nil {
+		delete(c.modified, projectID)
+		return
+	}
+	c.modified[projectID] = modified
+}
+
+// prune removes the metadata that has expired, so that tables that have been
+// deleted do not stay cached
+func (c *metadataCache) prune() {
+	if c == nil {
+		return
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	now := c.now()
+	for key, entry := range c.entries {
+		if now.Sub(entry.fetched) >= c.ttl {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// tableStorageQuery returns the SQL to read the given columns of every table
+// in a project from INFORMATION_SCHEMA.TABLE_STORAGE of a region
+func tableStorageQuery(projectID, region string, columns ...string) string {
+	return fmt.Sprintf(
+		"SELECT %s FROM `%s`.`region-%s`.INFORMATION_SCHEMA.TABLE_STORAGE WHERE NOT deleted",
+		strings.Join(columns, ", "),
+		projectID,
+		strings.ToLower(region),
+	)
+}
+
+// detectTableChanges reads when the storage of each table in a project was
+// last modified, so that the cached metadata of changed tables is read again.
+// If the times cannot be read, the cached metadata only expires with the TTL
+func (g Generator) detectTableChanges(ctx context.Context, p projectSource) {
+	if g.cache == nil || g.cfg.MetadataCache.Region == "" {
+		return
+	}
+
+	modified, err := g.readTableStorage(ctx, p)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("project_id", p.project.ProjectID).
+			Msg("Unable to detect table changes, cached table metadata will expire with its TTL")
+	}
+	g.cache.setModified(p.project.ProjectID, modified)
+}
+
+func (g Generator) readTableStorage(ctx context.Context, p projectSource) (map[string]time.Time, error) {
+	projectID := p.project.ProjectID
+	_, iter, err := runQuery(ctx, p.client, tableStorageQuery(projectID, g.cfg.MetadataCache.Region, "table_schema", "table_name", "storage_last_modified_time"), nil, g.cfg.MaxBytesBilled)
+	if err != nil {
+		return nil, fmt.Errorf("error reading table storage of project %s: %w", projectID, err)
+	}
+
+	modified := make(map[string]time.Time)
+	for {
+		var row map[string]bigquery.Value
+		err = iter.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading table storage of project %s: %w", projectID, err)
+		}
+
+		dataset, _ := row["table_schema"].(string)
+		table, _ := row["table_name"].(string)
+		at, ok := row["storage_last_modified_time"].(time.Time)
+		if !ok {
+			continue
+		}
+		modified[tableKey(projectID, dataset, table)] = at
+	}
+
+	return modified, nil
+}
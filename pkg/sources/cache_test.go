@@ -0,0 +1,162 @@
+package sources
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_newMetadataCache_disabled(t *testing.T) {
+	if c := newMetadataCache(config.MetadataCache{TTL: time.Hour}); c != nil {
+		t.Errorf("newMetadataCache() = %v, want nil", c)
+	}
+}
+
+func Test_metadataCache(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := newMetadataCache(config.MetadataCache{Enabled: true, TTL: time.Hour})
+	c.now = func() time.Time { return now }
+
+	if _, ok := c.get("my-project", "my-dataset", "my-table"); ok {
+		t.Errorf("get() of an empty cache ok = true, want false")
+	}
+
+	meta := &bigquery.TableMetadata{NumRows: 10}
+	c.put("my-project", "my-dataset", "my-table", meta)
+
+	now = now.Add(30 * time.Minute)
+	if got, ok := c.get("my-project", "my-dataset", "my-table"); !ok || got != meta {
+		t.Errorf("get() within the TTL = %v, %v, want %v, true", got, ok, meta)
+	}
+	if _, ok := c.get("my-project", "my-dataset", "other-table"); ok {
+		t.Errorf("get() of another table ok = true, want false")
+	}
+
+	now = now.Add(30 * time.Minute)
+	if _, ok := c.get("my-project", "my-dataset", "my-table"); ok {
+		t.Errorf("get() after the TTL ok = true, want false")
+	}
+
+	c.prune()
+	if len(c.entries) != 0 {
+		t.Errorf("prune() left %d entries, want 0", len(c.entries))
+	}
+}
+
+func Test_metadataCache_changeDetection(t *testing.T) {
+	modified := time.Date(2021, 6, 1, 9, 0, 0, 0, time.UTC)
+	key := tableKey("my-project", "my-dataset", "my-table")
+
+	c := newMetadataCache(config.MetadataCache{Enabled: true, TTL: time.Hour})
+	c.setModified("my-project", map[string]time.Time{key: modified})
+	c.put("my-project", "my-dataset", "my-table", &bigquery.TableMetadata{})
+
+	c.setModified("my-project", map[string]time.Time{key: modified})
+	if _, ok := c.get("my-project", "my-dataset", "my-table"); !ok {
+		t.Errorf("get() of an unchanged table ok = false, want true")
+	}
+
+	c.setModified("my-project", map[string]time.Time{key: modified.Add(time.Minute)})
+	if _, ok := c.get("my-project", "my-dataset", "my-table"); ok {
+		t.Errorf("get() of a changed table ok = true, want false")
+	}
+
+	c.setModified("my-project", nil)
+	if _, ok := c.get("my-project", "my-dataset", "my-table"); !ok {
+		t.Errorf("get() without change detection ok = false, want true")
+	}
+}
+
+func Test_metadataCache_nil(t *testing.T) {
+	var c *metadataCache
+	c.put("my-project", "my-dataset", "my-table", &bigquery.TableMetadata{})
+	c.setModified("my-project", map[string]time.Time{})
+	c.prune()
+	if _, ok := c.get("my-project", "my-dataset", "my-table"); ok {
+		t.Errorf("get() ok = true, want false")
+	}
+}
+
+func Test_tableStorageQuery(t *testing.T) {
+	want := "SELECT table_schema, table_name, storage_last_modified_time FROM `my-project`.`region-eu`.INFORMATION_SCHEMA.TABLE_STORAGE WHERE NOT deleted"
+	if got := tableStorageQuery("my-project", "EU", "table_schema", "table_name", "storage_last_modified_time"); got != want {
+		t.Errorf("tableStorageQuery() = %v, want %v", got, want)
+	}
+}
+
+func TestGenerator_ProduceMetrics_metadataCache(t *testing.T) {
+	cfg := &config.Config{
+		ExporterMetrics: config.ExporterMetrics{Enabled: true, Namespace: "exporter"},
+		MetadataCache:   config.MetadataCache{Enabled: true, TTL: time.Hour, Region: "eu"},
+	}
+	lmd := time.Now().Add(-time.Hour)
+	client := newMockClient("my-project", []mockDataset{
+		newMockDataset("my-dataset", "my-project", []mockTable{
+			newMockTable("table-1", "my-dataset", "my-project", bigquery.RegularTable, lmd, 10),
+			newMockTable("table-2", "my-dataset", "my-project", bigquery.RegularTable, lmd, 20),
+		}),
+	})
+	storage := func(modified time.Time) *mockQuery {
+		return &mockQuery{job: &mockJob{rows: &mockRowIterator{rows: []map[string]bigquery.Value{
+			{"table_schema": "my-dataset", "table_name": "table-1", "storage_last_modified_time": lmd},
+			{"table_schema": "my-dataset", "table_name": "table-2", "storage_last_modified_time": modified},
+		}}}}
+	}
+
+	g := Generator{
+		cfg:      cfg,
+		projects: []projectSource{{project: config.Project{ProjectID: "my-project"}, client: client}},
+		cache:    newMetadataCache(cfg.MetadataCache),
+		producer: metrics.NewProducer(cfg),
+	}
+
+	tests := []struct {
+		name     string
+		modified time.Time
+		want     map[string]float64
+	}{
+		{"first scan", lmd, map[string]float64{"exporter.table_scan.cache_hits": 0, "exporter.table_scan.cache_misses": 2, "exporter.table_scan.cache_hit_ratio": 0}},
+		{"unchanged tables", lmd, map[string]float64{"exporter.table_scan.cache_hits": 2, "exporter.table_scan.cache_misses": 0, "exporter.table_scan.cache_hit_ratio": 1}},
+		{"changed table", lmd.Add(time.Minute), map[string]float64{"exporter.table_scan.cache_hits": 1, "exporter.table_scan.cache_misses": 1, "exporter.table_scan.cache_hit_ratio": 0.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client.query = storage(tt.modified)
+			client.iterator = nil
+
+			out := make(chan *metrics.Metric, 100)
+			if _, err := g.ProduceMetrics(context.TODO(), out); err != nil {
+				t.Fatalf("ProduceMetrics() err = %v", err)
+			}
+			close(out)
+
+			got := make(map[string]float64)
+			ages := 0
+			for met := range out {
+				if strings.HasPrefix(met.Metric, "exporter.table_scan.cache_") {
+					got[met.Metric] = met.Points[0][1]
+				}
+				// Cached tables still report the age of their last modification as of now
+				if met.Metric == "table.last_modified" {
+					ages++
+					if age := met.Points[0][1]; age < time.Hour.Seconds() {
+						t.Errorf("ProduceMetrics() got table.last_modified = %v, want at least %v", age, time.Hour.Seconds())
+					}
+				}
+			}
+
+			if ages != 2 {
+				t.Errorf("ProduceMetrics() got %d table.last_modified metrics, want %d", ages, 2)
+			}
+			for name, want := range tt.want {
+				if got[name] != want {
+					t.Errorf("ProduceMetrics() got %s = %v, want %v", name, got[name], want)
+				}
+			}
+		})
+	}
+}
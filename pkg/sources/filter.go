@@ -0,0 +1,108 @@
+package sources
+
+import (
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"strings"
+)
+
+// tableFilter selects the datasets and tables that metrics are collected
+// from. A nil tableFilter includes everything
+type tableFilter struct {
+	includeDatasets []func(string) bool
+	excludeDatasets []func(string) bool
+	includeTables   []func(string) bool
+	excludeTables   []func(string) bool
+	labels          map[string]string
+}
+
+// newTableFilter compiles the patterns of the table filter configuration,
+// returning nil if it has no rules
+func newTableFilter(tf config.TableFilter) (*tableFilter, error) {
+	if len(tf.IncludeDatasets)+len(tf.ExcludeDatasets)+len(tf.IncludeTables)+len(tf.ExcludeTables)+len(tf.TableLabels) == 0 {
+		return nil, nil
+	}
+
+	f := &tableFilter{labels: make(map[string]string, len(tf.TableLabels))}
+	for _, set := range []struct {
+		patterns []string
+		matchers *[]func(string) bool
+	}{
+		{tf.IncludeDatasets, &f.includeDatasets},
+		{tf.ExcludeDatasets, &f.excludeDatasets},
+		{tf.IncludeTables, &f.includeTables},
+		{tf.ExcludeTables, &f.excludeTables},
+	} {
+		for _, pattern := range set.patterns {
+			match, err := config.CompilePattern(pattern)
+			if err != nil {
+				return nil, err
+			}
+			*set.matchers = append(*set.matchers, match)
+		}
+	}
+
+	for _, label := range tf.TableLabels {
+		parts := strings.SplitN(label, ":", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		f.labels[parts[0]] = parts[1]
+	}
+
+	return f, nil
+}
+
+// datasetIncluded returns whether metrics are collected from the dataset
+func (f *tableFilter) datasetIncluded(datasetID string) bool {
+	if f == nil {
+		return true
+	}
+
+	return included(datasetID, f.includeDatasets, f.excludeDatasets)
+}
+
+// tableIncluded returns whether metrics are collected from the table
+func (f *tableFilter) tableIncluded(tableID string) bool {
+	if f == nil {
+		return true
+	}
+
+	return included(tableID, f.includeTables, f.excludeTables)
+}
+
+// labelsMatch returns whether a table has every label of the filter. Labels
+// without a value match any value
+func (f *tableFilter) labelsMatch(labels map[string]string) bool {
+	if f == nil {
+		return true
+	}
+
+	for key, want := range f.labels {
+		got, ok := labels[key]
+		if !ok || (want != "" && got != want) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func included(id string, include, exclude []func(string) bool) bool {
+	for _, match := range exclude {
+		if match(id) {
+			return false
+		}
+	}
+
+	if len(include) == 0 {
+		return true
+	}
+
+	for _, match := range include {
+		if match(id) {
+			return true
+		}
+	}
+
+	return false
+}
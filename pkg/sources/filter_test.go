@@ -0,0 +1,159 @@
+package sources
+
+import (
+	"context"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_newTableFilter(t *testing.T) {
+	f, err := newTableFilter(config.TableFilter{})
+	if err != nil || f != nil {
+		t.Errorf("newTableFilter() of no rules = %v, %v, want nil, nil", f, err)
+	}
+
+	if _, err = newTableFilter(config.TableFilter{ExcludeTables: []string{"re:events_("}}); err == nil {
+		t.Errorf("newTableFilter() error = nil, want error")
+	}
+}
+
+func Test_tableFilter(t *testing.T) {
+	f, err := newTableFilter(config.TableFilter{
+		IncludeDatasets: []string{"analytics_*", "re:reporting|finance"},
+		ExcludeDatasets: []string{"analytics_tmp"},
+		ExcludeTables:   []string{"*_staging", "re:events_[0-9]{8}"},
+		TableLabels:     []string{"team:data", "tier"},
+	})
+	if err != nil {
+		t.Fatalf("newTableFilter() error = %v", err)
+	}
+
+	datasets := map[string]bool{
+		"analytics_web": true,
+		"analytics_tmp": false,
+		"reporting":     true,
+		"finance":       true,
+		"finance_old":   false,
+		"scratch":       false,
+	}
+	for id, want := range datasets {
+		if got := f.datasetIncluded(id); got != want {
+			t.Errorf("datasetIncluded(%s) = %v, want %v", id, got, want)
+		}
+	}
+
+	tables := map[string]bool{
+		"events":                 true,
+		"events_20210601":        false,
+		"events_20210601_backup": true,
+		"orders_staging":         false,
+	}
+	for id, want := range tables {
+		if got := f.tableIncluded(id); got != want {
+			t.Errorf("tableIncluded(%s) = %v, want %v", id, got, want)
+		}
+	}
+
+	labels := []struct {
+		labels map[string]string
+		want   bool
+	}{
+		{map[string]string{"team": "data", "tier": "gold"}, true},
+		{map[string]string{"team": "data", "tier": ""}, true},
+		{map[string]string{"team": "web", "tier": "gold"}, false},
+		{map[string]string{"team": "data"}, false},
+		{nil, false},
+	}
+	for _, tt := range labels {
+		if got := f.labelsMatch(tt.labels); got != tt.want {
+			t.Errorf("labelsMatch(%v) = %v, want %v", tt.labels, got, tt.want)
+		}
+	}
+}
+
+func Test_tableFilter_nil(t *testing.T) {
+	var f *tableFilter
+	if !f.datasetIncluded("dataset") || !f.tableIncluded("table") || !f.labelsMatch(nil) {
+		t.Errorf("nil tableFilter excluded a table, want everything included")
+	}
+}
+
+func Test_iterateTables_withTableFilter(t *testing.T) {
+	f, err := newTableFilter(config.TableFilter{ExcludeTables: []string{"*_staging"}})
+	if err != nil {
+		t.Fatalf("newTableFilter() error = %v", err)
+	}
+
+	ds := newMockDataset("my-dataset", "my-project", []mockTable{
+		newMockTableDefaults("orders"),
+		newMockTableDefaults("orders_staging"),
+	})
+
+	got := make([]string, 0)
+	for tbl := range iterateTables(context.TODO(), ds, f, nil) {
+		got = append(got, tbl.TableID())
+	}
+
+	if want := []string{"orders"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("iterateTables() got %v, want %v", got, want)
+	}
+}
+
+func Test_iterateDatasets_withTableFilter(t *testing.T) {
+	f, err := newTableFilter(config.TableFilter{IncludeDatasets: []string{"analytics_*"}})
+	if err != nil {
+		t.Fatalf("newTableFilter() error = %v", err)
+	}
+
+	cl := newMockClient("my-project", []mockDataset{
+		newMockDatasetDefaults("analytics_web"),
+		newMockDatasetDefaults("scratch"),
+	})
+
+	got := make([]string, 0)
+	for ds := range iterateDatasets(context.TODO(), cl, "", f, nil) {
+		got = append(got, ds.DatasetID())
+	}
+
+	if want := []string{"analytics_web"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("iterateDatasets() got %v, want %v", got, want)
+	}
+}
+
+func TestGenerator_ProduceMetrics_tableLabels(t *testing.T) {
+	f, err := newTableFilter(config.TableFilter{TableLabels: []string{"team:data"}})
+	if err != nil {
+		t.Fatalf("newTableFilter() error = %v", err)
+	}
+
+	labelled := newMockTable("labelled", "", "", "TABLE", time.Now(), 10)
+	labelled.meta.Labels = map[string]string{"team": "data"}
+	g := Generator{
+		cfg: &config.Config{},
+		projects: []projectSource{{
+			project: config.Project{ProjectID: "my-project"},
+			client: newMockClient("my-project", []mockDataset{
+				newMockDataset("my-dataset", "my-project", []mockTable{labelled, newMockTableDefaults("unlabelled")}),
+			}),
+		}},
+		filter:   f,
+		producer: metrics.NewProducer(&config.Config{}),
+	}
+
+	out := make(chan *metrics.Metric, 100)
+	if _, err = g.ProduceMetrics(context.TODO(), out); err != nil {
+		t.Fatalf("ProduceMetrics() error = %v", err)
+	}
+	close(out)
+
+	got := make(map[string]bool)
+	for m := range out {
+		got[tableTag(m.Tags)] = true
+	}
+	if want := map[string]bool{"table_id:labelled": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ProduceMetrics() got tables %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,58 @@
+package sources
+
+import (
+	"fmt"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
+	"time"
+)
+
+// freshnessCheck is the name of the service check reporting whether a table
+// meets its freshness SLO
+const freshnessCheck = "table.freshness"
+
+// findFreshnessSLO returns the first freshness SLO that applies to the table
+func findFreshnessSLO(slos []config.FreshnessSLO, projectID, datasetID, tableID string) (config.FreshnessSLO, bool) {
+	for _, slo := range slos {
+		if slo.Matches(projectID, datasetID, tableID) {
+			return slo, true
+		}
+	}
+
+	return config.FreshnessSLO{}, false
+}
+
+// freshnessStatus returns the service check status of a table last modified
+// the given time ago. The status is critical once the age exceeds the
+// maximum age of the SLO, and a warning once it exceeds the warning age
+func freshnessStatus(slo config.FreshnessSLO, age time.Duration) metrics.ServiceCheckStatus {
+	switch {
+	case age > slo.MaxAge:
+		return metrics.ServiceCheckCritical
+	case slo.WarnAge > 0 && age > slo.WarnAge:
+		return metrics.ServiceCheckWarning
+	default:
+		return metrics.ServiceCheckOK
+	}
+}
+
+// outputFreshness evaluates the freshness SLO of a table, if it has one,
+// outputting whether the SLO is met and recording a service check result
+func (g Generator) outputFreshness(projectID, datasetID, tableID string, lastModified time.Time, tags []string, out chan *metrics.Metric, stats *scanStats) {
+	slo, ok := findFreshnessSLO(g.cfg.FreshnessSLOs, projectID, datasetID, tableID)
+	if !ok {
+		return
+	}
+
+	age := time.Since(lastModified).Truncate(time.Second)
+	status := freshnessStatus(slo, age)
+
+	met := 1.0
+	if status == metrics.ServiceCheckCritical {
+		met = 0
+	}
+	out <- g.producer.Produce("table.freshness_slo.met", metrics.NewReading(met), tags)
+
+	message := fmt.Sprintf("Table %s.%s was last modified %s ago, the maximum age is %s", datasetID, tableID, age, slo.MaxAge)
+	stats.addCheck(g.producer.ProduceServiceCheck(freshnessCheck, status, message, append([]string(nil), tags...)))
+}
@@ -0,0 +1,104 @@
+package sources
+
+import (
+	"context"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tableTag(tags []string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, "table_id:") {
+			return tag
+		}
+	}
+	return ""
+}
+
+func Test_freshnessStatus(t *testing.T) {
+	slo := config.FreshnessSLO{Table: "*.*", MaxAge: 26 * time.Hour, WarnAge: 20 * time.Hour}
+	tests := []struct {
+		name string
+		slo  config.FreshnessSLO
+		age  time.Duration
+		want metrics.ServiceCheckStatus
+	}{
+		{"fresh", slo, time.Hour, metrics.ServiceCheckOK},
+		{"at warning age", slo, 20 * time.Hour, metrics.ServiceCheckOK},
+		{"past warning age", slo, 21 * time.Hour, metrics.ServiceCheckWarning},
+		{"at max age", slo, 26 * time.Hour, metrics.ServiceCheckWarning},
+		{"past max age", slo, 27 * time.Hour, metrics.ServiceCheckCritical},
+		{"no warning age", config.FreshnessSLO{Table: "*.*", MaxAge: 26 * time.Hour}, 25 * time.Hour, metrics.ServiceCheckOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := freshnessStatus(tt.slo, tt.age); got != tt.want {
+				t.Errorf("freshnessStatus() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerator_ProduceMetrics_freshnessSLOs(t *testing.T) {
+	now := time.Now()
+	cfg := &config.Config{
+		MetricTags: []string{"env:prod"},
+		FreshnessSLOs: []config.FreshnessSLO{
+			{Table: "dataset-1.events_*", MaxAge: 26 * time.Hour},
+			{Table: "dataset-1.*", MaxAge: time.Hour},
+		},
+	}
+	g := Generator{
+		cfg: cfg,
+		projects: []projectSource{{
+			project: config.Project{ProjectID: "project-1"},
+			client: newMockClient("project-1", []mockDataset{
+				newMockDataset("dataset-1", "project-1", []mockTable{
+					newMockTable("events_a", "dataset-1", "project-1", "TABLE", now.Add(-2*time.Hour), 10),
+					newMockTable("orders", "dataset-1", "project-1", "TABLE", now.Add(-2*time.Hour), 10),
+				}),
+				newMockDataset("dataset-2", "project-1", []mockTable{
+					newMockTable("orders", "dataset-2", "project-1", "TABLE", now.Add(-48*time.Hour), 10),
+				}),
+			}),
+		}},
+		producer: metrics.NewProducer(cfg),
+	}
+
+	out := make(chan *metrics.Metric, 100)
+	checks, err := g.ProduceMetrics(context.TODO(), out)
+	if err != nil {
+		t.Fatalf("ProduceMetrics() error = %v", err)
+	}
+	close(out)
+
+	met := make(map[string]float64)
+	for m := range out {
+		if m.Metric == "table.freshness_slo.met" {
+			met[tableTag(m.Tags)] = m.Points[0][1]
+		}
+	}
+	wantMet := map[string]float64{"table_id:events_a": 1, "table_id:orders": 0}
+	if !reflect.DeepEqual(met, wantMet) {
+		t.Errorf("ProduceMetrics() freshness SLO met = %v, want %v", met, wantMet)
+	}
+
+	status := make(map[string]metrics.ServiceCheckStatus)
+	for _, c := range checks {
+		if c.Check != freshnessCheck {
+			t.Errorf("ProduceMetrics() service check name = %v, want %v", c.Check, freshnessCheck)
+		}
+		status[tableTag(c.Tags)] = c.Status
+	}
+	wantStatus := map[string]metrics.ServiceCheckStatus{
+		"table_id:events_a": metrics.ServiceCheckOK,
+		"table_id:orders":   metrics.ServiceCheckCritical,
+	}
+	if !reflect.DeepEqual(status, wantStatus) {
+		t.Errorf("ProduceMetrics() service checks = %v, want %v", status, wantStatus)
+	}
+}
@@ -0,0 +1,147 @@
+package sources
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"fmt"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/iterator"
+	"strings"
+	"time"
+)
+
+// jobGroupColumns are the INFORMATION_SCHEMA.JOBS columns that job metrics can
+// be grouped by, keyed by their group-by setting
+var jobGroupColumns = map[string]string{
+	config.JobGroupUserEmail:          "user_email",
+	config.JobGroupDestinationDataset: "destination_table.dataset_id",
+	config.JobGroupReservation:        "reservation_id",
+	config.JobGroupPriority:           "priority",
+}
+
+// jobGroup returns the tag name and SQL expression for a job metrics group-by
+// setting. Label keys are validated with the config, so are safe to quote
+func jobGroup(group string) (tag, expr string) {
+	if key := strings.TrimPrefix(group, config.JobGroupLabelPrefix); key != group {
+		return "label_" + key, fmt.Sprintf("(SELECT value FROM UNNEST(labels) WHERE key = '%s')", key)
+	}
+
+	return group, jobGroupColumns[group]
+}
+
+// jobsQuery returns the SQL to summarise the jobs of a project between the
+// @since and @until parameters. Completed jobs are included if they ended
+// within the window, and pending or running jobs are included as they are
+// now. Jobs cannot run for more than a day, so only jobs created in the day
+// before the window need to be read
+func jobsQuery(projectID, region string, groupBy []string) string {
+	groups := []string{"state", "job_type", "statement_type"}
+
+	sb := strings.Builder{}
+	sb.WriteString("SELECT state, job_type, statement_type")
+	for i, group := range groupBy {
+		_, expr := jobGroup(group)
+		alias := fmt.Sprintf("group_%d", i)
+		sb.WriteString(fmt.Sprintf(", %s AS %s", expr, alias))
+		groups = append(groups, alias)
+	}
+	sb.WriteString(", COUNT(*) AS jobs, COUNTIF(error_result IS NOT NULL) AS errors")
+	sb.WriteString(", SUM(IFNULL(total_bytes_billed, 0)) AS bytes_billed, SUM(IFNULL(total_slot_ms, 0)) AS slot_ms ")
+	sb.WriteString(fmt.Sprintf("FROM `%s`.`region-%s`.INFORMATION_SCHEMA.JOBS_BY_PROJECT ", projectID, strings.ToLower(region)))
+	sb.WriteString("WHERE creation_time > TIMESTAMP_SUB(@since, INTERVAL 1 DAY) AND creation_time <= @until ")
+	sb.WriteString("AND (state != 'DONE' OR (end_time > @since AND end_time <= @until)) ")
+	sb.WriteString("GROUP BY ")
+	sb.WriteString(strings.Join(groups, ", "))
+	return sb.String()
+}
+
+// ProduceJobMetrics will generate metrics describing the BigQuery jobs of a
+// project. Completed jobs are counted if they ended after since and no later
+// than until, so that consecutive windows count each job once. No metrics are
+// output if the jobs could not be read, so that the window can be retried
+func (g Generator) ProduceJobMetrics(ctx context.Context, projectID string, since, until time.Time, out chan *metrics.Metric) error {
+	logger := log.With().
+		Str("project_id", projectID).
+		Time("since", since).
+		Time("until", until).
+		Logger()
+
+	logger.Debug().Msg("Producing job metrics")
+
+	// The Generator is a copy, so this does not affect the other generators
+	g.producer = g.producer.WithInterval(g.cfg.JobMetrics.Interval)
+
+	p := g.projectSource(projectID)
+	if p == nil {
+		return fmt.Errorf("error reading jobs: unknown project %s", projectID)
+	}
+
+	params := []bigquery.QueryParameter{
+		{Name: "since", Value: since},
+		{Name: "until", Value: until},
+	}
+	_, iter, err := runQuery(ctx, p.client, jobsQuery(projectID, g.cfg.JobMetrics.Region, g.cfg.JobMetrics.GroupBy), params, g.cfg.MaxBytesBilled)
+	if err != nil {
+		logger.Err(err).Msg("Error occurred reading jobs")
+		return fmt.Errorf("error reading jobs of project %s: %w", projectID, err)
+	}
+
+	rows := make([]map[string]bigquery.Value, 0)
+	for {
+		var row map[string]bigquery.Value
+		err = iter.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			logger.Err(err).Msg("Jobs results iterator produced an error")
+			return fmt.Errorf("error reading jobs of project %s: %w", projectID, err)
+		}
+		rows = append(rows, row)
+	}
+
+	for _, row := range rows {
+		g.outputJobMetricsRow(p.project, row, until, out)
+	}
+
+	return nil
+}
+
+func (g Generator) outputJobMetricsRow(p config.Project, row map[string]bigquery.Value, at time.Time, out chan *metrics.Metric) {
+	tags := []string{fmt.Sprintf("project_id:%s", p.ProjectID)}
+	for _, col := range []string{"state", "job_type", "statement_type"} {
+		if val, ok := row[col]; ok && val != nil {
+			tags = append(tags, fmt.Sprintf("%s:%s", col, strings.ToLower(fmt.Sprint(val))))
+		}
+	}
+	for i, group := range g.cfg.JobMetrics.GroupBy {
+		tag, _ := jobGroup(group)
+		if val, ok := row[fmt.Sprintf("group_%d", i)]; ok && val != nil {
+			tags = append(tags, fmt.Sprintf("%s:%v", tag, val))
+		}
+	}
+	tags = append(tags, p.MetricTags...)
+
+	columns := [][2]string{{"jobs.count", "jobs"}}
+	// The usage of jobs that are still pending or running is not final, so is
+	// only reported once they are done
+	if row["state"] == "DONE" {
+		columns = append(columns, [2]string{"jobs.errors", "errors"}, [2]string{"jobs.bytes_billed", "bytes_billed"}, [2]string{"jobs.slot_ms", "slot_ms"})
+	}
+
+	for _, column := range columns {
+		metric, col := column[0], column[1]
+		reading, err := metrics.NewReadingFrom(row[col], at)
+		if err != nil {
+			log.Err(err).
+				Str("project_id", p.ProjectID).
+				Str("column_id", col).
+				Msg("Jobs results must be of numeric type")
+			continue
+		}
+
+		out <- g.producer.Produce(metric, reading, tags)
+	}
+}
@@ -0,0 +1,141 @@
+package sources
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"errors"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_jobsQuery(t *testing.T) {
+	type args struct {
+		projectID string
+		region    string
+		groupBy   []string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			"no grouping",
+			args{"my-project", "US", nil},
+			"SELECT state, job_type, statement_type, COUNT(*) AS jobs, COUNTIF(error_result IS NOT NULL) AS errors, SUM(IFNULL(total_bytes_billed, 0)) AS bytes_billed, SUM(IFNULL(total_slot_ms, 0)) AS slot_ms FROM `my-project`.`region-us`.INFORMATION_SCHEMA.JOBS_BY_PROJECT WHERE creation_time > TIMESTAMP_SUB(@since, INTERVAL 1 DAY) AND creation_time <= @until AND (state != 'DONE' OR (end_time > @since AND end_time <= @until)) GROUP BY state, job_type, statement_type",
+		},
+		{
+			"grouped by user and label",
+			args{"my-project", "europe-west2", []string{config.JobGroupUserEmail, "label:team"}},
+			"SELECT state, job_type, statement_type, user_email AS group_0, (SELECT value FROM UNNEST(labels) WHERE key = 'team') AS group_1, COUNT(*) AS jobs, COUNTIF(error_result IS NOT NULL) AS errors, SUM(IFNULL(total_bytes_billed, 0)) AS bytes_billed, SUM(IFNULL(total_slot_ms, 0)) AS slot_ms FROM `my-project`.`region-europe-west2`.INFORMATION_SCHEMA.JOBS_BY_PROJECT WHERE creation_time > TIMESTAMP_SUB(@since, INTERVAL 1 DAY) AND creation_time <= @until AND (state != 'DONE' OR (end_time > @since AND end_time <= @until)) GROUP BY state, job_type, statement_type, group_0, group_1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jobsQuery(tt.args.projectID, tt.args.region, tt.args.groupBy); got != tt.want {
+				t.Errorf("jobsQuery() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerator_ProduceJobMetrics(t *testing.T) {
+	since := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	until := since.Add(5 * time.Minute)
+	query := &mockQuery{
+		job: &mockJob{
+			rows: &mockRowIterator{
+				rows: []map[string]bigquery.Value{
+					{"state": "DONE", "job_type": "QUERY", "statement_type": "SELECT", "group_0": "etl@my-project.iam.gserviceaccount.com", "group_1": "data", "jobs": int64(12), "errors": int64(1), "bytes_billed": int64(10485760), "slot_ms": int64(3600)},
+					{"state": "RUNNING", "job_type": "LOAD", "statement_type": nil, "group_0": "etl@my-project.iam.gserviceaccount.com", "group_1": nil, "jobs": int64(2), "errors": int64(0), "bytes_billed": int64(0), "slot_ms": int64(120)},
+				},
+			},
+		},
+	}
+
+	cfg := &config.Config{JobMetrics: config.JobMetrics{Enabled: true, Region: "eu", GroupBy: []string{config.JobGroupUserEmail, "label:team"}}}
+	g := Generator{
+		cfg: cfg,
+		projects: []projectSource{
+			{project: config.Project{ProjectID: "other-project"}, client: &mockClient{}},
+			{project: config.Project{ProjectID: "my-project", MetricTags: []string{"env:prod"}}, client: &mockClient{query: query}},
+		},
+		producer: metrics.NewProducer(cfg),
+	}
+
+	out := make(chan *metrics.Metric, 100)
+	if err := g.ProduceJobMetrics(context.TODO(), "my-project", since, until, out); err != nil {
+		t.Fatalf("ProduceJobMetrics() error = %v", err)
+	}
+	close(out)
+
+	wantParams := []bigquery.QueryParameter{{Name: "since", Value: since}, {Name: "until", Value: until}}
+	if !reflect.DeepEqual(query.cfg.Parameters, wantParams) {
+		t.Errorf("ProduceJobMetrics() query parameters = %v, want %v", query.cfg.Parameters, wantParams)
+	}
+
+	done := []string{"env:prod", "job_type:query", "label_team:data", "project_id:my-project", "state:done", "statement_type:select", "user_email:etl@my-project.iam.gserviceaccount.com"}
+	running := []string{"env:prod", "job_type:load", "project_id:my-project", "state:running", "user_email:etl@my-project.iam.gserviceaccount.com"}
+	ts := float64(until.Unix())
+	want := []*metrics.Metric{
+		{Metric: "jobs.count", Points: [][]float64{{ts, 12}}, Tags: done, Type: metrics.TypeGauge},
+		{Metric: "jobs.errors", Points: [][]float64{{ts, 1}}, Tags: done, Type: metrics.TypeGauge},
+		{Metric: "jobs.bytes_billed", Points: [][]float64{{ts, 10485760}}, Tags: done, Type: metrics.TypeGauge},
+		{Metric: "jobs.slot_ms", Points: [][]float64{{ts, 3600}}, Tags: done, Type: metrics.TypeGauge},
+		{Metric: "jobs.count", Points: [][]float64{{ts, 2}}, Tags: running, Type: metrics.TypeGauge},
+	}
+
+	got := make([]*metrics.Metric, 0)
+	for met := range out {
+		got = append(got, met)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("ProduceJobMetrics() got len = %v, want len = %v", len(got), len(want))
+	}
+
+	for i := range got {
+		if !compareMetrics(got[i], want[i]) || got[i].Points[0][0] != ts {
+			t.Errorf("ProduceJobMetrics() got metric = %v, want metric = %v", *got[i], *want[i])
+		}
+	}
+}
+
+func TestGenerator_ProduceJobMetrics_errors(t *testing.T) {
+	cfg := &config.Config{JobMetrics: config.JobMetrics{Enabled: true, Region: "us"}}
+	g := Generator{
+		cfg: cfg,
+		projects: []projectSource{{
+			project: config.Project{ProjectID: "my-project"},
+			client: &mockClient{query: &mockQuery{job: &mockJob{rows: &mockRowIterator{
+				rows: []map[string]bigquery.Value{{"state": "DONE", "job_type": "QUERY", "jobs": int64(1)}},
+				err:  errors.New("403 access denied"),
+			}}}},
+		}},
+		producer: metrics.NewProducer(cfg),
+	}
+
+	tests := []struct {
+		name    string
+		project string
+	}{
+		{"unknown project", "other-project"},
+		{"results error", "my-project"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := make(chan *metrics.Metric, 100)
+			if err := g.ProduceJobMetrics(context.TODO(), tt.project, time.Now().Add(-time.Minute), time.Now(), out); err == nil {
+				t.Errorf("ProduceJobMetrics() error = nil, want error")
+			}
+			close(out)
+
+			if len(out) != 0 {
+				t.Errorf("ProduceJobMetrics() produced %d metrics, want none", len(out))
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package sources
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"fmt"
+	bq "github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/iterator"
+	"strings"
+	"sync"
+	"time"
+)
+
+// partitionsQuery returns the SQL to read partition details for every table in
+// a dataset, limited to the newest max partitions per table if max is non-zero.
+// The pseudo-partitions holding NULL, unpartitioned and streaming buffer rows
+// are not real partitions, so would skew partition counts and ages
+func partitionsQuery(projectID, datasetID string, max int) string {
+	sb := strings.Builder{}
+	sb.WriteString("SELECT table_name, partition_id, total_rows, total_logical_bytes, last_modified_time ")
+	sb.WriteString(fmt.Sprintf("FROM `%s.%s.INFORMATION_SCHEMA.PARTITIONS` ", projectID, datasetID))
+	sb.WriteString("WHERE partition_id IS NOT NULL AND partition_id NOT IN ('__NULL__', '__UNPARTITIONED__', '__STREAMING_UNPARTITIONED__')")
+	if max > 0 {
+		sb.WriteString(" QUALIFY ROW_NUMBER() OVER (PARTITION BY table_name ORDER BY SAFE_CAST(partition_id AS INT64) DESC, partition_id DESC)")
+		sb.WriteString(fmt.Sprintf(" <= %d", max))
+	}
+	return sb.String()
+}
+
+// ProducePartitionMetrics will generate partition level metrics for the tables
+// in every dataset of a project. An error is returned if the datasets could not
+// be listed or the partitions of any dataset could not be read
+func (g Generator) ProducePartitionMetrics(ctx context.Context, projectID string, out chan *metrics.Metric) error {
+	log.Debug().
+		Str("project_id", projectID).
+		Msg("Producing partition level metrics")
+
+	// The Generator is a copy, so this does not affect the other generators
+	g.producer = g.producer.WithInterval(g.cfg.PartitionMetrics.Interval)
+
+	p := g.projectSource(projectID)
+	if p == nil {
+		return fmt.Errorf("error reading partitions: unknown project %s", projectID)
+	}
+
+	stats := &scanStats{}
+	wg := sync.WaitGroup{}
+	for ds := range iterateDatasets(ctx, p.client, p.project.DatasetFilter, g.filter, stats) {
+		wg.Add(1)
+		go g.outputPartitionMetrics(ctx, p.client, ds, p.project.MetricTags, out, &wg, stats)
+	}
+	wg.Wait()
+
+	return stats.Err()
+}
+
+func (g Generator) outputPartitionMetrics(ctx context.Context, client bq.Client, ds bq.Dataset, extraTags []string, out chan *metrics.Metric, wg *sync.WaitGroup, stats *scanStats) {
+	defer wg.Done()
+
+	logger := log.With().
+		Str("project_id", ds.ProjectID()).
+		Str("dataset_id", ds.DatasetID()).
+		Logger()
+
+	_, iter, err := runQuery(ctx, client, partitionsQuery(ds.ProjectID(), ds.DatasetID(), g.cfg.PartitionMetrics.MaxPartitions), nil, g.cfg.MaxBytesBilled)
+	if err != nil {
+		stats.record(fmt.Errorf("error reading partitions of dataset %s: %w", ds.DatasetID(), err))
+		logger.Err(err).Msg("An error occurred when fetching partition information")
+		return
+	}
+
+	now := time.Now()
+	for {
+		var row map[string]bigquery.Value
+		err = iter.Next(&row)
+		if err != nil {
+			if err == iterator.Done {
+				break
+			}
+
+			stats.record(fmt.Errorf("error reading partitions of dataset %s: %w", ds.DatasetID(), err))
+			logger.Err(err).Msg("Partition results iterator produced an error")
+			return
+		}
+
+		if !g.filter.tableIncluded(fmt.Sprint(row["table_name"])) {
+			continue
+		}
+
+		tags := append([]string{
+			fmt.Sprintf("dataset_id:%s", ds.DatasetID()),
+			fmt.Sprintf("table_id:%v", row["table_name"]),
+			fmt.Sprintf("project_id:%s", ds.ProjectID()),
+			fmt.Sprintf("partition_id:%v", row["partition_id"]),
+		}, extraTags...)
+
+		if reading, err := metrics.NewReadingFrom(row["total_rows"], now); err == nil {
+			out <- g.producer.Produce("partition.row_count", reading, tags)
+		}
+
+		if reading, err := metrics.NewReadingFrom(row["total_logical_bytes"], now); err == nil {
+			out <- g.producer.Produce("partition.size_bytes", reading, tags)
+		}
+
+		if lmt, ok := row["last_modified_time"].(time.Time); ok {
+			out <- g.producer.Produce("partition.last_modified_time", metrics.Reading{Timestamp: now, Value: float64(lmt.Unix())}, tags)
+			out <- g.producer.Produce("partition.last_modified", metrics.Reading{Timestamp: now, Value: float64(now.Unix() - lmt.Unix())}, tags)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package sources
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"errors"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
+	"testing"
+	"time"
+)
+
+func Test_partitionsQuery(t *testing.T) {
+	type args struct {
+		projectID string
+		datasetID string
+		max       int
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			"all partitions",
+			args{"my-project", "my_dataset", 0},
+			"SELECT table_name, partition_id, total_rows, total_logical_bytes, last_modified_time FROM `my-project.my_dataset.INFORMATION_SCHEMA.PARTITIONS` WHERE partition_id IS NOT NULL AND partition_id NOT IN ('__NULL__', '__UNPARTITIONED__', '__STREAMING_UNPARTITIONED__')",
+		},
+		{
+			"newest partitions",
+			args{"my-project", "my_dataset", 7},
+			"SELECT table_name, partition_id, total_rows, total_logical_bytes, last_modified_time FROM `my-project.my_dataset.INFORMATION_SCHEMA.PARTITIONS` WHERE partition_id IS NOT NULL AND partition_id NOT IN ('__NULL__', '__UNPARTITIONED__', '__STREAMING_UNPARTITIONED__') QUALIFY ROW_NUMBER() OVER (PARTITION BY table_name ORDER BY SAFE_CAST(partition_id AS INT64) DESC, partition_id DESC) <= 7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := partitionsQuery(tt.args.projectID, tt.args.datasetID, tt.args.max); got != tt.want {
+				t.Errorf("partitionsQuery() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerator_ProducePartitionMetrics(t *testing.T) {
+	lmt := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	client := newMockClient("my-project", []mockDataset{newMockDatasetDefaults("my-dataset")})
+	client.query = &mockQuery{
+		job: &mockJob{
+			rows: &mockRowIterator{
+				rows: []map[string]bigquery.Value{{
+					"table_name":          "my-table",
+					"partition_id":        "20200101",
+					"total_rows":          int64(100),
+					"total_logical_bytes": int64(2048),
+					"last_modified_time":  lmt,
+				}},
+			},
+		},
+	}
+
+	cfg := &config.Config{PartitionMetrics: config.PartitionMetrics{Enabled: true, MaxPartitions: 1, Interval: time.Hour}}
+	g := Generator{
+		cfg: cfg,
+		// The partitions are read with the client of the project, not the default client
+		client:   &mockClient{},
+		projects: []projectSource{{project: config.Project{ProjectID: "my-project", MetricTags: []string{"team:data"}}, client: client}},
+		producer: metrics.NewProducer(cfg),
+	}
+
+	out := make(chan *metrics.Metric, 100)
+	if err := g.ProducePartitionMetrics(context.TODO(), "my-project", out); err != nil {
+		t.Fatalf("ProducePartitionMetrics() error = %v", err)
+	}
+	close(out)
+
+	tags := []string{"dataset_id:my-dataset", "partition_id:20200101", "project_id:my-project", "table_id:my-table", "team:data"}
+	now := float64(time.Now().Unix())
+	want := []*metrics.Metric{
+		{Metric: "partition.row_count", Points: [][]float64{{now, 100}}, Tags: tags, Type: metrics.TypeGauge, Interval: 3600},
+		{Metric: "partition.size_bytes", Points: [][]float64{{now, 2048}}, Tags: tags, Type: metrics.TypeGauge, Interval: 3600},
+		{Metric: "partition.last_modified_time", Points: [][]float64{{now, 1577880000}}, Tags: tags, Type: metrics.TypeGauge, Interval: 3600},
+		{Metric: "partition.last_modified", Points: [][]float64{{now, now - 1577880000}}, Tags: tags, Type: metrics.TypeGauge, Interval: 3600},
+	}
+
+	got := make([]*metrics.Metric, 0)
+	for met := range out {
+		got = append(got, met)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("ProducePartitionMetrics() got len = %v, want len = %v", len(got), len(want))
+	}
+
+	for i := range got {
+		if !compareMetrics(got[i], want[i]) {
+			t.Errorf("ProducePartitionMetrics() got metric = %v, want metric = %v", *got[i], *want[i])
+		}
+	}
+}
+
+func TestGenerator_ProducePartitionMetrics_errors(t *testing.T) {
+	client := newMockClient("my-project", []mockDataset{newMockDatasetDefaults("my-dataset")})
+	client.query = &mockQuery{job: &mockJob{rows: &mockRowIterator{err: errors.New("403 access denied")}}}
+
+	cfg := &config.Config{PartitionMetrics: config.PartitionMetrics{Enabled: true, Interval: time.Hour}}
+	g := Generator{
+		cfg:      cfg,
+		projects: []projectSource{{project: config.Project{ProjectID: "my-project"}, client: client}},
+		producer: metrics.NewProducer(cfg),
+	}
+
+	tests := []struct {
+		name    string
+		project string
+	}{
+		{"unknown project", "other-project"},
+		{"results error", "my-project"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := make(chan *metrics.Metric, 100)
+			if err := g.ProducePartitionMetrics(context.TODO(), tt.project, out); err == nil {
+				t.Errorf("ProducePartitionMetrics() error = nil, want error")
+			}
+			close(out)
+		})
+	}
+}
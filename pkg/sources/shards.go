@@ -0,0 +1,131 @@
+package sources
+
+import (
+	"cloud.google.com/go/bigquery"
+	"fmt"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// shardSuffix matches the ID of a date-sharded table, such as events_20210601,
+// capturing the prefix shared by every shard and the date of the shard
+var shardSuffix = regexp.MustCompile(`^(.*[^0-9])([0-9]{8})$`)
+
+// shardOf returns the logical table of a date-sharded table, named as the
+// wildcard table events_* that would query every shard, and the date of the
+// shard. It returns false if the table is not a shard
+func shardOf(tableID string) (logical string, date time.Time, ok bool) {
+	match := shardSuffix.FindStringSubmatch(tableID)
+	if match == nil {
+		return "", time.Time{}, false
+	}
+
+	date, err := time.Parse("20060102", match[2])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	return match[1] + "*", date, true
+}
+
+// shardedTable holds the totals of the shards of a logical table seen during
+// a table scan
+type shardedTable struct {
+	projectID     string
+	datasetID     string
+	tableID       string
+	tags          []string
+	shards        int
+	newest        time.Time
+	lastModified  time.Time
+	rows          uint64
+	sizeBytes     int64
+	longTermBytes int64
+}
+
+// shardSet collects the shards of each logical table seen during a table scan
+type shardSet struct {
+	mx     sync.Mutex
+	tables map[string]*shardedTable
+}
+
+func newShardSet() *shardSet {
+	return &shardSet{tables: make(map[string]*shardedTable)}
+}
+
+// add records a shard of a logical table
+func (s *shardSet) add(projectID, datasetID, logical string, date time.Time, meta *bigquery.TableMetadata, extraTags []string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	key := fmt.Sprintf("%s.%s.%s", projectID, datasetID, logical)
+	st, ok := s.tables[key]
+	if !ok {
+		st = &shardedTable{projectID: projectID, datasetID: datasetID, tableID: logical, tags: extraTags}
+		s.tables[key] = st
+	}
+
+	st.shards++
+	st.rows += meta.NumRows
+	st.sizeBytes += meta.NumBytes
+	st.longTermBytes += meta.NumLongTermBytes
+	if date.After(st.newest) {
+		st.newest = date
+		st.lastModified = meta.LastModifiedTime
+	}
+}
+
+// sorted returns the logical tables seen, ordered by their ID
+func (s *shardSet) sorted() []*shardedTable {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	keys := make([]string, 0, len(s.tables))
+	for key := range s.tables {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tables := make([]*shardedTable, len(keys))
+	for i, key := range keys {
+		tables[i] = s.tables[key]
+	}
+	return tables
+}
+
+// outputShardedTables outputs the metrics of each logical table made up of
+// date-sharded tables, once every shard has been seen. The freshness of a
+// logical table is that of its newest shard
+func (g Generator) outputShardedTables(shards *shardSet, out chan *metrics.Metric, stats *scanStats) {
+	now := time.Now()
+	for _, st := range shards.sorted() {
+		tags := append([]string{
+			fmt.Sprintf("dataset_id:%s", st.datasetID),
+			fmt.Sprintf("table_id:%s", st.tableID),
+			fmt.Sprintf("project_id:%s", st.projectID),
+		}, st.tags...)
+
+		out <- g.producer.Produce("table.shard_count", metrics.Reading{Timestamp: now, Value: float64(st.shards)}, tags)
+		out <- g.producer.Produce("table.newest_shard_date", metrics.Reading{Timestamp: now, Value: float64(st.newest.Unix())}, tags)
+		out <- g.producer.Produce("table.row_count", metrics.Reading{Timestamp: now, Value: float64(st.rows)}, tags)
+		if !st.lastModified.IsZero() {
+			out <- g.producer.Produce("table.last_modified_time", metrics.Reading{Timestamp: now, Value: float64(st.lastModified.Unix())}, tags)
+			out <- g.producer.Produce("table.last_modified", metrics.Reading{Timestamp: now, Value: float64(now.Unix() - st.lastModified.Unix())}, tags)
+		}
+
+		if g.cfg.TableMetrics.SizeBytes {
+			out <- g.producer.Produce("table.size_bytes", metrics.Reading{Timestamp: now, Value: float64(st.sizeBytes)}, tags)
+		}
+
+		if g.cfg.TableMetrics.LongTermBytes {
+			out <- g.producer.Produce("table.long_term_bytes", metrics.Reading{Timestamp: now, Value: float64(st.longTermBytes)}, tags)
+		}
+
+		if !st.lastModified.IsZero() {
+			g.outputFreshness(st.projectID, st.datasetID, st.tableID, st.lastModified, tags, out, stats)
+		}
+	}
+}
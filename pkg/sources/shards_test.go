@@ -0,0 +1,117 @@
+package sources
+
+import (
+	"context"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/metrics"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_shardOf(t *testing.T) {
+	tests := []struct {
+		tableID     string
+		wantLogical string
+		wantDate    time.Time
+		wantOk      bool
+	}{
+		{"events_20210601", "events_*", time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC), true},
+		{"ga_sessions_20201231", "ga_sessions_*", time.Date(2020, 12, 31, 0, 0, 0, 0, time.UTC), true},
+		{"events20210601", "events*", time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC), true},
+		{"events", "", time.Time{}, false},
+		{"events_2021", "", time.Time{}, false},
+		{"events_20211301", "", time.Time{}, false},
+		{"events_120210601", "", time.Time{}, false},
+		{"20210601", "", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tableID, func(t *testing.T) {
+			logical, date, ok := shardOf(tt.tableID)
+			if logical != tt.wantLogical || !date.Equal(tt.wantDate) || ok != tt.wantOk {
+				t.Errorf("shardOf() = %v, %v, %v, want %v, %v, %v", logical, date, ok, tt.wantLogical, tt.wantDate, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestGenerator_ProduceMetrics_shardedTables(t *testing.T) {
+	now := time.Now()
+	newTables := func() []mockTable {
+		return []mockTable{
+			newMockTable("events_20210530", "", "", "TABLE", now.Add(-48*time.Hour), 10),
+			newMockTable("events_20210601", "", "", "TABLE", now.Add(-2*time.Hour), 30),
+			newMockTable("events_20210531", "", "", "TABLE", now.Add(-time.Hour), 20),
+			newMockTable("orders", "", "", "TABLE", now, 5),
+		}
+	}
+
+	tests := []struct {
+		name       string
+		sharded    config.ShardedTables
+		wantTables []string
+	}{
+		{"not collapsed", config.ShardedTables{}, []string{"events_20210530", "events_20210531", "events_20210601", "orders"}},
+		{"collapsed", config.ShardedTables{Collapse: true}, []string{"events_*", "orders"}},
+		{"collapsed keeping shards", config.ShardedTables{Collapse: true, KeepShards: true}, []string{"events_*", "events_20210530", "events_20210531", "events_20210601", "orders"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{ShardedTables: tt.sharded}
+			g := Generator{
+				cfg: cfg,
+				projects: []projectSource{{
+					project: config.Project{ProjectID: "my-project"},
+					client: newMockClient("my-project", []mockDataset{
+						newMockDataset("my-dataset", "my-project", newTables()),
+					}),
+				}},
+				producer: metrics.NewProducer(cfg),
+			}
+
+			out := make(chan *metrics.Metric, 100)
+			if _, err := g.ProduceMetrics(context.TODO(), out); err != nil {
+				t.Fatalf("ProduceMetrics() error = %v", err)
+			}
+			close(out)
+
+			tables := make(map[string]bool)
+			logical := make(map[string]float64)
+			for m := range out {
+				tag := tableTag(m.Tags)
+				tables[strings.TrimPrefix(tag, "table_id:")] = true
+				if tag == "table_id:events_*" {
+					logical[m.Metric] = m.Points[0][1]
+				}
+			}
+
+			got := make([]string, 0, len(tables))
+			for table := range tables {
+				got = append(got, table)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.wantTables) {
+				t.Errorf("ProduceMetrics() got tables %v, want %v", got, tt.wantTables)
+			}
+
+			if !tt.sharded.Collapse {
+				return
+			}
+
+			if logical["table.shard_count"] != 3 {
+				t.Errorf("ProduceMetrics() shard count = %v, want 3", logical["table.shard_count"])
+			}
+			if logical["table.row_count"] != 60 {
+				t.Errorf("ProduceMetrics() total rows = %v, want 60", logical["table.row_count"])
+			}
+			if want := float64(time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC).Unix()); logical["table.newest_shard_date"] != want {
+				t.Errorf("ProduceMetrics() newest shard date = %v, want %v", logical["table.newest_shard_date"], want)
+			}
+			if want := float64(now.Add(-2 * time.Hour).Unix()); logical["table.last_modified_time"] != want {
+				t.Errorf("ProduceMetrics() last modified time = %v, want the newest shard's %v", logical["table.last_modified_time"], want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package sources
+
+import (
+	"context"
+	"errors"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/googleapi"
+	"net/http"
+	"time"
+)
+
+// apiCaller limits the rate of the BigQuery API calls made for each table
+// during a table scan, and retries calls that fail because of a quota error
+type apiCaller struct {
+	limiter *rate.Limiter
+	retry   config.Retry
+	wait    func(context.Context, time.Duration) error
+}
+
+// newAPICaller returns an apiCaller following the table scan limits. Up to
+// one call per concurrent table can be made at once before the rate limit
+// applies
+func newAPICaller(ts config.TableScan) *apiCaller {
+	c := &apiCaller{retry: ts.Retry}
+	if ts.RateLimit > 0 {
+		burst := ts.Concurrency
+		if burst < 1 {
+			burst = 1
+		}
+		c.limiter = rate.NewLimiter(rate.Limit(ts.RateLimit), burst)
+	}
+	return c
+}
+
+// call runs fn once the rate limit allows it. If fn fails with a quota error
+// it is retried with exponential backoff, within the limits of the retry
+// configuration and the context deadline. A nil apiCaller runs fn once
+func (c *apiCaller) call(ctx context.Context, fn func() error) error {
+	if c == nil {
+		return fn()
+	}
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		if c.limiter != nil {
+			if err := c.limiter.Wait(ctx); err != nil {
+				return err
+			}
+		}
+
+		err := fn()
+		if err == nil || !isQuotaError(err) || attempt >= c.retry.MaxAttempts {
+			return err
+		}
+
+		wait := c.retry.Backoff(attempt)
+		if !c.retry.CanRetryWithin(ctx, start, wait) {
+			return err
+		}
+
+		log.Debug().
+			Err(err).
+			Int("attempt", attempt).
+			Str("retry_in", wait.String()).
+			Msg("BigQuery API quota exceeded, retrying")
+
+		if werr := c.sleep(ctx, wait); werr != nil {
+			return err
+		}
+	}
+}
+
+func (c *apiCaller) sleep(ctx context.Context, d time.Duration) error {
+	if c.wait != nil {
+		return c.wait(ctx, d)
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isQuotaError returns whether a BigQuery API call failed because a quota or
+// rate limit was exceeded
+func isQuotaError(err error) bool {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return false
+	}
+
+	if gerr.Code == http.StatusTooManyRequests {
+		return true
+	}
+
+	for _, item := range gerr.Errors {
+		switch item.Reason {
+		case "quotaExceeded", "rateLimitExceeded":
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,106 @@
+package sources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ovotech/bigquery-metrics-extractor/pkg/config"
+	"google.golang.org/api/googleapi"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_isQuotaError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"too many requests", &googleapi.Error{Code: http.StatusTooManyRequests}, true},
+		{"rate limit exceeded", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, true},
+		{"quota exceeded", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}}, true},
+		{"wrapped quota error", fmt.Errorf("error reading table: %w", &googleapi.Error{Code: http.StatusTooManyRequests}), true},
+		{"access denied", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "accessDenied"}}}, false},
+		{"not found", &googleapi.Error{Code: http.StatusNotFound}, false},
+		{"other error", errors.New("connection reset"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isQuotaError(tt.err); got != tt.want {
+				t.Errorf("isQuotaError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_apiCaller_call(t *testing.T) {
+	quota := &googleapi.Error{Code: http.StatusTooManyRequests}
+	retry := config.Retry{MaxAttempts: 3, InitialInterval: time.Second, MaxInterval: 10 * time.Second, MaxElapsedTime: time.Minute}
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantErr   error
+		wantCalls int
+	}{
+		{"succeeds first time", []error{nil}, nil, 1},
+		{"retries quota errors", []error{quota, quota, nil}, nil, 3},
+		{"gives up after max attempts", []error{quota, quota, quota, nil}, quota, 3},
+		{"does not retry other errors", []error{errors.New("404 not found"), nil}, errors.New("404 not found"), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waits := 0
+			c := newAPICaller(config.TableScan{Retry: retry})
+			c.wait = func(context.Context, time.Duration) error {
+				waits++
+				return nil
+			}
+
+			calls := 0
+			err := c.call(context.TODO(), func() error {
+				calls++
+				return tt.errs[calls-1]
+			})
+
+			if fmt.Sprint(err) != fmt.Sprint(tt.wantErr) {
+				t.Errorf("call() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("call() made %d calls, want %d", calls, tt.wantCalls)
+			}
+			if waits != calls-1 {
+				t.Errorf("call() waited %d times, want %d", waits, calls-1)
+			}
+		})
+	}
+}
+
+func Test_apiCaller_call_nil(t *testing.T) {
+	var c *apiCaller
+	calls := 0
+	err := c.call(context.TODO(), func() error {
+		calls++
+		return &googleapi.Error{Code: http.StatusTooManyRequests}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("call() error = %v with %d calls, want error with 1 call", err, calls)
+	}
+}
+
+func Test_apiCaller_call_rateLimit(t *testing.T) {
+	c := newAPICaller(config.TableScan{Concurrency: 1, RateLimit: 100})
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := c.call(context.TODO(), func() error { return nil }); err != nil {
+			t.Fatalf("call() error = %v", err)
+		}
+	}
+
+	// The first call is allowed immediately, the rest wait 10ms each
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("call() made 5 calls in %v, want at least %v", elapsed, 35*time.Millisecond)
+	}
+}
@@ -159,6 +159,7 @@ locals {
     metric-interval           = var.metric-interval
     metric-prefix             = var.metric-prefix
     metric-tags               = var.metric-tags
+    projects                  = var.projects
     healthcheck = {
       enabled = var.enable-autohealing
       port    = 8080
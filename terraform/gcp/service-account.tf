@@ -15,6 +15,14 @@ resource "google_project_iam_member" "bq-role" {
   project = local.bigquery-project
 }
 
+resource "google_project_iam_member" "bq-role-projects" {
+  for_each = local.create-service-account ? toset([for p in var.projects : p["project-id"]]) : toset([])
+
+  member  = "serviceAccount:${google_service_account.bqmetricsd.0.email}"
+  role    = "roles/bigquery.metadataViewer"
+  project = each.value
+}
+
 resource "google_project_iam_member" "logger-role" {
   count = local.create-service-account && var.stackdriver-logging ? 1 : 0
 
@@ -102,6 +102,20 @@ variable "project" {
   default     = ""
 }
 
+variable "projects" {
+  type        = any
+  description = <<-EOT
+  List of projects to collect table metrics from, when collecting from more than one project. Type is given as any as there are a number of optional components.
+  Expected type is below:
+  type = list(object({
+    project-id     = string
+    dataset-filter = optional(string)
+    metric-tags    = optional(list(string))
+  }))
+  EOT
+  default     = []
+}
+
 variable "region" {
   type        = string
   description = "The region to run the bqmetrics service in"